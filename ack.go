@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+
+	"stackfoundry.co.uk/appconfig"
+	"stackfoundry.co.uk/components"
+)
+
+// Acknowledger: Sends the visitor a copy of their inquiry with its reference.
+// A nil *Acknowledger is valid and sends nothing, so it is off unless configured.
+type Acknowledger struct {
+	Mailer         Mailer
+	Sender         string // From and Reply-To, so a reply reaches us
+	Limiter        RateLimitBackend
+	Policy         RatePolicy
+	ResponseWindow string
+}
+
+// newAcknowledgerFromConfig enables acknowledgements when ACK_EMAIL is on.
+// ACK_RESPONSE_WINDOW sets the promised reply time and ACK_LIMIT the
+// per-recipient rate (e.g. "3/d:2"). That limit is what stops the form being
+// used to send our mail to someone who never asked for it, so on Lambda it is
+// kept in the idempotency table rather than per instance.
+func newAcknowledgerFromConfig(ctx context.Context, cfg appconfig.Config, mailer Mailer, key []byte) (*Acknowledger, error) {
+	if !cfg.AckEmail || mailer == nil {
+		return nil, nil
+	}
+	policy, err := parseRatePolicy("ack", cfg.AckLimit)
+	if err != nil {
+		return nil, err
+	}
+	limiter, err := newRateBackendFromConfig(ctx, cfg, key)
+	if err != nil {
+		return nil, err
+	}
+	return &Acknowledger{
+		Mailer:         mailer,
+		Limiter:        limiter,
+		Policy:         policy,
+		Sender:         cfg.SenderEmail,
+		ResponseWindow: cfg.AckResponseWindow,
+	}, nil
+}
+
+// Send acknowledges inq to its sender. Failures are logged, never shown:
+// the inquiry itself has already been accepted.
+func (a *Acknowledger) Send(ctx context.Context, inq Inquiry) {
+	if a == nil {
+		return
+	}
+
+	recipient := strings.ToLower(inq.Email)
+	ok, _, err := a.Limiter.Take(ctx, "ack:"+recipient, a.Policy)
+	if err != nil {
+		slog.Error("ack_limit_failed", slog.Any("error", err))
+		return
+	}
+	if !ok {
+		slog.Info("ack_suppressed", slog.String("inquiry", inq.ID), slog.String("reason", "recipient_rate"))
+		return
+	}
+
+	n := inq.Notification()
+	var html, text bytes.Buffer
+	if err := components.AckEmailHTML(n, a.ResponseWindow).Render(ctx, &html); err != nil {
+		slog.Error("ack_render_failed", slog.Any("error", err))
+		return
+	}
+	if err := components.AckEmailText(n, a.ResponseWindow).Render(ctx, &text); err != nil {
+		slog.Error("ack_render_failed", slog.Any("error", err))
+		return
+	}
+
+	// Fixed subject: nothing the visitor typed goes into a header we send them
+	attempts, err := sendWithRetry(ctx, a.Mailer, Message{
+		From:    a.Sender,
+		To:      []string{sanitizeHeader(inq.Email)},
+		ReplyTo: []string{a.Sender},
+		Subject: "Inquiry received [" + inq.Reference() + "]",
+		Text:    text.String(),
+		HTML:    html.String(),
+	})
+	if err != nil {
+		slog.Error("ack_failure", slog.String("inquiry", inq.ID), slog.Any("error", err), slog.Int("attempts", attempts))
+		return
+	}
+	slog.Info("ack_sent", slog.String("inquiry", inq.ID), slog.Int("attempts", attempts))
+}
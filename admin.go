@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"stackfoundry.co.uk/components"
+)
+
+// AdminKey holds the signed-in admin's name, used as the author of notes
+const AdminKey ContextKey = "admin"
+
+const (
+	adminPageSize     = 25
+	maxNoteLength     = 2000
+	dispositionNewTag = "new" // how DispositionNew appears in URLs and the UI
+)
+
+// sameOrigin trusts Sec-Fetch-Site where the browser sends it, and otherwise
+// requires Origin (when present) to name this host
+func sameOrigin(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin" || site == "none"
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// registerAdminRoutes mounts sign-in and the inbox. Both a store and a
+// credential store are required; without either, /admin falls through to 404.
+// released runs for each quarantined inquiry an admin lets through.
+func registerAdminRoutes(mux *http.ServeMux, store InquiryStore, auth *AdminAuth, released func(context.Context, Inquiry)) {
+	if store == nil || auth == nil {
+		return
+	}
+	public := func(pattern string, h http.HandlerFunc) {
+		mux.Handle(pattern, auth.public(h))
+	}
+	require := func(perm Permission, pattern string, h http.HandlerFunc) {
+		mux.Handle(pattern, auth.Require(perm, h))
+	}
+
+	// Sign in
+	public("GET /admin/login", auth.loginPage)
+	public("POST /admin/login/passkey/options", auth.passkeyLoginOptions)
+	public("POST /admin/login/passkey", auth.passkeyLogin)
+	public("POST /admin/login/code", auth.codeLogin)
+	public("POST /admin/logout", auth.logout)
+	public("GET /admin/enroll", auth.enrollPage)
+	public("POST /admin/enroll", auth.enroll)
+
+	// Own sign-in methods
+	require(PermSecurity, "GET /admin/security", auth.securityPage)
+	require(PermSecurity, "POST /admin/security/passkeys/options", auth.passkeyRegisterOptions)
+	require(PermSecurity, "POST /admin/security/passkeys", auth.passkeyRegister)
+	require(PermSecurity, "POST /admin/security/passkeys/delete", auth.passkeyDelete)
+	require(PermSecurity, "POST /admin/security/totp", auth.totpEnable)
+	require(PermSecurity, "POST /admin/security/totp/delete", auth.totpDisable)
+	require(PermSecurity, "POST /admin/security/recovery", auth.recoveryCodes)
+	require(PermSecurity, "POST /admin/security/sessions", auth.signOutEverywhere)
+
+	// Inbox
+	require(PermRead, "GET /admin", adminInbox(store))
+	require(PermRead, "GET /admin/inquiries/{id}", adminInquiry(store))
+	require(PermExport, "GET /admin/export.csv", adminExportCSV(store))
+	require(PermExport, "GET /admin/inquiries/{id}/export", adminExportJSON(store))
+	require(PermTriage, "POST /admin/inquiries/{id}/disposition", adminSetDisposition(store, released))
+	require(PermTriage, "POST /admin/inquiries/{id}/notes", adminAddNote(store))
+}
+
+// --- INBOX ---
+
+func adminFilterFromQuery(q url.Values) components.AdminFilter {
+	page, _ := strconv.Atoi(q.Get("page"))
+	return components.AdminFilter{
+		Query:       strings.TrimSpace(q.Get("q")),
+		Disposition: q.Get("disposition"),
+		Service:     q.Get("service"),
+		Page:        max(page, 1),
+	}
+}
+
+// filterInquiries applies f to a newest-first list. Every search term must
+// appear somewhere in the inquiry or its notes.
+func filterInquiries(inqs []Inquiry, f components.AdminFilter) []Inquiry {
+	terms := strings.Fields(strings.ToLower(f.Query))
+	var out []Inquiry
+	for _, inq := range inqs {
+		switch f.Disposition {
+		case "all":
+		case "":
+			if inq.Disposition == DispositionSpam || inq.Disposition == DispositionArchived || inq.Disposition == DispositionQuarantine {
+				continue
+			}
+		default:
+			if dispositionTag(inq.Disposition) != f.Disposition {
+				continue
+			}
+		}
+		switch f.Service {
+		case "":
+		case "general":
+			if inq.Service != "" {
+				continue
+			}
+		default:
+			if inq.Service != f.Service {
+				continue
+			}
+		}
+		if len(terms) > 0 {
+			haystack := strings.ToLower(strings.Join([]string{
+				inq.Reference(), inq.Email, inq.Subject, inq.Message, components.ServiceLabel(inq.Service),
+			}, "\n"))
+			for _, n := range inq.Notes {
+				haystack += "\n" + strings.ToLower(n.Text)
+			}
+			if !allContained(haystack, terms) {
+				continue
+			}
+		}
+		out = append(out, inq)
+	}
+	return out
+}
+
+func allContained(haystack string, terms []string) bool {
+	for _, t := range terms {
+		if !strings.Contains(haystack, t) {
+			return false
+		}
+	}
+	return true
+}
+
+func dispositionTag(d Disposition) string {
+	if d == DispositionNew {
+		return dispositionNewTag
+	}
+	return string(d)
+}
+
+func adminRow(inq Inquiry) components.AdminRow {
+	return components.AdminRow{
+		ID:          inq.ID,
+		Reference:   inq.Reference(),
+		Email:       inq.Email,
+		Service:     components.ServiceLabel(inq.Service),
+		Subject:     inq.Subject,
+		Disposition: dispositionTag(inq.Disposition),
+		Delivery:    string(inq.Status),
+		Priority:    inq.Routing.Priority,
+		ReceivedAt:  inq.CreatedAt,
+	}
+}
+
+func adminInbox(store InquiryStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		all, err := store.List(r.Context())
+		if err != nil {
+			slog.Error("store_failure", slog.Any("error", err))
+			http.Error(w, "Inquiry store unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		f := adminFilterFromQuery(r.URL.Query())
+		matches := filterInquiries(all, f)
+		v := components.AdminInboxView{
+			Filter: f,
+			Total:  len(matches),
+			Pages:  max(1, (len(matches)+adminPageSize-1)/adminPageSize),
+		}
+		start := min((f.Page-1)*adminPageSize, len(matches))
+		for _, inq := range matches[start:min(start+adminPageSize, len(matches))] {
+			v.Rows = append(v.Rows, adminRow(inq))
+		}
+
+		// Filter changes only swap the results
+		if r.Header.Get("HX-Target") == "inbox_results" {
+			RenderHTML(w, r, components.AdminInboxResults(v))
+			return
+		}
+		sessionID, _ := r.Context().Value(SessionKey).(string)
+		RenderHTML(w, r, components.AdminInbox(sessionID, v))
+	}
+}
+
+// --- DETAIL ---
+
+func adminDetail(inq Inquiry) components.AdminDetail {
+	n := inq.Notification()
+	d := components.AdminDetail{
+		AdminRow:    adminRow(inq),
+		Message:     inq.Message,
+		SessionID:   inq.SessionID,
+		Referrer:    inq.Referrer,
+		UserAgent:   inq.UserAgent,
+		Route:       inq.Routing.Route,
+		Attempts:    inq.Attempts,
+		LastError:   inq.LastError,
+		Attachments: n.Attachments,
+		Brief:       n.Brief,
+		EmailFlags:  n.EmailFlags,
+		SpamScore:   inq.SpamScore,
+	}
+	for _, note := range inq.Notes {
+		d.Notes = append(d.Notes, components.AdminNote{At: note.At, Author: note.Author, Text: note.Text})
+	}
+	for _, f := range inq.WebhookFailures {
+		what := f.Error
+		if f.Status != 0 {
+			what = fmt.Sprintf("HTTP %d", f.Status)
+		}
+		d.WebhookFailures = append(d.WebhookFailures, fmt.Sprintf("%s: %s (%d attempts, %s)", f.Endpoint, what, f.Attempts, f.At.UTC().Format("2006-01-02 15:04")))
+	}
+	return d
+}
+
+// loadInquiry writes the error response itself when it returns false
+func loadInquiry(w http.ResponseWriter, r *http.Request, store InquiryStore) (Inquiry, bool) {
+	inq, err := store.Get(r.Context(), r.PathValue("id"))
+	if errors.Is(err, ErrInquiryNotFound) {
+		sessionID, _ := r.Context().Value(SessionKey).(string)
+		RenderHTMLStatus(w, r, http.StatusNotFound, components.NotFound(sessionID))
+		return Inquiry{}, false
+	}
+	if err != nil {
+		slog.Error("store_failure", slog.Any("error", err))
+		http.Error(w, "Inquiry store unavailable", http.StatusServiceUnavailable)
+		return Inquiry{}, false
+	}
+	return inq, true
+}
+
+func adminInquiry(store InquiryStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		inq, ok := loadInquiry(w, r, store)
+		if !ok {
+			return
+		}
+		sessionID, _ := r.Context().Value(SessionKey).(string)
+		RenderHTML(w, r, components.AdminInquiry(sessionID, adminDetail(inq)))
+	}
+}
+
+// renderAdminUpdate answers an admin action: the panel for HTMX, a redirect
+// back to the detail page for plain form posts
+func renderAdminUpdate(w http.ResponseWriter, r *http.Request, status int, d components.AdminDetail) {
+	if r.Header.Get("HX-Request") != "" {
+		RenderHTMLStatus(w, r, status, components.AdminInquiryPanel(d))
+		return
+	}
+	if status != http.StatusOK {
+		sessionID, _ := r.Context().Value(SessionKey).(string)
+		RenderHTMLStatus(w, r, status, components.AdminInquiry(sessionID, d))
+		return
+	}
+	http.Redirect(w, r, "/admin/inquiries/"+url.PathEscape(d.ID), http.StatusSeeOther)
+}
+
+// adminUpdateFailed answers a failed save. A conflict means the outbox or
+// another admin changed the inquiry since it was loaded; the admin gets the
+// current record back with a 409 and decides again.
+func adminUpdateFailed(w http.ResponseWriter, r *http.Request, store InquiryStore, id string, err error) {
+	if errors.Is(err, ErrInquiryConflict) {
+		slog.Info("admin_conflict", slog.String("inquiry", id))
+		if cur, gerr := store.Get(r.Context(), id); gerr == nil {
+			d := adminDetail(cur)
+			d.Errors = map[string]string{"form": "This inquiry changed while you were saving. Check it and try again."}
+			renderAdminUpdate(w, r, http.StatusConflict, d)
+			return
+		}
+	}
+	slog.Error("store_failure", slog.String("inquiry", id), slog.Any("error", err))
+	http.Error(w, "Inquiry store unavailable", http.StatusServiceUnavailable)
+}
+
+func adminSetDisposition(store InquiryStore, onRelease func(context.Context, Inquiry)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		inq, ok := loadInquiry(w, r, store)
+		if !ok {
+			return
+		}
+
+		tag := r.FormValue("disposition")
+		valid := slices.ContainsFunc(components.AdminDispositions, func(o components.AdminOption) bool { return o.Value == tag })
+		if !valid {
+			http.Error(w, "Unknown disposition", http.StatusBadRequest)
+			return
+		}
+		inq.Disposition = Disposition(tag)
+		if tag == dispositionNewTag {
+			inq.Disposition = DispositionNew
+		}
+		// Filing a held inquiry anywhere but spam releases it; the outbox
+		// dispatcher then delivers it as if it had just arrived. Its files
+		// were never stored, so the notification lists them as not attached.
+		released := inq.Status == StatusHeld && inq.Disposition != DispositionSpam && inq.Disposition != DispositionQuarantine
+		if released {
+			inq.Status = StatusPending
+		}
+		inq.UpdatedAt = time.Now()
+		updated, err := store.Update(r.Context(), inq)
+		if err != nil {
+			adminUpdateFailed(w, r, store, inq.ID, err)
+			return
+		}
+		inq = updated
+
+		admin, _ := r.Context().Value(AdminKey).(string)
+		slog.Info("admin_disposition", slog.String("inquiry", inq.ID), slog.String("disposition", tag), slog.String("admin", admin), slog.Bool("released", released))
+		if released && onRelease != nil {
+			// The acknowledgement and webhooks held back at submission
+			onRelease(r.Context(), inq)
+		}
+		renderAdminUpdate(w, r, http.StatusOK, adminDetail(inq))
+	}
+}
+
+func adminAddNote(store InquiryStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		inq, ok := loadInquiry(w, r, store)
+		if !ok {
+			return
+		}
+
+		text := strings.TrimSpace(r.FormValue("note"))
+		if text == "" || utf8.RuneCountInString(text) > maxNoteLength {
+			d := adminDetail(inq)
+			d.Errors = map[string]string{"note": "Notes must be between 1 and 2000 characters."}
+			renderAdminUpdate(w, r, http.StatusUnprocessableEntity, d)
+			return
+		}
+
+		admin, _ := r.Context().Value(AdminKey).(string)
+		inq.Notes = append(inq.Notes, Note{At: time.Now(), Author: admin, Text: text})
+		inq.UpdatedAt = time.Now()
+		updated, err := store.Update(r.Context(), inq)
+		if err != nil {
+			adminUpdateFailed(w, r, store, inq.ID, err)
+			return
+		}
+		inq = updated
+
+		slog.Info("admin_note", slog.String("inquiry", inq.ID), slog.String("admin", admin))
+		renderAdminUpdate(w, r, http.StatusOK, adminDetail(inq))
+	}
+}
+
+// --- EXPORT ---
+
+func adminExportJSON(store InquiryStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		inq, ok := loadInquiry(w, r, store)
+		if !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+inq.Reference()+`.json"`)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(inq)
+	}
+}
+
+// adminExportCSV exports every inquiry matching the inbox filter
+func adminExportCSV(store InquiryStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		all, err := store.List(r.Context())
+		if err != nil {
+			slog.Error("store_failure", slog.Any("error", err))
+			http.Error(w, "Inquiry store unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		matches := filterInquiries(all, adminFilterFromQuery(r.URL.Query()))
+
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="inquiries-`+time.Now().UTC().Format("20060102")+`.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"reference", "id", "received_at", "email", "service", "subject", "message", "disposition", "delivery", "priority", "notes"})
+		for _, inq := range matches {
+			notes := make([]string, len(inq.Notes))
+			for i, n := range inq.Notes {
+				notes[i] = n.Author + ": " + n.Text
+			}
+			row := []string{
+				inq.Reference(), inq.ID, inq.CreatedAt.UTC().Format(time.RFC3339),
+				inq.Email, inq.Service, inq.Subject, inq.Message,
+				dispositionTag(inq.Disposition), string(inq.Status), inq.Routing.Priority,
+				strings.Join(notes, "\n"),
+			}
+			for i := range row {
+				row[i] = csvSafe(row[i])
+			}
+			cw.Write(row)
+		}
+		cw.Flush()
+	}
+}
+
+// csvSafe stops spreadsheet apps treating visitor text as a formula
+func csvSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
@@ -0,0 +1,873 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"stackfoundry.co.uk/appconfig"
+	"stackfoundry.co.uk/components"
+)
+
+const (
+	adminSessionCookie   = "sf_admin"
+	adminChallengeCookie = "sf_admin_challenge"
+
+	sessionIdleTimeout = 30 * time.Minute
+	sessionMaxAge      = 12 * time.Hour
+	sessionRefresh     = time.Minute // how stale SeenAt gets before the cookie is reissued
+	inviteSessionTTL   = 30 * time.Minute
+	inviteTTL          = 72 * time.Hour
+	challengeTTL       = 5 * time.Minute
+
+	maxFailedCodes   = 5
+	maxCodeConflicts = 10 // concurrent tries a code sign-in retries past before giving up
+	codeLockout      = 15 * time.Minute
+	maxAuthBody      = 16 << 10
+	maxPasskeyName   = 60
+	adminIssuer      = "StackFoundry"
+	defaultAdminURL  = "/admin"
+)
+
+// How a session was started. Invite sessions may only set up a sign-in method.
+const (
+	methodPasskey  = "passkey"
+	methodTOTP     = "totp"
+	methodRecovery = "recovery"
+	methodInvite   = "invite"
+)
+
+// adminContextKey carries the adminContext for the signed-in admin
+const adminContextKey ContextKey = "admin_context"
+
+type adminContext struct {
+	session adminSession
+	user    AdminUser
+}
+
+// AdminAuth: Passkey and TOTP sign-in for /admin, with sessions in signed
+// cookies. A nil *AdminAuth means the admin area is not mounted.
+type AdminAuth struct {
+	Users       CredentialStore
+	RP          RelyingParty
+	Key         []byte // signs session, challenge and TOTP setup tokens
+	IdleTimeout time.Duration
+	MaxAge      time.Duration
+	now         func() time.Time
+}
+
+func NewAdminAuth(users CredentialStore, rp RelyingParty, key []byte) *AdminAuth {
+	return &AdminAuth{
+		Users:       users,
+		RP:          rp,
+		Key:         key,
+		IdleTimeout: sessionIdleTimeout,
+		MaxAge:      sessionMaxAge,
+		now:         time.Now,
+	}
+}
+
+// newAdminAuthFromConfig mounts the admin area when a credential store is
+// configured. ADMIN_ORIGINS lists the origins passkeys may be used from
+// (default http://localhost:$PORT); ADMIN_RP_ID defaults to the first one's host.
+func newAdminAuthFromConfig(ctx context.Context, cfg appconfig.Config) (*AdminAuth, error) {
+	users, err := newCredentialStoreFromConfig(ctx, cfg)
+	if err != nil || users == nil {
+		return nil, err
+	}
+	rp, err := relyingPartyFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	key := []byte(cfg.AdminSessionKey.Reveal())
+	if len(key) == 0 {
+		slog.Warn("admin_session_key_ephemeral")
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return NewAdminAuth(users, rp, key), nil
+}
+
+func relyingPartyFromConfig(cfg appconfig.Config) (RelyingParty, error) {
+	rp := RelyingParty{ID: cfg.AdminRPID, Name: adminIssuer}
+	for _, o := range strings.Split(cfg.AdminOrigins, ",") {
+		u, err := url.Parse(strings.TrimSpace(o))
+		if err != nil || u.Host == "" || (u.Scheme != "https" && u.Hostname() != "localhost") {
+			return RelyingParty{}, fmt.Errorf("ADMIN_ORIGINS: %q is not an https origin", o)
+		}
+		if rp.ID == "" {
+			rp.ID = u.Hostname()
+		}
+		if h := u.Hostname(); h != rp.ID && !strings.HasSuffix(h, "."+rp.ID) {
+			return RelyingParty{}, fmt.Errorf("ADMIN_ORIGINS: %q is outside ADMIN_RP_ID %q", o, rp.ID)
+		}
+		rp.Origins = append(rp.Origins, u.Scheme+"://"+u.Host)
+	}
+	return rp, nil
+}
+
+// --- SIGNED TOKENS ---
+
+// seal signs v for one purpose, so a token minted for one cookie is useless
+// in another: base64url(json) "." base64url(hmac)
+func (a *AdminAuth) seal(purpose string, v any) string {
+	b, _ := json.Marshal(v)
+	payload := b64url.EncodeToString(b)
+	return payload + "." + b64url.EncodeToString(a.mac(purpose, payload))
+}
+
+func (a *AdminAuth) open(purpose, token string, v any) bool {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	got, err := b64url.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, a.mac(purpose, payload)) {
+		return false
+	}
+	b, err := b64url.DecodeString(payload)
+	return err == nil && json.Unmarshal(b, v) == nil
+}
+
+func (a *AdminAuth) mac(purpose, payload string) []byte {
+	m := hmac.New(sha256.New, a.Key)
+	m.Write([]byte(purpose + "\x00" + payload))
+	return m.Sum(nil)
+}
+
+func (a *AdminAuth) cookie(name, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/admin",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   a.RP.ID != "localhost",
+		SameSite: http.SameSiteStrictMode,
+	}
+}
+
+// --- SESSIONS ---
+
+// adminSession lives entirely in the cookie. Epoch must match the user's, so
+// bumping it ends every session at once.
+type adminSession struct {
+	User     string `json:"u"`
+	Epoch    int    `json:"e"`
+	Method   string `json:"m"`
+	IssuedAt int64  `json:"i"`
+	SeenAt   int64  `json:"s"`
+}
+
+func (s adminSession) can(u AdminUser, p Permission) bool {
+	if s.Method == methodInvite {
+		return p == PermSecurity
+	}
+	return u.Role.Can(p)
+}
+
+func (a *AdminAuth) startSession(w http.ResponseWriter, u AdminUser, method string) {
+	now := a.now().Unix()
+	a.writeSession(w, adminSession{User: u.Name, Epoch: u.Epoch, Method: method, IssuedAt: now, SeenAt: now})
+}
+
+func (a *AdminAuth) writeSession(w http.ResponseWriter, s adminSession) {
+	// The absolute limit is enforced server-side; the cookie just stops being sent
+	remaining := s.IssuedAt + int64(a.MaxAge.Seconds()) - a.now().Unix()
+	http.SetCookie(w, a.cookie(adminSessionCookie, a.seal(adminSessionCookie, s), int(remaining)))
+}
+
+func (a *AdminAuth) endSession(w http.ResponseWriter) {
+	http.SetCookie(w, a.cookie(adminSessionCookie, "", -1))
+}
+
+// session returns the caller's live session and current user record
+func (a *AdminAuth) session(r *http.Request) (adminSession, AdminUser, bool) {
+	c, err := r.Cookie(adminSessionCookie)
+	if err != nil {
+		return adminSession{}, AdminUser{}, false
+	}
+	var s adminSession
+	if !a.open(adminSessionCookie, c.Value, &s) {
+		return adminSession{}, AdminUser{}, false
+	}
+
+	now := a.now()
+	maxAge := a.MaxAge
+	if s.Method == methodInvite {
+		maxAge = inviteSessionTTL
+	}
+	if now.Sub(time.Unix(s.IssuedAt, 0)) >= maxAge || now.Sub(time.Unix(s.SeenAt, 0)) >= a.IdleTimeout {
+		return adminSession{}, AdminUser{}, false
+	}
+
+	u, err := a.Users.GetUser(r.Context(), s.User)
+	if err != nil {
+		if !errors.Is(err, ErrAdminNotFound) {
+			slog.Error("credential_store_failure", slog.Any("error", err))
+		}
+		return adminSession{}, AdminUser{}, false
+	}
+	if u.Epoch != s.Epoch || !u.Role.Valid() {
+		return adminSession{}, AdminUser{}, false
+	}
+	return s, u, true
+}
+
+func adminFrom(r *http.Request) adminContext {
+	ac, _ := r.Context().Value(adminContextKey).(adminContext)
+	return ac
+}
+
+// --- MIDDLEWARE ---
+
+// public: Headers for every admin response, and a refusal of cross-site writes
+func (a *AdminAuth) public(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+		w.Header().Set("Cache-Control", "no-store")
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !sameOrigin(r) {
+			http.Error(w, "Cross-site request refused", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Require: Only lets through a live session whose role grants perm. Pages
+// redirect to sign in; anything else gets a bare 401.
+func (a *AdminAuth) Require(perm Permission, next http.Handler) http.Handler {
+	return a.public(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, u, ok := a.session(r)
+		if !ok {
+			a.endSession(w)
+			login := "/admin/login?next=" + url.QueryEscape(r.URL.RequestURI())
+			switch {
+			case r.Header.Get("HX-Request") != "":
+				w.Header().Set("HX-Redirect", login)
+				http.Error(w, "Sign in required", http.StatusUnauthorized)
+			case r.Method == http.MethodGet:
+				http.Redirect(w, r, login, http.StatusSeeOther)
+			default:
+				http.Error(w, "Sign in required", http.StatusUnauthorized)
+			}
+			return
+		}
+		if !s.can(u, perm) {
+			slog.Warn("admin_forbidden", slog.String("admin", u.Name), slog.String("permission", string(perm)), slog.String("path", r.URL.Path))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		// Sliding idle timeout, without a Set-Cookie on every request
+		if now := a.now().Unix(); now-s.SeenAt >= int64(sessionRefresh.Seconds()) {
+			s.SeenAt = now
+			a.writeSession(w, s)
+		}
+
+		ctx := context.WithValue(r.Context(), AdminKey, u.Name)
+		ctx = context.WithValue(ctx, adminContextKey, adminContext{session: s, user: u})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}))
+}
+
+// safeNext keeps post-login redirects inside the admin area
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/admin") || strings.ContainsAny(next, "\\\r\n") {
+		return defaultAdminURL
+	}
+	return next
+}
+
+// saveUser writes the error response itself when it returns false
+func (a *AdminAuth) saveUser(w http.ResponseWriter, r *http.Request, u AdminUser) (AdminUser, bool) {
+	u.UpdatedAt = a.now()
+	saved, err := a.Users.PutUser(r.Context(), u)
+	if errors.Is(err, ErrCredentialConflict) {
+		http.Error(w, "Your account changed in another tab. Reload and try again.", http.StatusConflict)
+		return AdminUser{}, false
+	}
+	if err != nil {
+		slog.Error("credential_store_failure", slog.String("admin", u.Name), slog.Any("error", err))
+		http.Error(w, "Credential store unavailable", http.StatusServiceUnavailable)
+		return AdminUser{}, false
+	}
+	return saved, true
+}
+
+// --- WEBAUTHN CHALLENGES ---
+
+type webauthnChallenge struct {
+	Challenge []byte `json:"c"`
+	Purpose   string `json:"p"`
+	User      string `json:"u"`
+	Expires   int64  `json:"x"`
+}
+
+func (a *AdminAuth) newChallenge(w http.ResponseWriter, purpose, user string) []byte {
+	c := make([]byte, 32)
+	rand.Read(c)
+	ch := webauthnChallenge{Challenge: c, Purpose: purpose, User: user, Expires: a.now().Add(challengeTTL).Unix()}
+	http.SetCookie(w, a.cookie(adminChallengeCookie, a.seal(adminChallengeCookie, ch), int(challengeTTL.Seconds())))
+	return c
+}
+
+// takeChallenge reads and clears the pending challenge, so each is tried once
+func (a *AdminAuth) takeChallenge(w http.ResponseWriter, r *http.Request, purpose string) (webauthnChallenge, bool) {
+	http.SetCookie(w, a.cookie(adminChallengeCookie, "", -1))
+	c, err := r.Cookie(adminChallengeCookie)
+	if err != nil {
+		return webauthnChallenge{}, false
+	}
+	var ch webauthnChallenge
+	if !a.open(adminChallengeCookie, c.Value, &ch) || ch.Purpose != purpose || a.now().Unix() > ch.Expires {
+		return webauthnChallenge{}, false
+	}
+	return ch, true
+}
+
+// passkeyRequest is what passkey.js posts: the form's fields plus, on the
+// second leg, the browser's credential
+type passkeyRequest struct {
+	User       string          `json:"user"`
+	Name       string          `json:"name"`
+	Next       string          `json:"next"`
+	Credential json.RawMessage `json:"credential"`
+}
+
+func decodePasskeyRequest(w http.ResponseWriter, r *http.Request) (passkeyRequest, bool) {
+	var req passkeyRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAuthBody)).Decode(&req); err != nil {
+		http.Error(w, "Malformed request", http.StatusBadRequest)
+		return req, false
+	}
+	req.User = strings.TrimSpace(req.User)
+	return req, true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// --- SIGN IN ---
+
+func (a *AdminAuth) loginPage(w http.ResponseWriter, r *http.Request) {
+	next := safeNext(r.URL.Query().Get("next"))
+	if s, _, ok := a.session(r); ok && s.Method != methodInvite {
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+	sessionID, _ := r.Context().Value(SessionKey).(string)
+	RenderHTML(w, r, components.AdminLogin(sessionID, components.AdminLoginView{Next: next}))
+}
+
+// passkeyLoginOptions answers the same way for unknown names, so the form
+// cannot be used to find out who has an account
+func (a *AdminAuth) passkeyLoginOptions(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodePasskeyRequest(w, r)
+	if !ok {
+		return
+	}
+	var passkeys []Passkey
+	if req.User != "" {
+		u, err := a.Users.GetUser(r.Context(), req.User)
+		if err != nil && !errors.Is(err, ErrAdminNotFound) {
+			slog.Error("credential_store_failure", slog.Any("error", err))
+			http.Error(w, "Credential store unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		passkeys = u.Passkeys
+	}
+	challenge := a.newChallenge(w, "login", req.User)
+	writeJSON(w, map[string]any{"publicKey": a.RP.requestOptions(passkeys, challenge)})
+}
+
+func (a *AdminAuth) passkeyLogin(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodePasskeyRequest(w, r)
+	if !ok {
+		return
+	}
+	fail := func(user, reason string) {
+		slog.Warn("admin_login_failed", slog.String("admin", user), slog.String("method", methodPasskey), slog.String("reason", reason), slog.String("ip", clientIP(r)))
+		http.Error(w, "That passkey was not accepted. Try again or use a code.", http.StatusUnauthorized)
+	}
+
+	ch, ok := a.takeChallenge(w, r, "login")
+	if !ok {
+		fail(req.User, "challenge expired")
+		return
+	}
+	var res AssertionResponse
+	if err := json.Unmarshal(req.Credential, &res); err != nil {
+		fail(ch.User, "malformed credential")
+		return
+	}
+
+	// Without a typed name, the passkey's user handle says whose it is
+	name := ch.User
+	if handle, err := b64url.DecodeString(res.UserHandle); err == nil && len(handle) > 0 {
+		if name != "" && name != string(handle) {
+			fail(name, "user handle mismatch")
+			return
+		}
+		name = string(handle)
+	}
+	u, err := a.Users.GetUser(r.Context(), name)
+	if err != nil {
+		fail(name, "unknown user")
+		return
+	}
+	id, _ := b64url.DecodeString(res.ID)
+	i := slices.IndexFunc(u.Passkeys, func(pk Passkey) bool { return subtle.ConstantTimeCompare(pk.ID, id) == 1 })
+	if i < 0 {
+		fail(name, "unknown credential")
+		return
+	}
+	count, err := a.RP.verifyAssertion(res, u.Passkeys[i], ch.Challenge)
+	if err != nil {
+		fail(name, err.Error())
+		return
+	}
+
+	u.Passkeys[i].SignCount = count
+	u.Passkeys[i].LastUsedAt = a.now()
+	if u, ok = a.saveUser(w, r, u); !ok {
+		return
+	}
+	a.startSession(w, u, methodPasskey)
+	slog.Info("admin_login", slog.String("admin", u.Name), slog.String("method", methodPasskey), slog.String("ip", clientIP(r)))
+	writeJSON(w, map[string]string{"redirect": safeNext(req.Next)})
+}
+
+// codeLogin takes a six digit TOTP code or a recovery code. Repeated misses
+// lock code sign-in for a while; passkeys keep working, so a stranger guessing
+// codes cannot lock the owner out.
+func (a *AdminAuth) codeLogin(w http.ResponseWriter, r *http.Request) {
+	v := components.AdminLoginView{
+		User: strings.TrimSpace(r.FormValue("user")),
+		Next: safeNext(r.FormValue("next")),
+	}
+	code := strings.TrimSpace(r.FormValue("code"))
+	sessionID, _ := r.Context().Value(SessionKey).(string)
+	reject := func(status int, reason, message string) {
+		slog.Warn("admin_login_failed", slog.String("admin", v.User), slog.String("method", "code"), slog.String("reason", reason), slog.String("ip", clientIP(r)))
+		v.Error = message
+		RenderHTMLStatus(w, r, status, components.AdminLogin(sessionID, v))
+	}
+	const notAccepted = "That code was not accepted."
+
+	// ATTEMPT: Each try is counted before its code is checked, in a write
+	// conditional on the version read and retried on conflict. Parallel
+	// guesses therefore each use up one of the allowance; if they keep
+	// colliding, the try is refused rather than checked uncounted.
+	const tooMany = "Too many attempts. Use a passkey, or try again in a few minutes."
+	now := a.now()
+	var u AdminUser
+	var unknown bool
+	for try := 0; ; try++ {
+		cur, err := a.Users.GetUser(r.Context(), v.User)
+		if errors.Is(err, ErrAdminNotFound) {
+			// UNKNOWN: A name with no account goes through the same write
+			// and code checks as a real one, so timing does not reveal
+			// which names exist
+			cur, err, unknown = decoyAdmin(v.User), nil, true
+		}
+		if err != nil {
+			slog.Error("credential_store_failure", slog.Any("error", err))
+			http.Error(w, "Credential store unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if now.Before(cur.LockedUntil) {
+			reject(http.StatusTooManyRequests, "locked", tooMany)
+			return
+		}
+		cur.FailedCodes++
+		if cur.FailedCodes >= maxFailedCodes {
+			cur.FailedCodes = 0
+			cur.LockedUntil = now.Add(codeLockout)
+			slog.Warn("admin_locked", slog.String("admin", cur.Name), slog.Duration("for", codeLockout))
+		}
+		cur.UpdatedAt = now
+		u, err = a.Users.PutUser(r.Context(), cur)
+		if err == nil {
+			break
+		}
+		if unknown && errors.Is(err, ErrCredentialConflict) {
+			u = cur
+			break
+		}
+		if !errors.Is(err, ErrCredentialConflict) {
+			slog.Error("credential_store_failure", slog.String("admin", cur.Name), slog.Any("error", err))
+			http.Error(w, "Credential store unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if try >= maxCodeConflicts {
+			reject(http.StatusTooManyRequests, "contended", tooMany)
+			return
+		}
+	}
+
+	method := ""
+	if u.TOTPSecret != "" {
+		if step, ok := verifyTOTP(u.TOTPSecret, code, now, u.TOTPLastStep); ok {
+			method = methodTOTP
+			u.TOTPLastStep = step
+		}
+	}
+	if i := slices.Index(u.RecoveryCodes, hashRecoveryCode(code)); method == "" && code != "" && i >= 0 {
+		method = methodRecovery
+		u.RecoveryCodes = slices.Delete(u.RecoveryCodes, i, i+1)
+	}
+	if unknown {
+		reject(http.StatusUnauthorized, "unknown user", notAccepted)
+		return
+	}
+	if method == "" {
+		reject(http.StatusUnauthorized, "bad code", notAccepted)
+		return
+	}
+
+	// The right code clears the count, and any lock its own try set
+	u.FailedCodes = 0
+	u.LockedUntil = time.Time{}
+	if u, ok := a.saveUser(w, r, u); ok {
+		a.startSession(w, u, method)
+		slog.Info("admin_login", slog.String("admin", u.Name), slog.String("method", method), slog.String("ip", clientIP(r)), slog.Int("recovery_codes_left", len(u.RecoveryCodes)))
+		// A recovery code means a lost device; send them to fix that first
+		if method == methodRecovery {
+			v.Next = "/admin/security"
+		}
+		http.Redirect(w, r, v.Next, http.StatusSeeOther)
+	}
+}
+
+// decoyAdmin stands in for a name with no account. Its version matches no
+// stored record, so the write counting its attempt is refused and creates
+// nothing.
+func decoyAdmin(name string) AdminUser {
+	_, hashes := newRecoveryCodes()
+	return AdminUser{Name: name, TOTPSecret: newTOTPSecret(), RecoveryCodes: hashes, Version: math.MaxInt32}
+}
+
+func (a *AdminAuth) logout(w http.ResponseWriter, r *http.Request) {
+	a.endSession(w)
+	http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+}
+
+// --- INVITES ---
+
+// newInvite returns a one-time sign-up token for u and records its hash.
+// The name rides in the token so the link can be checked with one read.
+func newInvite(u *AdminUser, now time.Time) string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	token := u.Name + "." + b64url.EncodeToString(b)
+	sum := sha256.Sum256([]byte(token))
+	u.InviteHash = hex.EncodeToString(sum[:])
+	u.InviteExpires = now.Add(inviteTTL)
+	return token
+}
+
+func (a *AdminAuth) checkInvite(ctx context.Context, token string) (AdminUser, bool) {
+	name, _, ok := strings.Cut(token, ".")
+	if !ok {
+		return AdminUser{}, false
+	}
+	u, err := a.Users.GetUser(ctx, name)
+	if err != nil || u.InviteHash == "" || a.now().After(u.InviteExpires) {
+		return AdminUser{}, false
+	}
+	sum := sha256.Sum256([]byte(token))
+	return u, subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(u.InviteHash)) == 1
+}
+
+// enrollPage only shows the invite; accepting it takes a POST, so link
+// previews and mail scanners do not use it up
+func (a *AdminAuth) enrollPage(w http.ResponseWriter, r *http.Request) {
+	sessionID, _ := r.Context().Value(SessionKey).(string)
+	token := r.URL.Query().Get("token")
+	u, ok := a.checkInvite(r.Context(), token)
+	if !ok {
+		RenderHTMLStatus(w, r, http.StatusNotFound, components.AdminEnroll(sessionID, components.AdminEnrollView{
+			Error: "This invite link is invalid, used or expired. Ask an owner for a new one.",
+		}))
+		return
+	}
+	RenderHTML(w, r, components.AdminEnroll(sessionID, components.AdminEnrollView{User: u.Name, Token: token}))
+}
+
+func (a *AdminAuth) enroll(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.checkInvite(r.Context(), r.FormValue("token"))
+	if !ok {
+		http.Error(w, "Invite invalid, used or expired", http.StatusNotFound)
+		return
+	}
+	u.InviteHash, u.InviteExpires = "", time.Time{}
+	if u, ok = a.saveUser(w, r, u); !ok {
+		return
+	}
+	a.startSession(w, u, methodInvite)
+	slog.Info("admin_invite_accepted", slog.String("admin", u.Name), slog.String("ip", clientIP(r)))
+	http.Redirect(w, r, "/admin/security", http.StatusSeeOther)
+}
+
+// --- SECURITY SETTINGS ---
+
+// totpSetup carries a proposed secret between the settings page and the
+// confirming code, so nothing is stored until the app is shown to work
+type totpSetup struct {
+	User    string `json:"u"`
+	Secret  string `json:"s"`
+	Expires int64  `json:"x"`
+}
+
+func (a *AdminAuth) securityView(ac adminContext) components.AdminSecurityView {
+	u := ac.user
+	v := components.AdminSecurityView{
+		User:              u.Name,
+		Role:              string(u.Role),
+		Invited:           ac.session.Method == methodInvite,
+		TOTPEnabled:       u.TOTPSecret != "",
+		RecoveryRemaining: len(u.RecoveryCodes),
+	}
+	for _, pk := range u.Passkeys {
+		v.Passkeys = append(v.Passkeys, components.AdminPasskey{
+			ID: b64url.EncodeToString(pk.ID), Name: pk.Name, CreatedAt: pk.CreatedAt, LastUsedAt: pk.LastUsedAt,
+		})
+	}
+	if !v.TOTPEnabled {
+		v.TOTPSecret = newTOTPSecret()
+		v.TOTPURI = totpURI(adminIssuer, u.Name, v.TOTPSecret)
+		v.TOTPSetup = a.seal("totp_setup", totpSetup{User: u.Name, Secret: v.TOTPSecret, Expires: a.now().Add(inviteSessionTTL).Unix()})
+	}
+	return v
+}
+
+func (a *AdminAuth) renderSecurity(w http.ResponseWriter, r *http.Request, status int, v components.AdminSecurityView) {
+	sessionID, _ := r.Context().Value(SessionKey).(string)
+	RenderHTMLStatus(w, r, status, components.AdminSecurity(sessionID, v))
+}
+
+func (a *AdminAuth) securityPage(w http.ResponseWriter, r *http.Request) {
+	a.renderSecurity(w, r, http.StatusOK, a.securityView(adminFrom(r)))
+}
+
+// firstFactor turns an invite session into a real one once the user has
+// a way to sign in again
+func (a *AdminAuth) firstFactor(w http.ResponseWriter, ac adminContext, u AdminUser, method string) {
+	if ac.session.Method == methodInvite {
+		a.startSession(w, u, method)
+	}
+}
+
+func (a *AdminAuth) passkeyRegisterOptions(w http.ResponseWriter, r *http.Request) {
+	ac := adminFrom(r)
+	challenge := a.newChallenge(w, "register", ac.user.Name)
+	writeJSON(w, map[string]any{"publicKey": a.RP.creationOptions(ac.user, challenge)})
+}
+
+func (a *AdminAuth) passkeyRegister(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodePasskeyRequest(w, r)
+	if !ok {
+		return
+	}
+	ac := adminFrom(r)
+	u := ac.user
+	ch, ok := a.takeChallenge(w, r, "register")
+	if !ok || ch.User != u.Name {
+		http.Error(w, "That took too long. Try again.", http.StatusBadRequest)
+		return
+	}
+	var res RegistrationResponse
+	if err := json.Unmarshal(req.Credential, &res); err != nil {
+		http.Error(w, "Malformed credential", http.StatusBadRequest)
+		return
+	}
+	pk, err := a.RP.verifyRegistration(res, ch.Challenge)
+	if err != nil {
+		slog.Warn("admin_passkey_rejected", slog.String("admin", u.Name), slog.Any("error", err))
+		http.Error(w, "That passkey could not be registered.", http.StatusBadRequest)
+		return
+	}
+	if slices.ContainsFunc(u.Passkeys, func(p Passkey) bool { return string(p.ID) == string(pk.ID) }) {
+		http.Error(w, "That passkey is already registered.", http.StatusConflict)
+		return
+	}
+
+	pk.Name = strings.TrimSpace(req.Name)
+	if pk.Name == "" {
+		pk.Name = fmt.Sprintf("Passkey %d", len(u.Passkeys)+1)
+	}
+	if utf8.RuneCountInString(pk.Name) > maxPasskeyName {
+		pk.Name = string([]rune(pk.Name)[:maxPasskeyName])
+	}
+	pk.CreatedAt = a.now()
+	u.Passkeys = append(u.Passkeys, pk)
+	if u, ok = a.saveUser(w, r, u); !ok {
+		return
+	}
+	a.firstFactor(w, ac, u, methodPasskey)
+	slog.Info("admin_passkey_added", slog.String("admin", u.Name), slog.Int("passkeys", len(u.Passkeys)))
+	writeJSON(w, map[string]string{"redirect": "/admin/security"})
+}
+
+// removeFactor refuses to take away the last way to sign in
+func (a *AdminAuth) removeFactor(w http.ResponseWriter, r *http.Request, u AdminUser, event string) {
+	if !u.HasFactor() {
+		v := a.securityView(adminFrom(r))
+		v.Errors = map[string]string{"factors": "Add another passkey or an authenticator app before removing this one."}
+		a.renderSecurity(w, r, http.StatusConflict, v)
+		return
+	}
+	if _, ok := a.saveUser(w, r, u); !ok {
+		return
+	}
+	slog.Info(event, slog.String("admin", u.Name))
+	http.Redirect(w, r, "/admin/security", http.StatusSeeOther)
+}
+
+func (a *AdminAuth) passkeyDelete(w http.ResponseWriter, r *http.Request) {
+	u := adminFrom(r).user
+	u.Passkeys = slices.DeleteFunc(slices.Clone(u.Passkeys), func(pk Passkey) bool {
+		return b64url.EncodeToString(pk.ID) == r.FormValue("id")
+	})
+	a.removeFactor(w, r, u, "admin_passkey_removed")
+}
+
+func (a *AdminAuth) totpEnable(w http.ResponseWriter, r *http.Request) {
+	ac := adminFrom(r)
+	u := ac.user
+	var setup totpSetup
+	if !a.open("totp_setup", r.FormValue("setup"), &setup) || setup.User != u.Name || a.now().Unix() > setup.Expires {
+		http.Error(w, "Setup expired. Reload and scan the new code.", http.StatusBadRequest)
+		return
+	}
+	step, ok := verifyTOTP(setup.Secret, strings.TrimSpace(r.FormValue("code")), a.now(), 0)
+	if !ok {
+		v := a.securityView(ac)
+		v.TOTPSecret, v.TOTPURI, v.TOTPSetup = setup.Secret, totpURI(adminIssuer, u.Name, setup.Secret), r.FormValue("setup")
+		v.Errors = map[string]string{"totp": "That code did not match. Check the time on your device and try again."}
+		a.renderSecurity(w, r, http.StatusUnprocessableEntity, v)
+		return
+	}
+
+	u.TOTPSecret, u.TOTPLastStep = setup.Secret, step
+	if u, ok = a.saveUser(w, r, u); !ok {
+		return
+	}
+	a.firstFactor(w, ac, u, methodTOTP)
+	slog.Info("admin_totp_enabled", slog.String("admin", u.Name))
+	http.Redirect(w, r, "/admin/security", http.StatusSeeOther)
+}
+
+func (a *AdminAuth) totpDisable(w http.ResponseWriter, r *http.Request) {
+	u := adminFrom(r).user
+	u.TOTPSecret, u.TOTPLastStep = "", 0
+	a.removeFactor(w, r, u, "admin_totp_disabled")
+}
+
+// recoveryCodes replaces any unused codes and shows the new ones, once
+func (a *AdminAuth) recoveryCodes(w http.ResponseWriter, r *http.Request) {
+	ac := adminFrom(r)
+	u := ac.user
+	if !u.HasFactor() {
+		http.Error(w, "Set up a passkey or authenticator app first", http.StatusConflict)
+		return
+	}
+	codes, hashes := newRecoveryCodes()
+	u.RecoveryCodes = hashes
+	u, ok := a.saveUser(w, r, u)
+	if !ok {
+		return
+	}
+	slog.Info("admin_recovery_codes", slog.String("admin", u.Name))
+	ac.user = u
+	v := a.securityView(ac)
+	v.RecoveryCodes = codes
+	a.renderSecurity(w, r, http.StatusOK, v)
+}
+
+// signOutEverywhere ends every other session by moving the epoch on
+func (a *AdminAuth) signOutEverywhere(w http.ResponseWriter, r *http.Request) {
+	ac := adminFrom(r)
+	u := ac.user
+	u.Epoch++
+	u, ok := a.saveUser(w, r, u)
+	if !ok {
+		return
+	}
+	a.startSession(w, u, ac.session.Method)
+	slog.Info("admin_sessions_revoked", slog.String("admin", u.Name))
+	http.Redirect(w, r, "/admin/security", http.StatusSeeOther)
+}
+
+// --- CLI ---
+
+// runAdmin: `admin invite -user NAME [-role owner|triage|viewer]` creates
+// the account if needed and prints a one-time sign-up link. Reinviting an
+// existing user is how they get back in with every device lost.
+func runAdmin(cfg appconfig.Config, args []string) error {
+	if len(args) == 0 || args[0] != "invite" {
+		return errors.New("usage: admin invite -user NAME [-role owner|triage|viewer]")
+	}
+	fs := flag.NewFlagSet("admin invite", flag.ContinueOnError)
+	name := fs.String("user", "", "admin user name")
+	role := fs.String("role", "", "role for a new user (default owner), or a new role for an existing one")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *name == "" || strings.ContainsAny(*name, ". \t") {
+		return errors.New("-user is required and may not contain dots or spaces")
+	}
+
+	ctx := context.Background()
+	users, err := newCredentialStoreFromConfig(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	if users == nil {
+		return errors.New("set ADMIN_CREDENTIALS_FILE or ADMIN_CREDENTIALS_TABLE")
+	}
+	rp, err := relyingPartyFromConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	u, err := users.GetUser(ctx, *name)
+	switch {
+	case errors.Is(err, ErrAdminNotFound):
+		u = AdminUser{Name: *name, Role: RoleOwner, CreatedAt: now}
+	case err != nil:
+		return err
+	}
+	if *role != "" {
+		u.Role = Role(*role)
+	}
+	if !u.Role.Valid() {
+		return fmt.Errorf("unknown role %q", u.Role)
+	}
+	token := newInvite(&u, now)
+	u.UpdatedAt = now
+	if _, err := users.PutUser(ctx, u); err != nil {
+		return err
+	}
+	fmt.Printf("Invite for %s (%s), valid for %s:\n%s/admin/enroll?token=%s\n", u.Name, u.Role, inviteTTL, rp.Origins[0], url.QueryEscape(token))
+	return nil
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestAdminAuth returns auth backed by a fresh file store holding users
+func newTestAdminAuth(t *testing.T, users ...AdminUser) *AdminAuth {
+	t.Helper()
+	store, err := OpenFileCredentialStore(filepath.Join(t.TempDir(), "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range users {
+		if _, err := store.PutUser(context.Background(), u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewAdminAuth(store, testRP, []byte("test-session-key"))
+}
+
+// adminCookie is a session for name started and last seen at the given time
+func adminCookie(auth *AdminAuth, name, method string, at time.Time) *http.Cookie {
+	u, _ := auth.Users.GetUser(context.Background(), name)
+	s := adminSession{User: name, Epoch: u.Epoch, Method: method, IssuedAt: at.Unix(), SeenAt: at.Unix()}
+	return &http.Cookie{Name: adminSessionCookie, Value: auth.seal(adminSessionCookie, s)}
+}
+
+func responseCookie(rr *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func newAuthRouter(auth *AdminAuth) http.Handler {
+	return testApp(App{Mailer: &MemoryMailer{}, Store: NewMemoryStore(), Admin: auth}).Handler()
+}
+
+func TestAdminSessions(t *testing.T) {
+	auth := newTestAdminAuth(t, AdminUser{Name: "joe", Role: RoleOwner})
+	router := newAuthRouter(auth)
+	now := time.Now()
+
+	get := func(c *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/admin", nil)
+		req.AddCookie(c)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// 1. Cookie attributes
+	rr := get(adminCookie(auth, "joe", methodPasskey, now.Add(-2*time.Minute)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Live session got %v", rr.Code)
+	}
+	c := responseCookie(rr, adminSessionCookie)
+	if c == nil || !c.HttpOnly || c.SameSite != http.SameSiteStrictMode || c.Path != "/admin" {
+		t.Fatalf("Refreshed cookie = %+v, want HttpOnly SameSite=Strict on /admin", c)
+	}
+	if c := responseCookie(get(adminCookie(auth, "joe", methodPasskey, now)), adminSessionCookie); c != nil {
+		t.Error("Fresh session reissued on every request")
+	}
+
+	// 2. Idle and absolute timeouts
+	idle := adminCookie(auth, "joe", methodPasskey, now.Add(-sessionIdleTimeout))
+	if rr := get(idle); rr.Code != http.StatusSeeOther {
+		t.Errorf("Idle session got %v", rr.Code)
+	}
+	var old adminSession
+	auth.open(adminSessionCookie, adminCookie(auth, "joe", methodPasskey, now).Value, &old)
+	old.IssuedAt = now.Add(-sessionMaxAge).Unix()
+	aged := &http.Cookie{Name: adminSessionCookie, Value: auth.seal(adminSessionCookie, old)}
+	if rr := get(aged); rr.Code != http.StatusSeeOther {
+		t.Errorf("Session past its absolute limit got %v", rr.Code)
+	}
+
+	// 3. A signed token for another purpose is not a session
+	other := &http.Cookie{Name: adminSessionCookie, Value: auth.seal(adminChallengeCookie, old)}
+	if rr := get(other); rr.Code != http.StatusSeeOther {
+		t.Errorf("Challenge token accepted as a session: %v", rr.Code)
+	}
+
+	// 4. Signing out everywhere ends other sessions but keeps this one
+	elsewhere := adminCookie(auth, "joe", methodPasskey, now)
+	req := httptest.NewRequest("POST", "/admin/security/sessions", nil)
+	req.AddCookie(adminCookie(auth, "joe", methodPasskey, now))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("Sign out everywhere got %v", rr.Code)
+	}
+	if rr := get(elsewhere); rr.Code != http.StatusSeeOther {
+		t.Errorf("Revoked session got %v", rr.Code)
+	}
+	if rr := get(responseCookie(rr, adminSessionCookie)); rr.Code != http.StatusOK {
+		t.Errorf("Current session was revoked too: %v", rr.Code)
+	}
+}
+
+func TestAdminPermissions(t *testing.T) {
+	auth := newTestAdminAuth(t,
+		AdminUser{Name: "vic", Role: RoleViewer},
+		AdminUser{Name: "tia", Role: RoleTriage},
+		AdminUser{Name: "new", Role: RoleOwner},
+	)
+	router := newAuthRouter(auth)
+
+	tests := []struct {
+		user, method, sessionMethod, path string
+		want                              int
+	}{
+		{"vic", "GET", methodPasskey, "/admin", http.StatusOK},
+		{"vic", "POST", methodPasskey, "/admin/inquiries/x/notes", http.StatusForbidden},
+		{"vic", "GET", methodPasskey, "/admin/export.csv", http.StatusForbidden},
+		{"vic", "GET", methodPasskey, "/admin/security", http.StatusOK},
+		{"tia", "POST", methodPasskey, "/admin/inquiries/x/notes", http.StatusNotFound},
+		{"tia", "GET", methodPasskey, "/admin/export.csv", http.StatusForbidden},
+		// An accepted invite only reaches the security page, whatever the role
+		{"new", "GET", methodInvite, "/admin", http.StatusForbidden},
+		{"new", "GET", methodInvite, "/admin/security", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user+" "+tt.method+" "+tt.path, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.AddCookie(adminCookie(auth, tt.user, tt.sessionMethod, time.Now()))
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if rr.Code != tt.want {
+				t.Errorf("Got %v, want %v", rr.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdminCodeLogin(t *testing.T) {
+	secret := newTOTPSecret()
+	codes, hashes := newRecoveryCodes()
+	auth := newTestAdminAuth(t, AdminUser{Name: "joe", Role: RoleOwner, TOTPSecret: secret, RecoveryCodes: hashes})
+	router := newAuthRouter(auth)
+	key, _ := totpEncoding.DecodeString(secret)
+
+	login := func(user, code string) *httptest.ResponseRecorder {
+		form := url.Values{"user": {user}, "code": {code}, "next": {"/admin?service=mvp"}}
+		return postForm(router, "/admin/login/code", form, false)
+	}
+	current := totpCode(key, time.Now().Unix()/totpPeriod)
+
+	// 1. TOTP signs in and goes where it was headed, once per code
+	rr := login("joe", current)
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/admin?service=mvp" || responseCookie(rr, adminSessionCookie) == nil {
+		t.Fatalf("TOTP login got %v to %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if rr := login("joe", current); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Replayed TOTP got %v", rr.Code)
+	}
+
+	// 2. Recovery codes work once and lead to the security page
+	if rr := login("joe", strings.ToUpper(codes[3])); rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/admin/security" {
+		t.Errorf("Recovery login got %v to %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if rr := login("joe", codes[3]); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Reused recovery code got %v", rr.Code)
+	}
+
+	// 3. Unknown users look the same as wrong codes, and the attempt
+	// spent on them creates no account
+	if rr := login("nobody", current); rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Body.String(), "not accepted") {
+		t.Errorf("Unknown user got %v", rr.Code)
+	}
+	if _, err := auth.Users.GetUser(context.Background(), "nobody"); !errors.Is(err, ErrAdminNotFound) {
+		t.Errorf("Unknown user's attempt stored a record: %v", err)
+	}
+
+	// 4. Too many misses lock code sign-in, even for a right code
+	for range maxFailedCodes {
+		login("joe", "000000")
+	}
+	if rr := login("joe", codes[4]); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Locked account got %v, want 429", rr.Code)
+	}
+}
+
+// slowReads: Widens the gap between reading a user and writing it back, so
+// parallel requests all read the same version
+type slowReads struct{ CredentialStore }
+
+func (s slowReads) GetUser(ctx context.Context, name string) (AdminUser, error) {
+	u, err := s.CredentialStore.GetUser(ctx, name)
+	time.Sleep(5 * time.Millisecond)
+	return u, err
+}
+
+func TestAdminCodeLoginConcurrent(t *testing.T) {
+	secret := newTOTPSecret()
+	auth := newTestAdminAuth(t, AdminUser{Name: "joe", Role: RoleOwner, TOTPSecret: secret})
+	auth.Users = slowReads{auth.Users}
+	router := newAuthRouter(auth)
+	key, _ := totpEncoding.DecodeString(secret)
+
+	login := func(code string) int {
+		form := url.Values{"user": {"joe"}, "code": {code}}
+		return postForm(router, "/admin/login/code", form, false).Code
+	}
+
+	// 1. Guesses sent in parallel are each counted, none lost to a conflict
+	var wg sync.WaitGroup
+	for i := range 4 * maxFailedCodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if code := login(fmt.Sprintf("guess-%d", i)); code != http.StatusUnauthorized && code != http.StatusTooManyRequests {
+				t.Errorf("Parallel guess got %v", code)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 2. So the account is locked, even for the right code
+	if code := login(totpCode(key, time.Now().Unix()/totpPeriod)); code != http.StatusTooManyRequests {
+		t.Errorf("Right code after a parallel burst got %v, want 429", code)
+	}
+}
+
+func TestAdminInviteAndPasskey(t *testing.T) {
+	auth := newTestAdminAuth(t)
+	router := newAuthRouter(auth)
+	ctx := context.Background()
+
+	u := AdminUser{Name: "ana", Role: RoleTriage}
+	token := newInvite(&u, time.Now())
+	auth.Users.PutUser(ctx, u)
+
+	var cookies []*http.Cookie
+	do := func(req *http.Request) *httptest.ResponseRecorder {
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		for _, c := range rr.Result().Cookies() {
+			cookies = filterCookie(cookies, c.Name)
+			if c.MaxAge >= 0 {
+				cookies = append(cookies, c)
+			}
+		}
+		return rr
+	}
+	postJSON := func(path string, body any) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		return do(httptest.NewRequest("POST", path, bytes.NewReader(b)))
+	}
+	form := func(path string, v url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(v.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return do(req)
+	}
+
+	// 1. Viewing the invite does not use it; accepting it does
+	if rr := do(httptest.NewRequest("GET", "/admin/enroll?token="+url.QueryEscape(token), nil)); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "ana") {
+		t.Fatalf("Invite page got %v", rr.Code)
+	}
+	if rr := form("/admin/enroll", url.Values{"token": {token}}); rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/admin/security" {
+		t.Fatalf("Accept invite got %v", rr.Code)
+	}
+	if rr := form("/admin/enroll", url.Values{"token": {token}}); rr.Code != http.StatusNotFound {
+		t.Errorf("Invite reused: %v", rr.Code)
+	}
+	if rr := do(httptest.NewRequest("GET", "/admin", nil)); rr.Code != http.StatusForbidden {
+		t.Errorf("Invite session reached the inbox: %v", rr.Code)
+	}
+
+	// 2. Registering a passkey makes it a full session
+	var opts struct{ PublicKey creationOptions }
+	json.Unmarshal(postJSON("/admin/security/passkeys/options", map[string]string{}).Body.Bytes(), &opts)
+	challenge, _ := b64url.DecodeString(opts.PublicKey.Challenge)
+	if opts.PublicKey.User.ID != b64url.EncodeToString([]byte("ana")) || opts.PublicKey.AuthenticatorSelection.UserVerification != "required" {
+		t.Errorf("Creation options = %+v", opts.PublicKey)
+	}
+	ta := newTestAuthenticator(t)
+	rr := postJSON("/admin/security/passkeys", map[string]any{"name": "Laptop", "credential": ta.register("http://localhost:8080", challenge)})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Register passkey got %v: %s", rr.Code, rr.Body)
+	}
+	if rr := do(httptest.NewRequest("GET", "/admin", nil)); rr.Code != http.StatusOK {
+		t.Errorf("Inbox after first passkey got %v", rr.Code)
+	}
+
+	// 3. Signing in with it, without typing a name
+	cookies = nil
+	var req struct{ PublicKey requestOptions }
+	json.Unmarshal(postJSON("/admin/login/passkey/options", map[string]string{}).Body.Bytes(), &req)
+	challenge, _ = b64url.DecodeString(req.PublicKey.Challenge)
+	assertion := ta.assert("http://localhost:8080", challenge, "ana")
+	rr = postJSON("/admin/login/passkey", map[string]any{"next": "https://evil.example/", "credential": assertion})
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"redirect":"/admin"`) {
+		t.Fatalf("Passkey login got %v: %s", rr.Code, rr.Body)
+	}
+	got, _ := auth.Users.GetUser(ctx, "ana")
+	if got.Passkeys[0].SignCount != 1 || got.Passkeys[0].LastUsedAt.IsZero() {
+		t.Errorf("Passkey not updated: %+v", got.Passkeys[0])
+	}
+
+	// 4. The same assertion cannot be replayed: the challenge is gone
+	rr = postJSON("/admin/login/passkey", map[string]any{"credential": assertion})
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Replayed assertion got %v", rr.Code)
+	}
+
+	// 5. The last sign-in method cannot be removed
+	cookies = []*http.Cookie{adminCookie(auth, "ana", methodPasskey, time.Now())}
+	if rr := form("/admin/security/passkeys/delete", url.Values{"id": {b64url.EncodeToString(ta.id)}}); rr.Code != http.StatusConflict {
+		t.Errorf("Removing the last passkey got %v", rr.Code)
+	}
+}
+
+func filterCookie(cookies []*http.Cookie, name string) []*http.Cookie {
+	var out []*http.Cookie
+	for _, c := range cookies {
+		if c.Name != name {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func TestSafeNext(t *testing.T) {
+	for in, want := range map[string]string{
+		"":                     "/admin",
+		"/admin/inquiries/abc": "/admin/inquiries/abc",
+		"https://evil.example": "/admin",
+		"//evil.example/admin": "/admin",
+		"/\\evil.example":      "/admin",
+		"/privacy":             "/admin",
+	} {
+		if got := safeNext(in); got != want {
+			t.Errorf("safeNext(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
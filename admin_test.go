@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// seedInbox saves two leads and a spam inquiry, an hour apart
+func seedInbox(t *testing.T, store InquiryStore) []Inquiry {
+	t.Helper()
+	base := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	inqs := []Inquiry{
+		{Email: "founder@startup.io", Service: "mvp", Subject: "MVP in six weeks", Message: "We need a Go backend"},
+		{Email: "cto@bigco.com", Service: "audit", Subject: "=HYPERLINK(\"http://evil\")", Message: "Costs are out of control"},
+		{Email: "bot@spam.example", Subject: "SEO services", Message: "Cheap backlinks", Disposition: DispositionSpam},
+	}
+	for i := range inqs {
+		inqs[i].ID = newInquiryID(base.Add(time.Duration(i) * time.Hour))
+		inqs[i].Status = StatusSent
+		inqs[i].CreatedAt = base.Add(time.Duration(i) * time.Hour)
+		if err := store.Save(context.Background(), inqs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return inqs
+}
+
+// adminRequest is signed in as joe, an owner
+func adminRequest(auth *AdminAuth, method, target string, form url.Values) *http.Request {
+	var req *http.Request
+	if form != nil {
+		req = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req = httptest.NewRequest(method, target, nil)
+	}
+	req.AddCookie(adminCookie(auth, "joe", methodPasskey, time.Now()))
+	return req
+}
+
+func TestAdminAuth(t *testing.T) {
+	store, auth := NewMemoryStore(), newTestAdminAuth(t, AdminUser{Name: "joe", Role: RoleOwner})
+	seedInbox(t, store)
+	router := testApp(App{Store: store, Admin: auth}).Handler()
+
+	// 1. Without a session, pages send you to sign in and nothing is served
+	forged := httptest.NewRequest("GET", "/admin", nil)
+	forged.AddCookie(&http.Cookie{Name: adminSessionCookie, Value: adminCookie(auth, "joe", methodPasskey, time.Now()).Value + "x"})
+	for name, req := range map[string]*http.Request{
+		"Anonymous":     httptest.NewRequest("GET", "/admin", nil),
+		"Forged Cookie": forged,
+	} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/admin/login?next=%2Fadmin" {
+			t.Errorf("%s: got %v to %q, want a redirect to sign in", name, rr.Code, rr.Header().Get("Location"))
+		}
+		if strings.Contains(rr.Body.String(), "founder@startup.io") {
+			t.Errorf("%s: inbox contents leaked", name)
+		}
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/inquiries/x/notes", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Anonymous POST got %v, want 401", rr.Code)
+	}
+
+	// 2. Cross-site writes are refused even with a session
+	req := adminRequest(auth, "POST", "/admin/inquiries/x/notes", url.Values{"note": {"hi"}})
+	req.Header.Set("Sec-Fetch-Site", "cross-site")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Cross-site POST got %v, want 403", rr.Code)
+	}
+
+	// 3. Without a credential store the admin area does not exist
+	rr = httptest.NewRecorder()
+	testApp(App{Mailer: &MemoryMailer{}, Store: NewMemoryStore()}).Handler().ServeHTTP(rr, adminRequest(auth, "GET", "/admin", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Admin without credentials got %v, want 404", rr.Code)
+	}
+}
+
+func TestAdminInbox(t *testing.T) {
+	store, auth := NewMemoryStore(), newTestAdminAuth(t, AdminUser{Name: "joe", Role: RoleOwner})
+	inqs := seedInbox(t, store)
+	router := testApp(App{Store: store, Admin: auth}).Handler()
+
+	tests := []struct {
+		name    string
+		query   string
+		want    []string
+		notWant []string
+	}{
+		{"Default Hides Spam", "", []string{"founder@startup.io", "cto@bigco.com"}, []string{"bot@spam.example"}},
+		{"Spam Filter", "disposition=spam", []string{"bot@spam.example"}, []string{"founder@startup.io"}},
+		{"Service Filter", "service=audit", []string{"cto@bigco.com"}, []string{"founder@startup.io"}},
+		{"Search All Terms", "q=go+backend", []string{"founder@startup.io"}, []string{"cto@bigco.com"}},
+		{"Search By Reference", "q=" + strings.ToLower(inqs[1].Reference()), []string{"cto@bigco.com"}, []string{"founder@startup.io"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, adminRequest(auth, "GET", "/admin?"+tt.query, nil))
+			body := rr.Body.String()
+			if rr.Code != http.StatusOK {
+				t.Fatalf("Got %v", rr.Code)
+			}
+			for _, s := range tt.want {
+				if !strings.Contains(body, s) {
+					t.Errorf("Missing %q", s)
+				}
+			}
+			for _, s := range tt.notWant {
+				if strings.Contains(body, s) {
+					t.Errorf("Unexpected %q", s)
+				}
+			}
+			if rr.Header().Get("Cache-Control") != "no-store" {
+				t.Errorf("Cache-Control = %q, want no-store", rr.Header().Get("Cache-Control"))
+			}
+		})
+	}
+
+	// HTMX filter changes get just the results, not a whole page
+	req := adminRequest(auth, "GET", "/admin?service=mvp", nil)
+	req.Header.Set("HX-Request", "true")
+	req.Header.Set("HX-Target", "inbox_results")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if body := rr.Body.String(); !strings.HasPrefix(body, `<div id="inbox_results">`) || strings.Contains(body, "<html") {
+		t.Errorf("HTMX filter did not return the results partial: %.80s", body)
+	}
+}
+
+func TestAdminActions(t *testing.T) {
+	store, auth := NewMemoryStore(), newTestAdminAuth(t, AdminUser{Name: "joe", Role: RoleOwner})
+	inqs := seedInbox(t, store)
+	router := testApp(App{Store: store, Admin: auth}).Handler()
+	id := inqs[0].ID
+	post := func(path string, form url.Values) *httptest.ResponseRecorder {
+		req := adminRequest(auth, "POST", "/admin/inquiries/"+id+path, form)
+		req.Header.Set("HX-Request", "true")
+		req.Header.Set("Sec-Fetch-Site", "same-origin")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// 1. Dispositions and notes are stored and the panel re-rendered
+	if rr := post("/disposition", url.Values{"disposition": {"replied"}}); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `id="inquiry_panel"`) {
+		t.Fatalf("Disposition update: got %v", rr.Code)
+	}
+	rr := post("/notes", url.Values{"note": {"Called back <b>Tuesday</b>"}})
+	if !strings.Contains(rr.Body.String(), "Called back &lt;b&gt;Tuesday&lt;/b&gt;") {
+		t.Errorf("Note not shown escaped in panel")
+	}
+	got, _ := store.Get(context.Background(), id)
+	if got.Disposition != DispositionReplied || len(got.Notes) != 1 || got.Notes[0].Author != "joe" {
+		t.Errorf("Stored inquiry = %+v", got)
+	}
+
+	// 2. Bad input is rejected without touching the record
+	if rr := post("/disposition", url.Values{"disposition": {"deleted"}}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Unknown disposition got %v", rr.Code)
+	}
+	if rr := post("/notes", url.Values{"note": {"   "}}); rr.Code != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), `id="note_error"`) {
+		t.Errorf("Empty note got %v", rr.Code)
+	}
+	if rr := post("/../"+"nope/notes", url.Values{"note": {"x"}}); rr.Code == http.StatusOK {
+		t.Errorf("Unknown inquiry accepted a note")
+	}
+
+	// 3. Exports
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, adminRequest(auth, "GET", "/admin/inquiries/"+id+"/export", nil))
+	var exported Inquiry
+	if err := json.Unmarshal(rr.Body.Bytes(), &exported); err != nil || exported.ID != id || len(exported.Notes) != 1 {
+		t.Errorf("JSON export = %+v, %v", exported, err)
+	}
+	if cd := rr.Header().Get("Content-Disposition"); !strings.Contains(cd, inqs[0].Reference()+".json") {
+		t.Errorf("Content-Disposition = %q", cd)
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, adminRequest(auth, "GET", "/admin/export.csv?disposition=all", nil))
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil || len(records) != 4 {
+		t.Fatalf("CSV export has %d records (err %v), want header + 3", len(records), err)
+	}
+	for _, rec := range records[1:] {
+		if rec[4] == "audit" && !strings.HasPrefix(rec[5], "'=") {
+			t.Errorf("Formula subject not neutralised: %q", rec[5])
+		}
+	}
+}
+
+// racedStore: Lets another writer in between a handler's read and its write
+type racedStore struct {
+	*MemoryStore
+	race func()
+}
+
+func (s *racedStore) Update(ctx context.Context, inq Inquiry) (Inquiry, error) {
+	if race := s.race; race != nil {
+		s.race = nil
+		race()
+	}
+	return s.MemoryStore.Update(ctx, inq)
+}
+
+func TestAdminConflict(t *testing.T) {
+	ctx := context.Background()
+	mem, auth := NewMemoryStore(), newTestAdminAuth(t, AdminUser{Name: "joe", Role: RoleOwner})
+	inqs := seedInbox(t, mem)
+	store := &racedStore{MemoryStore: mem}
+	router := testApp(App{Store: store, Admin: auth}).Handler()
+	id := inqs[0].ID
+	post := func() *httptest.ResponseRecorder {
+		req := adminRequest(auth, "POST", "/admin/inquiries/"+id+"/notes", url.Values{"note": {"Called back"}})
+		req.Header.Set("HX-Request", "true")
+		req.Header.Set("Sec-Fetch-Site", "same-origin")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// 1. The outbox records a delivery while the admin is saving a note
+	store.race = func() {
+		cur, _ := mem.Get(ctx, id)
+		cur.Attempts++
+		mem.Update(ctx, cur)
+	}
+	rr := post()
+	if rr.Code != http.StatusConflict || !strings.Contains(rr.Body.String(), `id="form_error"`) {
+		t.Fatalf("Raced note got %v", rr.Code)
+	}
+	got, _ := mem.Get(ctx, id)
+	if len(got.Notes) != 0 || got.Attempts != 1 {
+		t.Errorf("After the conflict the record is %+v", got)
+	}
+
+	// 2. Saving again applies to the current record
+	if rr := post(); rr.Code != http.StatusOK {
+		t.Fatalf("Retried note got %v", rr.Code)
+	}
+
+	// 3. A delivery that loses to an admin keeps the admin's change
+	stale, _ := mem.Get(ctx, id)
+	stale.Status = StatusFailed
+	stale, _ = mem.Update(ctx, stale)
+	store.race = func() {
+		cur, _ := mem.Get(ctx, id)
+		cur.Disposition = DispositionReplied
+		mem.Update(ctx, cur)
+	}
+	outbox := &Dispatcher{Store: store, Mailer: &MemoryMailer{}, Sender: testSender}
+	if _, err := outbox.Deliver(ctx, stale); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = mem.Get(ctx, id)
+	if got.Status != StatusSent || got.Attempts != 2 || got.Disposition != DispositionReplied || len(got.Notes) != 1 {
+		t.Errorf("After the raced delivery the record is %+v", got)
+	}
+}
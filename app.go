@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"stackfoundry.co.uk/appconfig"
+)
+
+// maxRecordConflicts: concurrent edits recording webhook failures retries past
+const maxRecordConflicts = 5
+
+//go:embed public/*
+var embeddedFiles embed.FS
+
+// App: The site and everything it depends on. NewApp wires it from a Config;
+// tests build one from fakes, leaving out what they do not exercise, since
+// a nil service is off. Lambda and local runs serve the same Handler.
+type App struct {
+	Config  appconfig.Config
+	Logger  *slog.Logger     // request logs; nil uses slog.Default
+	Proxies []netip.Prefix   // peers whose X-Forwarded-For is believed
+	Assets  fs.FS            // the public/ tree; nil serves no static files
+	Now     func() time.Time // nil uses time.Now
+
+	Mailer   Mailer
+	Store    InquiryStore
+	Keys     IdempotencyStore
+	Guard    *SpamGuard
+	Pow      *ProofOfWork
+	Limiter  *RateLimiter
+	Ack      *Acknowledger
+	Routes   *RoutingTable
+	Hooks    *Webhooks
+	Filter   *SpamFilter
+	Admin    *AdminAuth
+	Bookings *Bookings
+	Subjects *SubjectRequests
+	Purger   *Purger
+}
+
+// NewApp builds every service cfg turns on. A service that fails to
+// configure is left off and its error returned, joined with any others, and
+// main refuses to start on it: a bad setting fails the deploy, not a visitor.
+func NewApp(ctx context.Context, cfg appconfig.Config, logger *slog.Logger) (*App, error) {
+	a := &App{Config: cfg, Logger: logger, Now: time.Now}
+	var errs []error
+	check := func(setting string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", setting, err))
+		}
+	}
+
+	assets, err := fs.Sub(embeddedFiles, "public")
+	check("assets", err)
+	a.Assets = assets
+
+	a.Mailer, err = newMailerFromConfig(ctx, cfg)
+	check("mailer", err)
+	a.Store, err = newInquiryStoreFromConfig(ctx, cfg)
+	check("inquiry store", err)
+	a.Keys, err = newIdempotencyStoreFromConfig(ctx, cfg)
+	check("idempotency store", err)
+
+	log := a.logger()
+	spamKey := spamKeyFromConfig(cfg, log)
+	a.Guard, a.Pow = NewSpamGuard(spamKey), NewProofOfWork(spamKey)
+	a.Guard.Logger, a.Pow.Logger = log, log
+	if a.Keys != nil {
+		// Spent tokens and solutions share the idempotency table and its TTL
+		a.Guard.Used, a.Pow.Used = a.Keys, a.Keys
+	}
+	a.Pow.Rates, err = newRateBackendFromConfig(ctx, cfg, spamKey)
+	check("proof of work", err)
+	a.Proxies, err = parseTrustedProxies(cfg.TrustedProxies)
+	check("trusted proxies", err)
+	a.Limiter, err = newRateLimiterFromConfig(ctx, cfg, spamKey)
+	check("rate limits", err)
+
+	a.Ack, err = newAcknowledgerFromConfig(ctx, cfg, a.Mailer, spamKey)
+	check("acknowledgements", err)
+	a.Routes, err = newRoutingTableFromConfig(cfg)
+	check("routing", err)
+	a.Hooks, err = newWebhooksFromConfig(cfg)
+	check("webhooks", err)
+	if a.Hooks != nil {
+		a.Hooks.Logger = log
+	}
+	a.Filter, err = newSpamFilterFromConfig(cfg)
+	check("spam filter", err)
+	a.Admin, err = newAdminAuthFromConfig(ctx, cfg)
+	check("admin", err)
+	a.Bookings, err = newBookingsFromConfig(ctx, cfg, a.Mailer, spamKey)
+	check("bookings", err)
+	if a.Bookings != nil {
+		a.Bookings.Logger = log
+	}
+	a.Subjects, err = newSubjectRequestsFromConfig(ctx, cfg, a.Mailer, a.Store, a.Bookings, spamKey)
+	check("subject requests", err)
+	a.Purger, err = newPurgerFromConfig(ctx, cfg, a.Store, a.Bookings, spamKey)
+	check("retention", err)
+	return a, errors.Join(errs...)
+}
+
+// Handler is the whole site. CHAIN: Logger -> Compress -> ClientIP -> RateLimit -> routes
+func (a *App) Handler() http.Handler {
+	var next http.Handler = a.routes()
+	if a.Limiter != nil {
+		next = a.Limiter.Middleware(next)
+	}
+	next = ClientIPMiddleware(a.Proxies, next)
+	return LoggerMiddleware(a.logger(), CompressMiddleware(next))
+}
+
+// accepted runs what follows an inquiry being accepted: the visitor's
+// acknowledgement and the webhooks. The notification goes through the
+// outbox, or straight to the mailer without a store. Webhooks that gave up
+// are recorded on the stored inquiry for /admin. The acknowledgement and the
+// webhooks run side by side on budgets of their own, and the acknowledgement
+// still goes out if the visitor disconnects.
+func (a *App) accepted(ctx context.Context, inq Inquiry) {
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		actx, cancel := context.WithTimeout(context.WithoutCancel(ctx), ackTimeout)
+		defer cancel()
+		a.Ack.Send(actx, inq)
+	})
+	hctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	failures := a.Hooks.Send(hctx, inq)
+	cancel()
+	wg.Wait()
+	if len(failures) == 0 || a.Store == nil {
+		return
+	}
+
+	// Recording must not be cut short by the request deadline, and keeps any
+	// change the outbox or an admin made meanwhile
+	uctx := context.WithoutCancel(ctx)
+	for range maxRecordConflicts {
+		cur, err := a.Store.Get(uctx, inq.ID)
+		if err == nil {
+			cur.WebhookFailures = append(cur.WebhookFailures, failures...)
+			_, err = a.Store.Update(uctx, cur)
+		}
+		if !errors.Is(err, ErrInquiryConflict) {
+			if err != nil {
+				a.logger().Error("store_failure", slog.String("inquiry", inq.ID), slog.Any("error", err))
+			}
+			return
+		}
+	}
+	a.logger().Error("store_failure", slog.String("inquiry", inq.ID), slog.Any("error", ErrInquiryConflict))
+}
+
+// Outbox delivers and retries notifications for stored inquiries; nil
+// without a store
+func (a *App) Outbox() *Dispatcher {
+	if a.Store == nil {
+		return nil
+	}
+	return &Dispatcher{Store: a.Store, Mailer: a.Mailer, Sender: a.Config.SenderEmail, Logger: a.logger()}
+}
+
+func (a *App) logger() *slog.Logger {
+	if a.Logger == nil {
+		return slog.Default()
+	}
+	return a.Logger
+}
+
+func (a *App) now() time.Time {
+	if a.Now == nil {
+		return time.Now()
+	}
+	return a.Now()
+}
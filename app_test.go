@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"stackfoundry.co.uk/appconfig"
+)
+
+func TestNewApp(t *testing.T) {
+	cfg, err := appconfig.Load(nil, []string{"MAILER=memory", "INQUIRY_STORE=memory", "RATE_LIMITS=nonsense"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err := NewApp(t.Context(), cfg, slog.Default())
+
+	// 1. A bad setting is reported, naming it, so main can refuse to start
+	if err == nil || !strings.Contains(err.Error(), "rate limits: RATE_LIMITS") {
+		t.Errorf("NewApp error = %v, want the bad RATE_LIMITS", err)
+	}
+
+	// 2. Services follow the config; the bad setting turns off only its own
+	if _, ok := app.Mailer.(*MemoryMailer); !ok {
+		t.Errorf("Mailer %T, want memory", app.Mailer)
+	}
+	if app.Outbox() == nil || app.Filter == nil || app.Ack != nil || app.Admin != nil {
+		t.Errorf("Services %+v", app)
+	}
+	if app.Limiter != nil {
+		t.Error("Bad RATE_LIMITS left a limiter on")
+	}
+
+	// 3. The handler serves the embedded assets through the full chain
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/robots.txt", nil))
+	if rr.Code != http.StatusOK || rr.Header().Get("X-Frame-Options") != "DENY" {
+		t.Errorf("GET /robots.txt: %d %v", rr.Code, rr.Header())
+	}
+}
+
+func TestAppIsolation(t *testing.T) {
+	// Apps share nothing, so differently configured ones run side by side
+	for i, sender := range []string{"one@example.com", "two@example.com"} {
+		t.Run(sender, func(t *testing.T) {
+			t.Parallel()
+			mailer, store := &MemoryMailer{}, NewMemoryStore()
+			at := time.Date(2026, 3, 1+i, 9, 0, 0, 0, time.UTC)
+			app := testApp(App{Mailer: mailer, Store: store, Now: func() time.Time { return at }})
+			app.Config.SenderEmail = sender
+
+			rr := postForm(app.Handler(), "/api/contact", newContactForm("visitor@example.org", "Hello", "Hello from a parallel test, long enough to send."), true)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("Status %d: %s", rr.Code, rr.Body)
+			}
+			sent := mailer.Sent()
+			if len(sent) != 1 || sent[0].From != sender || sent[0].To[0] != sender {
+				t.Errorf("Sent %+v, want one message from and to %s", sent, sender)
+			}
+			inqs, _ := store.List(t.Context())
+			if len(inqs) != 1 || !inqs[0].CreatedAt.Equal(at) {
+				t.Errorf("Stored %+v, want one inquiry at %v", inqs, at)
+			}
+		})
+	}
+}
+
+func TestNewAppValid(t *testing.T) {
+	// The defaults, as a local run has them, configure without error
+	cfg, err := appconfig.Load(nil, []string{"MAILER=memory", "INQUIRY_STORE=memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.DiscardHandler)
+	app, err := NewApp(t.Context(), cfg, logger)
+	if err != nil {
+		t.Fatalf("NewApp: %v", err)
+	}
+
+	// Services log through the app's logger, not the global one
+	if app.Outbox().logger() != logger || app.Guard.logger() != logger || app.Pow.logger() != logger || app.Bookings.logger() != logger {
+		t.Error("A service does not log through the app's logger")
+	}
+}
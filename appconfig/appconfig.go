@@ -0,0 +1,480 @@
+// Package appconfig is the site's configuration: one typed Config shared by
+// the web binary and the CDK stack in infra/. Settings are layered, each
+// overriding the last: defaults, an optional JSON file, the environment,
+// then command-line flags.
+package appconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/mail"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Config: Every setting the app and the stack read. Each field's env tag is
+// its environment variable; the same name lower-cased is its key in the
+// config file, and kebab-cased its flag (SENDER_EMAIL, sender_email,
+// -sender-email).
+type Config struct {
+	// Site
+	Domain           string `env:"DOMAIN" default:"stackfoundry.co.uk" help:"apex domain; www. is served too"`
+	SenderEmail      string `env:"SENDER_EMAIL" default:"joe@stackfoundry.co.uk" help:"From address on every email, and the contact shown in errors"`
+	BudgetAlertEmail string `env:"BUDGET_ALERT_EMAIL" default:"joe@stackfoundry.co.uk" help:"recipient of AWS budget alerts (stack only)"`
+	DMARCReportEmail string `env:"DMARC_REPORT_EMAIL" default:"dmarc_rua@onsecureserver.net" help:"DMARC aggregate report address (stack only)"`
+	Region           string `env:"REGION" default:"eu-west-2" help:"AWS region for the stack and every AWS client"`
+	Port             int    `env:"PORT" default:"8080" help:"local listen port"`
+	LambdaFunction   string `env:"AWS_LAMBDA_FUNCTION_NAME" help:"set by Lambda; switches stores and mail to their Lambda defaults"`
+
+	// Signing keys. Each may instead be given as a Secrets Manager ARN,
+	// read once at startup, so the value never sits in the environment.
+	SpamSigningKey     Secret `env:"SPAM_SIGNING_KEY" help:"signs form tokens, links and purge reports; random per process when unset"`
+	SpamSigningKeyARN  string `env:"SPAM_SIGNING_KEY_ARN" help:"Secrets Manager secret holding SPAM_SIGNING_KEY"`
+	AdminSessionKey    Secret `env:"ADMIN_SESSION_KEY" help:"signs admin session cookies; random per process when unset"`
+	AdminSessionKeyARN string `env:"ADMIN_SESSION_KEY_ARN" help:"Secrets Manager secret holding ADMIN_SESSION_KEY"`
+	AuditKey           Secret `env:"AUDIT_KEY" help:"keys the address hashes in the audit log; never rotate it, or past entries stop matching"`
+	AuditKeyARN        string `env:"AUDIT_KEY_ARN" help:"Secrets Manager secret holding AUDIT_KEY"`
+
+	// Mail
+	Mailer            string `env:"MAILER" help:"ses, smtp, outbox or memory (default ses on Lambda, outbox locally)"`
+	SMTPAddr          string `env:"SMTP_ADDR" help:"host:port for the smtp mailer"`
+	SMTPUsername      string `env:"SMTP_USERNAME"`
+	SMTPPassword      Secret `env:"SMTP_PASSWORD"`
+	OutboxDir         string `env:"OUTBOX_DIR" default:"outbox" help:"where the outbox mailer writes .eml files"`
+	AckEmail          bool   `env:"ACK_EMAIL" help:"email visitors a copy of their inquiry"`
+	AckResponseWindow string `env:"ACK_RESPONSE_WINDOW" default:"24 hours" help:"reply time promised in acknowledgements"`
+	AckLimit          string `env:"ACK_LIMIT" default:"3/d:2" help:"acknowledgements per recipient, N/UNIT:BURST"`
+
+	// Storage
+	InquiryStore          string `env:"INQUIRY_STORE" help:"jsonl, dynamodb, memory or none (default dynamodb on Lambda, jsonl locally)"`
+	InquiryStorePath      string `env:"INQUIRY_STORE_PATH" default:"data/inquiries.jsonl"`
+	InquiryTable          string `env:"INQUIRY_TABLE"`
+	IdempotencyTable      string `env:"IDEMPOTENCY_TABLE"`
+	BookingTable          string `env:"BOOKING_TABLE"`
+	SubjectAuditTable     string `env:"SUBJECT_AUDIT_TABLE"`
+	AdminCredentialsTable string `env:"ADMIN_CREDENTIALS_TABLE"`
+	AdminCredentialsFile  string `env:"ADMIN_CREDENTIALS_FILE"`
+
+	// Public addresses (default http://localhost:PORT)
+	AdminOrigins   string `env:"ADMIN_ORIGINS" help:"comma-separated origins passkeys may be used from"`
+	AdminRPID      string `env:"ADMIN_RP_ID" help:"passkey relying party; defaults to the first origin's host"`
+	BookingBaseURL string `env:"BOOKING_BASE_URL" help:"site address used in booking emails"`
+	PrivacyBaseURL string `env:"PRIVACY_BASE_URL" help:"site address used in data access emails"`
+
+	// Policies, each a file replacing the one embedded in the binary
+	RoutingRules    string `env:"ROUTING_RULES"`
+	BookingSchedule string `env:"BOOKING_SCHEDULE"`
+	RetentionPolicy string `env:"RETENTION_POLICY"`
+	SpamModel       string `env:"SPAM_MODEL"`
+
+	SpamFilter    bool    `env:"SPAM_FILTER" default:"on" help:"score inquiries and quarantine likely spam"`
+	SpamThreshold float64 `env:"SPAM_THRESHOLD" default:"0.9" help:"score (0 to 1) at which inquiries are quarantined"`
+	RateLimits    string  `env:"RATE_LIMITS" help:"per-route overrides, ROUTE=N/UNIT:BURST,..."`
+	// TrustedProxies only matters off API Gateway, e.g. behind a local
+	// reverse proxy. Without it X-Forwarded-For is ignored.
+	TrustedProxies string `env:"TRUSTED_PROXIES" help:"comma-separated addresses or CIDRs whose X-Forwarded-For is believed"`
+
+	// Webhooks
+	Webhooks       string            `env:"WEBHOOKS" help:"NAME=FORMAT:URL,..."`
+	WebhookSecret  Secret            `env:"WEBHOOK_SECRET" help:"signing secret for endpoints without their own"`
+	WebhookSecrets map[string]Secret `env:"WEBHOOK_SECRET_*" help:"per-endpoint secrets, keyed by upper-cased endpoint name"`
+
+	sources map[string]string // env name -> "default", "file", "env" or "flag"
+}
+
+// Secret: A setting that must not be printed. fmt, JSON and slog all see
+// "[redacted]"; Reveal returns the value.
+type Secret string
+
+func (s Secret) Reveal() string { return string(s) }
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return "[redacted]"
+}
+
+func (s Secret) GoString() string             { return strconv.Quote(s.String()) }
+func (s Secret) MarshalJSON() ([]byte, error) { return json.Marshal(s.String()) }
+func (s Secret) LogValue() slog.Value         { return slog.StringValue(s.String()) }
+
+// Defaults is the configuration with nothing set, as a local run sees it
+func Defaults() Config {
+	c, _ := Load(nil, nil)
+	return c
+}
+
+// Load builds a Config from defaults, the JSON file named by -config or
+// CONFIG_FILE, environ (as from os.Environ) and the flags in args. It fails
+// on values that do not parse; Validate checks that they make sense.
+func Load(args []string, environ []string) (Config, error) {
+	c := Config{sources: map[string]string{}}
+	var errs []error
+	for _, f := range fields() {
+		if f.def != "" {
+			errs = append(errs, c.set(f, f.def, "default"))
+		}
+	}
+
+	env := map[string]string{}
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			env[k] = v
+		}
+	}
+
+	// Flags are parsed first, for -config, but applied last
+	fs := flag.NewFlagSet("stackfoundry", flag.ContinueOnError)
+	file := fs.String("config", env["CONFIG_FILE"], "JSON config file (default $CONFIG_FILE)")
+	type flagValue struct {
+		f     field
+		value string
+	}
+	var flagged []flagValue
+	for _, f := range fields() {
+		if f.prefix {
+			continue
+		}
+		fs.Func(f.flag(), f.usage(), func(v string) error {
+			flagged = append(flagged, flagValue{f, v})
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+	if fs.NArg() > 0 {
+		return c, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	if *file != "" {
+		values, err := readFile(*file)
+		if err != nil {
+			return c, err
+		}
+		errs = append(errs, c.apply(values, "file"))
+	}
+	errs = append(errs, c.apply(env, "env"))
+	for _, fv := range flagged {
+		errs = append(errs, c.set(fv.f, fv.value, "flag"))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return c, err
+	}
+
+	// Settings whose default depends on others
+	local := "http://localhost:" + strconv.Itoa(c.Port)
+	for _, d := range []struct {
+		env string
+		v   *string
+		def string
+	}{
+		{"MAILER", &c.Mailer, c.pick("ses", "outbox")},
+		{"INQUIRY_STORE", &c.InquiryStore, c.pick("dynamodb", "jsonl")},
+		{"ADMIN_ORIGINS", &c.AdminOrigins, local},
+		{"BOOKING_BASE_URL", &c.BookingBaseURL, local},
+		{"PRIVACY_BASE_URL", &c.PrivacyBaseURL, local},
+	} {
+		if *d.v == "" {
+			*d.v = d.def
+			c.sources[d.env] = "default"
+		}
+	}
+	return c, nil
+}
+
+// OnLambda reports whether the process is a Lambda function
+func (c Config) OnLambda() bool {
+	return c.LambdaFunction != ""
+}
+
+func (c Config) pick(lambda, local string) string {
+	if c.OnLambda() {
+		return lambda
+	}
+	return local
+}
+
+// WebhookSecretFor is the signing secret for a webhook endpoint: its own
+// WEBHOOK_SECRET_<NAME>, or WEBHOOK_SECRET
+func (c Config) WebhookSecretFor(name string) Secret {
+	if s := c.WebhookSecrets[strings.ToUpper(strings.ReplaceAll(name, "-", "_"))]; s != "" {
+		return s
+	}
+	return c.WebhookSecret
+}
+
+var (
+	regionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-\d$`)
+	domainPattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,}$`)
+)
+
+// Validate reports every setting that is out of range, inconsistent with
+// another, or missing where the app cannot work without it
+func (c Config) Validate() error {
+	var errs []error
+	bad := func(env, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: "+format, append([]any{env}, args...)...))
+	}
+
+	if !domainPattern.MatchString(c.Domain) {
+		bad("DOMAIN", "%q is not a domain name", c.Domain)
+	}
+	for env, addr := range map[string]string{"SENDER_EMAIL": c.SenderEmail, "BUDGET_ALERT_EMAIL": c.BudgetAlertEmail, "DMARC_REPORT_EMAIL": c.DMARCReportEmail} {
+		if a, err := mail.ParseAddress(addr); err != nil || a.Address != addr {
+			bad(env, "%q is not a bare email address", addr)
+		}
+	}
+	if !regionPattern.MatchString(c.Region) {
+		bad("REGION", "%q is not an AWS region", c.Region)
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		bad("PORT", "%d is out of range", c.Port)
+	}
+	if c.SpamThreshold <= 0 || c.SpamThreshold > 1 {
+		bad("SPAM_THRESHOLD", "must be above 0 and at most 1, got %g", c.SpamThreshold)
+	}
+
+	switch c.Mailer {
+	case "ses", "outbox", "memory":
+	case "smtp":
+		if c.SMTPAddr == "" {
+			bad("SMTP_ADDR", "is required for the smtp mailer")
+		}
+	default:
+		bad("MAILER", "unknown mailer %q", c.Mailer)
+	}
+	switch c.InquiryStore {
+	case "jsonl", "memory", "none":
+	case "dynamodb":
+		if c.InquiryTable == "" {
+			bad("INQUIRY_TABLE", "is required for the dynamodb store")
+		}
+	default:
+		bad("INQUIRY_STORE", "unknown inquiry store %q", c.InquiryStore)
+	}
+
+	for env, raw := range map[string]string{"BOOKING_BASE_URL": c.BookingBaseURL, "PRIVACY_BASE_URL": c.PrivacyBaseURL} {
+		if u, err := url.Parse(raw); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			bad(env, "%q is not an absolute http(s) URL", raw)
+		}
+	}
+	for env, path := range map[string]string{"ROUTING_RULES": c.RoutingRules, "BOOKING_SCHEDULE": c.BookingSchedule, "RETENTION_POLICY": c.RetentionPolicy, "SPAM_MODEL": c.SpamModel} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			bad(env, "%v", err)
+		}
+	}
+
+	// On Lambda every instance must share keys and state
+	if c.OnLambda() {
+		if c.SpamSigningKey == "" && c.SpamSigningKeyARN == "" {
+			bad("SPAM_SIGNING_KEY", "or its _ARN is required on Lambda")
+		}
+		if c.AuditKey == "" && c.AuditKeyARN == "" {
+			bad("AUDIT_KEY", "or its _ARN is required on Lambda")
+		}
+		if c.AdminCredentialsTable != "" && c.AdminSessionKey == "" && c.AdminSessionKeyARN == "" {
+			bad("ADMIN_SESSION_KEY", "or its _ARN is required on Lambda when the admin area is enabled")
+		}
+		for env, table := range map[string]string{"BOOKING_TABLE": c.BookingTable, "IDEMPOTENCY_TABLE": c.IdempotencyTable, "SUBJECT_AUDIT_TABLE": c.SubjectAuditTable} {
+			if table == "" {
+				bad(env, "is required on Lambda")
+			}
+		}
+	}
+
+	slices.SortFunc(errs, func(a, b error) int { return strings.Compare(a.Error(), b.Error()) })
+	return errors.Join(errs...)
+}
+
+// Setting: One field as printed by "config check"
+type Setting struct {
+	Name   string
+	Value  string // secrets are redacted
+	Source string // "default", "file", "env", "flag" or "" when unset
+	Help   string
+}
+
+// Settings lists every field in declaration order
+func (c Config) Settings() []Setting {
+	v := reflect.ValueOf(c)
+	var out []Setting
+	for _, f := range fields() {
+		fv := v.Field(f.index)
+		if f.prefix {
+			for _, k := range slices.Sorted(maps.Keys(c.WebhookSecrets)) {
+				name := strings.TrimSuffix(f.env, "*") + k
+				out = append(out, Setting{Name: name, Value: c.WebhookSecrets[k].String(), Source: c.sources[name], Help: f.help})
+			}
+			continue
+		}
+		s := Setting{Name: f.env, Source: c.sources[f.env], Help: f.help}
+		if fv.Kind() == reflect.Bool {
+			s.Value = map[bool]string{true: "on", false: "off"}[fv.Bool()]
+		} else {
+			s.Value = fmt.Sprint(fv.Interface())
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// String lists the settings one per line, with secrets redacted, so a
+// Config is safe to print or log
+func (c Config) String() string {
+	var b strings.Builder
+	for _, s := range c.Settings() {
+		fmt.Fprintf(&b, "%s=%s", s.Name, s.Value)
+		if s.Source != "" {
+			fmt.Fprintf(&b, " (%s)", s.Source)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func (c Config) GoString() string { return c.String() }
+
+// --- FIELDS ---
+
+type field struct {
+	index  int
+	env    string
+	def    string
+	help   string
+	prefix bool // WEBHOOK_SECRET_*: any variable starting with the prefix
+}
+
+func (f field) flag() string {
+	return strings.ReplaceAll(strings.ToLower(f.env), "_", "-")
+}
+
+func (f field) usage() string {
+	return strings.TrimSpace(f.help + " ($" + f.env + ")")
+}
+
+func fields() []field {
+	t := reflect.TypeFor[Config]()
+	var out []field
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		env := sf.Tag.Get("env")
+		if env == "" {
+			continue
+		}
+		out = append(out, field{index: i, env: env, def: sf.Tag.Get("default"), help: sf.Tag.Get("help"), prefix: strings.HasSuffix(env, "*")})
+	}
+	return out
+}
+
+// apply sets every field named in values, keyed by env name
+func (c *Config) apply(values map[string]string, source string) error {
+	var errs []error
+	for _, f := range fields() {
+		if f.prefix {
+			prefix := strings.TrimSuffix(f.env, "*")
+			for k, v := range values {
+				if name := strings.ToUpper(k); strings.HasPrefix(name, prefix) && len(name) > len(prefix) && v != "" {
+					c.setPrefixed(f, name, v, source)
+				}
+			}
+			continue
+		}
+		if v := values[f.env]; v != "" {
+			errs = append(errs, c.set(f, v, source))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Config) set(f field, raw, source string) error {
+	fv := reflect.ValueOf(c).Elem().Field(f.index)
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(raw)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a whole number", f.env, raw)
+		}
+		fv.SetInt(int64(n))
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a number", f.env, raw)
+		}
+		fv.SetFloat(n)
+	case reflect.Bool:
+		switch strings.ToLower(raw) {
+		case "on", "true", "yes", "1":
+			fv.SetBool(true)
+		case "off", "false", "no", "0":
+			fv.SetBool(false)
+		default:
+			return fmt.Errorf("%s: %q is not on or off", f.env, raw)
+		}
+	}
+	c.sources[f.env] = source
+	return nil
+}
+
+func (c *Config) setPrefixed(f field, name, raw, source string) {
+	fv := reflect.ValueOf(c).Elem().Field(f.index)
+	if fv.IsNil() {
+		fv.Set(reflect.MakeMap(fv.Type()))
+	}
+	key := strings.TrimPrefix(name, strings.TrimSuffix(f.env, "*"))
+	fv.SetMapIndex(reflect.ValueOf(key), reflect.ValueOf(raw).Convert(fv.Type().Elem()))
+	c.sources[name] = source
+}
+
+// readFile loads a JSON object of settings. Keys are env names, in either
+// case; values may be strings, numbers or booleans.
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config file: %w", err)
+	}
+	var raw map[string]any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	known := map[string]bool{}
+	var prefixes []string
+	for _, f := range fields() {
+		if f.prefix {
+			prefixes = append(prefixes, strings.TrimSuffix(f.env, "*"))
+		}
+		known[f.env] = true
+	}
+	values := map[string]string{}
+	for k, v := range raw {
+		name := strings.ToUpper(k)
+		if !known[name] && !slices.ContainsFunc(prefixes, func(p string) bool { return strings.HasPrefix(name, p) }) {
+			return nil, fmt.Errorf("%s: unknown setting %q", path, k)
+		}
+		switch v.(type) {
+		case string, json.Number, bool:
+			values[name] = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("%s: %q must be a string, number or boolean", path, k)
+		}
+	}
+	return values, nil
+}
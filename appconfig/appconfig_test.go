@@ -0,0 +1,134 @@
+package appconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadLayers(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(file, []byte(`{"domain": "file.example", "port": 9000, "ack_email": true, "region": "eu-west-1"}`), 0o600)
+
+	// 1. Defaults, then file, then env, then flags
+	c, err := Load(
+		[]string{"-config", file, "-region", "us-east-1"},
+		[]string{"DOMAIN=env.example", "REGION=eu-central-1", "WEBHOOK_SECRET_CRM=crm-secret"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, got := range map[string][2]any{
+		"Domain":   {c.Domain, "env.example"},
+		"Port":     {c.Port, 9000},
+		"AckEmail": {c.AckEmail, true},
+		"Region":   {c.Region, "us-east-1"},
+		"Outbox":   {c.OutboxDir, "outbox"},
+	} {
+		if got[0] != got[1] {
+			t.Errorf("%s = %v, want %v", name, got[0], got[1])
+		}
+	}
+	for env, want := range map[string]string{"DOMAIN": "env", "PORT": "file", "REGION": "flag", "OUTBOX_DIR": "default", "WEBHOOK_SECRET_CRM": "env"} {
+		if got := c.sources[env]; got != want {
+			t.Errorf("%s came from %q, want %q", env, got, want)
+		}
+	}
+
+	// 2. Derived defaults follow the settings they depend on
+	if c.BookingBaseURL != "http://localhost:9000" || c.Mailer != "outbox" || c.InquiryStore != "jsonl" {
+		t.Errorf("Local defaults %q %q %q", c.BookingBaseURL, c.Mailer, c.InquiryStore)
+	}
+	c, _ = Load(nil, []string{"AWS_LAMBDA_FUNCTION_NAME=site"})
+	if c.Mailer != "ses" || c.InquiryStore != "dynamodb" {
+		t.Errorf("Lambda defaults %q %q", c.Mailer, c.InquiryStore)
+	}
+
+	// 3. Values that do not parse, and unknown file keys, fail
+	for name, load := range map[string]func() (Config, error){
+		"Port":       func() (Config, error) { return Load(nil, []string{"PORT=eighty"}) },
+		"Switch":     func() (Config, error) { return Load([]string{"-spam-filter", "maybe"}, nil) },
+		"Flag":       func() (Config, error) { return Load([]string{"-sender"}, nil) },
+		"Positional": func() (Config, error) { return Load([]string{"serve"}, nil) },
+		"File Key": func() (Config, error) {
+			os.WriteFile(file, []byte(`{"sender": "a@b.example"}`), 0o600)
+			return Load(nil, []string{"CONFIG_FILE=" + file})
+		},
+	} {
+		if _, err := load(); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	// 1. The defaults are valid for a local run
+	if err := Defaults().Validate(); err != nil {
+		t.Errorf("Defaults: %v", err)
+	}
+
+	// 2. Every problem is reported, not just the first
+	c, err := Load(nil, []string{"SENDER_EMAIL=Joe <joe@example.com>", "REGION=london", "SPAM_THRESHOLD=2", "MAILER=smtp", "BOOKING_BASE_URL=/book"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Validate()
+	for _, want := range []string{"SENDER_EMAIL", "REGION", "SPAM_THRESHOLD", "SMTP_ADDR", "BOOKING_BASE_URL"} {
+		if err == nil || !strings.Contains(err.Error(), want+":") {
+			t.Errorf("No %s error in %v", want, err)
+		}
+	}
+
+	// 3. Lambda needs shared keys and tables
+	c, _ = Load(nil, []string{"AWS_LAMBDA_FUNCTION_NAME=site", "INQUIRY_TABLE=inquiries"})
+	err = c.Validate()
+	for _, want := range []string{"SPAM_SIGNING_KEY", "AUDIT_KEY", "BOOKING_TABLE", "IDEMPOTENCY_TABLE", "SUBJECT_AUDIT_TABLE"} {
+		if err == nil || !strings.Contains(err.Error(), want+":") {
+			t.Errorf("No %s error on Lambda in %v", want, err)
+		}
+	}
+
+	// 4. Keys given as Secrets Manager ARNs satisfy it; they are read at startup
+	c, _ = Load(nil, []string{
+		"AWS_LAMBDA_FUNCTION_NAME=site", "INQUIRY_TABLE=inquiries", "BOOKING_TABLE=bookings", "IDEMPOTENCY_TABLE=keys", "SUBJECT_AUDIT_TABLE=audit",
+		"SPAM_SIGNING_KEY_ARN=arn:aws:secretsmanager:eu-west-2:123456789012:secret:form", "AUDIT_KEY_ARN=arn:aws:secretsmanager:eu-west-2:123456789012:secret:audit",
+	})
+	if err := c.Validate(); err != nil {
+		t.Errorf("Lambda with key ARNs: %v", err)
+	}
+}
+
+func TestSecretsRedacted(t *testing.T) {
+	c, err := Load(nil, []string{"SPAM_SIGNING_KEY=hunter2", "SMTP_PASSWORD=hunter2", "WEBHOOK_SECRET_CRM=hunter2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.SpamSigningKey.Reveal() != "hunter2" || c.WebhookSecretFor("crm").Reveal() != "hunter2" {
+		t.Fatal("Secret values lost")
+	}
+
+	// 1. Nothing that prints a Config shows them
+	js, _ := json.Marshal(c)
+	var log strings.Builder
+	slog.New(slog.NewTextHandler(&log, nil)).Info("config", slog.Any("key", c.SpamSigningKey))
+	for name, out := range map[string]string{
+		"String":   c.String(),
+		"Sprintf":  fmt.Sprintf("%v %+v %#v", c, c, c),
+		"JSON":     string(js),
+		"Log":      log.String(),
+		"Settings": fmt.Sprint(c.Settings()),
+	} {
+		if strings.Contains(out, "hunter2") {
+			t.Errorf("%s shows a secret:\n%s", name, out)
+		}
+	}
+
+	// 2. The listing says where each setting came from
+	if !strings.Contains(c.String(), "SPAM_SIGNING_KEY=[redacted] (env)\n") || !strings.Contains(c.String(), "REGION=eu-west-2 (default)\n") {
+		t.Errorf("Listing:\n%s", c)
+	}
+}
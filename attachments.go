@@ -0,0 +1,181 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"unicode"
+
+	"stackfoundry.co.uk/components"
+)
+
+// Upload limits. Lambda caps synchronous requests at 6 MB and API Gateway
+// base64-encodes binary bodies (+33%), so 4 MB of files is the most that
+// reliably arrives. Keep in step with ATTACH_LIMITS in components.ContactForm.
+const (
+	maxAttachments     = components.MaxAttachments
+	maxAttachmentBytes = components.MaxAttachmentBytes
+	maxUploadBytes     = components.MaxUploadBytes
+	maxFormOverhead    = 64 << 10 // text fields and multipart framing
+)
+
+const docxType = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+
+// attachmentTypes maps each accepted extension to the type its bytes must sniff as
+var attachmentTypes = map[string]string{
+	".pdf":  "application/pdf",
+	".png":  "image/png",
+	".docx": docxType,
+}
+
+var errUploadTooLarge = errors.New("upload too large")
+
+// Attachment: A file the visitor uploaded, already sniffed and size-checked
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// AttachmentMeta is what the inquiry store keeps about an attachment. The
+// bytes only travel with the request; DynamoDB items cap out at 400 KB.
+type AttachmentMeta struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	SHA256      string `json:"sha256"`
+}
+
+func (a Attachment) Meta() AttachmentMeta {
+	sum := sha256.Sum256(a.Data)
+	return AttachmentMeta{Filename: a.Filename, ContentType: a.ContentType, Size: len(a.Data), SHA256: hex.EncodeToString(sum[:])}
+}
+
+// parseContactRequest parses either encoding of the form. Multipart bodies
+// are capped before parsing so an oversized upload fails fast.
+func parseContactRequest(w http.ResponseWriter, r *http.Request) error {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		return r.ParseForm()
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes+maxFormOverhead)
+	err := r.ParseMultipartForm(maxUploadBytes + maxFormOverhead)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return errUploadTooLarge
+	}
+	return err
+}
+
+// parseAttachments reads and checks the uploaded files. The returned message
+// is shown in the attachments_error slot; it is empty when all files pass.
+func parseAttachments(r *http.Request) ([]Attachment, string) {
+	if r.MultipartForm == nil {
+		return nil, ""
+	}
+	var headers []*multipart.FileHeader
+	for _, fh := range r.MultipartForm.File["attachments"] {
+		if fh.Size > 0 || fh.Filename != "" {
+			headers = append(headers, fh)
+		}
+	}
+	if len(headers) > maxAttachments {
+		return nil, fmt.Sprintf("Attach at most %d files.", maxAttachments)
+	}
+
+	var out []Attachment
+	total := 0
+	for _, fh := range headers {
+		name := cleanFilename(fh.Filename)
+		if fh.Size > maxAttachmentBytes {
+			return nil, fmt.Sprintf("%s is larger than %s.", name, formatBytes(maxAttachmentBytes))
+		}
+		f, err := fh.Open()
+		if err != nil {
+			return nil, fmt.Sprintf("%s could not be read.", name)
+		}
+		data, err := io.ReadAll(io.LimitReader(f, maxAttachmentBytes+1))
+		f.Close()
+		if err != nil || len(data) > maxAttachmentBytes {
+			return nil, fmt.Sprintf("%s could not be read.", name)
+		}
+
+		contentType, ok := sniffAttachment(name, data)
+		if !ok {
+			return nil, fmt.Sprintf("%s is not a PDF, PNG or DOCX file.", name)
+		}
+		total += len(data)
+		out = append(out, Attachment{Filename: name, ContentType: contentType, Data: data})
+	}
+	if total > maxUploadBytes {
+		return nil, fmt.Sprintf("Attachments must total %s or less.", formatBytes(maxUploadBytes))
+	}
+	return out, ""
+}
+
+// sniffAttachment checks the magic bytes agree with the extension. A DOCX is
+// a zip, so it must also contain the Word document part.
+func sniffAttachment(name string, data []byte) (string, bool) {
+	want, ok := attachmentTypes[strings.ToLower(path.Ext(name))]
+	if !ok {
+		return "", false
+	}
+	switch want {
+	case "application/pdf":
+		if bytes.HasPrefix(data, []byte("%PDF-")) {
+			return want, true
+		}
+	case "image/png":
+		if bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+			return want, true
+		}
+	case docxType:
+		if !bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+			return "", false
+		}
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return "", false
+		}
+		for _, f := range zr.File {
+			if f.Name == "word/document.xml" {
+				return want, true
+			}
+		}
+	}
+	return "", false
+}
+
+// cleanFilename keeps the base name only, without control characters or
+// quotes, so it is safe in a MIME header and in the inbox.
+func cleanFilename(name string) string {
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+	if runes := []rune(name); len(runes) > 100 {
+		ext := path.Ext(name)
+		name = string(runes[:100-len([]rune(ext))]) + ext
+	}
+	if name == "" || name == "." || name == "/" {
+		return "attachment"
+	}
+	return name
+}
+
+func formatBytes(n int) string {
+	if n >= 1<<20 {
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	}
+	return fmt.Sprintf("%d KB", (n+1023)/1024)
+}
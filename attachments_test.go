@@ -0,0 +1,110 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestSniffAttachment(t *testing.T) {
+	var docx bytes.Buffer
+	zw := zip.NewWriter(&docx)
+	for _, name := range []string{"[Content_Types].xml", "word/document.xml"} {
+		w, _ := zw.Create(name)
+		w.Write([]byte("<xml/>"))
+	}
+	zw.Close()
+
+	var plainZip bytes.Buffer
+	zw = zip.NewWriter(&plainZip)
+	w, _ := zw.Create("payload.exe")
+	w.Write([]byte("MZ"))
+	zw.Close()
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"brief.pdf", []byte("%PDF-1.4\n"), "application/pdf"},
+		{"BRIEF.PDF", []byte("%PDF-1.4\n"), "application/pdf"},
+		{"logo.png", []byte("\x89PNG\r\n\x1a\n...."), "image/png"},
+		{"spec.docx", docx.Bytes(), docxType},
+		{"spec.docx", plainZip.Bytes(), ""},
+		{"brief.pdf", []byte("\x89PNG\r\n\x1a\n"), ""},
+		{"logo.png.exe", []byte("\x89PNG\r\n\x1a\n"), ""},
+		{"brief", []byte("%PDF-1.4\n"), ""},
+	}
+	for _, tt := range tests {
+		got, ok := sniffAttachment(tt.name, tt.data)
+		if ok != (tt.want != "") || got != tt.want {
+			t.Errorf("sniffAttachment(%q) = %q, %v; want %q", tt.name, got, ok, tt.want)
+		}
+	}
+
+	for in, want := range map[string]string{
+		`C:\Users\me\brief.pdf`:           "brief.pdf",
+		"../../etc/passwd":                "passwd",
+		"bad\r\nname\".pdf":               "badname.pdf",
+		"":                                "attachment",
+		strings.Repeat("a", 200) + ".pdf": strings.Repeat("a", 96) + ".pdf",
+	} {
+		if got := cleanFilename(in); got != want {
+			t.Errorf("cleanFilename(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestMessageBytesAttachments(t *testing.T) {
+	pdf := []byte("%PDF-1.7\n" + strings.Repeat("x", 200))
+	raw, err := Message{
+		From:        testSender,
+		To:          []string{testSender},
+		Subject:     "Brief",
+		Text:        "See attached",
+		HTML:        "<p>See attached</p>",
+		Attachments: []Attachment{{Filename: "Brief – v2.pdf", ContentType: "application/pdf", Data: pdf}},
+	}.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if mediaType != "multipart/mixed" {
+		t.Fatalf("Content-Type = %q, want multipart/mixed", mediaType)
+	}
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	body, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct, _, _ := mime.ParseMediaType(body.Header.Get("Content-Type")); ct != "multipart/alternative" {
+		t.Errorf("First part = %q, want multipart/alternative", ct)
+	}
+
+	// multipart.Reader decodes quoted-printable but not base64; FileName decodes RFC 2231
+	att, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if att.FileName() != "Brief – v2.pdf" {
+		t.Errorf("Attachment filename = %q", att.FileName())
+	}
+	if att.Header.Get("Content-Transfer-Encoding") != "base64" {
+		t.Errorf("Attachment is not base64 encoded")
+	}
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if len(line) > 998 {
+			t.Fatalf("Line exceeds RFC 5322 limit: %d chars", len(line))
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	"stackfoundry.co.uk/appconfig"
+)
+
+// Audit actions for data-subject requests
+const (
+	auditLinkRequested = "link_requested"
+	auditView          = "view"
+	auditExport        = "export"
+	auditErase         = "erase"
+)
+
+// AuditEntry: One data-subject action. It outlives the data it describes, so
+// the subject is a keyed hash of their address, never the address itself.
+type AuditEntry struct {
+	ID      string    `json:"id"`
+	Subject string    `json:"subject"`
+	Action  string    `json:"action"`
+	Records int       `json:"records"`           // how many records the action found or erased
+	Outcome string    `json:"outcome,omitempty"` // e.g. "sent", "nothing_held", "failed"
+	Detail  string    `json:"detail,omitempty"`  // the signed report, for purge entries
+	At      time.Time `json:"at"`
+}
+
+// subjectHash identifies a data subject in the audit log. It is keyed, so
+// the log cannot be matched against a list of addresses by anyone without
+// AUDIT_KEY, and that key never rotates, so entries still match years later.
+func subjectHash(key []byte, email string) string {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("audit-subject\x00" + strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// auditKeyFromConfig is AUDIT_KEY, or a random key when it is unset. The
+// memory log used then does not outlive the process, so neither need the key.
+func auditKeyFromConfig(cfg appconfig.Config) []byte {
+	key := []byte(cfg.AuditKey.Reveal())
+	if len(key) == 0 {
+		slog.Warn("audit_key_ephemeral")
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return key
+}
+
+// newAuditID sorts by time to the nanosecond, so a subject's entries list
+// in the order they happened, with a random suffix against collisions
+func newAuditID(now time.Time) string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return now.UTC().Format(auditIDLayout) + "-" + hex.EncodeToString(b)
+}
+
+const auditIDLayout = "20060102T150405.000000000Z"
+
+// AuditLog: Append-only record of data-subject requests and purge runs.
+// Entries are never updated, and only the retention purge deletes them.
+type AuditLog interface {
+	Record(ctx context.Context, e AuditEntry) error
+	// List returns a subject's entries, oldest first
+	List(ctx context.Context, subject string) ([]AuditEntry, error)
+	// Before returns every entry recorded before cutoff, for the purge
+	Before(ctx context.Context, cutoff time.Time) ([]AuditEntry, error)
+	Delete(ctx context.Context, e AuditEntry) error
+}
+
+// newAuditLogFromConfig uses the DynamoDB table named by SUBJECT_AUDIT_TABLE,
+// or memory for local runs. On Lambda memory would lose the log, so the
+// table is required there.
+func newAuditLogFromConfig(ctx context.Context, cfg appconfig.Config) (AuditLog, error) {
+	switch {
+	case cfg.SubjectAuditTable != "":
+		aws, err := loadAWSConfig(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &DynamoAuditLog{Client: dynamodb.NewFromConfig(aws), Table: cfg.SubjectAuditTable}, nil
+	case cfg.OnLambda():
+		return nil, errors.New("SUBJECT_AUDIT_TABLE is required on Lambda")
+	default:
+		return NewMemoryAuditLog(), nil
+	}
+}
+
+// MemoryAuditLog: In-process log for local runs and tests
+type MemoryAuditLog struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+}
+
+func NewMemoryAuditLog() *MemoryAuditLog {
+	return &MemoryAuditLog{}
+}
+
+func (l *MemoryAuditLog) Record(ctx context.Context, e AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, e)
+	return nil
+}
+
+func (l *MemoryAuditLog) List(ctx context.Context, subject string) ([]AuditEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var out []AuditEntry
+	for _, e := range l.entries {
+		if e.Subject == subject {
+			out = append(out, e)
+		}
+	}
+	slices.SortStableFunc(out, func(a, b AuditEntry) int { return cmp.Compare(a.ID, b.ID) })
+	return out, nil
+}
+
+func (l *MemoryAuditLog) Before(ctx context.Context, cutoff time.Time) ([]AuditEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var out []AuditEntry
+	for _, e := range l.entries {
+		if e.At.Before(cutoff) {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+func (l *MemoryAuditLog) Delete(ctx context.Context, e AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = slices.DeleteFunc(l.entries, func(x AuditEntry) bool { return x.Subject == e.Subject && x.ID == e.ID })
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoAuditLog: Items keyed by "subject" (the address hash) and "id",
+// which sorts by time, so one query returns a subject's history in order
+type DynamoAuditLog struct {
+	Client *dynamodb.Client
+	Table  string
+}
+
+func (l *DynamoAuditLog) Record(ctx context.Context, e AuditEntry) error {
+	item := map[string]types.AttributeValue{
+		"subject": &types.AttributeValueMemberS{Value: e.Subject},
+		"id":      &types.AttributeValueMemberS{Value: e.ID},
+		"action":  &types.AttributeValueMemberS{Value: e.Action},
+		"records": &types.AttributeValueMemberN{Value: strconv.Itoa(e.Records)},
+		"at":      &types.AttributeValueMemberS{Value: e.At.UTC().Format(time.RFC3339Nano)},
+	}
+	if e.Outcome != "" {
+		item["outcome"] = &types.AttributeValueMemberS{Value: e.Outcome}
+	}
+	if e.Detail != "" {
+		item["detail"] = &types.AttributeValueMemberS{Value: e.Detail}
+	}
+	_, err := l.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(l.Table),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	return err
+}
+
+func (l *DynamoAuditLog) List(ctx context.Context, subject string) ([]AuditEntry, error) {
+	var out []AuditEntry
+	p := dynamodb.NewQueryPaginator(l.Client, &dynamodb.QueryInput{
+		TableName:              aws.String(l.Table),
+		KeyConditionExpression: aws.String("subject = :s"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":s": &types.AttributeValueMemberS{Value: subject},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			out = append(out, itemToAuditEntry(item))
+		}
+	}
+	return out, nil
+}
+
+// Before scans the table, comparing IDs rather than the "at" attribute: IDs
+// start with a fixed-width timestamp, so they order as strings
+func (l *DynamoAuditLog) Before(ctx context.Context, cutoff time.Time) ([]AuditEntry, error) {
+	var out []AuditEntry
+	p := dynamodb.NewScanPaginator(l.Client, &dynamodb.ScanInput{
+		TableName:                aws.String(l.Table),
+		FilterExpression:         aws.String("#id < :c"),
+		ExpressionAttributeNames: map[string]string{"#id": "id"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":c": &types.AttributeValueMemberS{Value: cutoff.UTC().Format(auditIDLayout)},
+		},
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			out = append(out, itemToAuditEntry(item))
+		}
+	}
+	return out, nil
+}
+
+func (l *DynamoAuditLog) Delete(ctx context.Context, e AuditEntry) error {
+	_, err := l.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(l.Table),
+		Key: map[string]types.AttributeValue{
+			"subject": &types.AttributeValueMemberS{Value: e.Subject},
+			"id":      &types.AttributeValueMemberS{Value: e.ID},
+		},
+	})
+	return err
+}
+
+func itemToAuditEntry(item map[string]types.AttributeValue) AuditEntry {
+	str := func(k string) string {
+		if v, ok := item[k].(*types.AttributeValueMemberS); ok {
+			return v.Value
+		}
+		return ""
+	}
+	e := AuditEntry{
+		ID:      str("id"),
+		Subject: str("subject"),
+		Action:  str("action"),
+		Outcome: str("outcome"),
+		Detail:  str("detail"),
+	}
+	if v, ok := item["records"].(*types.AttributeValueMemberN); ok {
+		e.Records, _ = strconv.Atoi(v.Value)
+	}
+	e.At, _ = time.Parse(time.RFC3339Nano, str("at"))
+	return e
+}
@@ -0,0 +1,928 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // Lambda's provided runtime has no zoneinfo
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	"stackfoundry.co.uk/appconfig"
+	"stackfoundry.co.uk/components"
+)
+
+// defaultBookingSchedule is the availability shipped with the binary.
+// BOOKING_SCHEDULE points at a replacement file.
+//
+//go:embed booking.json
+var defaultBookingSchedule []byte
+
+var (
+	ErrSlotTaken       = errors.New("slot already booked")
+	ErrBookingNotFound = errors.New("booking not found")
+	ErrBookingChanged  = errors.New("booking changed since it was read")
+)
+
+// --- SCHEDULE ---
+
+// clockRange: A window in minutes after local midnight
+type clockRange struct{ From, To int }
+
+// Schedule: When discovery calls can be booked. Slots start at the beginning
+// of each weekly window and step by Duration+Buffer, so every booking lands
+// on a fixed grid and two bookings can only collide by claiming the same
+// start time.
+type Schedule struct {
+	Location    *time.Location
+	Duration    time.Duration
+	Buffer      time.Duration
+	Notice      time.Duration
+	HorizonDays int
+	Weekly      [7][]clockRange // indexed by time.Weekday
+	Closed      map[string]bool // "2006-01-02", on top of bank holidays
+}
+
+// ScheduleDay: One local date and the grid slots still ahead of the notice period
+type ScheduleDay struct {
+	Date  time.Time
+	Slots []time.Time
+}
+
+type scheduleFile struct {
+	Timezone        string              `json:"timezone"`
+	DurationMinutes int                 `json:"duration_minutes"`
+	BufferMinutes   int                 `json:"buffer_minutes"`
+	NoticeHours     int                 `json:"notice_hours"`
+	HorizonDays     int                 `json:"horizon_days"`
+	Weekly          map[string][]string `json:"weekly"`
+	Closed          []string            `json:"closed"`
+}
+
+var weekdayKeys = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseSchedule(data []byte) (*Schedule, error) {
+	var f scheduleFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return nil, fmt.Errorf("booking schedule: %w", err)
+	}
+	loc, err := time.LoadLocation(f.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("booking schedule: %w", err)
+	}
+	if f.DurationMinutes <= 0 || f.HorizonDays <= 0 || f.BufferMinutes < 0 || f.NoticeHours < 0 {
+		return nil, errors.New("booking schedule: duration and horizon must be positive, buffer and notice not negative")
+	}
+
+	s := &Schedule{
+		Location:    loc,
+		Duration:    time.Duration(f.DurationMinutes) * time.Minute,
+		Buffer:      time.Duration(f.BufferMinutes) * time.Minute,
+		Notice:      time.Duration(f.NoticeHours) * time.Hour,
+		HorizonDays: f.HorizonDays,
+		Closed:      map[string]bool{},
+	}
+	for day, windows := range f.Weekly {
+		wd, ok := weekdayKeys[day]
+		if !ok {
+			return nil, fmt.Errorf("booking schedule: unknown day %q", day)
+		}
+		for _, w := range windows {
+			from, to, ok := strings.Cut(w, "-")
+			r := clockRange{From: clockMinutes(from), To: clockMinutes(to)}
+			if !ok || r.From < 0 || r.To < 0 || r.From+f.DurationMinutes > r.To {
+				return nil, fmt.Errorf("booking schedule: %s window %q must be HH:MM-HH:MM and fit a call", day, w)
+			}
+			s.Weekly[wd] = append(s.Weekly[wd], r)
+		}
+		slices.SortFunc(s.Weekly[wd], func(a, b clockRange) int { return a.From - b.From })
+		for i := 1; i < len(s.Weekly[wd]); i++ {
+			if s.Weekly[wd][i].From < s.Weekly[wd][i-1].To {
+				return nil, fmt.Errorf("booking schedule: %s windows overlap", day)
+			}
+		}
+	}
+	for _, d := range f.Closed {
+		if _, err := time.Parse(time.DateOnly, d); err != nil {
+			return nil, fmt.Errorf("booking schedule: closed date %q: %w", d, err)
+		}
+		s.Closed[d] = true
+	}
+	return s, nil
+}
+
+// clockMinutes parses "HH:MM", returning -1 if it is not a time of day
+func clockMinutes(s string) int {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return -1
+	}
+	return t.Hour()*60 + t.Minute()
+}
+
+// open reports whether calls can be taken at all on day's local date
+func (s *Schedule) open(day time.Time) bool {
+	key := day.Format(time.DateOnly)
+	return len(s.Weekly[day.Weekday()]) > 0 && !s.Closed[key] && !bankHolidays(day.Year())[key]
+}
+
+// slots returns every grid start on day's local date, booked or not
+func (s *Schedule) slots(day time.Time) []time.Time {
+	day = day.In(s.Location)
+	if !s.open(day) {
+		return nil
+	}
+	y, m, d := day.Date()
+	dur := int(s.Duration / time.Minute)
+	step := int((s.Duration + s.Buffer) / time.Minute)
+	var out []time.Time
+	for _, w := range s.Weekly[day.Weekday()] {
+		for start := w.From; start+dur <= w.To; start += step {
+			out = append(out, time.Date(y, m, d, start/60, start%60, 0, 0, s.Location))
+		}
+	}
+	return out
+}
+
+// window is what can be booked at now: from the end of the notice period to
+// midnight at the end of the horizon
+func (s *Schedule) window(now time.Time) (from, to time.Time) {
+	y, m, d := now.In(s.Location).Date()
+	return now.Add(s.Notice), time.Date(y, m, d+s.HorizonDays, 0, 0, 0, 0, s.Location)
+}
+
+// Bookable reports whether start is a grid slot inside the window at now
+func (s *Schedule) Bookable(start, now time.Time) bool {
+	from, to := s.window(now)
+	if start.Before(from) || !start.Before(to) {
+		return false
+	}
+	return slices.ContainsFunc(s.slots(start), start.Equal)
+}
+
+// Days lists the open dates in the horizon that still have a slot after the notice period
+func (s *Schedule) Days(now time.Time) []ScheduleDay {
+	from, to := s.window(now)
+	y, m, d := now.In(s.Location).Date()
+	var out []ScheduleDay
+	for i := range s.HorizonDays {
+		day := time.Date(y, m, d+i, 0, 0, 0, 0, s.Location)
+		slots := slices.DeleteFunc(s.slots(day), func(t time.Time) bool { return t.Before(from) || !t.Before(to) })
+		if len(slots) > 0 {
+			out = append(out, ScheduleDay{Date: day, Slots: slots})
+		}
+	}
+	return out
+}
+
+// bankHolidays returns England and Wales bank holidays for year, keyed
+// "2006-01-02", with weekend dates moved to the next free weekday. One-off
+// holidays proclaimed for royal events go in the schedule's closed list.
+func bankHolidays(year int) map[string]bool {
+	date := func(m time.Month, d int) time.Time { return time.Date(year, m, d, 0, 0, 0, 0, time.UTC) }
+	weekday := func(t time.Time) time.Time {
+		for t.Weekday() == time.Saturday || t.Weekday() == time.Sunday {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t
+	}
+	monday := func(t time.Time, step int) time.Time {
+		for t.Weekday() != time.Monday {
+			t = t.AddDate(0, 0, step)
+		}
+		return t
+	}
+
+	easter := easterSunday(year)
+	days := []time.Time{
+		weekday(date(time.January, 1)),
+		easter.AddDate(0, 0, -2), // Good Friday
+		easter.AddDate(0, 0, 1),  // Easter Monday
+		monday(date(time.May, 1), 1),
+		monday(date(time.June, 0), -1),
+		monday(date(time.September, 0), -1),
+	}
+	// Christmas and Boxing Day each take the next weekday not already taken
+	christmas := weekday(date(time.December, 25))
+	days = append(days, christmas, weekday(christmas.AddDate(0, 0, 1)))
+
+	out := make(map[string]bool, len(days))
+	for _, t := range days {
+		out[t.Format(time.DateOnly)] = true
+	}
+	return out
+}
+
+// easterSunday is the Gregorian computus (the anonymous "Meeus/Jones/Butcher" algorithm)
+func easterSunday(year int) time.Time {
+	a := year % 19
+	b, c := year/100, year%100
+	d, e := b/4, b%4
+	f := (b + 8) / 25
+	g := (b - f + 1) / 3
+	h := (19*a + b - d - g + 15) % 30
+	i, k := c/4, c%4
+	l := (32 + 2*e + 2*i - h - k) % 7
+	m := (a + 11*h + 22*l) / 451
+	month := (h + l - 7*m + 114) / 31
+	day := (h+l-7*m+114)%31 + 1
+	return time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+}
+
+// --- BOOKINGS ---
+
+type BookingStatus string
+
+const (
+	BookingConfirmed BookingStatus = "confirmed"
+	BookingCancelled BookingStatus = "cancelled"
+)
+
+// Booking: One discovery call. Sequence counts changes, as iTIP wants: each
+// reschedule or cancellation resends the same UID with a higher SEQUENCE.
+type Booking struct {
+	ID        string        `json:"id"`
+	Status    BookingStatus `json:"status"`
+	Start     time.Time     `json:"start"`
+	End       time.Time     `json:"end"`
+	Name      string        `json:"name"`
+	Email     string        `json:"email"`
+	Topic     string        `json:"topic,omitempty"`
+	Sequence  int           `json:"sequence"`
+	CreatedAt time.Time     `json:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+}
+
+// Reference is the short form shown to the visitor, e.g. "BK-1A2B3C4D"
+func (b Booking) Reference() string {
+	_, suffix, _ := strings.Cut(b.ID, "-")
+	return "BK-" + strings.ToUpper(suffix)
+}
+
+// BookingStore: Persists bookings and the slots they hold. Holding a slot is
+// atomic with saving the booking, which is the double-booking protection.
+type BookingStore interface {
+	// Reserve saves a new booking and holds its slot, or returns ErrSlotTaken
+	Reserve(ctx context.Context, b Booking) error
+	Get(ctx context.Context, id string) (Booking, error)
+	// Update replaces prev with next, moving or releasing the held slot to
+	// match. It returns ErrBookingChanged if prev is stale and ErrSlotTaken
+	// if next's slot is held by another booking.
+	Update(ctx context.Context, prev, next Booking) error
+	// Held returns the held slot starts in [from, to)
+	Held(ctx context.Context, from, to time.Time) ([]time.Time, error)
+	// ByEmail returns every booking made by email, matched case-insensitively
+	ByEmail(ctx context.Context, email string) ([]Booking, error)
+	// List returns every booking, oldest first
+	List(ctx context.Context) ([]Booking, error)
+	// Delete removes a booking for good, releasing its slot if it still
+	// holds one, or returns ErrBookingNotFound
+	Delete(ctx context.Context, id string) error
+	// DeleteSequence deletes only while the stored Sequence is still
+	// sequence, and returns ErrBookingChanged if it has moved on
+	DeleteSequence(ctx context.Context, id string, sequence int) error
+}
+
+// MemoryBookingStore: In-process store for local runs and tests
+type MemoryBookingStore struct {
+	mu       sync.Mutex
+	bookings map[string]Booking
+	slots    map[int64]string // start (unix) -> booking ID
+}
+
+func NewMemoryBookingStore() *MemoryBookingStore {
+	return &MemoryBookingStore{bookings: map[string]Booking{}, slots: map[int64]string{}}
+}
+
+func (s *MemoryBookingStore) Reserve(ctx context.Context, b Booking) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, held := s.slots[b.Start.Unix()]; held {
+		return ErrSlotTaken
+	}
+	s.slots[b.Start.Unix()] = b.ID
+	s.bookings[b.ID] = b
+	return nil
+}
+
+func (s *MemoryBookingStore) Get(ctx context.Context, id string) (Booking, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.bookings[id]
+	if !ok {
+		return Booking{}, ErrBookingNotFound
+	}
+	return b, nil
+}
+
+func (s *MemoryBookingStore) Update(ctx context.Context, prev, next Booking) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, ok := s.bookings[next.ID]
+	if !ok {
+		return ErrBookingNotFound
+	}
+	if cur.Sequence != prev.Sequence {
+		return ErrBookingChanged
+	}
+	moved := next.Status == BookingConfirmed && !next.Start.Equal(prev.Start)
+	if moved {
+		if _, held := s.slots[next.Start.Unix()]; held {
+			return ErrSlotTaken
+		}
+		s.slots[next.Start.Unix()] = next.ID
+	}
+	if (moved || next.Status == BookingCancelled) && s.slots[prev.Start.Unix()] == prev.ID {
+		delete(s.slots, prev.Start.Unix())
+	}
+	s.bookings[next.ID] = next
+	return nil
+}
+
+func (s *MemoryBookingStore) Held(ctx context.Context, from, to time.Time) ([]time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []time.Time
+	for start := range s.slots {
+		if t := time.Unix(start, 0); !t.Before(from) && t.Before(to) {
+			out = append(out, t)
+		}
+	}
+	slices.SortFunc(out, time.Time.Compare)
+	return out, nil
+}
+
+func (s *MemoryBookingStore) ByEmail(ctx context.Context, email string) ([]Booking, error) {
+	all, _ := s.List(ctx)
+	return slices.DeleteFunc(all, func(b Booking) bool { return !strings.EqualFold(strings.TrimSpace(b.Email), email) }), nil
+}
+
+func (s *MemoryBookingStore) List(ctx context.Context) ([]Booking, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := slices.Collect(maps.Values(s.bookings))
+	slices.SortFunc(out, func(a, b Booking) int { return strings.Compare(a.ID, b.ID) })
+	return out, nil
+}
+
+func (s *MemoryBookingStore) Delete(ctx context.Context, id string) error {
+	return s.remove(id, nil)
+}
+
+func (s *MemoryBookingStore) DeleteSequence(ctx context.Context, id string, sequence int) error {
+	return s.remove(id, &sequence)
+}
+
+func (s *MemoryBookingStore) remove(id string, sequence *int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.bookings[id]
+	if !ok {
+		return ErrBookingNotFound
+	}
+	if sequence != nil && b.Sequence != *sequence {
+		return ErrBookingChanged
+	}
+	if s.slots[b.Start.Unix()] == id {
+		delete(s.slots, b.Start.Unix())
+	}
+	delete(s.bookings, id)
+	return nil
+}
+
+// --- SERVICE ---
+
+// Bookings: Discovery-call booking. A nil *Bookings is valid; /book then
+// sends visitors to the contact form instead.
+type Bookings struct {
+	Schedule *Schedule
+	Store    BookingStore
+	Mailer   Mailer       // nil skips the invites; the confirmation page still has the manage link
+	Sender   string       // From address, organiser and the host's inbox
+	BaseURL  string       // absolute site URL for links in emails
+	Domain   string       // ends each calendar UID, so it is unique to this site
+	Logger   *slog.Logger // nil uses slog.Default
+	// Limiter caps the invites each visitor address receives under Policy.
+	// The host's copy is never limited.
+	Limiter RateLimitBackend
+	Policy  RatePolicy
+
+	key []byte
+	now func() time.Time
+}
+
+// bookingMailPolicy leaves room to book, move and cancel a few times a day
+var bookingMailPolicy = RatePolicy{Name: "booking_mail", Rate: 6.0 / 86400, Burst: 6}
+
+// bookingMailTimeout is each invite's budget. The visitor's and the host's
+// are sent one after the other after the store write, inside the Lambda timeout.
+const bookingMailTimeout = 3 * time.Second
+
+// NewBookings signs manage links with key. Invites are limited in memory
+// until Limiter is replaced.
+func NewBookings(schedule *Schedule, store BookingStore, mailer Mailer, sender, baseURL, domain string, key []byte) *Bookings {
+	return &Bookings{Schedule: schedule, Store: store, Mailer: mailer, Sender: sender, BaseURL: strings.TrimSuffix(baseURL, "/"), Domain: domain, Limiter: NewMemoryRateBackend(), Policy: bookingMailPolicy, key: key, now: time.Now}
+}
+
+// newBookingsFromConfig loads BOOKING_SCHEDULE (or the embedded booking.json)
+// and keeps bookings in BOOKING_TABLE, or in memory for local runs.
+// BOOKING_BASE_URL is the site address used in emailed links.
+func newBookingsFromConfig(ctx context.Context, cfg appconfig.Config, mailer Mailer, key []byte) (*Bookings, error) {
+	data := defaultBookingSchedule
+	if path := cfg.BookingSchedule; path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("BOOKING_SCHEDULE: %w", err)
+		}
+		data = b
+	}
+	schedule, err := parseSchedule(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var store BookingStore
+	switch {
+	case cfg.BookingTable != "":
+		aws, err := loadAWSConfig(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		store = &DynamoBookingStore{Client: dynamodb.NewFromConfig(aws), Table: cfg.BookingTable}
+	case cfg.OnLambda():
+		// Every instance would keep its own calendar and double-book
+		return nil, errors.New("BOOKING_TABLE is required on Lambda")
+	default:
+		store = NewMemoryBookingStore()
+	}
+
+	bookings := NewBookings(schedule, store, mailer, cfg.SenderEmail, cfg.BookingBaseURL, cfg.Domain, key)
+	// Like the acknowledgement limit, this is what stops the form mailing
+	// someone who never asked, so on Lambda it is shared across instances
+	if bookings.Limiter, err = newRateBackendFromConfig(ctx, cfg, key); err != nil {
+		return nil, err
+	}
+	return bookings, nil
+}
+
+// sign returns the manage-link signature for a booking. The purpose prefix
+// keeps it distinct from anything else signed with the same key.
+func (b *Bookings) sign(id string) string {
+	mac := hmac.New(sha256.New, b.key)
+	mac.Write([]byte("booking-manage\x00" + id))
+	return b64url.EncodeToString(mac.Sum(nil))
+}
+
+func (b *Bookings) verify(id, sig string) bool {
+	return hmac.Equal([]byte(b.sign(id)), []byte(sig))
+}
+
+func (b *Bookings) managePath(id string) string {
+	return "/book/manage/" + id + "?sig=" + b.sign(id)
+}
+
+// when formats a call for people, in the schedule's time zone
+func (b *Bookings) logger() *slog.Logger {
+	if b.Logger == nil {
+		return slog.Default()
+	}
+	return b.Logger
+}
+
+func (b *Bookings) when(bk Booking) string {
+	start, end := bk.Start.In(b.Schedule.Location), bk.End.In(b.Schedule.Location)
+	return start.Format("Monday 2 January 2006, 15:04") + "–" + end.Format("15:04 MST")
+}
+
+// notify emails the visitor and us the booking's current state with an
+// iTIP invite attached. Failures are logged, never shown: the booking
+// stands, and the page the visitor is looking at has the manage link.
+func (b *Bookings) notify(ctx context.Context, bk Booking) {
+	if b.Mailer == nil {
+		b.logger().Warn("booking_mail_skipped", slog.String("booking", bk.ID))
+		return
+	}
+
+	status := "confirmed"
+	switch {
+	case bk.Status == BookingCancelled:
+		status = "cancelled"
+	case bk.Sequence > 0:
+		status = "rescheduled"
+	}
+	view := components.BookingEmail{
+		Reference: bk.Reference(),
+		Status:    status,
+		When:      b.when(bk),
+		Name:      bk.Name,
+		Email:     bk.Email,
+		Topic:     bk.Topic,
+		ManageURL: b.BaseURL + b.managePath(bk.ID),
+		BookURL:   b.BaseURL + "/book",
+	}
+
+	event := CalendarEvent{
+		Method:      icsRequest,
+		UID:         bk.ID + "@" + b.Domain,
+		Sequence:    bk.Sequence,
+		Start:       bk.Start,
+		End:         bk.End,
+		Stamp:       b.now(),
+		Summary:     "StackFoundry discovery call",
+		Description: "Reschedule or cancel: " + view.ManageURL,
+		URL:         view.ManageURL,
+		Organizer:   b.Sender,
+		Attendees:   []string{sanitizeHeader(bk.Email)},
+	}
+	filename := "invite.ics"
+	if bk.Status == BookingCancelled {
+		event.Method, filename = icsCancel, "cancel.ics"
+	}
+	invite := Attachment{
+		Filename:    filename,
+		ContentType: "text/calendar; charset=utf-8; method=" + event.Method,
+		Data:        event.ICS(),
+	}
+
+	local := bk.Start.In(b.Schedule.Location).Format("Mon 2 Jan 15:04")
+	for _, to := range []struct {
+		host    bool
+		rcpt    []string
+		replyTo string
+		subject string
+	}{
+		// Fixed subject: nothing the visitor typed goes into a header we send them
+		{false, []string{sanitizeHeader(bk.Email)}, b.Sender, "Discovery call " + status + " [" + bk.Reference() + "]"},
+		{true, []string{b.Sender}, sanitizeHeader(bk.Email), defaultRouting.SubjectPrefix + " Discovery call " + status + ": " + bk.Name + ", " + local},
+	} {
+		if !to.host && !b.mayMail(ctx, bk) {
+			continue
+		}
+		view.Host = to.host
+		var html, text bytes.Buffer
+		if err := components.BookingEmailHTML(view).Render(ctx, &html); err != nil {
+			b.logger().Error("booking_render_failed", slog.Any("error", err))
+			return
+		}
+		if err := components.BookingEmailText(view).Render(ctx, &text); err != nil {
+			b.logger().Error("booking_render_failed", slog.Any("error", err))
+			return
+		}
+		sctx, cancel := context.WithTimeout(ctx, bookingMailTimeout)
+		attempts, err := sendWithRetry(sctx, b.Mailer, Message{
+			From:        b.Sender,
+			To:          to.rcpt,
+			ReplyTo:     []string{to.replyTo},
+			Subject:     to.subject,
+			Text:        text.String(),
+			HTML:        html.String(),
+			Attachments: []Attachment{invite},
+		})
+		cancel()
+		if err != nil {
+			b.logger().Error("booking_mail_failure", slog.String("booking", bk.ID), slog.Bool("host", to.host), slog.Any("error", err), slog.Int("attempts", attempts))
+			continue
+		}
+		b.logger().Info("booking_mail_sent", slog.String("booking", bk.ID), slog.Bool("host", to.host), slog.Int("attempts", attempts))
+	}
+}
+
+// mayMail takes from the visitor's per-recipient allowance, so the form
+// cannot be used to send our invites to someone who never asked for them
+func (b *Bookings) mayMail(ctx context.Context, bk Booking) bool {
+	ok, _, err := b.Limiter.Take(ctx, "booking:"+strings.ToLower(bk.Email), b.Policy)
+	if err != nil {
+		b.logger().Error("booking_limit_failed", slog.String("booking", bk.ID), slog.Any("error", err))
+		return false
+	}
+	if !ok {
+		b.logger().Info("booking_mail_suppressed", slog.String("booking", bk.ID), slog.String("reason", "recipient_rate"))
+	}
+	return ok
+}
+
+// picker lists the bookable days with their free slots. It selects date if
+// that day is listed, otherwise the first day with room, and checks chosen.
+func (b *Bookings) picker(ctx context.Context, base, date string, chosen time.Time) (components.BookingPicker, error) {
+	now := b.now()
+	from, to := b.Schedule.window(now)
+	held, err := b.Store.Held(ctx, from, to)
+	if err != nil {
+		return components.BookingPicker{}, err
+	}
+
+	p := components.BookingPicker{Base: base, TimeZone: b.Schedule.Location.String(), Minutes: int(b.Schedule.Duration / time.Minute)}
+	var free [][]time.Time
+	for _, d := range b.Schedule.Days(now) {
+		slots := slices.DeleteFunc(d.Slots, func(t time.Time) bool { return slices.ContainsFunc(held, t.Equal) })
+		free = append(free, slots)
+		p.Days = append(p.Days, components.BookingDay{
+			Date:    d.Date.Format(time.DateOnly),
+			Weekday: d.Date.Format("Mon"),
+			Label:   d.Date.Format("2 Jan"),
+			Free:    len(slots),
+		})
+	}
+	selected := slices.IndexFunc(p.Days, func(d components.BookingDay) bool { return d.Date == date })
+	if selected < 0 {
+		selected = slices.IndexFunc(p.Days, func(d components.BookingDay) bool { return d.Free > 0 })
+	}
+	if selected < 0 {
+		return p, nil
+	}
+	p.Date = p.Days[selected].Date
+	for _, t := range free[selected] {
+		p.Slots = append(p.Slots, components.BookingSlot{
+			Value:   t.UTC().Format(time.RFC3339),
+			Label:   t.In(b.Schedule.Location).Format("15:04"),
+			Checked: t.Equal(chosen),
+		})
+	}
+	return p, nil
+}
+
+// chosenDate is the local date of a submitted slot, so a rejected form
+// reopens the picker on the day the visitor was looking at
+func (b *Bookings) chosenDate(start time.Time) string {
+	if start.IsZero() {
+		return ""
+	}
+	return start.In(b.Schedule.Location).Format(time.DateOnly)
+}
+
+// --- HANDLERS ---
+
+// registerBookingRoutes mounts /book. Without a booking service the page
+// sends visitors to the contact form instead.
+func registerBookingRoutes(mux *http.ServeMux, bookings *Bookings, guard *SpamGuard, pow *ProofOfWork) {
+	if bookings == nil {
+		mux.HandleFunc("GET /book", func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "/#contact", http.StatusSeeOther)
+		})
+		return
+	}
+	mux.HandleFunc("GET /book", bookings.handlePage(guard))
+	mux.HandleFunc("POST /book", bookings.handleBook(guard, pow))
+	mux.HandleFunc("GET /book/manage/{id}", bookings.handleManage)
+	mux.HandleFunc("POST /book/manage/{id}/cancel", bookings.handleCancel)
+	mux.HandleFunc("POST /book/manage/{id}/reschedule", bookings.handleReschedule)
+}
+
+func (b *Bookings) handlePage(guard *SpamGuard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := b.picker(r.Context(), "/book?date=", r.URL.Query().Get("date"), time.Time{})
+		if err != nil {
+			b.logger().Error("booking_store_failure", slog.Any("error", err))
+			http.Error(w, "Booking is unavailable right now. Please email "+b.Sender+".", http.StatusServiceUnavailable)
+			return
+		}
+		// Day tabs swap only the picker
+		if r.Header.Get("HX-Target") == "slot_picker" {
+			RenderHTML(w, r, components.BookingSlotPicker(p))
+			return
+		}
+		sessionID, _ := r.Context().Value(SessionKey).(string)
+		RenderHTML(w, r, components.BookingPage(sessionID, components.BookingFormState{Token: guard.Issue(), Picker: p}))
+	}
+}
+
+func (b *Bookings) handleBook(guard *SpamGuard, pow *ProofOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, 64<<10)
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Failed to parse form", http.StatusBadRequest)
+			return
+		}
+		form := parseBookingForm(r)
+		start, _ := time.Parse(time.RFC3339, form.Start)
+
+		b.logger().Info("booking_attempt", slog.String("email", form.Email))
+
+		// SPAM: Bots get the same confirmation as people, so they learn nothing
+		if reason := guard.Check(r); reason != "" {
+			b.logger().Info("spam_blocked", slog.String("reason", reason))
+			fake := Booking{ID: newInquiryID(b.now()), Start: start, End: start.Add(b.Schedule.Duration)}
+			RenderHTML(w, r, components.BookingConfirmed(components.BookingConfirmation{Reference: fake.Reference(), When: b.when(fake), Email: form.Email}))
+			return
+		}
+
+		// reject re-renders the panel with the visitor's values and a fresh picker
+		reject := func(status int, errs map[string]string) {
+			form.Errors = errs
+			form.Token = guard.IssueForRetry()
+			p, err := b.picker(r.Context(), "/book?date=", b.chosenDate(start), start)
+			if err != nil {
+				b.logger().Error("booking_store_failure", slog.Any("error", err))
+			}
+			form.Picker = p
+			RenderHTMLStatus(w, r, status, components.BookingPanel(form))
+		}
+
+		// VALIDATION
+		errs := validateBooking(form)
+		if !b.Schedule.Bookable(start, b.now()) {
+			errs["start"] = "Choose one of the available times."
+		}
+		if len(errs) > 0 {
+			b.logger().Info("booking_invalid", slog.Any("fields", slices.Sorted(maps.Keys(errs))))
+			reject(http.StatusUnprocessableEntity, errs)
+			return
+		}
+
+		// PROOF OF WORK: Solved in the browser by public/js/pow.js. Browsers
+		// without JavaScript face a long time trap and a tight limit instead.
+		tokenAge, _ := guard.Age(form.Token)
+		if ok, plain := pow.Passes(r, tokenAge); !ok {
+			b.logger().Info("pow_failed", slog.Bool("plain", plain))
+			reject(http.StatusUnprocessableEntity, map[string]string{"form": powFailure(plain, b.Sender)})
+			return
+		}
+
+		// REPLAY: Spent atomically, so racing copies cannot both book
+		if !guard.Spend(r.Context(), form.Token) {
+			b.logger().Info("spam_blocked", slog.String("reason", spamReplayed))
+			fake := Booking{ID: newInquiryID(b.now()), Start: start, End: start.Add(b.Schedule.Duration)}
+			RenderHTML(w, r, components.BookingConfirmed(components.BookingConfirmation{Reference: fake.Reference(), When: b.when(fake), Email: form.Email}))
+			return
+		}
+
+		now := b.now()
+		bk := Booking{
+			ID:        newInquiryID(now),
+			Status:    BookingConfirmed,
+			Start:     start,
+			End:       start.Add(b.Schedule.Duration),
+			Name:      form.Name,
+			Email:     form.Email,
+			Topic:     form.Topic,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), storeTimeout)
+		err := b.Store.Reserve(ctx, bk)
+		cancel()
+		if errors.Is(err, ErrSlotTaken) {
+			b.logger().Info("booking_slot_taken", slog.Time("start", start))
+			reject(http.StatusConflict, map[string]string{"start": "That time was just taken. Please choose another."})
+			return
+		}
+		if err != nil {
+			b.logger().Error("booking_store_failure", slog.Any("error", err))
+			reject(http.StatusServiceUnavailable, map[string]string{"form": "We could not book that time. Please try again, or email " + b.Sender + "."})
+			return
+		}
+		b.logger().Info("booking_reserved", slog.String("booking", bk.ID))
+
+		b.notify(r.Context(), bk)
+
+		RenderHTML(w, r, components.BookingConfirmed(components.BookingConfirmation{
+			Reference: bk.Reference(),
+			When:      b.when(bk),
+			Email:     bk.Email,
+			ManageURL: b.managePath(bk.ID),
+		}))
+	}
+}
+
+// load returns the booking a signed manage link names. Anything else is a
+// 404, so a bad signature does not reveal whether the booking exists.
+func (b *Bookings) load(w http.ResponseWriter, r *http.Request) (Booking, bool) {
+	id := r.PathValue("id")
+	if !b.verify(id, r.FormValue("sig")) {
+		sessionID, _ := r.Context().Value(SessionKey).(string)
+		RenderHTMLStatus(w, r, http.StatusNotFound, components.NotFound(sessionID))
+		return Booking{}, false
+	}
+	bk, err := b.Store.Get(r.Context(), id)
+	if errors.Is(err, ErrBookingNotFound) {
+		sessionID, _ := r.Context().Value(SessionKey).(string)
+		RenderHTMLStatus(w, r, http.StatusNotFound, components.NotFound(sessionID))
+		return Booking{}, false
+	}
+	if err != nil {
+		b.logger().Error("booking_store_failure", slog.Any("error", err))
+		http.Error(w, "Booking is unavailable right now. Please email "+b.Sender+".", http.StatusServiceUnavailable)
+		return Booking{}, false
+	}
+	return bk, true
+}
+
+// renderManage shows a booking with its cancel and reschedule forms
+func (b *Bookings) renderManage(w http.ResponseWriter, r *http.Request, status int, bk Booking, v components.BookingManageView) {
+	v.Reference = bk.Reference()
+	v.Name = bk.Name
+	v.When = b.when(bk)
+	v.Cancelled = bk.Status == BookingCancelled
+	v.Started = !b.now().Before(bk.Start)
+	v.Action = "/book/manage/" + bk.ID
+	v.Sig = b.sign(bk.ID)
+	if !v.Cancelled && !v.Started {
+		p, err := b.picker(r.Context(), b.managePath(bk.ID)+"&date=", r.FormValue("date"), time.Time{})
+		if err != nil {
+			b.logger().Error("booking_store_failure", slog.Any("error", err))
+		}
+		v.Picker = p
+	}
+	if r.Header.Get("HX-Target") == "slot_picker" {
+		RenderHTML(w, r, components.BookingSlotPicker(v.Picker))
+		return
+	}
+	sessionID, _ := r.Context().Value(SessionKey).(string)
+	RenderHTMLStatus(w, r, status, components.BookingManage(sessionID, v))
+}
+
+func (b *Bookings) handleManage(w http.ResponseWriter, r *http.Request) {
+	bk, ok := b.load(w, r)
+	if !ok {
+		return
+	}
+	b.renderManage(w, r, http.StatusOK, bk, components.BookingManageView{})
+}
+
+func (b *Bookings) handleCancel(w http.ResponseWriter, r *http.Request) {
+	bk, ok := b.load(w, r)
+	if !ok {
+		return
+	}
+	if bk.Status == BookingCancelled || !b.now().Before(bk.Start) {
+		b.renderManage(w, r, http.StatusConflict, bk, components.BookingManageView{Error: "This call can no longer be cancelled."})
+		return
+	}
+
+	next := bk
+	next.Status = BookingCancelled
+	next.Sequence++
+	next.UpdatedAt = b.now()
+	b.update(w, r, bk, next, "Your call has been cancelled. We have emailed you a cancellation for your calendar.")
+}
+
+func (b *Bookings) handleReschedule(w http.ResponseWriter, r *http.Request) {
+	bk, ok := b.load(w, r)
+	if !ok {
+		return
+	}
+	start, _ := time.Parse(time.RFC3339, r.FormValue("start"))
+	switch {
+	case bk.Status == BookingCancelled || !b.now().Before(bk.Start):
+		b.renderManage(w, r, http.StatusConflict, bk, components.BookingManageView{Error: "This call can no longer be moved."})
+		return
+	case start.Equal(bk.Start):
+		b.renderManage(w, r, http.StatusOK, bk, components.BookingManageView{Notice: "Your call is already at that time."})
+		return
+	case !b.Schedule.Bookable(start, b.now()):
+		b.renderManage(w, r, http.StatusUnprocessableEntity, bk, components.BookingManageView{Error: "Choose one of the available times."})
+		return
+	}
+
+	next := bk
+	next.Start = start
+	next.End = start.Add(b.Schedule.Duration)
+	next.Sequence++
+	next.UpdatedAt = b.now()
+	b.update(w, r, bk, next, "Your call has been moved. We have emailed you an updated invite.")
+}
+
+// update saves a cancel or reschedule, sends the new invite and shows the result
+func (b *Bookings) update(w http.ResponseWriter, r *http.Request, prev, next Booking, notice string) {
+	ctx, cancel := context.WithTimeout(r.Context(), storeTimeout)
+	err := b.Store.Update(ctx, prev, next)
+	cancel()
+	switch {
+	case errors.Is(err, ErrSlotTaken):
+		b.logger().Info("booking_slot_taken", slog.Time("start", next.Start))
+		b.renderManage(w, r, http.StatusConflict, prev, components.BookingManageView{Error: "That time was just taken. Please choose another."})
+		return
+	case errors.Is(err, ErrBookingChanged):
+		latest, ok := b.load(w, r)
+		if ok {
+			b.renderManage(w, r, http.StatusConflict, latest, components.BookingManageView{Error: "This booking was changed elsewhere. Here is the latest."})
+		}
+		return
+	case err != nil:
+		b.logger().Error("booking_store_failure", slog.String("booking", prev.ID), slog.Any("error", err))
+		b.renderManage(w, r, http.StatusServiceUnavailable, prev, components.BookingManageView{Error: "We could not save that change. Please try again, or email " + b.Sender + "."})
+		return
+	}
+	b.logger().Info("booking_updated", slog.String("booking", next.ID), slog.String("status", string(next.Status)), slog.Int("sequence", next.Sequence))
+
+	b.notify(r.Context(), next)
+	b.renderManage(w, r, http.StatusOK, next, components.BookingManageView{Notice: notice})
+}
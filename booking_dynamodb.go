@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// bookingSlotPK is the partition every held slot lives in, sorted by start
+const bookingSlotPK = "slot"
+
+// DynamoBookingStore: Bookings and the slots they hold share a table keyed by
+// "pk" and "sk". A booking is ("booking#<id>", "booking") holding the JSON
+// document and its sequence; a held slot is ("slot", <UTC start>) naming its
+// booking. The conditional put that creates a slot item is the double-booking
+// check, and both items are written in one transaction.
+type DynamoBookingStore struct {
+	Client *dynamodb.Client
+	Table  string
+}
+
+func (s *DynamoBookingStore) Reserve(ctx context.Context, b Booking) error {
+	item, err := bookingToItem(b)
+	if err != nil {
+		return err
+	}
+	_, err = s.Client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{Put: &types.Put{
+				TableName:           aws.String(s.Table),
+				Item:                slotItem(b),
+				ConditionExpression: aws.String("attribute_not_exists(pk)"),
+			}},
+			{Put: &types.Put{
+				TableName:           aws.String(s.Table),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(pk)"),
+			}},
+		},
+	})
+	if failedAt(err) == 0 {
+		return ErrSlotTaken
+	}
+	return err
+}
+
+func (s *DynamoBookingStore) Get(ctx context.Context, id string) (Booking, error) {
+	out, err := s.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.Table),
+		Key:            bookingKey(id),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return Booking{}, err
+	}
+	data, ok := out.Item["data"].(*types.AttributeValueMemberS)
+	if !ok {
+		return Booking{}, ErrBookingNotFound
+	}
+	var b Booking
+	if err := json.Unmarshal([]byte(data.Value), &b); err != nil {
+		return Booking{}, err
+	}
+	return b, nil
+}
+
+func (s *DynamoBookingStore) Update(ctx context.Context, prev, next Booking) error {
+	item, err := bookingToItem(next)
+	if err != nil {
+		return err
+	}
+	// 1. The booking itself, only if nobody else has changed it
+	items := []types.TransactWriteItem{{Put: &types.Put{
+		TableName:                aws.String(s.Table),
+		Item:                     item,
+		ConditionExpression:      aws.String("#seq = :seq"),
+		ExpressionAttributeNames: map[string]string{"#seq": "sequence"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":seq": &types.AttributeValueMemberN{Value: strconv.Itoa(prev.Sequence)},
+		},
+	}}}
+	moved := next.Status == BookingConfirmed && !next.Start.Equal(prev.Start)
+	// 2. Hold the new slot
+	if moved {
+		items = append(items, types.TransactWriteItem{Put: &types.Put{
+			TableName:           aws.String(s.Table),
+			Item:                slotItem(next),
+			ConditionExpression: aws.String("attribute_not_exists(pk)"),
+		}})
+	}
+	// 3. Release the old one, if it is still ours
+	if moved || next.Status == BookingCancelled {
+		items = append(items, types.TransactWriteItem{Delete: &types.Delete{
+			TableName:                aws.String(s.Table),
+			Key:                      slotKey(prev.Start),
+			ConditionExpression:      aws.String("#b = :id"),
+			ExpressionAttributeNames: map[string]string{"#b": "booking"},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":id": &types.AttributeValueMemberS{Value: prev.ID},
+			},
+		}})
+	}
+
+	_, err = s.Client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	switch failedAt(err) {
+	case 0:
+		return ErrBookingChanged
+	case 1:
+		if moved {
+			return ErrSlotTaken
+		}
+	}
+	return err
+}
+
+func (s *DynamoBookingStore) Held(ctx context.Context, from, to time.Time) ([]time.Time, error) {
+	var out []time.Time
+	p := dynamodb.NewQueryPaginator(s.Client, &dynamodb.QueryInput{
+		TableName:              aws.String(s.Table),
+		KeyConditionExpression: aws.String("pk = :pk AND sk BETWEEN :from AND :to"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk":   &types.AttributeValueMemberS{Value: bookingSlotPK},
+			":from": &types.AttributeValueMemberS{Value: slotSK(from)},
+			":to":   &types.AttributeValueMemberS{Value: slotSK(to)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			sk, _ := item["sk"].(*types.AttributeValueMemberS)
+			if sk == nil {
+				continue
+			}
+			// BETWEEN is inclusive; Held is not
+			if t, err := time.Parse(time.RFC3339, sk.Value); err == nil && t.Before(to) {
+				out = append(out, t)
+			}
+		}
+	}
+	return out, nil
+}
+
+// ByEmail filters List. The address is only inside the JSON document, so it
+// cannot be matched in the scan.
+func (s *DynamoBookingStore) ByEmail(ctx context.Context, email string) ([]Booking, error) {
+	all, err := s.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(all, func(b Booking) bool { return !strings.EqualFold(strings.TrimSpace(b.Email), email) }), nil
+}
+
+// List scans the bookings, like DynamoStore.List does for inquiries
+func (s *DynamoBookingStore) List(ctx context.Context) ([]Booking, error) {
+	var out []Booking
+	p := dynamodb.NewScanPaginator(s.Client, &dynamodb.ScanInput{
+		TableName:        aws.String(s.Table),
+		FilterExpression: aws.String("sk = :sk"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":sk": &types.AttributeValueMemberS{Value: "booking"},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			data, ok := item["data"].(*types.AttributeValueMemberS)
+			if !ok {
+				continue
+			}
+			var b Booking
+			if err := json.Unmarshal([]byte(data.Value), &b); err != nil {
+				return nil, err
+			}
+			out = append(out, b)
+		}
+	}
+	slices.SortFunc(out, func(a, b Booking) int { return strings.Compare(a.ID, b.ID) })
+	return out, nil
+}
+
+// Delete releases the slot first, if this booking still holds it, so a
+// failure part way leaves the booking to be deleted again
+func (s *DynamoBookingStore) Delete(ctx context.Context, id string) error {
+	return s.remove(ctx, id, nil)
+}
+
+// DeleteSequence checks the sequence before releasing the slot, and again on
+// the booking item in case it moved on in between
+func (s *DynamoBookingStore) DeleteSequence(ctx context.Context, id string, sequence int) error {
+	return s.remove(ctx, id, &sequence)
+}
+
+func (s *DynamoBookingStore) remove(ctx context.Context, id string, sequence *int) error {
+	b, err := s.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if sequence != nil && b.Sequence != *sequence {
+		return ErrBookingChanged
+	}
+	_, err = s.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                aws.String(s.Table),
+		Key:                      slotKey(b.Start),
+		ConditionExpression:      aws.String("#b = :id"),
+		ExpressionAttributeNames: map[string]string{"#b": "booking"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	var cfe *types.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &cfe) {
+		return err
+	}
+	del := &dynamodb.DeleteItemInput{
+		TableName:           aws.String(s.Table),
+		Key:                 bookingKey(id),
+		ConditionExpression: aws.String("attribute_exists(pk)"),
+	}
+	if sequence != nil {
+		del.ConditionExpression = aws.String("attribute_exists(pk) AND #seq = :seq")
+		del.ExpressionAttributeNames = map[string]string{"#seq": "sequence"}
+		del.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":seq": &types.AttributeValueMemberN{Value: strconv.Itoa(*sequence)},
+		}
+		del.ReturnValuesOnConditionCheckFailure = types.ReturnValuesOnConditionCheckFailureAllOld
+	}
+	_, err = s.Client.DeleteItem(ctx, del)
+	if errors.As(err, &cfe) {
+		if sequence != nil && cfe.Item != nil {
+			return ErrBookingChanged
+		}
+		return ErrBookingNotFound
+	}
+	return err
+}
+
+// failedAt returns the index of the transaction item whose condition failed, or -1
+func failedAt(err error) int {
+	var tce *types.TransactionCanceledException
+	if !errors.As(err, &tce) {
+		return -1
+	}
+	for i, r := range tce.CancellationReasons {
+		if aws.ToString(r.Code) == "ConditionalCheckFailed" {
+			return i
+		}
+	}
+	return -1
+}
+
+// slotSK is sortable because every start is formatted in UTC to the second
+func slotSK(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func slotKey(start time.Time) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"pk": &types.AttributeValueMemberS{Value: bookingSlotPK},
+		"sk": &types.AttributeValueMemberS{Value: slotSK(start)},
+	}
+}
+
+// slotItem expires a day after the call, via the table's TTL, once it can no longer clash
+func slotItem(b Booking) map[string]types.AttributeValue {
+	item := slotKey(b.Start)
+	item["booking"] = &types.AttributeValueMemberS{Value: b.ID}
+	item["expires"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(b.Start.Add(24*time.Hour).Unix(), 10)}
+	return item
+}
+
+func bookingKey(id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"pk": &types.AttributeValueMemberS{Value: "booking#" + id},
+		"sk": &types.AttributeValueMemberS{Value: "booking"},
+	}
+}
+
+func bookingToItem(b Booking) (map[string]types.AttributeValue, error) {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	item := bookingKey(b.ID)
+	item["data"] = &types.AttributeValueMemberS{Value: string(data)}
+	item["sequence"] = &types.AttributeValueMemberN{Value: strconv.Itoa(b.Sequence)}
+	return item, nil
+}
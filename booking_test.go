@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"stackfoundry.co.uk/components"
+)
+
+// bookingNow is a Monday morning in British Summer Time, a week before the clocks go back
+var bookingNow = time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+
+func newTestBookings(t *testing.T) (*Bookings, *MemoryMailer, http.Handler) {
+	t.Helper()
+	schedule, err := parseSchedule(defaultBookingSchedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailer := &MemoryMailer{}
+	bookings := NewBookings(schedule, NewMemoryBookingStore(), mailer, testSender, "https://www.stackfoundry.co.uk", "example.com", []byte("test-signing-key"))
+	bookings.now = func() time.Time { return bookingNow }
+	return bookings, mailer, testApp(App{Mailer: mailer, Bookings: bookings}).Handler()
+}
+
+// newBookingForm returns form values for start with a valid token and solved challenge
+func newBookingForm(start string) url.Values {
+	challenge, difficulty := testPow.Issue(context.Background(), "192.0.2.1")
+	form := url.Values{}
+	form.Add("name", "Ada Lovelace")
+	form.Add("email", "ada@example.com")
+	form.Add("topic", "Analytical engine, v2")
+	form.Add("start", start)
+	form.Add(components.FormTokenField, testGuard.issueAt(time.Now().Add(-time.Minute)))
+	form.Add(components.PowChallengeField, challenge)
+	form.Add(components.PowNonceField, solvePow(challenge, difficulty))
+	return form
+}
+
+var manageLink = regexp.MustCompile(`/book/manage/[^"?]+\?sig=[A-Za-z0-9_-]+`)
+
+func TestBankHolidays(t *testing.T) {
+	tests := []struct {
+		year int
+		want []string
+	}{
+		// Christmas on a Friday: Boxing Day moves to Monday
+		{2026, []string{"2026-01-01", "2026-04-03", "2026-04-06", "2026-05-04", "2026-05-25", "2026-08-31", "2026-12-25", "2026-12-28"}},
+		// Christmas on a Saturday: both move
+		{2027, []string{"2027-01-01", "2027-03-26", "2027-03-29", "2027-05-03", "2027-05-31", "2027-08-30", "2027-12-27", "2027-12-28"}},
+		// New Year's Day on a Saturday, Christmas on a Sunday
+		{2022, []string{"2022-01-03", "2022-04-15", "2022-04-18", "2022-05-02", "2022-05-30", "2022-08-29", "2022-12-26", "2022-12-27"}},
+	}
+	for _, tt := range tests {
+		got := bankHolidays(tt.year)
+		if len(got) != len(tt.want) {
+			t.Errorf("%d: got %d holidays, want %d: %v", tt.year, len(got), len(tt.want), got)
+		}
+		for _, d := range tt.want {
+			if !got[d] {
+				t.Errorf("%d: missing %s", tt.year, d)
+			}
+		}
+	}
+}
+
+func TestScheduleSlots(t *testing.T) {
+	schedule, err := parseSchedule(defaultBookingSchedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	london := schedule.Location
+	at := func(y int, m time.Month, d, hh, mm int) time.Time { return time.Date(y, m, d, hh, mm, 0, 0, london) }
+
+	// 1. The grid steps by the call plus the buffer and stops where a call would overrun
+	var got []string
+	for _, s := range schedule.slots(at(2026, 10, 20, 0, 0)) {
+		got = append(got, s.In(london).Format("15:04"))
+	}
+	if want := []string{"09:30", "10:15", "11:00", "14:00", "14:45", "15:30", "16:15"}; !slices.Equal(got, want) {
+		t.Errorf("slots = %v, want %v", got, want)
+	}
+
+	// 2. No slots at weekends, on bank holidays or on configured closures
+	for _, day := range []time.Time{at(2026, 10, 24, 0, 0), at(2026, 12, 25, 0, 0), at(2026, 12, 24, 0, 0)} {
+		if s := schedule.slots(day); len(s) != 0 {
+			t.Errorf("%s: got %d slots, want none", day.Format(time.DateOnly), len(s))
+		}
+	}
+
+	// 3. Bookable needs a grid slot past the notice period and inside the horizon
+	tests := []struct {
+		name  string
+		start time.Time
+		want  bool
+	}{
+		{"next day", at(2026, 10, 20, 9, 30), true},
+		{"inside notice", at(2026, 10, 19, 14, 0), false},
+		{"off grid", at(2026, 10, 20, 9, 45), false},
+		{"after the clocks change", at(2026, 10, 26, 9, 30), true},
+		{"beyond horizon", at(2026, 11, 16, 9, 30), false},
+		{"last weekday in horizon", at(2026, 11, 13, 9, 30), true},
+	}
+	for _, tt := range tests {
+		if got := schedule.Bookable(tt.start, bookingNow); got != tt.want {
+			t.Errorf("%s: Bookable(%s) = %v, want %v", tt.name, tt.start, got, tt.want)
+		}
+	}
+	// Local 09:30 is 08:30 UTC in summer and 09:30 UTC after the change
+	if !schedule.Bookable(time.Date(2026, 10, 20, 8, 30, 0, 0, time.UTC), bookingNow) || !schedule.Bookable(time.Date(2026, 10, 26, 9, 30, 0, 0, time.UTC), bookingNow) {
+		t.Error("slots should follow local time across the clock change")
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	tests := map[string]string{
+		"unknown day": `{"timezone":"Europe/London","duration_minutes":30,"horizon_days":7,"weekly":{"funday":["09:00-10:00"]}}`,
+		"overlap":     `{"timezone":"Europe/London","duration_minutes":30,"horizon_days":7,"weekly":{"mon":["09:00-11:00","10:00-12:00"]}}`,
+		"too short":   `{"timezone":"Europe/London","duration_minutes":30,"horizon_days":7,"weekly":{"mon":["09:00-09:15"]}}`,
+		"bad zone":    `{"timezone":"Mars/Olympus","duration_minutes":30,"horizon_days":7}`,
+		"bad closure": `{"timezone":"Europe/London","duration_minutes":30,"horizon_days":7,"closed":["25/12/2026"]}`,
+		"no duration": `{"timezone":"Europe/London","horizon_days":7}`,
+		"unknown key": `{"timezone":"Europe/London","duration_minutes":30,"horizon_days":7,"holidays":[]}`,
+	}
+	for name, data := range tests {
+		if _, err := parseSchedule([]byte(data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestBookingFlow(t *testing.T) {
+	bookings, mailer, router := newTestBookings(t)
+	first := "2026-10-20T08:30:00Z" // Tuesday 09:30 BST
+
+	// 1. The page offers the first free slot; day tabs swap only the picker
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/book", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `value="`+first+`"`) {
+		t.Fatalf("GET /book = %d, want the first slot offered", rr.Code)
+	}
+	req := httptest.NewRequest("GET", "/book?date=2026-10-21", nil)
+	req.Header.Set("HX-Request", "true")
+	req.Header.Set("HX-Target", "slot_picker")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if body := rr.Body.String(); !strings.HasPrefix(body, `<div id="slot_picker"`) || !strings.Contains(body, "2026-10-21T08:30:00Z") {
+		t.Errorf("picker partial = %.200s", body)
+	}
+
+	// 2. Booking reserves the slot and sends both parties a REQUEST
+	rr = postForm(router, "/book", newBookingForm(first), false)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "BK-") {
+		t.Fatalf("POST /book = %d: %s", rr.Code, rr.Body.String())
+	}
+	manage := manageLink.FindString(rr.Body.String())
+	if manage == "" {
+		t.Fatal("confirmation has no manage link")
+	}
+	sent := mailer.Sent()
+	if len(sent) != 2 {
+		t.Fatalf("sent %d emails, want visitor and host", len(sent))
+	}
+	if sent[0].To[0] != "ada@example.com" || sent[1].To[0] != testSender || sent[1].ReplyTo[0] != "ada@example.com" {
+		t.Errorf("recipients = %v / %v", sent[0].To, sent[1].To)
+	}
+	if strings.Contains(sent[0].Subject, "Ada") {
+		t.Errorf("visitor subject carries their input: %q", sent[0].Subject)
+	}
+	for _, msg := range sent {
+		if len(msg.Attachments) != 1 || msg.Attachments[0].ContentType != "text/calendar; charset=utf-8; method=REQUEST" {
+			t.Fatalf("attachments = %+v", msg.Attachments)
+		}
+		ics := string(msg.Attachments[0].Data)
+		if !strings.Contains(ics, "SEQUENCE:0") || !strings.Contains(ics, "DTSTART:20261020T083000Z") || !strings.Contains(ics, "@example.com\r\n") {
+			t.Errorf("invite = %s", ics)
+		}
+		if !strings.Contains(msg.Text, "https://www.stackfoundry.co.uk"+manage) {
+			t.Errorf("email lacks the manage link: %s", msg.Text)
+		}
+	}
+
+	// 3. The same slot cannot be booked twice
+	rr = postForm(router, "/book", newBookingForm(first), false)
+	if rr.Code != http.StatusConflict || !strings.Contains(rr.Body.String(), "just taken") {
+		t.Errorf("second booking = %d, want 409", rr.Code)
+	}
+
+	// 4. Rescheduling moves the hold and resends with a higher sequence
+	id := strings.TrimPrefix(manage[:strings.Index(manage, "?")], "/book/manage/")
+	sig := bookings.sign(id)
+	rr = postForm(router, "/book/manage/"+id+"/reschedule", url.Values{"sig": {sig}, "start": {"2026-10-20T09:15:00Z"}}, false)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "has been moved") {
+		t.Fatalf("reschedule = %d: %s", rr.Code, rr.Body.String())
+	}
+	last := mailer.Sent()[len(mailer.Sent())-1]
+	if ics := string(last.Attachments[0].Data); !strings.Contains(ics, "SEQUENCE:1") || !strings.Contains(ics, "DTSTART:20261020T091500Z") {
+		t.Errorf("rescheduled invite = %s", ics)
+	}
+	if rr := postForm(router, "/book", newBookingForm(first), false); rr.Code != http.StatusOK {
+		t.Errorf("old slot should be free again, got %d", rr.Code)
+	}
+
+	// 5. Cancelling sends a CANCEL and cannot be repeated
+	rr = postForm(router, "/book/manage/"+id+"/cancel", url.Values{"sig": {sig}}, false)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "cancelled") {
+		t.Fatalf("cancel = %d", rr.Code)
+	}
+	last = mailer.Sent()[len(mailer.Sent())-1]
+	if a := last.Attachments[0]; a.ContentType != "text/calendar; charset=utf-8; method=CANCEL" || !strings.Contains(string(a.Data), "SEQUENCE:2") {
+		t.Errorf("cancellation = %s %s", a.ContentType, a.Data)
+	}
+	if rr := postForm(router, "/book/manage/"+id+"/cancel", url.Values{"sig": {sig}}, false); rr.Code != http.StatusConflict {
+		t.Errorf("second cancel = %d, want 409", rr.Code)
+	}
+	held, _ := bookings.Store.Held(context.Background(), bookingNow, bookingNow.AddDate(0, 1, 0))
+	if len(held) != 1 || !held[0].Equal(time.Date(2026, 10, 20, 8, 30, 0, 0, time.UTC)) {
+		t.Errorf("held = %v, want only the rebooked first slot", held)
+	}
+
+	// 6. A browser without JavaScript books with a plain POST and no challenge
+	plain := newBookingForm("2026-10-20T09:15:00Z")
+	plain.Del(components.PowChallengeField)
+	plain.Del(components.PowNonceField)
+	if rr := postForm(router, "/book", plain, false); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "BK-") {
+		t.Errorf("no-JavaScript booking = %d", rr.Code)
+	}
+}
+
+func TestBookingManageSignature(t *testing.T) {
+	bookings, _, router := newTestBookings(t)
+	rr := postForm(router, "/book", newBookingForm("2026-10-20T08:30:00Z"), false)
+	manage := manageLink.FindString(rr.Body.String())
+	id := strings.TrimPrefix(manage[:strings.Index(manage, "?")], "/book/manage/")
+
+	for name, target := range map[string]string{
+		"valid":          manage,
+		"missing sig":    "/book/manage/" + id,
+		"wrong sig":      "/book/manage/" + id + "?sig=" + bookings.sign("someone-else"),
+		"unknown signed": "/book/manage/nope?sig=" + bookings.sign("nope"),
+	} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+		want := http.StatusNotFound
+		if name == "valid" {
+			want = http.StatusOK
+		}
+		if rr.Code != want {
+			t.Errorf("%s: got %d, want %d", name, rr.Code, want)
+		}
+	}
+
+	// A forged cancel changes nothing
+	postForm(router, "/book/manage/"+id+"/cancel", url.Values{"sig": {"forged"}}, false)
+	if b, _ := bookings.Store.Get(context.Background(), id); b.Status != BookingConfirmed {
+		t.Errorf("status = %s after forged cancel", b.Status)
+	}
+}
+
+func TestBookingMailLimit(t *testing.T) {
+	bookings, mailer, router := newTestBookings(t)
+	bookings.Policy = RatePolicy{Name: "booking_mail", Rate: 1.0 / 86400, Burst: 1}
+
+	// 1. The first booking mails the visitor and the host
+	postForm(router, "/book", newBookingForm("2026-10-20T08:30:00Z"), false)
+	if n := len(mailer.Sent()); n != 2 {
+		t.Fatalf("sent %d emails, want visitor and host", n)
+	}
+
+	// 2. Past the limit the address gets nothing, but the host still hears of it
+	form := newBookingForm("2026-10-20T09:15:00Z")
+	form.Set("email", "ADA@example.com")
+	if rr := postForm(router, "/book", form, false); rr.Code != http.StatusOK {
+		t.Fatalf("second booking = %d", rr.Code)
+	}
+	sent := mailer.Sent()
+	if len(sent) != 3 || sent[2].To[0] != testSender {
+		t.Errorf("after the limit sent %d emails, last to %v; want only the host's copy", len(sent), sent[len(sent)-1].To)
+	}
+}
+
+func TestBookingValidation(t *testing.T) {
+	bookings, mailer, router := newTestBookings(t)
+
+	tests := []struct {
+		name  string
+		edit  func(url.Values)
+		field string
+	}{
+		{"missing name", func(f url.Values) { f.Set("name", "") }, "name_error"},
+		{"bad email", func(f url.Values) { f.Set("email", "nope") }, "email_error"},
+		{"off grid", func(f url.Values) { f.Set("start", "2026-10-20T08:45:00Z") }, "start_error"},
+		{"inside notice", func(f url.Values) { f.Set("start", "2026-10-19T13:00:00Z") }, "start_error"},
+		{"not a time", func(f url.Values) { f.Set("start", "tomorrow") }, "start_error"},
+	}
+	for _, tt := range tests {
+		form := newBookingForm("2026-10-20T08:30:00Z")
+		tt.edit(form)
+		rr := postForm(router, "/book", form, false)
+		if rr.Code != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), tt.field) {
+			t.Errorf("%s: got %d, want 422 with %s", tt.name, rr.Code, tt.field)
+		}
+	}
+
+	// Bots see a confirmation but nothing is held or sent
+	form := newBookingForm("2026-10-20T08:30:00Z")
+	form.Set(components.HoneypotField, "http://spam.example")
+	if rr := postForm(router, "/book", form, false); rr.Code != http.StatusOK || manageLink.MatchString(rr.Body.String()) {
+		t.Errorf("honeypot: got %d", rr.Code)
+	}
+
+	held, _ := bookings.Store.Held(context.Background(), bookingNow, bookingNow.AddDate(0, 1, 0))
+	if len(held) != 0 || len(mailer.Sent()) != 0 {
+		t.Errorf("rejected bookings held %d slots and sent %d emails", len(held), len(mailer.Sent()))
+	}
+}
+
+func TestBookingDisabled(t *testing.T) {
+	router := testApp(App{Mailer: &MemoryMailer{}}).Handler()
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/book", nil))
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/#contact" {
+		t.Errorf("got %d to %q, want a redirect to the contact form", rr.Code, rr.Header().Get("Location"))
+	}
+}
+
+func TestMemoryBookingStoreRace(t *testing.T) {
+	store := NewMemoryBookingStore()
+	start := time.Date(2026, 10, 20, 8, 30, 0, 0, time.UTC)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- store.Reserve(context.Background(), Booking{ID: newInquiryID(start) + string(rune('a'+i)), Start: start})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	won := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			won++
+		case !errors.Is(err, ErrSlotTaken):
+			t.Fatal(err)
+		}
+	}
+	if won != 1 {
+		t.Errorf("%d bookings won the slot, want 1", won)
+	}
+}
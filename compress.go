@@ -0,0 +1,272 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressMinSize: Bodies smaller than this go out as they are; the framing
+// and CPU cost more than the bytes saved
+const compressMinSize = 1024
+
+// compressor is what brotli, zstd and gzip writers have in common
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// contentCoding: One Content-Encoding we can produce, with a pool of writers
+// so each response does not allocate a fresh window
+type contentCoding struct {
+	name string
+	pool *sync.Pool
+}
+
+func newContentCoding(name string, newWriter func() compressor) contentCoding {
+	return contentCoding{name: name, pool: &sync.Pool{New: func() any { return newWriter() }}}
+}
+
+// contentCodings in our order of preference, used to break ties between
+// codings the client rates equally. Levels favour speed: every response is
+// compressed on the fly, on a small Lambda.
+var contentCodings = []contentCoding{
+	newContentCoding("br", func() compressor { return brotli.NewWriterLevel(nil, 5) }),
+	newContentCoding("zstd", func() compressor {
+		// One goroutine, and a window within the 8 MB browsers accept
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(1<<20))
+		return w
+	}),
+	newContentCoding("gzip", func() compressor { return gzip.NewWriter(nil) }),
+}
+
+// negotiateEncoding picks a coding from an Accept-Encoding header (RFC 9110
+// section 12.5.3): the highest q-value wins, q=0 refuses a coding, and "*"
+// stands for any coding not named. It returns nil for identity.
+func negotiateEncoding(header string) *contentCoding {
+	named := map[string]float64{}
+	wildcard := -1.0
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+			if !ok || !strings.EqualFold(strings.TrimSpace(k), "q") {
+				continue
+			}
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil || f < 0 || f > 1 {
+				f = 0 // a malformed weight is not consent
+			}
+			q = f
+		}
+		switch coding {
+		case "*":
+			wildcard = q
+		case "x-gzip":
+			coding = "gzip"
+			fallthrough
+		default:
+			if prev, ok := named[coding]; !ok || q > prev {
+				named[coding] = q
+			}
+		}
+	}
+
+	var best *contentCoding
+	bestQ := 0.0
+	for i := range contentCodings {
+		c := &contentCodings[i]
+		q, ok := named[c.name]
+		if !ok {
+			q = max(wildcard, 0)
+		}
+		if q > bestQ {
+			best, bestQ = c, q
+		}
+	}
+	return best
+}
+
+// compressibleType reports whether a Content-Type is worth compressing.
+// Images other than SVG, fonts, archives and PDFs are compressed already.
+func compressibleType(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mt, "text/"),
+		strings.HasSuffix(mt, "+json"), strings.HasSuffix(mt, "+xml"):
+		return true
+	}
+	switch mt {
+	case "application/json", "application/javascript", "application/xml",
+		"application/x-ndjson", "application/wasm", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// CompressMiddleware: Negotiates br, zstd or gzip from Accept-Encoding and
+// compresses responses worth compressing. Small bodies, compressed content
+// types, HEAD, 204, 206 and 304 responses, and anything already encoded go
+// out untouched. Every response says Vary: Accept-Encoding, so caches never
+// hand a compressed body to a client that cannot read it.
+func CompressMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		coding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if coding == nil || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, coding: coding}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter: Holds back the status and up to compressMinSize bytes
+// until it knows the type and size, then either compresses or passes the
+// response through as written
+type compressWriter struct {
+	http.ResponseWriter
+	coding *contentCoding
+
+	status  int
+	buf     []byte
+	decided bool
+	enc     compressor // nil once decided means pass through
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status != 0 {
+		return
+	}
+	if status < 200 {
+		// 1xx (103 Early Hints) go straight out; the real status follows
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.status = status
+	switch status {
+	case http.StatusNoContent, http.StatusPartialContent, http.StatusNotModified:
+		cw.start(false)
+		return
+	}
+	if cl := cw.Header().Get("Content-Length"); cl != "" {
+		if n, err := strconv.Atoi(cl); err == nil && n < compressMinSize {
+			cw.start(false)
+		}
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < compressMinSize {
+			return len(b), nil
+		}
+		if err := cw.start(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// start settles whether to compress, writes the held-back status and
+// flushes the buffer. enough says the body is large enough.
+func (cw *compressWriter) start(enough bool) error {
+	cw.decided = true
+	h := cw.Header()
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		// net/http would sniff the compressed bytes instead
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	if enough && h.Get("Content-Encoding") == "" && compressibleType(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", cw.coding.name)
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		// The encoded body is a different representation from the plain one
+		if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+			h.Set("ETag", "W/"+etag)
+		}
+		cw.enc = cw.coding.pool.Get().(compressor)
+		cw.enc.Reset(cw.ResponseWriter)
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if cw.enc != nil {
+		_, err := cw.enc.Write(buf)
+		return err
+	}
+	_, err := cw.ResponseWriter.Write(buf)
+	return err
+}
+
+// Flush sends what is buffered now. A handler that flushes is streaming, so
+// the body is compressed without waiting for compressMinSize.
+func (cw *compressWriter) Flush() {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		cw.start(true)
+	}
+	if cw.enc != nil {
+		cw.enc.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close finishes the response: a body that never reached compressMinSize
+// goes out as it is, and the writer goes back to its pool
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if cw.status == 0 {
+			// Nothing was written; let net/http send its implicit 200
+			return nil
+		}
+		cw.start(false)
+	}
+	if cw.enc == nil {
+		return nil
+	}
+	err := cw.enc.Close()
+	cw.enc.Reset(nil)
+	cw.coding.pool.Put(cw.enc)
+	cw.enc = nil
+	return err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"gzip, deflate, br, zstd", "br"},
+		{"gzip;q=1.0, br;q=0.5", "gzip"},
+		{"br;q=0, gzip", "gzip"},
+		{"GZIP", "gzip"},
+		{"x-gzip", "gzip"},
+		{"gzip;q=0", ""},
+		{"gzip;q=0.0, *;q=0", ""},
+		{"*", "br"},
+		{"*;q=0.5, br;q=0, zstd;q=0", "gzip"},
+		{"deflate, identity", ""},
+		{"gzip;q=abc", ""},
+		{"zstd;q=0.9, gzip;q=0.9", "zstd"},
+	}
+	for _, tt := range tests {
+		got := ""
+		if c := negotiateEncoding(tt.header); c != nil {
+			got = c.name
+		}
+		if got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+// decode undoes a Content-Encoding the way a browser would
+func decode(t *testing.T, coding string, body []byte) string {
+	t.Helper()
+	var r io.Reader
+	switch coding {
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(body))
+	case "zstd":
+		d, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		r = d
+	case "gzip":
+		g, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = g
+	default:
+		return string(body)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("%s body: %v", coding, err)
+	}
+	return string(out)
+}
+
+func TestCompressMiddleware(t *testing.T) {
+	page := strings.Repeat("<p>Fractional CTO for early-stage teams.</p>\n", 100)
+	serve := func(h http.HandlerFunc, method, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/", nil)
+		if accept != "" {
+			req.Header.Set("Accept-Encoding", accept)
+		}
+		rr := httptest.NewRecorder()
+		CompressMiddleware(h).ServeHTTP(rr, req)
+		return rr
+	}
+	html := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Length", "4600")
+		w.Write([]byte(page))
+	}
+
+	// 1. Each coding round-trips, with Vary set and the stale length gone.
+	// Writers come from a pool, so run each twice.
+	for _, coding := range []string{"br", "zstd", "gzip", "br", "zstd", "gzip"} {
+		rr := serve(html, "GET", coding)
+		if got := rr.Header().Get("Content-Encoding"); got != coding {
+			t.Fatalf("%s: Content-Encoding %q", coding, got)
+		}
+		if rr.Header().Get("Vary") != "Accept-Encoding" || rr.Header().Get("Content-Length") != "" {
+			t.Errorf("%s: headers %v", coding, rr.Header())
+		}
+		if rr.Body.Len() >= len(page) || decode(t, coding, rr.Body.Bytes()) != page {
+			t.Errorf("%s: body of %d bytes does not decode to the page", coding, rr.Body.Len())
+		}
+	}
+
+	// 2. Responses that must or should go out as they are
+	png := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(bytes.Repeat([]byte{0x89}, 4096))
+	}
+	small := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("ok"))
+	}
+	notModified := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNotModified) }
+	encoded := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write([]byte(page))
+	}
+	for name, tt := range map[string]struct {
+		h      http.HandlerFunc
+		method string
+		accept string
+		status int
+		length string
+	}{
+		"Not Accepted":    {html, "GET", "gzip;q=0, br;q=0, zstd;q=0", http.StatusOK, "4600"},
+		"HEAD":            {html, "HEAD", "gzip", http.StatusOK, "4600"},
+		"Image":           {png, "GET", "gzip", http.StatusOK, ""},
+		"Small":           {small, "GET", "gzip", http.StatusOK, ""},
+		"Not Modified":    {notModified, "GET", "gzip", http.StatusNotModified, ""},
+		"Already Encoded": {encoded, "GET", "br", http.StatusOK, ""},
+	} {
+		rr := serve(tt.h, tt.method, tt.accept)
+		if rr.Code != tt.status || rr.Header().Get("Content-Length") != tt.length || rr.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s: %d %v", name, rr.Code, rr.Header())
+		}
+		if name != "Already Encoded" && rr.Header().Get("Content-Encoding") != "" {
+			t.Errorf("%s: encoded as %q", name, rr.Header().Get("Content-Encoding"))
+		}
+	}
+	if rr := serve(small, "GET", "gzip"); rr.Body.String() != "ok" {
+		t.Errorf("Small body %q", rr.Body)
+	}
+	if rr := serve(encoded, "GET", "br"); rr.Header().Get("Content-Encoding") != "gzip" || rr.Body.String() != page {
+		t.Error("An encoded body was encoded again")
+	}
+
+	// 3. Untyped bodies are sniffed before compressing, not after
+	rr := serve(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(page)) }, "GET", "gzip")
+	if !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/html") || rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("Sniffed %v", rr.Header())
+	}
+
+	// 4. Flushing streams compressed bytes straight away
+	stream := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/events", nil)
+	req.Header.Set("Accept-Encoding", "zstd")
+	CompressMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: one\n\n"))
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			t.Errorf("Flush: %v", err)
+		}
+		if !stream.Flushed || stream.Body.Len() == 0 {
+			t.Error("Nothing reached the client on Flush")
+		}
+		w.Write([]byte("data: two\n\n"))
+	})).ServeHTTP(stream, req)
+	if got := decode(t, "zstd", stream.Body.Bytes()); got != "data: one\n\ndata: two\n\n" {
+		t.Errorf("Stream %q", got)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"stackfoundry.co.uk/appconfig"
+)
+
+// runConfig: "config check [flags]" prints the configuration the server would
+// start with, secrets redacted, each setting with where it came from, and
+// fails if it does not validate. It takes the server's flags.
+func runConfig(args []string) error {
+	if len(args) == 0 || args[0] != "check" {
+		return errors.New("usage: config check [flags]")
+	}
+	cfg, err := appconfig.Load(args[1:], os.Environ())
+	if err != nil {
+		return err
+	}
+	fmt.Print(cfg)
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("\ninvalid configuration:\n%w", err)
+	}
+	fmt.Println("\nconfiguration ok")
+	return nil
+}
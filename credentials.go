@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	"stackfoundry.co.uk/appconfig"
+)
+
+var (
+	ErrAdminNotFound      = errors.New("admin user not found")
+	ErrCredentialConflict = errors.New("admin user changed concurrently")
+)
+
+// Role: What an admin may do. Checked on every request, so a change takes
+// effect without signing anyone out.
+type Role string
+
+const (
+	RoleOwner  Role = "owner"  // everything
+	RoleTriage Role = "triage" // read and file inquiries
+	RoleViewer Role = "viewer" // read only
+)
+
+// Permission: What a route needs, granted by roles
+type Permission string
+
+const (
+	PermRead     Permission = "read"
+	PermTriage   Permission = "triage"
+	PermExport   Permission = "export"
+	PermSecurity Permission = "security" // manage one's own sign-in methods
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleOwner:  {PermRead, PermTriage, PermExport, PermSecurity},
+	RoleTriage: {PermRead, PermTriage, PermSecurity},
+	RoleViewer: {PermRead, PermSecurity},
+}
+
+func (r Role) Valid() bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
+
+func (r Role) Can(p Permission) bool {
+	return slices.Contains(rolePermissions[r], p)
+}
+
+// AdminUser: One admin and every way they can sign in. Version guards against
+// lost updates, e.g. two sign-ins racing to bump a passkey counter.
+type AdminUser struct {
+	Name          string    `json:"name"`
+	Role          Role      `json:"role"`
+	Passkeys      []Passkey `json:"passkeys,omitempty"`
+	TOTPSecret    string    `json:"totp_secret,omitempty"`
+	TOTPLastStep  int64     `json:"totp_last_step,omitempty"`
+	RecoveryCodes []string  `json:"recovery_codes,omitempty"` // SHA-256 of unused codes
+	InviteHash    string    `json:"invite_hash,omitempty"`    // SHA-256 of a pending invite token
+	InviteExpires time.Time `json:"invite_expires,omitzero"`
+	Epoch         int       `json:"epoch"` // bumped to end every session
+	FailedCodes   int       `json:"failed_codes,omitempty"`
+	LockedUntil   time.Time `json:"locked_until,omitzero"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	Version       int       `json:"version"`
+}
+
+// HasFactor reports whether the user can sign in without an invite
+func (u AdminUser) HasFactor() bool {
+	return len(u.Passkeys) > 0 || u.TOTPSecret != ""
+}
+
+// CredentialStore: Persistence for admin accounts. PutUser succeeds only if
+// the stored Version still matches (0 for a new user), then increments it.
+type CredentialStore interface {
+	GetUser(ctx context.Context, name string) (AdminUser, error)
+	PutUser(ctx context.Context, u AdminUser) (AdminUser, error)
+}
+
+// newCredentialStoreFromConfig: DynamoDB when ADMIN_CREDENTIALS_TABLE is set,
+// a local JSON file when ADMIN_CREDENTIALS_FILE is. Neither means no admin area.
+func newCredentialStoreFromConfig(ctx context.Context, cfg appconfig.Config) (CredentialStore, error) {
+	if cfg.AdminCredentialsTable != "" {
+		aws, err := loadAWSConfig(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &DynamoCredentialStore{Client: dynamodb.NewFromConfig(aws), Table: cfg.AdminCredentialsTable}, nil
+	}
+	if cfg.AdminCredentialsFile != "" {
+		return OpenFileCredentialStore(cfg.AdminCredentialsFile)
+	}
+	return nil, nil
+}
+
+// --- FILE ---
+
+// FileCredentialStore: Every user in one JSON file, rewritten atomically on
+// each change. For local development and single-instance hosting.
+type FileCredentialStore struct {
+	mu    sync.Mutex
+	path  string
+	users map[string]AdminUser
+}
+
+func OpenFileCredentialStore(path string) (*FileCredentialStore, error) {
+	s := &FileCredentialStore{path: path, users: map[string]AdminUser{}}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.users); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *FileCredentialStore) GetUser(ctx context.Context, name string) (AdminUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[name]
+	if !ok {
+		return AdminUser{}, ErrAdminNotFound
+	}
+	return u, nil
+}
+
+func (s *FileCredentialStore) PutUser(ctx context.Context, u AdminUser) (AdminUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.users[u.Name].Version != u.Version {
+		return AdminUser{}, ErrCredentialConflict
+	}
+	u.Version++
+	prev, existed := s.users[u.Name]
+	s.users[u.Name] = u
+	if err := s.flush(); err != nil {
+		if existed {
+			s.users[u.Name] = prev
+		} else {
+			delete(s.users, u.Name)
+		}
+		return AdminUser{}, err
+	}
+	return u, nil
+}
+
+// flush writes a temp file and renames it over the old one. The file holds
+// TOTP secrets, so it is readable by the owner only.
+func (s *FileCredentialStore) flush() error {
+	b, err := json.MarshalIndent(s.users, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
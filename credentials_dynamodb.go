@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoCredentialStore: One item per admin, keyed by "name". The user is
+// kept as a JSON document beside a numeric "version" for conditional writes.
+type DynamoCredentialStore struct {
+	Client *dynamodb.Client
+	Table  string
+}
+
+func (s *DynamoCredentialStore) GetUser(ctx context.Context, name string) (AdminUser, error) {
+	out, err := s.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.Table),
+		Key:            map[string]types.AttributeValue{"name": &types.AttributeValueMemberS{Value: name}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return AdminUser{}, err
+	}
+	data, ok := out.Item["data"].(*types.AttributeValueMemberS)
+	if !ok {
+		return AdminUser{}, ErrAdminNotFound
+	}
+	var u AdminUser
+	if err := json.Unmarshal([]byte(data.Value), &u); err != nil {
+		return AdminUser{}, err
+	}
+	return u, nil
+}
+
+func (s *DynamoCredentialStore) PutUser(ctx context.Context, u AdminUser) (AdminUser, error) {
+	expected := u.Version
+	u.Version++
+	b, err := json.Marshal(u)
+	if err != nil {
+		return AdminUser{}, err
+	}
+
+	in := &dynamodb.PutItemInput{
+		TableName: aws.String(s.Table),
+		Item: map[string]types.AttributeValue{
+			"name":    &types.AttributeValueMemberS{Value: u.Name},
+			"data":    &types.AttributeValueMemberS{Value: string(b)},
+			"version": &types.AttributeValueMemberN{Value: strconv.Itoa(u.Version)},
+		},
+		ExpressionAttributeNames: map[string]string{"#n": "name"},
+		ConditionExpression:      aws.String("attribute_not_exists(#n)"),
+	}
+	if expected > 0 {
+		in.ConditionExpression = aws.String("version = :v")
+		in.ExpressionAttributeNames = nil
+		in.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":v": &types.AttributeValueMemberN{Value: strconv.Itoa(expected)},
+		}
+	}
+
+	_, err = s.Client.PutItem(ctx, in)
+	var cfe *types.ConditionalCheckFailedException
+	if errors.As(err, &cfe) {
+		return AdminUser{}, ErrCredentialConflict
+	}
+	if err != nil {
+		return AdminUser{}, err
+	}
+	return u, nil
+}
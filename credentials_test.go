@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileCredentialStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "admin", "users.json")
+	store, err := OpenFileCredentialStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 1. New users start at version 1; a stale write is refused
+	u, err := store.PutUser(ctx, AdminUser{Name: "joe", Role: RoleOwner, TOTPSecret: "SECRET"})
+	if err != nil || u.Version != 1 {
+		t.Fatalf("Create: %+v, %v", u, err)
+	}
+	if _, err := store.PutUser(ctx, AdminUser{Name: "joe", Role: RoleViewer}); !errors.Is(err, ErrCredentialConflict) {
+		t.Errorf("Recreate got %v, want a conflict", err)
+	}
+	u.Epoch++
+	if u, err = store.PutUser(ctx, u); err != nil || u.Version != 2 {
+		t.Fatalf("Update: %+v, %v", u, err)
+	}
+	stale := u
+	stale.Version = 1
+	if _, err := store.PutUser(ctx, stale); !errors.Is(err, ErrCredentialConflict) {
+		t.Errorf("Stale update got %v, want a conflict", err)
+	}
+
+	// 2. Survives a reopen, owner-readable only
+	reopened, err := OpenFileCredentialStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := reopened.GetUser(ctx, "joe"); err != nil || got.Epoch != 1 || got.TOTPSecret != "SECRET" {
+		t.Errorf("Reopened: %+v, %v", got, err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("File mode = %v, want 0600", info.Mode().Perm())
+	}
+	if _, err := reopened.GetUser(ctx, "nobody"); !errors.Is(err, ErrAdminNotFound) {
+		t.Errorf("Unknown user got %v", err)
+	}
+}
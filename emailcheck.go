@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"stackfoundry.co.uk/components"
+)
+
+// defaultDisposableDomains is the list shipped with the binary. Update it
+// with `disposable refresh` and rebuild.
+//
+//go:embed disposable_domains.txt
+var defaultDisposableDomains []byte
+
+var disposableDomains = mustDomainSet(defaultDisposableDomains)
+
+// roleLocalParts are shared inboxes rather than a person
+var roleLocalParts = map[string]bool{
+	"abuse": true, "accounts": true, "admin": true, "billing": true, "careers": true,
+	"contact": true, "enquiries": true, "hello": true, "help": true, "hostmaster": true,
+	"info": true, "inquiries": true, "jobs": true, "marketing": true, "no-reply": true,
+	"noreply": true, "office": true, "postmaster": true, "press": true, "sales": true,
+	"security": true, "support": true, "team": true, "webmaster": true,
+}
+
+// freemailDomains are checked for near-misses. Short ones such as me.com are
+// left out: one edit from them is another real domain too often.
+var freemailDomains = []string{
+	"btinternet.com", "email.com", "fastmail.com", "gmail.com", "googlemail.com",
+	"hotmail.co.uk", "hotmail.com", "icloud.com", "live.co.uk", "live.com",
+	"mail.com", "outlook.com", "proton.me", "protonmail.com", "virginmedia.com",
+	"yahoo.co.uk", "yahoo.com", "ymail.com",
+}
+
+// EmailScreening: What offline checks found wrong with an otherwise valid
+// address. It never blocks a submission; it warns the visitor and flags the
+// notification.
+type EmailScreening struct {
+	Disposable bool   `json:"disposable,omitempty"`
+	Role       bool   `json:"role,omitempty"`
+	Suggestion string `json:"suggestion,omitempty"` // the address they probably meant
+}
+
+// Flagged reports whether any check fired
+func (s EmailScreening) Flagged() bool {
+	return s.Disposable || s.Role || s.Suggestion != ""
+}
+
+// Flags lists the findings for the team, most serious first
+func (s EmailScreening) Flags() []string {
+	var out []string
+	if s.Suggestion != "" {
+		out = append(out, "Possible typo, did they mean "+s.Suggestion+"?")
+	}
+	if s.Disposable {
+		out = append(out, "Disposable address")
+	}
+	if s.Role {
+		out = append(out, "Shared role address")
+	}
+	return out
+}
+
+// Warning is the soft warning shown under the form's email field
+func (s EmailScreening) Warning() string {
+	switch {
+	case s.Suggestion != "":
+		return "Did you mean " + s.Suggestion + "? Replies to a mistyped address never arrive."
+	case s.Disposable:
+		return "This looks like a throwaway address. We may not be able to reply once it expires."
+	case s.Role:
+		return "Shared inboxes are fine, but replies can sit unread. A personal address reaches you faster."
+	}
+	return ""
+}
+
+// screenEmail runs the offline checks on a syntactically valid address.
+// Invalid addresses come back unflagged; validation reports those.
+func screenEmail(addr string) EmailScreening {
+	local, domain, ok := splitEmail(addr)
+	if !ok {
+		return EmailScreening{}
+	}
+	domain = strings.ToLower(domain)
+	tag, _, _ := strings.Cut(strings.ToLower(local), "+")
+
+	s := EmailScreening{
+		Disposable: isDisposable(domain),
+		Role:       roleLocalParts[tag],
+	}
+	if !s.Disposable {
+		if d := nearestFreemail(domain); d != "" {
+			s.Suggestion = local + "@" + d
+		}
+	}
+	return s
+}
+
+// isDisposable matches the domain or any parent of it
+func isDisposable(domain string) bool {
+	for d := domain; d != ""; {
+		if disposableDomains[d] {
+			return true
+		}
+		_, d, _ = strings.Cut(d, ".")
+	}
+	return false
+}
+
+// nearestFreemail returns the well-known domain one edit (or, for long
+// domains, two) away from domain, or "" if domain is one or none is close
+func nearestFreemail(domain string) string {
+	if slices.Contains(freemailDomains, domain) {
+		return ""
+	}
+	for _, d := range freemailDomains {
+		limit := 1
+		if len(d) >= 12 {
+			limit = 2
+		}
+		if editDistance(domain, d) <= limit {
+			return d
+		}
+	}
+	return ""
+}
+
+// editDistance is the optimal string alignment distance: insertions,
+// deletions, substitutions and swaps of neighbours each cost one
+func editDistance(a, b string) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+// handleEmailCheck returns the hint under the contact form's email field.
+// Bad syntax gets no hint here; the form's own validation reports it.
+func handleEmailCheck(w http.ResponseWriter, r *http.Request) {
+	email := strings.TrimSpace(r.URL.Query().Get("email"))
+	if len(email) > components.MaxEmailLength {
+		email = ""
+	}
+	RenderHTML(w, r, components.EmailHint(screenEmail(email).Warning()))
+}
+
+// --- SYNTAX ---
+
+// validEmail checks an address we can actually send to: an RFC 5322
+// dot-atom local part at a hostname, within RFC 5321's length limits. SES
+// takes only 7-bit addresses, so quoted local parts, address literals and
+// UTF-8 are refused; an internationalised domain can be typed as xn--.
+func validEmail(addr string) bool {
+	_, _, ok := splitEmail(addr)
+	return ok
+}
+
+// splitEmail splits at the last "@", which is the only one a valid address has
+func splitEmail(addr string) (local, domain string, ok bool) {
+	if len(addr) > 254 {
+		return "", "", false
+	}
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 {
+		return "", "", false
+	}
+	local, domain = addr[:i], addr[i+1:]
+	if len(local) == 0 || len(local) > 64 || !validDotAtom(local) || !validDomain(domain) {
+		return "", "", false
+	}
+	return local, domain, true
+}
+
+// atext is RFC 5322 section 3.2.3
+func isAtext(r rune) bool {
+	return 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' ||
+		strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", r)
+}
+
+func validDotAtom(s string) bool {
+	for part := range strings.SplitSeq(s, ".") {
+		if part == "" || strings.IndexFunc(part, func(r rune) bool { return !isAtext(r) }) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// validDomain accepts a hostname of at least two labels whose top label is
+// not numeric. Labels are letters, digits and inner hyphens.
+func validDomain(s string) bool {
+	if len(s) > 253 {
+		return false
+	}
+	labels := strings.Split(s, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, l := range labels {
+		if l == "" || len(l) > 63 || l[0] == '-' || l[len(l)-1] == '-' {
+			return false
+		}
+		for _, r := range l {
+			if !(r == '-' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9') {
+				return false
+			}
+		}
+	}
+	top := labels[len(labels)-1]
+	return strings.IndexFunc(top, func(r rune) bool { return r < '0' || r > '9' }) >= 0
+}
+
+// --- DISPOSABLE LIST ---
+
+// parseDomainList reads one domain per line, ignoring blanks and # comments.
+// Entries may be written as "*.example.com" or "@example.com".
+func parseDomainList(data []byte) ([]string, error) {
+	var out []string
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		line = strings.ToLower(strings.TrimSpace(line))
+		line = strings.TrimPrefix(strings.TrimPrefix(line, "*."), "@")
+		if line == "" {
+			continue
+		}
+		if !validDomain(line) {
+			return nil, fmt.Errorf("line %d: %q is not a domain", n, line)
+		}
+		out = append(out, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	slices.Sort(out)
+	return slices.Compact(out), nil
+}
+
+func mustDomainSet(data []byte) map[string]bool {
+	domains, err := parseDomainList(data)
+	if err != nil {
+		panic("disposable_domains.txt: " + err.Error())
+	}
+	set := make(map[string]bool, len(domains))
+	for _, d := range domains {
+		set[d] = true
+	}
+	return set
+}
+
+// runDisposable rewrites the embedded list from a local file, for example a
+// download of a community-maintained list. Rebuild to ship it.
+func runDisposable(args []string) error {
+	if len(args) == 0 || args[0] != "refresh" {
+		return errors.New("usage: disposable refresh -from FILE [-out disposable_domains.txt]")
+	}
+	fs := flag.NewFlagSet("disposable refresh", flag.ContinueOnError)
+	from := fs.String("from", "", "domain list to import, one per line")
+	out := fs.String("out", "disposable_domains.txt", "file to write")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *from == "" {
+		return errors.New("-from is required")
+	}
+	data, err := os.ReadFile(*from)
+	if err != nil {
+		return err
+	}
+	domains, err := parseDomainList(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", *from, err)
+	}
+	if len(domains) == 0 {
+		return fmt.Errorf("%s: no domains", *from)
+	}
+
+	var added, removed int
+	for _, d := range domains {
+		if !disposableDomains[d] {
+			added++
+		}
+	}
+	removed = len(disposableDomains) - (len(domains) - added)
+
+	var b strings.Builder
+	b.WriteString("# Disposable email domains, one per line. Subdomains match too.\n")
+	b.WriteString("# Regenerate with: go run . disposable refresh -from FILE\n")
+	for _, d := range domains {
+		b.WriteString(d + "\n")
+	}
+	if err := os.WriteFile(*out, []byte(b.String()), 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %d domains to %s (%d added, %d removed); rebuild to embed them\n", len(domains), *out, added, removed)
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidEmail(t *testing.T) {
+	valid := []string{
+		"dev@example.com",
+		"first.last+tag@sub.example.co.uk",
+		"o'brien@example.ie",
+		"x@example.museum",
+		"jorg@xn--bcher-kva.de",
+		strings.Repeat("a", 64) + "@example.com",
+	}
+	invalid := []string{
+		"",
+		"plainaddress",
+		"@example.com",
+		"user@",
+		"user@localhost",
+		".user@example.com",
+		"user.@example.com",
+		"us..er@example.com",
+		"us er@example.com",
+		"user@exa mple.com",
+		"user@-example.com",
+		"user@example-.com",
+		"user@example..com",
+		"user@example.123",
+		`"unclosed@example.com`,
+		`"bad"quote"@example.com`,
+		`"john doe"@example.com`,
+		`"a@b"@example.com`,
+		"user@[192.0.2.1]",
+		"user@[IPv6:2001:db8::1]",
+		"jörg@example.de",
+		"jorg@bücher.de",
+		"<script>@example.com",
+		strings.Repeat("a", 65) + "@example.com",
+		"user@" + strings.Repeat("a", 64) + ".com",
+		"user@" + strings.Repeat("abcdefghi.", 25) + "com",
+	}
+	for _, addr := range valid {
+		if !validEmail(addr) {
+			t.Errorf("validEmail(%q) = false, want true", addr)
+		}
+	}
+	for _, addr := range invalid {
+		if validEmail(addr) {
+			t.Errorf("validEmail(%q) = true, want false", addr)
+		}
+	}
+}
+
+func TestScreenEmail(t *testing.T) {
+	tests := []struct {
+		addr string
+		want EmailScreening
+	}{
+		{"dev@example.com", EmailScreening{}},
+		{"dev@gmail.com", EmailScreening{}},
+		{"dev@mail.com", EmailScreening{}},
+		{"dev@gmial.com", EmailScreening{Suggestion: "dev@gmail.com"}},
+		{"Dev@GMAIL.CON", EmailScreening{Suggestion: "Dev@gmail.com"}},
+		{"dev@hotmail.co", EmailScreening{Suggestion: "dev@hotmail.com"}},
+		{"dev@protonmial.cm", EmailScreening{Suggestion: "dev@protonmail.com"}},
+		{"dev@mailinator.com", EmailScreening{Disposable: true}},
+		{"dev@eu.mailinator.com", EmailScreening{Disposable: true}},
+		{"dev@notmailinator.com", EmailScreening{}},
+		{"info@example.com", EmailScreening{Role: true}},
+		{"Sales+web@example.com", EmailScreening{Role: true}},
+		{"support@yopmail.com", EmailScreening{Disposable: true, Role: true}},
+		{"not an address", EmailScreening{}},
+	}
+	for _, tt := range tests {
+		if got := screenEmail(tt.addr); got != tt.want {
+			t.Errorf("screenEmail(%q) = %+v, want %+v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want int
+	}{
+		{"gmail.com", "gmail.com", 0},
+		{"gmial.com", "gmail.com", 1},
+		{"gmai.com", "gmail.com", 1},
+		{"gmaill.com", "gmail.com", 1},
+		{"gnail.com", "gmail.com", 1},
+		{"hotmail.co.uk", "hotmail.com", 3},
+	} {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestContactEmailScreening(t *testing.T) {
+	mailer := &MemoryMailer{}
+	store := NewMemoryStore()
+	router := testApp(App{Mailer: mailer, Store: store}).Handler()
+
+	// 1. The hint endpoint suggests a fix without blocking anything
+	req := httptest.NewRequest("GET", "/api/email-check?email=jo%40gmial.com", nil)
+	req.Header.Set("HX-Request", "true")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "Did you mean jo@gmail.com?") {
+		t.Errorf("Email check: status %d, body %s", rr.Code, rr.Body.String())
+	}
+
+	// 2. A re-rendered panel keeps the warning next to the field error it is not
+	form := newContactForm("jo@mailinator.com", "Hi", "")
+	rr = postForm(router, "/api/contact", form, true)
+	if rr.Code != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), "throwaway address") {
+		t.Errorf("Invalid submission: status %d, want 422 with the warning", rr.Code)
+	}
+
+	// 3. A flagged address still sends, and the notification says why it was flagged
+	rr = postForm(router, "/api/contact", newContactForm("jo@mailinator.com", "Hi", "Quick question."), true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Flagged submission: status %d", rr.Code)
+	}
+	sent := mailer.Sent()
+	if len(sent) != 1 || !strings.Contains(sent[0].Text, "! Disposable address") || !strings.Contains(sent[0].HTML, "Disposable address") {
+		t.Errorf("Notification missing the disposable flag: %+v", sent)
+	}
+	inqs, _ := store.List(t.Context())
+	if len(inqs) != 1 || inqs[0].Screening == nil || !inqs[0].Screening.Disposable {
+		t.Errorf("Screening not stored: %+v", inqs)
+	}
+
+	// 4. A clean address carries no flags
+	postForm(router, "/api/contact", newContactForm("jo@example.com", "Hi", "Quick question."), true)
+	if sent := mailer.Sent(); len(sent) != 2 || strings.Contains(sent[1].Text, "! ") {
+		t.Errorf("Clean address was flagged: %s", sent[len(sent)-1].Text)
+	}
+}
+
+func TestDisposableRefresh(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "list.txt")
+	out := filepath.Join(dir, "disposable_domains.txt")
+	os.WriteFile(in, []byte("# upstream list\nMailinator.com\n*.newthrowaway.io\n@another.example\n\nmailinator.com\n"), 0o644)
+
+	// 1. Entries are normalised, deduplicated and sorted
+	if err := runDisposable([]string{"refresh", "-from", in, "-out", out}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(out)
+	got, err := parseDomainList(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, ",") != "another.example,mailinator.com,newthrowaway.io" {
+		t.Errorf("Refreshed list is %v", got)
+	}
+
+	// 2. A malformed entry fails the refresh rather than shipping a broken list
+	os.WriteFile(in, []byte("fine.example\nnot a domain\n"), 0o644)
+	if err := runDisposable([]string{"refresh", "-from", in, "-out", out}); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Malformed list: err = %v", err)
+	}
+
+	// 3. The embedded list parses
+	if len(disposableDomains) == 0 {
+		t.Error("Embedded disposable list is empty")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Calendar methods (RFC 5546). A REQUEST with a higher SEQUENCE updates an
+// event already in the recipient's calendar; a CANCEL with the same UID removes it.
+const (
+	icsRequest = "REQUEST"
+	icsCancel  = "CANCEL"
+)
+
+const icsProdID = "-//StackFoundry//Discovery Calls//EN"
+
+// CalendarEvent: One meeting as an iTIP message
+type CalendarEvent struct {
+	Method      string
+	UID         string
+	Sequence    int
+	Start       time.Time
+	End         time.Time
+	Stamp       time.Time
+	Summary     string
+	Description string
+	URL         string
+	Organizer   string // email
+	Attendees   []string
+}
+
+// ICS renders the event as an RFC 5545 VCALENDAR: CRLF line endings, lines
+// folded at 75 octets, TEXT values escaped, times in UTC.
+func (e CalendarEvent) ICS() []byte {
+	var b strings.Builder
+	line := func(name, value string) { b.WriteString(foldICS(name + ":" + value)) }
+	utc := func(t time.Time) string { return t.UTC().Format("20060102T150405Z") }
+
+	status, partstat := "CONFIRMED", "ACCEPTED"
+	if e.Method == icsCancel {
+		status, partstat = "CANCELLED", "DECLINED"
+	}
+
+	line("BEGIN", "VCALENDAR")
+	line("VERSION", "2.0")
+	line("PRODID", icsProdID)
+	line("CALSCALE", "GREGORIAN")
+	line("METHOD", e.Method)
+	line("BEGIN", "VEVENT")
+	line("UID", e.UID)
+	line("SEQUENCE", fmt.Sprint(e.Sequence))
+	line("DTSTAMP", utc(e.Stamp))
+	line("DTSTART", utc(e.Start))
+	line("DTEND", utc(e.End))
+	line("SUMMARY", escapeICS(e.Summary))
+	if e.Description != "" {
+		line("DESCRIPTION", escapeICS(e.Description))
+	}
+	if e.URL != "" {
+		line("URL", e.URL)
+	}
+	line("STATUS", status)
+	line("TRANSP", "OPAQUE")
+	line("ORGANIZER;CN=StackFoundry", "mailto:"+e.Organizer)
+	for _, a := range e.Attendees {
+		line("ATTENDEE;ROLE=REQ-PARTICIPANT;PARTSTAT="+partstat+";RSVP=FALSE", "mailto:"+a)
+	}
+	line("END", "VEVENT")
+	line("END", "VCALENDAR")
+	return []byte(b.String())
+}
+
+// escapeICS escapes a TEXT value (RFC 5545 §3.3.11)
+func escapeICS(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`, "\r", `\n`).Replace(s)
+}
+
+// foldICS splits a content line into 75-octet pieces joined by CRLF and a
+// space, never inside a UTF-8 sequence (RFC 5545 §3.1)
+func foldICS(s string) string {
+	var b strings.Builder
+	limit := 75
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		b.WriteString(s[:cut] + "\r\n ")
+		s = s[cut:]
+		limit = 74 // the leading space counts
+	}
+	b.WriteString(s + "\r\n")
+	return b.String()
+}
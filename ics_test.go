@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestCalendarEventICS(t *testing.T) {
+	start := time.Date(2026, 10, 20, 9, 30, 0, 0, time.UTC)
+	event := CalendarEvent{
+		Method:      icsRequest,
+		UID:         "20261019T090000Z-1a2b3c4d@stackfoundry.co.uk",
+		Sequence:    2,
+		Start:       start,
+		End:         start.Add(30 * time.Minute),
+		Stamp:       start.Add(-24 * time.Hour),
+		Summary:     "Call; with, StackFoundry",
+		Description: "Line one\nReschedule or cancel: https://www.stackfoundry.co.uk/book/manage/20261019T090000Z-1a2b3c4d?sig=abcdefghijklmnopqrstuvwxyz",
+		Organizer:   testSender,
+		Attendees:   []string{"visitor@example.com"},
+	}
+	ics := string(event.ICS())
+
+	// 1. CRLF everywhere, nothing longer than 75 octets
+	if !strings.HasSuffix(ics, "\r\n") || strings.Contains(strings.ReplaceAll(ics, "\r\n", ""), "\n") {
+		t.Fatalf("lines must end in CRLF:\n%q", ics)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(ics, "\r\n"), "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("line is %d octets: %q", len(line), line)
+		}
+	}
+
+	// 2. Unfolded, the properties are intact and TEXT is escaped
+	unfolded := strings.ReplaceAll(ics, "\r\n ", "")
+	for _, want := range []string{
+		"METHOD:REQUEST\r\n",
+		"UID:20261019T090000Z-1a2b3c4d@stackfoundry.co.uk\r\n",
+		"SEQUENCE:2\r\n",
+		"DTSTART:20261020T093000Z\r\n",
+		"DTEND:20261020T100000Z\r\n",
+		"DTSTAMP:20261019T093000Z\r\n",
+		`SUMMARY:Call\; with\, StackFoundry` + "\r\n",
+		`DESCRIPTION:Line one\nReschedule or cancel: https://www.stackfoundry.co.uk/book/manage/`,
+		"STATUS:CONFIRMED\r\n",
+		"ORGANIZER;CN=StackFoundry:mailto:" + testSender + "\r\n",
+		"PARTSTAT=ACCEPTED;RSVP=FALSE:mailto:visitor@example.com\r\n",
+	} {
+		if !strings.Contains(unfolded, want) {
+			t.Errorf("missing %q in:\n%s", want, unfolded)
+		}
+	}
+
+	// 3. A cancellation is the same event, marked cancelled
+	event.Method = icsCancel
+	cancelled := string(event.ICS())
+	for _, want := range []string{"METHOD:CANCEL\r\n", "STATUS:CANCELLED\r\n", "PARTSTAT=DECLINED"} {
+		if !strings.Contains(cancelled, want) {
+			t.Errorf("cancel missing %q", want)
+		}
+	}
+}
+
+func TestFoldICSKeepsRunesWhole(t *testing.T) {
+	folded := foldICS("SUMMARY:" + strings.Repeat("é", 100))
+	for _, line := range strings.Split(strings.TrimSuffix(folded, "\r\n"), "\r\n") {
+		if len(line) > 75 || !utf8.ValidString(line) {
+			t.Errorf("bad fold %q", line)
+		}
+	}
+	if got := strings.ReplaceAll(folded, "\r\n ", ""); got != "SUMMARY:"+strings.Repeat("é", 100)+"\r\n" {
+		t.Errorf("unfolded = %q", got)
+	}
+}
+
+func TestMessageBytesKeepsAttachmentParams(t *testing.T) {
+	msg := Message{
+		From:    testSender,
+		To:      []string{"visitor@example.com"},
+		Subject: "Discovery call confirmed",
+		Text:    "See you then.",
+		Attachments: []Attachment{{
+			Filename:    "invite.ics",
+			ContentType: "text/calendar; charset=utf-8; method=REQUEST",
+			Data:        []byte("BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n"),
+		}},
+	}
+	raw, err := msg.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Content-Type: text/calendar; charset=utf-8; method=REQUEST; name=invite.ics"; !strings.Contains(string(raw), want) {
+		t.Errorf("missing %q in:\n%s", want, raw)
+	}
+}
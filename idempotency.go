@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	"stackfoundry.co.uk/appconfig"
+)
+
+// idempotencyWindow matches maxFormAge: after that the form token is
+// rejected anyway, so there is nothing left to deduplicate
+const idempotencyWindow = maxFormAge
+
+// pendingClaimTTL outlives any request (the Lambda timeout is 10s), so a
+// claim whose holder died neither committed nor released frees itself soon
+const pendingClaimTTL = 30 * time.Second
+
+// IdempotencyStore: Remembers which inquiry reference each rendered contact
+// form produced, so a double-click or an htmx retry gets the original answer
+// instead of a second email. A claim is pending until its holder commits it,
+// so a duplicate is only told the reference once the inquiry is safe. Keys
+// expire after the ttl they were last claimed or committed with.
+type IdempotencyStore interface {
+	// Get returns the reference recorded for key, or "" if there is none,
+	// and whether its holder has committed it
+	Get(ctx context.Context, key string) (ref string, committed bool, err error)
+	// Claim records ref for key as pending unless the key is already held,
+	// in which case it returns the holder's reference and records nothing
+	Claim(ctx context.Context, key, ref string, ttl time.Duration) (held string, committed bool, err error)
+	// Commit marks key's claim as done and keeps it for ttl
+	Commit(ctx context.Context, key string, ttl time.Duration) error
+	// Release forgets key, so a submission that failed can be retried with it
+	Release(ctx context.Context, key string) error
+}
+
+// newIdempotencyKey returns a random key for one rendering of the contact form
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return b64url.EncodeToString(b)
+}
+
+// validIdempotencyKey accepts only keys shaped like newIdempotencyKey's, so
+// arbitrary input never reaches the store
+func validIdempotencyKey(key string) bool {
+	b, err := b64url.DecodeString(key)
+	return err == nil && len(b) == 16
+}
+
+// recordedReference looks key up, treating a store failure as a miss so an
+// outage never blocks a genuine inquiry
+func (a *App) recordedReference(ctx context.Context, key string) (ref string, committed bool) {
+	if a.Keys == nil {
+		return "", false
+	}
+	ref, committed, err := a.Keys.Get(ctx, key)
+	if err != nil {
+		a.logger().Error("idempotency_failure", slog.Any("error", err))
+		return "", false
+	}
+	return ref, committed
+}
+
+// newIdempotencyStoreFromConfig uses the DynamoDB table named by
+// IDEMPOTENCY_TABLE, or memory. On Lambda, memory only catches duplicates
+// that land on the same warm instance.
+func newIdempotencyStoreFromConfig(ctx context.Context, cfg appconfig.Config) (IdempotencyStore, error) {
+	if cfg.IdempotencyTable == "" {
+		return NewMemoryIdempotencyStore(), nil
+	}
+	aws, err := loadAWSConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &DynamoIdempotencyStore{Client: dynamodb.NewFromConfig(aws), Table: cfg.IdempotencyTable}, nil
+}
+
+// MemoryIdempotencyStore: In-process store for local runs and tests
+type MemoryIdempotencyStore struct {
+	mu   sync.Mutex
+	keys map[string]idempotencyEntry
+	now  func() time.Time
+}
+
+type idempotencyEntry struct {
+	ref       string
+	committed bool
+	expires   time.Time
+}
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{keys: map[string]idempotencyEntry{}, now: time.Now}
+}
+
+func (s *MemoryIdempotencyStore) Get(ctx context.Context, key string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.keys[key]
+	if !ok || s.now().After(e.expires) {
+		return "", false, nil
+	}
+	return e.ref, e.committed, nil
+}
+
+func (s *MemoryIdempotencyStore) Claim(ctx context.Context, key, ref string, ttl time.Duration) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for k, e := range s.keys {
+		if now.After(e.expires) {
+			delete(s.keys, k)
+		}
+	}
+	if e, ok := s.keys[key]; ok {
+		return e.ref, e.committed, nil
+	}
+	s.keys[key] = idempotencyEntry{ref: ref, expires: now.Add(ttl)}
+	return "", false, nil
+}
+
+func (s *MemoryIdempotencyStore) Commit(ctx context.Context, key string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.keys[key]; ok {
+		e.committed, e.expires = true, s.now().Add(ttl)
+		s.keys[key] = e
+	}
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, key)
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoIdempotencyStore: One item per key, named "key", holding the
+// inquiry reference, a "committed" flag once its holder commits, and an
+// "expires" epoch the table's TTL deletes it by.
+// TTL deletion lags, so expiry is also checked on every read and claim.
+type DynamoIdempotencyStore struct {
+	Client *dynamodb.Client
+	Table  string
+}
+
+func (s *DynamoIdempotencyStore) Get(ctx context.Context, key string) (string, bool, error) {
+	out, err := s.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.Table),
+		Key:            idempotencyKey(key),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return "", false, err
+	}
+	ref, committed := liveIdempotencyRef(out.Item, time.Now())
+	return ref, committed, nil
+}
+
+func (s *DynamoIdempotencyStore) Claim(ctx context.Context, key, ref string, ttl time.Duration) (string, bool, error) {
+	now := time.Now()
+	item := idempotencyKey(key)
+	item["ref"] = &types.AttributeValueMemberS{Value: ref}
+	item["expires"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(ttl).Unix(), 10)}
+
+	_, err := s.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(s.Table),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(#k) OR expires < :now"),
+		ExpressionAttributeNames: map[string]string{
+			"#k": "key",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		held, committed := liveIdempotencyRef(ccf.Item, now)
+		return held, committed, nil
+	}
+	return "", false, err
+}
+
+// Commit only touches a key that still exists, so a claim that expired
+// meanwhile is not brought back half-written
+func (s *DynamoIdempotencyStore) Commit(ctx context.Context, key string, ttl time.Duration) error {
+	_, err := s.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(s.Table),
+		Key:                 idempotencyKey(key),
+		UpdateExpression:    aws.String("SET committed = :t, expires = :exp"),
+		ConditionExpression: aws.String("attribute_exists(#k)"),
+		ExpressionAttributeNames: map[string]string{
+			"#k": "key",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":t":   &types.AttributeValueMemberBOOL{Value: true},
+			":exp": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)},
+		},
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return nil
+	}
+	return err
+}
+
+func (s *DynamoIdempotencyStore) Release(ctx context.Context, key string) error {
+	_, err := s.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.Table),
+		Key:       idempotencyKey(key),
+	})
+	return err
+}
+
+func idempotencyKey(key string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{"key": &types.AttributeValueMemberS{Value: key}}
+}
+
+// liveIdempotencyRef returns the item's reference and whether it is
+// committed, unless it has expired
+func liveIdempotencyRef(item map[string]types.AttributeValue, now time.Time) (string, bool) {
+	ref, _ := item["ref"].(*types.AttributeValueMemberS)
+	exp, _ := item["expires"].(*types.AttributeValueMemberN)
+	if ref == nil || exp == nil {
+		return "", false
+	}
+	if n, err := strconv.ParseInt(exp.Value, 10, 64); err != nil || now.Unix() > n {
+		return "", false
+	}
+	committed, _ := item["committed"].(*types.AttributeValueMemberBOOL)
+	return ref.Value, committed != nil && committed.Value
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"stackfoundry.co.uk/components"
+)
+
+var referencePattern = regexp.MustCompile(`SF-[0-9A-F]{8}`)
+
+func TestContactIdempotency(t *testing.T) {
+	mailer := &MemoryMailer{}
+	keys := NewMemoryIdempotencyStore()
+	router := testApp(App{Mailer: mailer, Store: NewMemoryStore(), Keys: keys}).Handler()
+
+	form := newContactForm("test@example.com", "Twice", "Clicked the button twice.")
+	key := newIdempotencyKey()
+	form.Set(components.IdempotencyField, key)
+
+	// 1. The first submission is sent and its reference recorded
+	first := postForm(router, "/api/contact", form, true)
+	ref := referencePattern.FindString(first.Body.String())
+	if first.Code != http.StatusOK || ref == "" {
+		t.Fatalf("First submission: status %d: %s", first.Code, first.Body.String())
+	}
+
+	// 2. A repeat, even with its spent token and challenge, gets the same answer and sends nothing
+	second := postForm(router, "/api/contact", form, true)
+	if second.Code != http.StatusOK || referencePattern.FindString(second.Body.String()) != ref {
+		t.Errorf("Repeat got status %d, reference %q, want %q", second.Code, referencePattern.FindString(second.Body.String()), ref)
+	}
+	if n := len(mailer.Sent()); n != 1 {
+		t.Errorf("Sent %d emails, want 1", n)
+	}
+
+	// 3. Another form's key is a separate inquiry
+	other := newContactForm("test@example.com", "Twice", "Clicked the button twice.")
+	other.Set(components.IdempotencyField, newIdempotencyKey())
+	if rr := postForm(router, "/api/contact", other, true); referencePattern.FindString(rr.Body.String()) == ref {
+		t.Error("A different key was answered with the first reference")
+	}
+	if n := len(mailer.Sent()); n != 2 {
+		t.Errorf("Sent %d emails, want 2", n)
+	}
+}
+
+func TestContactIdempotencyConcurrent(t *testing.T) {
+	mailer := &MemoryMailer{}
+	router := testApp(App{Mailer: mailer, Store: NewMemoryStore(), Keys: NewMemoryIdempotencyStore()}).Handler()
+
+	// Each request solves its own challenge, as separate htmx retries would,
+	// so only the idempotency key ties them together
+	key := newIdempotencyKey()
+	token := testGuard.issueAt(time.Now().Add(-time.Minute))
+	refs := make([]string, 5)
+	var wg sync.WaitGroup
+	for i := range refs {
+		form := newContactForm("test@example.com", "Race", "Double click on a slow line.")
+		form.Set(components.FormTokenField, token)
+		form.Set(components.IdempotencyField, key)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rr := postForm(router, "/api/contact", form, true)
+			switch rr.Code {
+			case http.StatusOK:
+				refs[i] = referencePattern.FindString(rr.Body.String())
+			case http.StatusConflict:
+				// Still pending when it arrived; the visitor sends again
+			default:
+				t.Errorf("Concurrent repeat: status %d", rr.Code)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every repeat told a reference was told the same one, and a repeat
+	// after the race is too
+	form := newContactForm("test@example.com", "Race", "Double click on a slow line.")
+	form.Set(components.IdempotencyField, key)
+	want := referencePattern.FindString(postForm(router, "/api/contact", form, true).Body.String())
+	for _, ref := range refs {
+		if want == "" || ref != "" && ref != want {
+			t.Fatalf("Concurrent repeats got references %v, then %q, want one", refs, want)
+		}
+	}
+	if n := len(mailer.Sent()); n != 1 {
+		t.Errorf("Sent %d emails, want 1", n)
+	}
+}
+
+func TestContactIdempotencyPending(t *testing.T) {
+	mailer := &MemoryMailer{}
+	keys := NewMemoryIdempotencyStore()
+	router := testApp(App{Mailer: mailer, Store: NewMemoryStore(), Keys: keys}).Handler()
+
+	// A first request holds the key but has not committed yet
+	key := newIdempotencyKey()
+	keys.Claim(t.Context(), key, "SF-AAAAAAAA", pendingClaimTTL)
+	form := newContactForm("test@example.com", "Slow", "The first request is still sending.")
+	form.Set(components.IdempotencyField, key)
+
+	// 1. A repeat is not told success, and gets the key back to send again with
+	rr := postForm(router, "/api/contact", form, true)
+	if rr.Code != http.StatusConflict || referencePattern.MatchString(rr.Body.String()) || !strings.Contains(rr.Body.String(), `value="`+key+`"`) {
+		t.Fatalf("Pending repeat: status %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// 2. Once the first request commits, the repeat gets its reference
+	keys.Commit(t.Context(), key, idempotencyWindow)
+	retry := newContactForm("test@example.com", "Slow", "The first request is still sending.")
+	retry.Set(components.IdempotencyField, key)
+	if rr := postForm(router, "/api/contact", retry, true); rr.Code != http.StatusOK || referencePattern.FindString(rr.Body.String()) != "SF-AAAAAAAA" {
+		t.Errorf("Committed repeat: status %d, reference %q", rr.Code, referencePattern.FindString(rr.Body.String()))
+	}
+	if n := len(mailer.Sent()); n != 0 {
+		t.Errorf("Sent %d emails, want 0", n)
+	}
+}
+
+func TestContactIdempotencyRelease(t *testing.T) {
+	mailer := &MemoryMailer{Err: errors.New("ses down")}
+	keys := NewMemoryIdempotencyStore()
+	router := testApp(App{Mailer: mailer, Keys: keys}).Handler()
+
+	form := newContactForm("test@example.com", "Retry", "The relay was down.")
+	key := newIdempotencyKey()
+	form.Set(components.IdempotencyField, key)
+
+	// 1. A failed send keeps the key in the retry form but does not hold it
+	rr := postForm(router, "/api/contact", form, true)
+	if rr.Code != http.StatusBadGateway || !strings.Contains(rr.Body.String(), `value="`+key+`"`) {
+		t.Fatalf("Failed send: status %d", rr.Code)
+	}
+	if ref, _, _ := keys.Get(t.Context(), key); ref != "" {
+		t.Errorf("Key still held as %s after a failed send", ref)
+	}
+
+	// 2. The retry with the same key goes out
+	mailer.Err = nil
+	retry := newContactForm("test@example.com", "Retry", "The relay was down.")
+	retry.Set(components.IdempotencyField, key)
+	if rr := postForm(router, "/api/contact", retry, true); rr.Code != http.StatusOK || len(mailer.Sent()) != 1 {
+		t.Errorf("Retry: status %d, %d sent", rr.Code, len(mailer.Sent()))
+	}
+}
+
+func TestMemoryIdempotencyStoreExpiry(t *testing.T) {
+	now := time.Date(2026, 10, 17, 9, 0, 0, 0, time.UTC)
+	s := NewMemoryIdempotencyStore()
+	s.now = func() time.Time { return now }
+	ctx := t.Context()
+
+	// 1. Claim, then a second claim sees the holder, still pending
+	if held, _, _ := s.Claim(ctx, "k", "SF-AAAAAAAA", time.Minute); held != "" {
+		t.Fatalf("First claim held by %q", held)
+	}
+	if held, committed, _ := s.Claim(ctx, "k", "SF-BBBBBBBB", time.Hour); held != "SF-AAAAAAAA" || committed {
+		t.Errorf("Second claim got %q (committed %v), want the first holder, pending", held, committed)
+	}
+
+	// 2. Committing marks it done and keeps it for the longer ttl
+	s.Commit(ctx, "k", time.Hour)
+	now = now.Add(2 * time.Minute)
+	if ref, committed, _ := s.Get(ctx, "k"); ref != "SF-AAAAAAAA" || !committed {
+		t.Errorf("Committed key returns %q (committed %v)", ref, committed)
+	}
+
+	// 3. After the ttl the key is free again
+	now = now.Add(time.Hour)
+	if ref, _, _ := s.Get(ctx, "k"); ref != "" {
+		t.Errorf("Expired key still returns %q", ref)
+	}
+	if held, _, _ := s.Claim(ctx, "k", "SF-CCCCCCCC", time.Hour); held != "" {
+		t.Errorf("Claim after expiry held by %q", held)
+	}
+}
+
+func TestValidIdempotencyKey(t *testing.T) {
+	if !validIdempotencyKey(newIdempotencyKey()) {
+		t.Error("Generated key rejected")
+	}
+	for _, key := range []string{"", "short", strings.Repeat("A", 64), "!!!!!!!!!!!!!!!!!!!!!!"} {
+		if validIdempotencyKey(key) {
+			t.Errorf("Accepted %q", key)
+		}
+	}
+}
@@ -1,11 +1,12 @@
 module infra
 
-go 1.23.0
+go 1.25.6
 
 require (
 	github.com/aws/aws-cdk-go/awscdk/v2 v2.235.1
 	github.com/aws/constructs-go/constructs/v10 v10.4.4
 	github.com/aws/jsii-runtime-go v1.125.0
+	stackfoundry.co.uk v0.0.0
 )
 
 require (
@@ -23,3 +24,5 @@ require (
 	golang.org/x/sys v0.35.0 // indirect
 	golang.org/x/tools v0.36.0 // indirect
 )
+
+replace stackfoundry.co.uk => ../
@@ -2,35 +2,50 @@ package main
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/aws/aws-cdk-go/awscdk/v2"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsapigatewayv2"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsapigatewayv2integrations"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsbudgets"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awscertificatemanager"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsdynamodb"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsevents"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awseventstargets"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awslogs"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsroute53"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsroute53targets"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssecretsmanager"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsses"
 	"github.com/aws/constructs-go/constructs/v10"
 	"github.com/aws/jsii-runtime-go"
+
+	"stackfoundry.co.uk/appconfig"
 )
 
+// StackFoundryWebsiteStackProps: Config is the app's own configuration; the
+// stack takes its domain, addresses and region from it, and passes the
+// settings the function needs on as its environment. Unset means defaults.
 type StackFoundryWebsiteStackProps struct {
 	awscdk.StackProps
+	Config *appconfig.Config
 }
 
 func NewStackFoundryWebsiteStack(scope constructs.Construct, id string, props *StackFoundryWebsiteStackProps) awscdk.Stack {
 	var sprops awscdk.StackProps
+	cfg := appconfig.Defaults()
 	if props != nil {
 		sprops = props.StackProps
+		if props.Config != nil {
+			cfg = *props.Config
+		}
 	}
 	stack := awscdk.NewStack(scope, &id, &sprops)
 
 	// 1. DOMAIN & DNS
-	domainNameStr := "stackfoundry.co.uk"
+	domainNameStr := cfg.Domain
 	wwwDomainNameStr := "www." + domainNameStr
 
 	zone := awsroute53.NewHostedZone(stack, jsii.String("HostedZone"), &awsroute53.HostedZoneProps{
@@ -81,7 +96,7 @@ func NewStackFoundryWebsiteStack(scope constructs.Construct, id string, props *S
 		Zone:       zone,
 		RecordName: jsii.String("_dmarc"),
 		Values: jsii.Strings(
-			"v=DMARC1; p=reject; adkim=r; aspf=r; rua=mailto:dmarc_rua@onsecureserver.net;",
+			"v=DMARC1; p=reject; adkim=r; aspf=r; rua=mailto:" + cfg.DMARCReportEmail + ";",
 		),
 		Ttl: awscdk.Duration_Minutes(jsii.Number(60)),
 	})
@@ -106,7 +121,99 @@ func NewStackFoundryWebsiteStack(scope constructs.Construct, id string, props *S
 		Certificate: cert,
 	})
 
-	// 4. LAMBDA FUNCTION
+	// 4. INQUIRY STORE (DynamoDB)
+	// Every contact submission is saved here before SES is attempted; the
+	// status index lets the outbox find undelivered inquiries.
+	inquiries := awsdynamodb.NewTable(stack, jsii.String("Inquiries"), &awsdynamodb.TableProps{
+		PartitionKey: &awsdynamodb.Attribute{Name: jsii.String("id"), Type: awsdynamodb.AttributeType_STRING},
+		BillingMode:  awsdynamodb.BillingMode_PAY_PER_REQUEST,
+		PointInTimeRecoverySpecification: &awsdynamodb.PointInTimeRecoverySpecification{
+			PointInTimeRecoveryEnabled: jsii.Bool(true),
+		},
+		RemovalPolicy: awscdk.RemovalPolicy_RETAIN,
+	})
+	inquiries.AddGlobalSecondaryIndex(&awsdynamodb.GlobalSecondaryIndexProps{
+		IndexName:    jsii.String("status-index"),
+		PartitionKey: &awsdynamodb.Attribute{Name: jsii.String("status"), Type: awsdynamodb.AttributeType_STRING},
+		SortKey:      &awsdynamodb.Attribute{Name: jsii.String("updated_at"), Type: awsdynamodb.AttributeType_STRING},
+	})
+
+	// 4a. FORM SIGNING KEY
+	// Signs the contact form's render timestamp. Shared by every Lambda
+	// instance, so a form rendered by one can be submitted to another.
+	formKey := awssecretsmanager.NewSecret(stack, jsii.String("FormSigningKey"), &awssecretsmanager.SecretProps{
+		GenerateSecretString: &awssecretsmanager.SecretStringGenerator{
+			PasswordLength:     jsii.Number(64),
+			ExcludePunctuation: jsii.Bool(true),
+		},
+	})
+
+	// 4b. ADMIN CREDENTIALS
+	// Passkeys, TOTP secrets and recovery code hashes for /admin, one item per
+	// admin. The session key signs admin cookies across Lambda instances.
+	adminCredentials := awsdynamodb.NewTable(stack, jsii.String("AdminCredentials"), &awsdynamodb.TableProps{
+		PartitionKey: &awsdynamodb.Attribute{Name: jsii.String("name"), Type: awsdynamodb.AttributeType_STRING},
+		BillingMode:  awsdynamodb.BillingMode_PAY_PER_REQUEST,
+		PointInTimeRecoverySpecification: &awsdynamodb.PointInTimeRecoverySpecification{
+			PointInTimeRecoveryEnabled: jsii.Bool(true),
+		},
+		RemovalPolicy: awscdk.RemovalPolicy_RETAIN,
+	})
+	adminSessionKey := awssecretsmanager.NewSecret(stack, jsii.String("AdminSessionKey"), &awssecretsmanager.SecretProps{
+		GenerateSecretString: &awssecretsmanager.SecretStringGenerator{
+			PasswordLength:     jsii.Number(64),
+			ExcludePunctuation: jsii.Bool(true),
+		},
+	})
+
+	// 4c. BOOKINGS
+	// Discovery calls and the slots they hold. Slot items carry an "expires"
+	// TTL so past slots clear themselves.
+	bookings := awsdynamodb.NewTable(stack, jsii.String("Bookings"), &awsdynamodb.TableProps{
+		PartitionKey:        &awsdynamodb.Attribute{Name: jsii.String("pk"), Type: awsdynamodb.AttributeType_STRING},
+		SortKey:             &awsdynamodb.Attribute{Name: jsii.String("sk"), Type: awsdynamodb.AttributeType_STRING},
+		BillingMode:         awsdynamodb.BillingMode_PAY_PER_REQUEST,
+		TimeToLiveAttribute: jsii.String("expires"),
+		PointInTimeRecoverySpecification: &awsdynamodb.PointInTimeRecoverySpecification{
+			PointInTimeRecoveryEnabled: jsii.Bool(true),
+		},
+		RemovalPolicy: awscdk.RemovalPolicy_RETAIN,
+	})
+
+	// 4d. IDEMPOTENCY KEYS
+	// One item per accepted contact form, so repeats are answered without
+	// sending again. TTL clears them after a day.
+	idempotency := awsdynamodb.NewTable(stack, jsii.String("IdempotencyKeys"), &awsdynamodb.TableProps{
+		PartitionKey:        &awsdynamodb.Attribute{Name: jsii.String("key"), Type: awsdynamodb.AttributeType_STRING},
+		BillingMode:         awsdynamodb.BillingMode_PAY_PER_REQUEST,
+		TimeToLiveAttribute: jsii.String("expires"),
+		RemovalPolicy:       awscdk.RemovalPolicy_DESTROY,
+	})
+
+	// 4e. DATA-SUBJECT AUDIT LOG
+	// Every access and erasure request, keyed by a hash of the address. Kept
+	// when the stack is deleted: it is the record that requests were honoured.
+	subjectAudit := awsdynamodb.NewTable(stack, jsii.String("SubjectAudit"), &awsdynamodb.TableProps{
+		PartitionKey: &awsdynamodb.Attribute{Name: jsii.String("subject"), Type: awsdynamodb.AttributeType_STRING},
+		SortKey:      &awsdynamodb.Attribute{Name: jsii.String("id"), Type: awsdynamodb.AttributeType_STRING},
+		BillingMode:  awsdynamodb.BillingMode_PAY_PER_REQUEST,
+		PointInTimeRecoverySpecification: &awsdynamodb.PointInTimeRecoverySpecification{
+			PointInTimeRecoveryEnabled: jsii.Bool(true),
+		},
+		RemovalPolicy: awscdk.RemovalPolicy_RETAIN,
+	})
+
+	// Keys the address hashes in the audit log. It must never change, or
+	// old entries stop matching, so it is kept with the table.
+	auditKey := awssecretsmanager.NewSecret(stack, jsii.String("AuditKey"), &awssecretsmanager.SecretProps{
+		GenerateSecretString: &awssecretsmanager.SecretStringGenerator{
+			PasswordLength:     jsii.Number(64),
+			ExcludePunctuation: jsii.Bool(true),
+		},
+		RemovalPolicy: awscdk.RemovalPolicy_RETAIN,
+	})
+
+	// 5. LAMBDA FUNCTION
 	logGroup := awslogs.NewLogGroup(stack, jsii.String("AppLogs"), &awslogs.LogGroupProps{
 		Retention:     awslogs.RetentionDays_ONE_WEEK,
 		RemovalPolicy: awscdk.RemovalPolicy_DESTROY,
@@ -118,20 +225,63 @@ func NewStackFoundryWebsiteStack(scope constructs.Construct, id string, props *S
 		Handler:      jsii.String("bootstrap"),
 		Code:         awslambda.Code_FromAsset(jsii.String("../dist"), nil),
 		MemorySize:   jsii.Number(128),
-		Timeout:      awscdk.Duration_Seconds(jsii.Number(5)),
+		Timeout:      awscdk.Duration_Seconds(jsii.Number(10)),
 		Environment: &map[string]*string{
-			"GIN_MODE": jsii.String("release"),
+			"GIN_MODE":      jsii.String("release"),
+			"DOMAIN":        jsii.String(cfg.Domain),
+			"SENDER_EMAIL":  jsii.String(cfg.SenderEmail),
+			"REGION":        jsii.String(cfg.Region),
+			"INQUIRY_TABLE": inquiries.TableName(),
+			// Only the ARNs: the app reads the keys at cold start, so their
+			// values are in neither the template nor the function's settings
+			"SPAM_SIGNING_KEY_ARN":  formKey.SecretArn(),
+			"ADMIN_SESSION_KEY_ARN": adminSessionKey.SecretArn(),
+			// Passkeys are bound to the apex domain so they work on www too
+			"ADMIN_CREDENTIALS_TABLE": adminCredentials.TableName(),
+			"ADMIN_RP_ID":             jsii.String(domainNameStr),
+			"ADMIN_ORIGINS":           jsii.String("https://" + domainNameStr + ",https://" + wwwDomainNameStr),
+			// Manage links in booking emails point at the canonical host
+			"BOOKING_TABLE":     bookings.TableName(),
+			"BOOKING_BASE_URL":  jsii.String("https://" + wwwDomainNameStr),
+			"IDEMPOTENCY_TABLE": idempotency.TableName(),
+			// Access links in data request emails, like booking links
+			"SUBJECT_AUDIT_TABLE": subjectAudit.TableName(),
+			"AUDIT_KEY_ARN":       auditKey.SecretArn(),
+			"PRIVACY_BASE_URL":    jsii.String("https://" + wwwDomainNameStr),
 		},
 		LogGroup: logGroup,
 	})
 
-	// 5. PERMISSIONS (SES)
+	// 6. PERMISSIONS (SES + DynamoDB + the three keys)
 	fn.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
 		Actions:   jsii.Strings("ses:SendEmail", "ses:SendRawEmail"),
 		Resources: jsii.Strings("*"),
 	}))
+	inquiries.GrantReadWriteData(fn)
+	adminCredentials.GrantReadWriteData(fn)
+	bookings.GrantReadWriteData(fn)
+	idempotency.GrantReadWriteData(fn)
+	subjectAudit.GrantReadWriteData(fn)
+	formKey.GrantRead(fn, nil)
+	adminSessionKey.GrantRead(fn, nil)
+	auditKey.GrantRead(fn, nil)
+
+	// Daily retention purge, handled by the same function
+	awsevents.NewRule(stack, jsii.String("RetentionPurge"), &awsevents.RuleProps{
+		Schedule: awsevents.Schedule_Cron(&awsevents.CronOptions{Hour: jsii.String("3"), Minute: jsii.String("15")}),
+		Targets:  &[]awsevents.IRuleTarget{awseventstargets.NewLambdaFunction(fn, nil)},
+	})
+
+	// Outbox retries. The in-process dispatcher only runs while an instance
+	// is warm, so failed notifications are also drained on a schedule.
+	awsevents.NewRule(stack, jsii.String("OutboxDrain"), &awsevents.RuleProps{
+		Schedule: awsevents.Schedule_Rate(awscdk.Duration_Minutes(jsii.Number(5))),
+		Targets: &[]awsevents.IRuleTarget{awseventstargets.NewLambdaFunction(fn, &awseventstargets.LambdaFunctionProps{
+			Event: awsevents.RuleTargetInput_FromObject(map[string]interface{}{"task": "outbox-drain"}),
+		})},
+	})
 
-	// 6. API GATEWAY (HTTP API)
+	// 7. API GATEWAY (HTTP API)
 	api := awsapigatewayv2.NewHttpApi(stack, jsii.String("StackFoundryAPI"), &awsapigatewayv2.HttpApiProps{
 		DefaultIntegration: awsapigatewayv2integrations.NewHttpLambdaIntegration(
 			jsii.String("LambdaIntegration"),
@@ -152,7 +302,7 @@ func NewStackFoundryWebsiteStack(scope constructs.Construct, id string, props *S
 		DomainName: dnWww,
 	})
 
-	// 7. RATE LIMITING
+	// 8. RATE LIMITING
 	if api.DefaultStage() != nil && api.DefaultStage().Node() != nil && api.DefaultStage().Node().DefaultChild() != nil {
 		cfnStage := api.DefaultStage().Node().DefaultChild().(awsapigatewayv2.CfnStage)
 		cfnStage.SetDefaultRouteSettings(&awsapigatewayv2.CfnStage_RouteSettingsProperty{
@@ -161,7 +311,7 @@ func NewStackFoundryWebsiteStack(scope constructs.Construct, id string, props *S
 		})
 	}
 
-	// 8. BILLING ALARM
+	// 9. BILLING ALARM
 	awsbudgets.NewCfnBudget(stack, jsii.String("LowCostBudget"), &awsbudgets.CfnBudgetProps{
 		Budget: &awsbudgets.CfnBudget_BudgetDataProperty{
 			BudgetType: jsii.String("COST"),
@@ -181,14 +331,14 @@ func NewStackFoundryWebsiteStack(scope constructs.Construct, id string, props *S
 				Subscribers: []interface{}{
 					&awsbudgets.CfnBudget_SubscriberProperty{
 						SubscriptionType: jsii.String("EMAIL"),
-						Address:          jsii.String("joe@stackfoundry.co.uk"),
+						Address:          jsii.String(cfg.BudgetAlertEmail),
 					},
 				},
 			},
 		},
 	})
 
-	// 9. DNS RECORDS
+	// 10. DNS RECORDS
 	// Root A-Record
 	awsroute53.NewARecord(stack, jsii.String("AliasRecord"), &awsroute53.ARecordProps{
 		Zone: zone,
@@ -240,15 +390,26 @@ func main() {
 
 	stackName := "StackFoundryWebsite-" + stageStr
 
+	// The same CONFIG_FILE and variables the app reads
+	cfg, err := appconfig.Load(nil, os.Environ())
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	NewStackFoundryWebsiteStack(app, stackName, &StackFoundryWebsiteStackProps{
-		awscdk.StackProps{
+		StackProps: awscdk.StackProps{
 			Env: &awscdk.Environment{
-				Region: jsii.String("eu-west-2"),
+				Region: jsii.String(cfg.Region),
 			},
 			Tags: &map[string]*string{
 				"Environment": jsii.String(stageStr),
 			},
 		},
+		Config: &cfg,
 	})
 
 	app.Synth(nil)
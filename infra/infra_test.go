@@ -6,6 +6,8 @@ import (
 	"github.com/aws/aws-cdk-go/awscdk/v2"
 	"github.com/aws/aws-cdk-go/awscdk/v2/assertions"
 	"github.com/aws/jsii-runtime-go"
+
+	"stackfoundry.co.uk/appconfig"
 )
 
 func TestStackFoundryWebsiteStack(t *testing.T) {
@@ -14,7 +16,7 @@ func TestStackFoundryWebsiteStack(t *testing.T) {
 
 	// WHEN
 	stack := NewStackFoundryWebsiteStack(app, "MyTestStack", &StackFoundryWebsiteStackProps{
-		awscdk.StackProps{
+		StackProps: awscdk.StackProps{
 			Env: &awscdk.Environment{
 				Region: jsii.String("eu-west-2"),
 			},
@@ -29,7 +31,7 @@ func TestStackFoundryWebsiteStack(t *testing.T) {
 		"Runtime":    "provided.al2023",
 		"Handler":    "bootstrap",
 		"MemorySize": 128,
-		"Timeout":    5,
+		"Timeout":    10,
 		"Architectures": []interface{}{
 			"arm64",
 		},
@@ -92,7 +94,99 @@ func TestStackFoundryWebsiteStack(t *testing.T) {
 		// We can broadly check that we have TXT records configured
 	})
 
-	// 7. Verify Budget Alarm
+	// 7. Verify Inquiry Store, Admin Credentials, Bookings, Idempotency Keys, Subject Audit and Lambda wiring
+	template.HasResourceProperties(jsii.String("AWS::DynamoDB::Table"), map[string]interface{}{
+		"KeySchema": []interface{}{
+			map[string]interface{}{"AttributeName": "id", "KeyType": "HASH"},
+		},
+		"BillingMode": "PAY_PER_REQUEST",
+		"GlobalSecondaryIndexes": []interface{}{
+			assertions.Match_ObjectLike(&map[string]interface{}{"IndexName": "status-index"}),
+		},
+	})
+	template.HasResourceProperties(jsii.String("AWS::Lambda::Function"), map[string]interface{}{
+		"Environment": map[string]interface{}{
+			"Variables": assertions.Match_ObjectLike(&map[string]interface{}{
+				"SENDER_EMAIL":            "joe@stackfoundry.co.uk",
+				"REGION":                  "eu-west-2",
+				"INQUIRY_TABLE":           assertions.Match_AnyValue(),
+				"SPAM_SIGNING_KEY_ARN":    map[string]interface{}{"Ref": assertions.Match_StringLikeRegexp(jsii.String("FormSigningKey"))},
+				"ADMIN_SESSION_KEY_ARN":   map[string]interface{}{"Ref": assertions.Match_StringLikeRegexp(jsii.String("AdminSessionKey"))},
+				"AUDIT_KEY_ARN":           map[string]interface{}{"Ref": assertions.Match_StringLikeRegexp(jsii.String("AuditKey"))},
+				"ADMIN_CREDENTIALS_TABLE": assertions.Match_AnyValue(),
+				"ADMIN_RP_ID":             "stackfoundry.co.uk",
+				"BOOKING_TABLE":           assertions.Match_AnyValue(),
+				"BOOKING_BASE_URL":        "https://www.stackfoundry.co.uk",
+				"IDEMPOTENCY_TABLE":       assertions.Match_AnyValue(),
+				"SUBJECT_AUDIT_TABLE":     assertions.Match_AnyValue(),
+				"PRIVACY_BASE_URL":        "https://www.stackfoundry.co.uk",
+			}),
+		},
+	})
+
+	template.HasResourceProperties(jsii.String("AWS::DynamoDB::Table"), map[string]interface{}{
+		"KeySchema": []interface{}{
+			map[string]interface{}{"AttributeName": "name", "KeyType": "HASH"},
+		},
+	})
+	template.HasResourceProperties(jsii.String("AWS::DynamoDB::Table"), map[string]interface{}{
+		"KeySchema": []interface{}{
+			map[string]interface{}{"AttributeName": "pk", "KeyType": "HASH"},
+			map[string]interface{}{"AttributeName": "sk", "KeyType": "RANGE"},
+		},
+		"TimeToLiveSpecification": map[string]interface{}{"AttributeName": "expires", "Enabled": true},
+	})
+	template.HasResourceProperties(jsii.String("AWS::DynamoDB::Table"), map[string]interface{}{
+		"KeySchema": []interface{}{
+			map[string]interface{}{"AttributeName": "key", "KeyType": "HASH"},
+		},
+		"TimeToLiveSpecification": map[string]interface{}{"AttributeName": "expires", "Enabled": true},
+	})
+	template.HasResource(jsii.String("AWS::DynamoDB::Table"), map[string]interface{}{
+		"Properties": assertions.Match_ObjectLike(&map[string]interface{}{
+			"KeySchema": []interface{}{
+				map[string]interface{}{"AttributeName": "subject", "KeyType": "HASH"},
+				map[string]interface{}{"AttributeName": "id", "KeyType": "RANGE"},
+			},
+		}),
+		"DeletionPolicy": "Retain",
+	})
+	template.HasResourceProperties(jsii.String("AWS::Events::Rule"), map[string]interface{}{
+		"ScheduleExpression": "cron(15 3 * * ? *)",
+		"Targets": []interface{}{
+			assertions.Match_ObjectLike(&map[string]interface{}{"Arn": assertions.Match_AnyValue()}),
+		},
+	})
+	template.HasResourceProperties(jsii.String("AWS::Events::Rule"), map[string]interface{}{
+		"ScheduleExpression": "rate(5 minutes)",
+		"Targets": []interface{}{
+			assertions.Match_ObjectLike(&map[string]interface{}{"Input": `{"task":"outbox-drain"}`}),
+		},
+	})
+	template.HasResourceProperties(jsii.String("AWS::Lambda::Permission"), map[string]interface{}{
+		"Principal": "events.amazonaws.com",
+	})
+	template.ResourceCountIs(jsii.String("AWS::SecretsManager::Secret"), jsii.Number(3))
+
+	// Key values never reach the function's environment; it reads them
+	for _, env := range []string{"SPAM_SIGNING_KEY", "ADMIN_SESSION_KEY", "AUDIT_KEY"} {
+		template.HasResourceProperties(jsii.String("AWS::Lambda::Function"), map[string]interface{}{
+			"Environment": map[string]interface{}{
+				"Variables": assertions.Match_ObjectLike(&map[string]interface{}{env: assertions.Match_Absent()}),
+			},
+		})
+	}
+	template.HasResourceProperties(jsii.String("AWS::IAM::Policy"), map[string]interface{}{
+		"PolicyDocument": map[string]interface{}{
+			"Statement": assertions.Match_ArrayWith(&[]interface{}{
+				assertions.Match_ObjectLike(&map[string]interface{}{
+					"Action": []interface{}{"secretsmanager:GetSecretValue", "secretsmanager:DescribeSecret"},
+				}),
+			}),
+		},
+	})
+
+	// 8. Verify Budget Alarm
 	template.HasResourceProperties(jsii.String("AWS::Budgets::Budget"), map[string]interface{}{
 		"Budget": map[string]interface{}{
 			"BudgetLimit": map[string]interface{}{
@@ -113,3 +207,54 @@ func TestStackFoundryWebsiteStack(t *testing.T) {
 		},
 	})
 }
+
+func TestStackFoundryWebsiteStackConfig(t *testing.T) {
+	// GIVEN
+	app := awscdk.NewApp(nil)
+	cfg, err := appconfig.Load(nil, []string{
+		"DOMAIN=example.org",
+		"SENDER_EMAIL=hello@example.org",
+		"BUDGET_ALERT_EMAIL=billing@example.org",
+		"DMARC_REPORT_EMAIL=dmarc@example.net",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// WHEN
+	stack := NewStackFoundryWebsiteStack(app, "ConfigStack", &StackFoundryWebsiteStackProps{Config: &cfg})
+
+	// THEN
+	template := assertions.Template_FromStack(stack, nil)
+
+	// 1. Domains and addresses come from the config
+	template.HasResourceProperties(jsii.String("AWS::CertificateManager::Certificate"), map[string]interface{}{
+		"DomainName":              "example.org",
+		"SubjectAlternativeNames": []interface{}{"www.example.org"},
+	})
+	template.HasResourceProperties(jsii.String("AWS::Route53::RecordSet"), map[string]interface{}{
+		"Type":            "TXT",
+		"Name":            "_dmarc.example.org.",
+		"ResourceRecords": assertions.Match_ArrayWith(&[]interface{}{assertions.Match_StringLikeRegexp(jsii.String("rua=mailto:dmarc@example.net;"))}),
+	})
+	template.HasResourceProperties(jsii.String("AWS::Budgets::Budget"), map[string]interface{}{
+		"NotificationsWithSubscribers": []interface{}{
+			assertions.Match_ObjectLike(&map[string]interface{}{
+				"Subscribers": []interface{}{
+					map[string]interface{}{"Address": "billing@example.org", "SubscriptionType": "EMAIL"},
+				},
+			}),
+		},
+	})
+
+	// 2. The function is told the same settings
+	template.HasResourceProperties(jsii.String("AWS::Lambda::Function"), map[string]interface{}{
+		"Environment": map[string]interface{}{
+			"Variables": assertions.Match_ObjectLike(&map[string]interface{}{
+				"DOMAIN":       "example.org",
+				"SENDER_EMAIL": "hello@example.org",
+				"ADMIN_RP_ID":  "example.org",
+			}),
+		},
+	})
+}
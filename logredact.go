@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// piiLogKeys are attributes that identify a person. Their values are replaced
+// by a keyed hash, so one visitor's events still line up in the logs.
+var piiLogKeys = map[string]bool{
+	"email":      true,
+	"recipient":  true,
+	"ip":         true,
+	"user_agent": true,
+	"referrer":   true,
+}
+
+// safeLogKeys are attributes known to hold no PII. Anything not in one of
+// these lists is logged as "[redacted]", so a new attribute has to be added
+// to one before its value shows up. Email addresses in these values (an SES
+// error quoting the recipient, say) are still hashed.
+var safeLogKeys = map[string]bool{
+	"action": true, "addr": true, "admin": true, "attempts": true, "booking": true,
+	"budget": true, "committed": true, "deliveries": true, "disposable": true, "disposition": true, "dry_run": true, "dur": true,
+	"endpoint": true, "error": true, "errors": true, "fields": true, "for": true,
+	"host": true, "id": true, "inquiry": true, "method": true, "mode": true,
+	"outcome": true, "passkeys": true, "path": true, "permission": true, "plain": true, "policy": true,
+	"port": true, "present": true, "project": true, "provider": true, "purged": true,
+	"reason": true, "records": true, "recovery_codes_left": true, "reference": true, "released": true,
+	"retry_after": true, "role": true, "score": true, "sent": true, "sequence": true,
+	"session": true, "start": true, "status": true, "step": true,
+	"trigger": true, "typo": true,
+}
+
+// urlLogKeys hold a page address; query strings can carry signed links, so
+// only the path is kept
+var urlLogKeys = map[string]bool{"url_context": true}
+
+var logEmailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)+`)
+
+// newLogger is the application logger: JSON lines to w, with PII redacted.
+// The hash key is logKey in main, so pseudonyms are stable across cold
+// starts and deploys.
+func newLogger(w io.Writer, key []byte) *slog.Logger {
+	return slog.New(NewRedactingHandler(slog.NewJSONHandler(w, nil), key))
+}
+
+// logKey derives the pseudonym key from SPAM_SIGNING_KEY under a purpose of
+// its own, so the logs never hold a MAC made with the key that signs form
+// tokens and manage links. Empty stays empty, for a random per-process key.
+func logKey(spamKey string) []byte {
+	if spamKey == "" {
+		return nil
+	}
+	m := hmac.New(sha256.New, []byte(spamKey))
+	m.Write([]byte("log-pseudonym\x00"))
+	return m.Sum(nil)
+}
+
+// RedactingHandler: Wraps another slog.Handler and rewrites attributes on
+// their way through; see piiLogKeys and safeLogKeys. Keys are matched by
+// their own name wherever they sit in a group.
+type RedactingHandler struct {
+	next slog.Handler
+	key  []byte
+}
+
+// NewRedactingHandler hashes with key, or with a random one when it is empty,
+// in which case pseudonyms only match within one process
+func NewRedactingHandler(next slog.Handler, key []byte) *RedactingHandler {
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return &RedactingHandler{next: next, key: key}
+}
+
+func (h *RedactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *RedactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(h.redact(a))
+		return true
+	})
+	return h.next.Handle(ctx, out)
+}
+
+func (h *RedactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = h.redact(a)
+	}
+	return &RedactingHandler{next: h.next.WithAttrs(redacted), key: h.key}
+}
+
+func (h *RedactingHandler) WithGroup(name string) slog.Handler {
+	return &RedactingHandler{next: h.next.WithGroup(name), key: h.key}
+}
+
+func (h *RedactingHandler) redact(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() == slog.KindGroup {
+		group := a.Value.Group()
+		redacted := make([]slog.Attr, len(group))
+		for i, g := range group {
+			redacted[i] = h.redact(g)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redacted...)}
+	}
+
+	switch {
+	case piiLogKeys[a.Key]:
+		if s := a.Value.String(); s != "" {
+			return slog.String(a.Key, h.pseudonym(s))
+		}
+		return a
+	case urlLogKeys[a.Key]:
+		if u, err := url.Parse(a.Value.String()); err == nil {
+			return slog.String(a.Key, u.Path)
+		}
+		return slog.String(a.Key, "[redacted]")
+	case safeLogKeys[a.Key]:
+		switch a.Value.Kind() {
+		case slog.KindString, slog.KindAny:
+			// Only rewrite when there is something to hide, so structured
+			// values keep their JSON shape
+			if s := fmt.Sprint(a.Value.Any()); logEmailPattern.MatchString(s) {
+				return slog.String(a.Key, logEmailPattern.ReplaceAllStringFunc(s, h.pseudonym))
+			}
+		}
+		return a
+	default:
+		return slog.String(a.Key, "[redacted]")
+	}
+}
+
+// pseudonym is a short keyed hash of a value, case-insensitive so an address
+// typed two ways still matches
+func (h *RedactingHandler) pseudonym(v string) string {
+	m := hmac.New(sha256.New, h.key)
+	m.Write([]byte("log-pseudonym\x00" + strings.ToLower(strings.TrimSpace(v))))
+	return "h_" + hex.EncodeToString(m.Sum(nil)[:8])
+}
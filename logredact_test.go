@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testLogs collects every record the package's tests log, through the same
+// logger main uses
+var testLogs = &lockedBuffer{}
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestMain fails the run if any handler, router test included, managed to
+// log an email address past the redacting handler
+func TestMain(m *testing.M) {
+	slog.SetDefault(newLogger(testLogs, []byte("test-signing-key")))
+	code := m.Run()
+	var leaks []string
+	for line := range strings.Lines(testLogs.String()) {
+		if logEmailPattern.MatchString(line) {
+			leaks = append(leaks, strings.TrimSpace(line))
+		}
+	}
+	if len(leaks) > 0 {
+		fmt.Fprintf(os.Stderr, "FAIL: %d log records contain an email address:\n%s\n", len(leaks), strings.Join(leaks, "\n"))
+		code = 1
+	}
+	os.Exit(code)
+}
+
+func logRecord(t *testing.T, log func(*slog.Logger)) map[string]any {
+	t.Helper()
+	var buf bytes.Buffer
+	log(newLogger(&buf, []byte("test-signing-key")))
+	var rec map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("Log line %q: %v", buf.String(), err)
+	}
+	return rec
+}
+
+func TestRedactingHandler(t *testing.T) {
+	// 1. PII keys become stable, case-insensitive pseudonyms
+	a := logRecord(t, func(l *slog.Logger) { l.Info("contact_attempt", slog.String("email", "Jo@Example.com")) })
+	b := logRecord(t, func(l *slog.Logger) { l.Info("ses_success", slog.String("recipient", "jo@example.com")) })
+	if a["email"] != b["recipient"] || !strings.HasPrefix(a["email"].(string), "h_") {
+		t.Errorf("Pseudonyms %v and %v", a["email"], b["recipient"])
+	}
+
+	// 2. Safe keys pass, with addresses inside them hashed
+	rec := logRecord(t, func(l *slog.Logger) {
+		l.Error("ses_failure", slog.String("inquiry", "abc"), slog.Int("attempts", 2), slog.Int("deliveries", 10), slog.Any("error", errors.New("rejected jo@example.com")))
+	})
+	if rec["inquiry"] != "abc" || rec["attempts"] != 2.0 || rec["deliveries"] != 10.0 || rec["error"] != "rejected "+a["email"].(string) {
+		t.Errorf("Safe keys %+v", rec)
+	}
+	rec = logRecord(t, func(l *slog.Logger) { l.Info("contact_invalid", slog.Any("fields", []string{"email", "message"})) })
+	if _, ok := rec["fields"].([]any); !ok {
+		t.Errorf("Structured value reshaped: %#v", rec["fields"])
+	}
+
+	// 3. Unknown keys are withheld, in groups and With too
+	rec = logRecord(t, func(l *slog.Logger) {
+		l.With(slog.String("message", "Call me on 07700 900000")).Info("x", slog.Group("form", slog.String("name", "Jo"), slog.String("path", "/contact")))
+	})
+	form, _ := rec["form"].(map[string]any)
+	if rec["message"] != "[redacted]" || form["name"] != "[redacted]" || form["path"] != "/contact" {
+		t.Errorf("Unknown keys %+v", rec)
+	}
+
+	// 4. Page addresses lose their query string
+	rec = logRecord(t, func(l *slog.Logger) {
+		l.Info("human_traffic", slog.String("url_context", "https://www.example.com/privacy/data?t=secret"))
+	})
+	if rec["url_context"] != "/privacy/data" {
+		t.Errorf("url_context %v", rec["url_context"])
+	}
+}
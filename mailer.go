@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/ses/types"
+
+	"stackfoundry.co.uk/appconfig"
+)
+
+// Message: A single outbound email, independent of how it is delivered
+type Message struct {
+	From        string
+	To          []string
+	ReplyTo     []string
+	Subject     string
+	Text        string
+	HTML        string
+	Attachments []Attachment
+}
+
+// Mailer: Delivers messages. Chosen once at startup and injected into the router.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// newMailerFromConfig picks a Mailer from MAILER (ses, smtp, outbox, memory).
+// Lambda defaults to SES; local runs default to the outbox so `go run .`
+// works without AWS credentials.
+func newMailerFromConfig(ctx context.Context, cfg appconfig.Config) (Mailer, error) {
+	switch cfg.Mailer {
+	case "ses":
+		aws, err := loadAWSConfig(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &SESMailer{Client: ses.NewFromConfig(aws)}, nil
+	case "smtp":
+		if cfg.SMTPAddr == "" {
+			return nil, errors.New("SMTP_ADDR is required for the smtp mailer")
+		}
+		return &SMTPMailer{
+			Addr:     cfg.SMTPAddr,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword.Reveal(),
+		}, nil
+	case "outbox":
+		return &OutboxMailer{Dir: cfg.OutboxDir}, nil
+	case "memory":
+		return &MemoryMailer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown mailer %q", cfg.Mailer)
+	}
+}
+
+// --- RETRY ---
+
+// Delivery retry policy. A contact request saves, delivers the notification,
+// then sends the acknowledgement and webhooks side by side, each on its own
+// budget. Together they stay inside the 10s Lambda timeout.
+const (
+	storeTimeout    = time.Second
+	deliveryTimeout = 4 * time.Second
+	ackTimeout      = 2 * time.Second
+	webhookTimeout  = 3 * time.Second
+	maxSendAttempts = 3
+)
+
+var sendBackoff = 200 * time.Millisecond
+
+// sendWithRetry retries failed sends with exponential backoff. It gives up
+// early rather than sleeping past the context deadline, returning the last
+// error so the visitor can be told instead of shown a false success.
+func sendWithRetry(ctx context.Context, mailer Mailer, msg Message) (attempts int, err error) {
+	backoff := sendBackoff
+	for attempts = 1; ; attempts++ {
+		if err = mailer.Send(ctx, msg); err == nil {
+			return attempts, nil
+		}
+		if attempts == maxSendAttempts {
+			return attempts, err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+			return attempts, err
+		}
+		select {
+		case <-ctx.Done():
+			return attempts, errors.Join(err, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// --- SES ---
+
+type SESMailer struct {
+	Client *ses.Client
+}
+
+// Send uses SendEmail for plain messages and SendRawEmail, with the MIME
+// built by Message.Bytes, once there are attachments.
+func (m *SESMailer) Send(ctx context.Context, msg Message) error {
+	if len(msg.Attachments) > 0 {
+		raw, err := msg.Bytes()
+		if err != nil {
+			return err
+		}
+		_, err = m.Client.SendRawEmail(ctx, &ses.SendRawEmailInput{
+			Destinations: msg.To,
+			Source:       aws.String(msg.From),
+			RawMessage:   &types.RawMessage{Data: raw},
+		})
+		return err
+	}
+
+	body := &types.Body{}
+	if msg.Text != "" {
+		body.Text = &types.Content{Data: aws.String(msg.Text)}
+	}
+	if msg.HTML != "" {
+		body.Html = &types.Content{Data: aws.String(msg.HTML)}
+	}
+	_, err := m.Client.SendEmail(ctx, &ses.SendEmailInput{
+		Destination: &types.Destination{ToAddresses: msg.To},
+		Message: &types.Message{
+			Body:    body,
+			Subject: &types.Content{Data: aws.String(sanitizeHeader(msg.Subject))},
+		},
+		Source:           aws.String(msg.From),
+		ReplyToAddresses: msg.ReplyTo,
+	})
+	return err
+}
+
+// --- SMTP ---
+
+// SMTPMailer: Plain net/smtp delivery. Auth is only attempted when a username is set.
+type SMTPMailer struct {
+	Addr     string
+	Username string
+	Password string
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	raw, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, _ := strings.Cut(m.Addr, ":")
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	// net/smtp has no context support; the Lambda deadline still bounds the request
+	return smtp.SendMail(m.Addr, auth, msg.From, msg.To, raw)
+}
+
+// --- OUTBOX ---
+
+// OutboxMailer: Writes each message to Dir as an .eml file for local inspection
+type OutboxMailer struct {
+	Dir string
+}
+
+func (m *OutboxMailer) Send(ctx context.Context, msg Message) error {
+	raw, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405Z"), hex.EncodeToString(suffix))
+	return os.WriteFile(filepath.Join(m.Dir, name), raw, 0o644)
+}
+
+// --- MEMORY ---
+
+// MemoryMailer: Keeps sent messages in memory. Used by tests.
+// Setting Err makes every Send fail without recording the message.
+type MemoryMailer struct {
+	Err error
+
+	mu       sync.Mutex
+	sent     []Message
+	attempts int
+}
+
+func (m *MemoryMailer) Send(ctx context.Context, msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.attempts++
+	if m.Err != nil {
+		return m.Err
+	}
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// Attempts counts every call to Send, including failed ones
+func (m *MemoryMailer) Attempts() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.attempts
+}
+
+// Sent returns a copy of every message delivered so far
+func (m *MemoryMailer) Sent() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.sent...)
+}
+
+// --- MIME ---
+
+// Bytes renders the message as RFC 5322. The body is multipart/alternative,
+// wrapped in multipart/mixed when there are attachments.
+func (msg Message) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+
+	header := func(k, v string) { fmt.Fprintf(&buf, "%s: %s\r\n", k, sanitizeHeader(v)) }
+	header("From", msg.From)
+	header("To", strings.Join(msg.To, ", "))
+	if len(msg.ReplyTo) > 0 {
+		header("Reply-To", strings.Join(msg.ReplyTo, ", "))
+	}
+	header("Subject", mime.QEncoding.Encode("utf-8", sanitizeHeader(msg.Subject)))
+	header("Date", time.Now().UTC().Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+
+	if len(msg.Attachments) == 0 {
+		alt := multipart.NewWriter(&buf)
+		header("Content-Type", fmt.Sprintf("multipart/alternative; boundary=%q", alt.Boundary()))
+		buf.WriteString("\r\n")
+		if err := msg.writeAlternatives(alt); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	mixed := multipart.NewWriter(&buf)
+	header("Content-Type", fmt.Sprintf("multipart/mixed; boundary=%q", mixed.Boundary()))
+	buf.WriteString("\r\n")
+
+	var body bytes.Buffer
+	alt := multipart.NewWriter(&body)
+	if err := msg.writeAlternatives(alt); err != nil {
+		return nil, err
+	}
+	pw, err := mixed.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {fmt.Sprintf("multipart/alternative; boundary=%q", alt.Boundary())},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pw.Write(body.Bytes()); err != nil {
+		return nil, err
+	}
+
+	for _, a := range msg.Attachments {
+		// Keep parameters such as text/calendar's method; add the name
+		mediaType, params, err := mime.ParseMediaType(a.ContentType)
+		if err != nil {
+			return nil, fmt.Errorf("attachment %q: %w", a.Filename, err)
+		}
+		params["name"] = a.Filename
+		pw, err := mixed.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType(mediaType, params)},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeBase64Lines(pw, a.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := mixed.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeAlternatives writes the text and HTML parts and closes mw
+func (msg Message) writeAlternatives(mw *multipart.Writer) error {
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		if part.body == "" {
+			continue
+		}
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return err
+		}
+		qp := quotedprintable.NewWriter(pw)
+		if _, err := qp.Write([]byte(part.body)); err != nil {
+			return err
+		}
+		if err := qp.Close(); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// writeBase64Lines wraps base64 at 76 characters, as RFC 2045 requires
+func writeBase64Lines(w io.Writer, data []byte) error {
+	enc := base64.StdEncoding.EncodeToString(data)
+	for len(enc) > 0 {
+		n := min(76, len(enc))
+		if _, err := io.WriteString(w, enc[:n]+"\r\n"); err != nil {
+			return err
+		}
+		enc = enc[n:]
+	}
+	return nil
+}
@@ -1,78 +1,38 @@
 package main
 
 import (
-	"compress/gzip"
 	"context"
 	"crypto/rand"
-	"embed"
 	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"io/fs"
 	"log/slog"
+	"maps"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/a-h/templ"
-	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/awslabs/aws-lambda-go-api-proxy/httpadapter"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/ses"
-	"github.com/aws/aws-sdk-go-v2/service/ses/types"
-
+	"stackfoundry.co.uk/appconfig"
 	"stackfoundry.co.uk/components"
 )
 
-//go:embed public/*
-var embeddedFiles embed.FS
-
-var sesClient *ses.Client
-
-const SenderEmail = "joe@stackfoundry.co.uk"
-
 type ContextKey string
 
 const SessionKey ContextKey = "session_id"
 
 // --- MIDDLEWARES ---
 
-// GzipMiddleware: Compresses responses if client supports it
-func GzipMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// 1. Check if client supports Gzip
-		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-			next.ServeHTTP(w, r)
-			return
-		}
-
-		// 2. Wrap the writer
-		w.Header().Set("Content-Encoding", "gzip")
-		gz := gzip.NewWriter(w)
-		defer gz.Close()
-
-		// 3. Serve with GzipWriter
-		gzipWriter := &gzipResponseWriter{Writer: gz, ResponseWriter: w}
-		next.ServeHTTP(gzipWriter, r)
-	})
-}
-
-// Helper struct to wrap ResponseWriter
-type gzipResponseWriter struct {
-	io.Writer
-	http.ResponseWriter
-}
-
-func (w *gzipResponseWriter) Write(b []byte) (int, error) {
-	return w.Writer.Write(b)
-}
-
 // LoggerMiddleware: Tracks sessions, filters bots, Security Headers
-func LoggerMiddleware(next http.Handler) http.Handler {
+func LoggerMiddleware(log *slog.Logger, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
@@ -107,7 +67,7 @@ func LoggerMiddleware(next http.Handler) http.Handler {
 		ctx := context.WithValue(r.Context(), SessionKey, sessionID)
 		r = r.WithContext(ctx)
 
-		logger := slog.Default().With(
+		logger := log.With(
 			slog.String("session", sessionID),
 			slog.String("method", r.Method),
 			slog.String("path", r.URL.Path),
@@ -136,12 +96,20 @@ func CacheControlMiddleware(next http.Handler) http.Handler {
 // --- RENDERING HELPERS ---
 
 func RenderHTML(w http.ResponseWriter, r *http.Request, component templ.Component) {
+	RenderHTMLStatus(w, r, http.StatusOK, component)
+}
+
+// RenderHTMLStatus: Like RenderHTML, but headers are set before the status is written
+func RenderHTMLStatus(w http.ResponseWriter, r *http.Request, status int, component templ.Component) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.Header().Set("Cache-Control", "no-cache")
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
 	if r.Header.Get("HX-Request") == "" {
 		sessionID, _ := r.Context().Value(SessionKey).(string)
 		w.Header().Set("X-Session-ID", sessionID)
 	}
+	w.WriteHeader(status)
 	component.Render(r.Context(), w)
 }
 
@@ -165,12 +133,10 @@ func serveEmbeddedFile(w http.ResponseWriter, r *http.Request, fsys fs.FS, path
 
 // --- ROUTER ---
 
-func setupRouter() *http.ServeMux {
+// routes mounts every page and API on a new mux
+func (a *App) routes() *http.ServeMux {
 	mux := http.NewServeMux()
-	publicFS, err := fs.Sub(embeddedFiles, "public")
-	if err != nil {
-		slog.Error("assets_missing", slog.Any("error", err))
-	} else {
+	if publicFS := a.Assets; publicFS != nil {
 
 		// 1. STATIC ASSETS -> Cached + Gzipped (Handled by middleware wrapper)
 		assetHandler := http.FileServer(http.FS(publicFS))
@@ -196,100 +162,346 @@ func setupRouter() *http.ServeMux {
 	// 3. PAGES
 	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
 		sessionID, _ := r.Context().Value(SessionKey).(string)
-		RenderHTML(w, r, components.Home(sessionID))
+		RenderHTML(w, r, components.Home(sessionID, components.ContactFormState{Token: a.Guard.Issue(), IdempotencyKey: newIdempotencyKey()}))
 	})
+	// The privacy page states the policy the purge applies
+	retention, _ := parseRetentionPolicy(defaultRetentionPolicy)
+	if a.Purger != nil {
+		retention = a.Purger.Policy
+	}
 	mux.HandleFunc("GET /privacy", func(w http.ResponseWriter, r *http.Request) {
 		sessionID, _ := r.Context().Value(SessionKey).(string)
-		RenderHTML(w, r, components.Privacy(sessionID))
+		RenderHTML(w, r, components.Privacy(sessionID, retention.Notice()))
 	})
 
+	// Data-subject access and erasure
+	registerSubjectRoutes(mux, a.Subjects, a.Guard, a.Pow)
+
+	// Project brief wizard, which ends at the contact form
+	registerQualifyRoutes(mux, a.Guard)
+
+	// Discovery calls (redirects to the contact form when booking is off)
+	registerBookingRoutes(mux, a.Bookings, a.Guard, a.Pow)
+
 	// 4. API
-	mux.HandleFunc("POST /api/contact", handleContact)
+	mux.HandleFunc("GET /api/challenge", handleChallenge(a.Pow))
+	mux.HandleFunc("GET /api/email-check", handleEmailCheck)
+	mux.HandleFunc("POST /api/contact", a.handleContact)
+
+	// 5. ADMIN (only mounted when both a store and a credential store are configured)
+	registerAdminRoutes(mux, a.Store, a.Admin, a.accepted)
 
 	// 404
 	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusNotFound)
 		sessionID, _ := r.Context().Value(SessionKey).(string)
-		RenderHTML(w, r, components.NotFound(sessionID))
+		RenderHTMLStatus(w, r, http.StatusNotFound, components.NotFound(sessionID))
 	}))
 
 	return mux
 }
 
-func handleContact(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseForm(); err != nil {
+func (a *App) handleContact(w http.ResponseWriter, r *http.Request) {
+	if err := parseContactRequest(w, r); err != nil {
+		// Too large to read at all, so there are no values to put back
+		if errors.Is(err, errUploadTooLarge) {
+			a.logger().Info("contact_too_large")
+			state := components.ContactFormState{
+				Token:          a.Guard.IssueForRetry(),
+				IdempotencyKey: newIdempotencyKey(),
+				Errors:         map[string]string{"attachments": fmt.Sprintf("Attachments must total %s or less. Please resend without the largest file.", formatBytes(maxUploadBytes))},
+			}
+			RenderHTMLStatus(w, r, http.StatusRequestEntityTooLarge, components.ContactPanel(state))
+			return
+		}
 		http.Error(w, "Failed to parse form", http.StatusBadRequest)
 		return
 	}
 
-	visitorEmail := r.FormValue("email")
-	visitorSubject := r.FormValue("subject")
-	visitorMessage := r.FormValue("message")
+	form := parseContactForm(r)
+	if !validIdempotencyKey(form.IdempotencyKey) {
+		form.IdempotencyKey = newIdempotencyKey()
+	}
+
+	a.logger().Info("contact_attempt", slog.String("email", form.Email))
+
+	// IDEMPOTENCY: A repeat of an accepted form gets the original answer.
+	// Checked before the token is spent, or the repeat would be a replay.
+	if ref, committed := a.recordedReference(r.Context(), form.IdempotencyKey); ref != "" {
+		a.contactDuplicate(w, r, form, ref, committed)
+		return
+	}
+
+	// SPAM: Bots get the same success partial as people, so they learn nothing
+	if reason := a.Guard.Check(r); reason != "" {
+		a.logger().Info("spam_blocked", slog.String("reason", reason))
+		RenderHTML(w, r, components.ContactSuccess(inquiryReference(newInquiryID(a.now()))))
+		return
+	}
 
-	slog.Info("contact_attempt", slog.String("email", visitorEmail))
+	// VALIDATION: Re-render the panel with the visitor's values and field errors.
+	// Browsers cannot refill a file input, so a rejected upload is chosen again.
+	files, fileErr := parseAttachments(r)
+	errs := validateContact(form)
+	if fileErr != "" {
+		errs["attachments"] = fileErr
+	}
+	// The wizard's answers are signed; anything else is dropped with a note
+	var brief *Brief
+	if form.Brief != "" {
+		if st, ok := a.Guard.openBrief(form.Brief); ok && st.done() {
+			brief = &st.Brief
+		} else {
+			errs["form"] = "Your project answers expired, so they have been dropped. Send again without them, or start over at /project."
+			form.Brief = ""
+		}
+	}
+	screening := screenEmail(form.Email)
+	if len(errs) > 0 {
+		a.logger().Info("contact_invalid", slog.Any("fields", slices.Sorted(maps.Keys(errs))))
 
-	if sesClient != nil && visitorEmail != "" {
-		err := sendEmail(r.Context(), visitorEmail, visitorSubject, visitorMessage)
+		form.Errors = errs
+		form.EmailWarning = screening.Warning()
+		RenderHTMLStatus(w, r, http.StatusUnprocessableEntity, components.ContactPanel(form))
+		return
+	}
+
+	// PROOF OF WORK: Solved in the browser by public/js/pow.js. Browsers
+	// without JavaScript post plainly and face a long time trap and a tight
+	// per-client limit instead.
+	challenge, nonce := powFields(r)
+	plain := powPlain(r, challenge, nonce)
+	tokenAge, _ := a.Guard.Age(form.Token)
+	if plain && !a.Pow.Plain(r.Context(), clientIP(r), tokenAge) || !plain && !a.Pow.Verify(challenge, nonce) {
+		a.logger().Info("pow_failed", slog.Bool("present", nonce != ""), slog.Bool("plain", plain))
+
+		form.EmailWarning = screening.Warning()
+		form.Errors = map[string]string{"form": powFailure(plain, a.Config.SenderEmail)}
+		RenderHTMLStatus(w, r, http.StatusUnprocessableEntity, components.ContactPanel(form))
+		return
+	}
+
+	inq := newInquiry(r, form, files, a.now())
+	inq.Brief = brief
+	if screening.Flagged() {
+		a.logger().Info("email_flagged", slog.String("inquiry", inq.ID), slog.Bool("disposable", screening.Disposable), slog.Bool("role", screening.Role), slog.Bool("typo", screening.Suggestion != ""))
+		inq.Screening = &screening
+	}
+
+	// Claim the key before anything is sent. A duplicate racing this one
+	// loses the claim, and is told the same reference once this commits.
+	if a.Keys != nil {
+		held, committed, err := a.Keys.Claim(r.Context(), form.IdempotencyKey, inq.Reference(), pendingClaimTTL)
 		if err != nil {
-			slog.Error("ses_failure", slog.Any("error", err))
+			a.logger().Error("idempotency_failure", slog.Any("error", err))
+		} else if held != "" {
+			a.contactDuplicate(w, r, form, held, committed)
+			return
+		}
+	}
+	// release lets the visitor retry with the same key when nothing went out;
+	// commit lets duplicates see the reference once the inquiry is safe
+	release := func() {
+		if a.Keys == nil {
+			return
+		}
+		if err := a.Keys.Release(context.WithoutCancel(r.Context()), form.IdempotencyKey); err != nil {
+			a.logger().Error("idempotency_failure", slog.Any("error", err))
+		}
+	}
+	commit := func() {
+		if a.Keys == nil {
+			return
+		}
+		if err := a.Keys.Commit(context.WithoutCancel(r.Context()), form.IdempotencyKey, idempotencyWindow); err != nil {
+			a.logger().Error("idempotency_failure", slog.Any("error", err))
+		}
+	}
+
+	// REPLAY: The solution and the token are each spent in one step, so of
+	// two submissions racing with the same ones only a single one gets past.
+	if !plain && !a.Pow.Spend(r.Context(), challenge) {
+		a.logger().Info("pow_failed", slog.Bool("present", true))
+		release()
+		form.EmailWarning = screening.Warning()
+		form.Errors = map[string]string{"form": powFailure(false, a.Config.SenderEmail)}
+		RenderHTMLStatus(w, r, http.StatusUnprocessableEntity, components.ContactPanel(form))
+		return
+	}
+	if !a.Guard.Spend(r.Context(), form.Token) {
+		a.logger().Info("spam_blocked", slog.String("reason", spamReplayed))
+		release()
+		RenderHTML(w, r, components.ContactSuccess(inquiryReference(newInquiryID(a.now()))))
+		return
+	}
+	inq.Routing = a.Routes.Match(inq)
+	retry := form
+	retry.Token = a.Guard.IssueForRetry()
+
+	// QUARANTINE: Likely spam is stored but held, with no email, ack or
+	// webhook. The visitor sees the usual success so spammers learn nothing.
+	inq.SpamScore = a.Filter.Score(inq.Subject, inq.Message)
+	if a.Filter.Quarantine(inq.SpamScore) && a.Store != nil {
+		held := inq
+		held.Status = StatusHeld
+		held.Disposition = DispositionQuarantine
+		sctx, cancel := context.WithTimeout(r.Context(), storeTimeout)
+		err := a.Store.Save(sctx, held)
+		cancel()
+		if err != nil {
+			a.logger().Error("store_failure", slog.String("inquiry", inq.ID), slog.Any("error", err))
 		} else {
-			slog.Info("ses_success", slog.String("recipient", visitorEmail))
+			a.logger().Info("inquiry_quarantined", slog.String("inquiry", inq.ID), slog.Float64("score", inq.SpamScore))
+			commit()
+			RenderHTML(w, r, components.ContactSuccess(inq.Reference()))
+			return
 		}
 	}
 
-	RenderHTML(w, r, components.ContactSuccess())
+	// OUTBOX: Save first. Once stored, a failed send is retried by the
+	// dispatcher, so the visitor can be told it was received. Each stage
+	// has its own budget, so a slow one cannot starve those after it.
+	ctx, cancel := context.WithTimeout(r.Context(), deliveryTimeout)
+	defer cancel()
+	stored := false
+	if a.Store != nil {
+		sctx, scancel := context.WithTimeout(r.Context(), storeTimeout)
+		err := a.Store.Save(sctx, inq)
+		scancel()
+		if err != nil {
+			a.logger().Error("store_failure", slog.String("inquiry", inq.ID), slog.Any("error", err))
+		} else {
+			a.logger().Info("inquiry_stored", slog.String("inquiry", inq.ID))
+			stored = true
+			if _, err := a.Outbox().Deliver(ctx, inq); err != nil && len(inq.files) > 0 {
+				// ATTACHMENTS: Files are never stored, so a retry would go
+				// out without them. Withdraw the record and let the visitor
+				// send again while they still have the files.
+				if err := a.Store.Delete(context.WithoutCancel(r.Context()), inq.ID); err != nil {
+					a.logger().Error("store_failure", slog.String("inquiry", inq.ID), slog.Any("error", err))
+				} else {
+					a.logger().Info("inquiry_withdrawn", slog.String("inquiry", inq.ID), slog.String("reason", "attachments_unsent"))
+					release()
+					RenderHTMLStatus(w, r, http.StatusBadGateway, components.ContactFailure(retry, a.Config.SenderEmail))
+					return
+				}
+			}
+		}
+	}
+
+	// DELIVERY: Without a stored copy, never show success for an inquiry that went nowhere
+	if !stored {
+		if a.Mailer == nil {
+			a.logger().Error("mailer_unavailable", slog.String("inquiry", inq.ID))
+			release()
+			RenderHTMLStatus(w, r, http.StatusServiceUnavailable, components.ContactFailure(retry, a.Config.SenderEmail))
+			return
+		}
+		attempts, err := sendEmail(ctx, a.Mailer, a.Config.SenderEmail, inq)
+		if err != nil {
+			a.logger().Error("ses_failure", slog.String("inquiry", inq.ID), slog.Any("error", err), slog.Int("attempts", attempts))
+			release()
+			RenderHTMLStatus(w, r, http.StatusBadGateway, components.ContactFailure(retry, a.Config.SenderEmail))
+			return
+		}
+		a.logger().Info("ses_success", slog.String("inquiry", inq.ID), slog.String("recipient", form.Email), slog.Int("attempts", attempts))
+	}
+
+	commit()
+	a.accepted(r.Context(), inq)
+
+	RenderHTML(w, r, components.ContactSuccess(inq.Reference()))
+}
+
+// contactDuplicate answers a repeat of a form that already claimed its key.
+// Until the first request commits it may still fail and release the key, so
+// the repeat gets a 409 and a fresh token to send again with.
+func (a *App) contactDuplicate(w http.ResponseWriter, r *http.Request, form components.ContactFormState, ref string, committed bool) {
+	a.logger().Info("contact_duplicate", slog.String("reference", ref), slog.Bool("committed", committed))
+	if committed {
+		RenderHTML(w, r, components.ContactSuccess(ref))
+		return
+	}
+	form.Token = a.Guard.IssueForRetry()
+	form.Errors = map[string]string{"form": "Your message is still being sent. Send it again in a moment to see its reference."}
+	RenderHTMLStatus(w, r, http.StatusConflict, components.ContactPanel(form))
 }
 
 func main() {
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	// SUBCOMMANDS: Developer tools that share the binary. Their flags are
+	// their own, so they take configuration from the file and environment.
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		cfg, err := appconfig.Load(nil, os.Environ())
+		if err == nil {
+			// Keys passed by ARN, as on Lambda, so purge and train sign and
+			// hash with the same keys as the site
+			if err = loadSecrets(context.TODO(), &cfg); err != nil {
+				err = fmt.Errorf("secrets: %w", err)
+			}
+		}
+		if err == nil {
+			slog.SetDefault(newLogger(os.Stdout, logKey(cfg.SpamSigningKey.Reveal())))
+			switch os.Args[1] {
+			case "config":
+				err = runConfig(os.Args[2:])
+			case "webhook-receiver":
+				err = runWebhookReceiver(cfg, os.Args[2:])
+			case "admin":
+				err = runAdmin(cfg, os.Args[2:])
+			case "disposable":
+				err = runDisposable(os.Args[2:])
+			case "train":
+				err = runTrain(cfg, os.Args[2:])
+			case "purge":
+				err = runPurge(cfg, os.Args[2:])
+			default:
+				err = fmt.Errorf("unknown command %q", os.Args[1])
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// CONFIG: Defaults < CONFIG_FILE < environment < flags
+	cfg, err := appconfig.Load(os.Args[1:], os.Environ())
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	// SECRETS: Keys passed by ARN are read once, at cold start
+	if err := loadSecrets(context.TODO(), &cfg); err != nil {
+		fmt.Fprintln(os.Stderr, "secrets:", err)
+		os.Exit(1)
+	}
+	logger := newLogger(os.Stdout, logKey(cfg.SpamSigningKey.Reveal()))
 	slog.SetDefault(logger)
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion("eu-west-2"))
+	// Refuse to start half-configured: on Lambda the failed init shows up
+	// in the deploy, where a quietly disabled feature would not
+	if err := cfg.Validate(); err != nil {
+		slog.Error("config_invalid", slog.Any("error", err))
+		os.Exit(1)
+	}
+	app, err := NewApp(context.TODO(), cfg, logger)
 	if err != nil {
-		slog.Warn("aws_config_failed", slog.Any("error", err))
-	} else {
-		sesClient = ses.NewFromConfig(cfg)
+		slog.Error("app_config_failed", slog.Any("error", err))
+		os.Exit(1)
 	}
+	handler := app.Handler()
 
-	mux := setupRouter()
-
-	// CHAIN MIDDLEWARE: Logger -> Gzip -> Mux
-	handler := LoggerMiddleware(GzipMiddleware(mux))
-
-	if os.Getenv("AWS_LAMBDA_FUNCTION_NAME") != "" {
+	if cfg.OnLambda() {
 		slog.Info("server_starting", slog.String("mode", "lambda_v1"))
-		adapter := httpadapter.New(handler)
-		lambda.Start(func(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-			return adapter.ProxyWithContext(ctx, req)
-		})
+		lambda.Start(lambdaHandler(httpadapter.New(handler), app.Outbox(), app.Purger))
 	} else {
-		port := os.Getenv("PORT")
-		if port == "" {
-			port = "8080"
+		if outbox := app.Outbox(); outbox != nil {
+			go outbox.Run(context.Background(), outboxInterval)
 		}
+		port := strconv.Itoa(cfg.Port)
 		slog.Info("server_starting", slog.String("mode", "local"), slog.String("port", port))
 		http.ListenAndServe(":"+port, handler)
 	}
 }
-
-func sendEmail(ctx context.Context, replyTo, subject, body string) error {
-	input := &ses.SendEmailInput{
-		Destination: &types.Destination{ToAddresses: []string{SenderEmail}},
-		Message: &types.Message{
-			Body: &types.Body{
-				Text: &types.Content{Data: aws.String(fmt.Sprintf("From: %s\n\nMessage:\n%s", replyTo, body))},
-				Html: &types.Content{Data: aws.String(fmt.Sprintf(`
-					<h3>New Inquiry from StackFoundry</h3>
-					<p><strong>From:</strong> %s</p>
-					<p><strong>Subject:</strong> %s</p>
-					<hr/>
-					<p>%s</p>
-				`, replyTo, subject, body))},
-			},
-			Subject: &types.Content{Data: aws.String("[StackFoundry] " + subject)},
-		},
-		Source:           aws.String(SenderEmail),
-		ReplyToAddresses: []string{replyTo},
-	}
-	_, err := sesClient.SendEmail(ctx, input)
-	return err
-}
@@ -1,17 +1,116 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"io"
+	"io/fs"
+	"maps"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"stackfoundry.co.uk/appconfig"
+	"stackfoundry.co.uk/components"
+)
+
+var (
+	testGuard  = NewSpamGuard([]byte("test-signing-key"))
+	testPow    = newTestPow()
+	testSender = appconfig.Defaults().SenderEmail
 )
 
+// testApp: An App on the default config, with the site's assets and the
+// shared test guards. Tests set the fakes they exercise; the rest stay off.
+func testApp(a App) *App {
+	a.Config = appconfig.Defaults()
+	a.Assets, _ = fs.Sub(embeddedFiles, "public")
+	a.Guard, a.Pow = testGuard, testPow
+	return &a
+}
+
+// postForm submits form to target as a plain browser POST, or as htmx sends
+// it when htmx is set
+func postForm(h http.Handler, target string, form url.Values, htmx bool) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if htmx {
+		req.Header.Set("HX-Request", "true")
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+// newTestPow keeps difficulty low so tests solve challenges instantly
+func newTestPow() *ProofOfWork {
+	pow := NewProofOfWork([]byte("test-signing-key"))
+	pow.BaseBits, pow.MaxBits = 4, 8
+	return pow
+}
+
+// solvePow does in Go what public/js/pow.js does in the browser
+func solvePow(challenge string, difficulty int) string {
+	for nonce := 0; ; nonce++ {
+		n := strconv.Itoa(nonce)
+		if leadingZeroBits(sha256.Sum256([]byte(challenge+":"+n))) >= difficulty {
+			return n
+		}
+	}
+}
+
+// newContactForm returns form values carrying a valid form token, aged past
+// the time trap, and a solved proof-of-work challenge
+func newContactForm(email, subject, message string) url.Values {
+	challenge, difficulty := testPow.Issue(context.Background(), "192.0.2.1")
+	form := url.Values{}
+	form.Add("email", email)
+	form.Add("subject", subject)
+	form.Add("message", message)
+	form.Add(components.FormTokenField, testGuard.issueAt(time.Now().Add(-time.Minute)))
+	form.Add(components.PowChallengeField, challenge)
+	form.Add(components.PowNonceField, solvePow(challenge, difficulty))
+	return form
+}
+
+// newMultipartContact encodes form plus files (name -> contents) the way the
+// browser does once the form has an attachments field
+func newMultipartContact(t *testing.T, form url.Values, files map[string][]byte) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, vs := range form {
+		for _, v := range vs {
+			mw.WriteField(k, v)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		fw, err := mw.CreateFormFile("attachments", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(files[name])
+	}
+	mw.Close()
+	return &body, mw.FormDataContentType()
+}
+
 func TestRoutes(t *testing.T) {
 	// Initialize the router
-	router := setupRouter()
+	router := testApp(App{Mailer: &MemoryMailer{}}).Handler()
 
 	// Define test cases
 	tests := []struct {
@@ -85,18 +184,13 @@ func TestRoutes(t *testing.T) {
 }
 
 func TestContactFormSubmission(t *testing.T) {
-	router := setupRouter()
+	mailer := &MemoryMailer{}
+	store := NewMemoryStore()
+	router := testApp(App{Mailer: mailer, Store: store}).Handler()
 
-	form := url.Values{}
-	form.Add("email", "test@example.com")
-	form.Add("subject", "Test Subject")
-	form.Add("message", "This is a test message from main_test.go")
-
-	req := httptest.NewRequest("POST", "/api/contact", strings.NewReader(form.Encode()))
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	form := newContactForm("test@example.com", "Test Subject", "This is a test message from main_test.go")
 
-	rr := httptest.NewRecorder()
-	router.ServeHTTP(rr, req)
+	rr := postForm(router, "/api/contact", form, false)
 
 	// 1. Verify 200 OK
 	if rr.Code != http.StatusOK {
@@ -116,4 +210,815 @@ func TestContactFormSubmission(t *testing.T) {
 	if !strings.Contains(rr.Body.String(), expected) {
 		t.Errorf("Contact handler did not render success message: got body %v", rr.Body.String())
 	}
+
+	// 4. Verify the notification was handed to the mailer
+	sent := mailer.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("Contact handler sent %d messages, want 1", len(sent))
+	}
+	msg := sent[0]
+	if len(msg.To) != 1 || msg.To[0] != testSender {
+		t.Errorf("Notification sent to %v, want %v", msg.To, testSender)
+	}
+	if len(msg.ReplyTo) != 1 || msg.ReplyTo[0] != "test@example.com" {
+		t.Errorf("Notification reply-to is %v, want test@example.com", msg.ReplyTo)
+	}
+	if msg.Subject != "[StackFoundry] Test Subject" {
+		t.Errorf("Notification subject is %q", msg.Subject)
+	}
+	if !strings.Contains(msg.Text, "This is a test message from main_test.go") {
+		t.Errorf("Notification text missing message body: got %v", msg.Text)
+	}
+
+	// 5. Verify the inquiry was stored and marked sent
+	stored, _ := store.ListByStatus(t.Context(), StatusSent)
+	if len(stored) != 1 || stored[0].Email != "test@example.com" || stored[0].Attempts != 1 {
+		t.Errorf("Inquiry not recorded as sent: got %+v", stored)
+	}
+}
+
+func TestContactFormValidation(t *testing.T) {
+	mailer := &MemoryMailer{}
+	router := testApp(App{Mailer: mailer}).Handler()
+
+	tests := []struct {
+		name          string
+		email         string
+		subject       string
+		message       string
+		expectedError string
+	}{
+		{
+			name:          "Invalid Email",
+			email:         "not-an-email",
+			subject:       "Hello",
+			message:       "Valid message",
+			expectedError: "Please enter a valid email address.",
+		},
+		{
+			name:          "Email Too Long",
+			email:         strings.Repeat("a", 250) + "@example.com",
+			subject:       "Hello",
+			message:       "Valid message",
+			expectedError: "Please enter a valid email address.",
+		},
+		{
+			name:          "Markup In Subject",
+			email:         "test@example.com",
+			subject:       "<script>alert(1)</script>",
+			message:       "Valid message",
+			expectedError: "Subject too long or contains invalid characters.",
+		},
+		{
+			name:          "Empty Message",
+			email:         "test@example.com",
+			subject:       "Hello",
+			message:       "   ",
+			expectedError: "Mission parameters required.",
+		},
+		{
+			name:          "Message Too Long",
+			email:         "test@example.com",
+			subject:       "Hello",
+			message:       strings.Repeat("x", 3334),
+			expectedError: "Message exceeds limit.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := newContactForm(tt.email, tt.subject, tt.message)
+
+			rr := postForm(router, "/api/contact", form, true)
+
+			// 1. Verify 422 so HTMX knows the submission was rejected
+			if rr.Code != http.StatusUnprocessableEntity {
+				t.Errorf("Contact handler returned wrong status code: got %v want %v",
+					rr.Code, http.StatusUnprocessableEntity)
+			}
+
+			body := rr.Body.String()
+
+			// 2. Verify the field error is rendered into its slot
+			if !strings.Contains(body, tt.expectedError) {
+				t.Errorf("Contact handler did not render field error %q: got body %v", tt.expectedError, body)
+			}
+
+			// 3. Verify the panel (not the success state) came back with the visitor's email
+			if strings.Contains(body, "Transmission Received") {
+				t.Errorf("Contact handler rendered success for invalid input")
+			}
+			if !strings.Contains(body, `id="contact_target"`) {
+				t.Errorf("Contact handler did not render the contact panel: got body %v", body)
+			}
+			if tt.email != "" && !strings.Contains(body, `value="`+tt.email+`"`) {
+				t.Errorf("Contact handler did not preserve the email value: got body %v", body)
+			}
+		})
+	}
+
+	// Rejected submissions never reach the mailer
+	if n := len(mailer.Sent()); n != 0 {
+		t.Errorf("Contact handler sent %d messages for invalid input", n)
+	}
+}
+
+func TestContactNotificationEscaping(t *testing.T) {
+	mailer := &MemoryMailer{}
+	router := testApp(App{Mailer: mailer}).Handler()
+
+	form := newContactForm("test@example.com", "Hello\r\nBcc: victim@example.com", "Line one <b>bold</b>\nLine two & more")
+
+	req := httptest.NewRequest("POST", "/api/contact", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("HX-Current-URL", "https://stackfoundry.co.uk/#contact")
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Test)")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	sent := mailer.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("Contact handler sent %d messages, want 1", len(sent))
+	}
+	msg := sent[0]
+
+	// 1. Subject is flattened to a single line
+	if strings.ContainsAny(msg.Subject, "\r\n") {
+		t.Errorf("Notification subject contains a line break: %q", msg.Subject)
+	}
+	if msg.Subject != "[StackFoundry] Hello Bcc: victim@example.com" {
+		t.Errorf("Notification subject is %q", msg.Subject)
+	}
+
+	// 2. Visitor markup is escaped in the HTML part and line breaks survive
+	if strings.Contains(msg.HTML, "<b>bold</b>") {
+		t.Errorf("Notification HTML contains unescaped visitor markup")
+	}
+	if !strings.Contains(msg.HTML, "&lt;b&gt;bold&lt;/b&gt;") {
+		t.Errorf("Notification HTML missing escaped message: got %v", msg.HTML)
+	}
+	if !strings.Contains(msg.HTML, "&lt;/b&gt;<br>") || !strings.Contains(msg.HTML, "Line two &amp; more") {
+		t.Errorf("Notification HTML did not preserve the line break: got %v", msg.HTML)
+	}
+
+	// 3. Plain text part is verbatim
+	if !strings.Contains(msg.Text, "Line one <b>bold</b>\nLine two & more") {
+		t.Errorf("Notification text altered the message: got %v", msg.Text)
+	}
+
+	// 4. Request metadata is included
+	for _, want := range []string{"https://stackfoundry.co.uk/#contact", "Mozilla/5.0 (Test)", "Session: "} {
+		if !strings.Contains(msg.Text, want) {
+			t.Errorf("Notification text missing %q: got %v", want, msg.Text)
+		}
+	}
+
+	// 5. The rendered .eml carries no injected header
+	raw, err := msg.Bytes()
+	if err != nil {
+		t.Fatalf("Message.Bytes: %v", err)
+	}
+	headers, _, _ := strings.Cut(string(raw), "\r\n\r\n")
+	if strings.Contains(headers, "\r\nBcc:") {
+		t.Errorf("Raw message contains an injected Bcc header")
+	}
+}
+
+func TestContactDeliveryFailure(t *testing.T) {
+	defer func(b time.Duration) { sendBackoff = b }(sendBackoff)
+	sendBackoff = time.Millisecond
+
+	tests := []struct {
+		name             string
+		mailer           Mailer
+		expectedStatus   int
+		expectedAttempts int
+	}{
+		{
+			name:             "Mailer Rejects",
+			mailer:           &MemoryMailer{Err: errors.New("throttled")},
+			expectedStatus:   http.StatusBadGateway,
+			expectedAttempts: maxSendAttempts,
+		},
+		{
+			name:           "No Mailer Configured",
+			mailer:         nil,
+			expectedStatus: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := testApp(App{Mailer: tt.mailer}).Handler()
+
+			form := newContactForm("test@example.com", "Test Subject", "Please call me back")
+
+			rr := postForm(router, "/api/contact", form, true)
+
+			// 1. Verify the failure status, not a false success
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("Contact handler returned wrong status code: got %v want %v", rr.Code, tt.expectedStatus)
+			}
+
+			body := rr.Body.String()
+			if strings.Contains(body, "Transmission Received") {
+				t.Errorf("Contact handler rendered success for a failed delivery")
+			}
+
+			// 2. Verify the retry form and mailto fallback carry the visitor's draft
+			if !strings.Contains(body, "Transmission Failed") {
+				t.Errorf("Contact handler did not render the failure panel: got body %v", body)
+			}
+			if !strings.Contains(body, `name="message" value="Please call me back"`) {
+				t.Errorf("Failure panel did not preserve the message for retry: got body %v", body)
+			}
+			if !strings.Contains(body, "mailto:"+testSender+"?subject=Test%20Subject&amp;body=Please%20call%20me%20back") {
+				t.Errorf("Failure panel missing mailto fallback: got body %v", body)
+			}
+
+			// 3. Verify the send was retried
+			if m, ok := tt.mailer.(*MemoryMailer); ok && m.Attempts() != tt.expectedAttempts {
+				t.Errorf("Mailer attempted %d sends, want %d", m.Attempts(), tt.expectedAttempts)
+			}
+		})
+	}
+}
+
+func TestContactOutbox(t *testing.T) {
+	defer func(b time.Duration) { sendBackoff = b }(sendBackoff)
+	sendBackoff = time.Millisecond
+
+	mailer := &MemoryMailer{Err: errors.New("throttled")}
+	store := NewMemoryStore()
+	router := testApp(App{Mailer: mailer, Store: store}).Handler()
+
+	form := newContactForm("test@example.com", "Test Subject", "Please call me back")
+
+	rr := postForm(router, "/api/contact", form, false)
+
+	// 1. Stored inquiries are safe, so the visitor sees success even when SES is down
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "Transmission Received") {
+		t.Fatalf("Contact handler did not report success for a stored inquiry: got %v %v", rr.Code, rr.Body.String())
+	}
+
+	failed, _ := store.ListByStatus(t.Context(), StatusFailed)
+	if len(failed) != 1 || failed[0].LastError == "" {
+		t.Fatalf("Inquiry not recorded as failed: got %+v", failed)
+	}
+
+	// 2. Records inside the grace period are left for the request that owns them
+	outbox := &Dispatcher{Store: store, Mailer: mailer, Sender: testSender}
+	mailer.Err = nil
+	if n, _ := outbox.Drain(t.Context()); n != 0 {
+		t.Errorf("Drain delivered %d fresh inquiries, want 0", n)
+	}
+
+	// 3. Once the grace period passes the dispatcher delivers and marks it sent
+	inq := failed[0]
+	inq.UpdatedAt = time.Now().Add(-2 * outboxGrace)
+	store.Update(t.Context(), inq)
+
+	if n, err := outbox.Drain(t.Context()); n != 1 || err != nil {
+		t.Fatalf("Drain delivered %d inquiries (err %v), want 1", n, err)
+	}
+	got, _ := store.Get(t.Context(), inq.ID)
+	if got.Status != StatusSent || got.Attempts != 2 || got.LastError != "" {
+		t.Errorf("Inquiry not marked sent after drain: got %+v", got)
+	}
+	if n := len(mailer.Sent()); n != 1 {
+		t.Errorf("Mailer delivered %d messages, want 1", n)
+	}
+
+	// 4. Dispatchers draining at once claim the record, so only one sends it
+	got.Status, got.UpdatedAt = StatusFailed, time.Now().Add(-2*outboxGrace)
+	got, _ = store.Update(t.Context(), got)
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Go(func() { outbox.Drain(t.Context()) })
+	}
+	wg.Wait()
+	if n := len(mailer.Sent()); n != 2 {
+		t.Errorf("Concurrent drains delivered %d messages in total, want 2", n)
+	}
+
+	// 5. A claim left by a dispatcher that died is taken over once it lapses
+	got, _ = store.Get(t.Context(), inq.ID)
+	got.Status, got.UpdatedAt, got.LeaseUntil = StatusSending, time.Now().Add(-2*outboxGrace), time.Now().Add(outboxLease)
+	got, _ = store.Update(t.Context(), got)
+	if n, _ := outbox.Drain(t.Context()); n != 0 {
+		t.Errorf("Drain delivered %d inquiries under a live claim, want 0", n)
+	}
+	got.LeaseUntil = time.Now().Add(-time.Second)
+	store.Update(t.Context(), got)
+	if n, _ := outbox.Drain(t.Context()); n != 1 {
+		t.Errorf("Drain delivered %d inquiries after the claim lapsed, want 1", n)
+	}
+}
+
+func TestContactSpamDefence(t *testing.T) {
+	consumed := newContactForm("test@example.com", "Hello", "Valid message")
+	testGuard.Spend(context.Background(), consumed.Get(components.FormTokenField))
+
+	tests := []struct {
+		name   string
+		mutate func(form url.Values)
+	}{
+		{
+			name:   "Honeypot Filled",
+			mutate: func(form url.Values) { form.Set(components.HoneypotField, "https://spam.example") },
+		},
+		{
+			name:   "Missing Token",
+			mutate: func(form url.Values) { form.Del(components.FormTokenField) },
+		},
+		{
+			name: "Forged Token",
+			mutate: func(form url.Values) {
+				forged := NewSpamGuard([]byte("other-key")).issueAt(time.Now().Add(-time.Minute))
+				form.Set(components.FormTokenField, forged)
+			},
+		},
+		{
+			name: "Unprefixed Token",
+			mutate: func(form url.Values) {
+				// Signed with the right key but outside the form-token purpose
+				payload := make([]byte, 16)
+				binary.BigEndian.PutUint64(payload, uint64(time.Now().Add(-time.Minute).Unix()))
+				mac := hmac.New(sha256.New, []byte("test-signing-key"))
+				mac.Write(payload)
+				form.Set(components.FormTokenField, base64.RawURLEncoding.EncodeToString(payload)+"."+base64.RawURLEncoding.EncodeToString(mac.Sum(nil)))
+			},
+		},
+		{
+			name: "Too Fast",
+			mutate: func(form url.Values) {
+				form.Set(components.FormTokenField, testGuard.issueAt(time.Now()))
+			},
+		},
+		{
+			name: "Expired Token",
+			mutate: func(form url.Values) {
+				form.Set(components.FormTokenField, testGuard.issueAt(time.Now().Add(-maxFormAge-time.Minute)))
+			},
+		},
+		{
+			name:   "Replayed Token",
+			mutate: func(form url.Values) { form.Set(components.FormTokenField, consumed.Get(components.FormTokenField)) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mailer := &MemoryMailer{}
+			store := NewMemoryStore()
+			router := testApp(App{Mailer: mailer, Store: store}).Handler()
+
+			form := newContactForm("test@example.com", "Hello", "Valid message")
+			tt.mutate(form)
+
+			rr := postForm(router, "/api/contact", form, false)
+
+			// 1. Bots see the same success partial as people
+			if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "Transmission Received") {
+				t.Errorf("Spam submission did not get the success partial: got %v %v", rr.Code, rr.Body.String())
+			}
+
+			// 2. Nothing is stored or sent
+			if n := len(mailer.Sent()); n != 0 {
+				t.Errorf("Spam submission sent %d messages", n)
+			}
+			if pending, _ := store.ListByStatus(t.Context(), StatusSent); len(pending) != 0 {
+				t.Errorf("Spam submission was stored")
+			}
+		})
+	}
+
+	// A genuine submission spends its token, so resubmitting it is blocked
+	mailer := &MemoryMailer{}
+	router := testApp(App{Mailer: mailer}).Handler()
+	form := newContactForm("test@example.com", "Hello", "Valid message")
+	for range 2 {
+		postForm(router, "/api/contact", form, false)
+	}
+	if n := len(mailer.Sent()); n != 1 {
+		t.Errorf("Resubmitted token sent %d messages, want 1", n)
+	}
+}
+
+func TestContactReplayConcurrent(t *testing.T) {
+	mailer := &MemoryMailer{}
+	router := testApp(App{Mailer: mailer}).Handler()
+
+	// The same token and solution under different idempotency keys, as a
+	// bot replaying one captured form in parallel would send
+	form := newContactForm("test@example.com", "Race", "One form, many copies.")
+	var wg sync.WaitGroup
+	for range 8 {
+		copied := url.Values{}
+		for k, v := range form {
+			copied[k] = slices.Clone(v)
+		}
+		copied.Set(components.IdempotencyField, newIdempotencyKey())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			postForm(router, "/api/contact", copied, true)
+		}()
+	}
+	wg.Wait()
+
+	if n := len(mailer.Sent()); n != 1 {
+		t.Errorf("Concurrent replays sent %d messages, want 1", n)
+	}
+}
+
+func TestSpendShared(t *testing.T) {
+	// Two instances with the same key and store, as on Lambda
+	used := NewMemoryIdempotencyStore()
+	a, b := NewSpamGuard([]byte("k")), NewSpamGuard([]byte("k"))
+	a.Used, b.Used = used, used
+	pa, pb := NewProofOfWork([]byte("k")), NewProofOfWork([]byte("k"))
+	pa.Used, pb.Used = used, used
+
+	// 1. A token or challenge is spent once, whichever instance sees it
+	token := a.Issue()
+	if !a.Spend(t.Context(), token) || b.Spend(t.Context(), token) {
+		t.Error("Form token was not spent exactly once across instances")
+	}
+	challenge, _ := pa.Issue(context.Background(), "192.0.2.1")
+	if !pb.Spend(t.Context(), challenge) || pa.Spend(t.Context(), challenge) {
+		t.Error("Challenge was not spent exactly once across instances")
+	}
+
+	// 2. Forgeries are never spendable
+	if NewSpamGuard([]byte("other")).Spend(t.Context(), a.Issue()) {
+		t.Error("Forged token was spent")
+	}
+}
+
+func TestContactProofOfWork(t *testing.T) {
+	mailer := &MemoryMailer{}
+	router := testApp(App{Mailer: mailer}).Handler()
+
+	// 1. The challenge endpoint hands out signed, uncached challenges
+	req := httptest.NewRequest("GET", "/api/challenge", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var issued struct {
+		Challenge  string `json:"challenge"`
+		Difficulty int    `json:"difficulty"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&issued); err != nil || issued.Challenge == "" {
+		t.Fatalf("Challenge endpoint returned %v (err %v)", issued, err)
+	}
+	if cc := rr.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("Challenge endpoint Cache-Control is %q, want no-store", cc)
+	}
+
+	// 2. A solved challenge is accepted once
+	form := newContactForm("test@example.com", "Hello", "Valid message")
+	form.Set(components.PowChallengeField, issued.Challenge)
+	form.Set(components.PowNonceField, solvePow(issued.Challenge, issued.Difficulty))
+	if rr := postForm(router, "/api/contact", form, true); rr.Code != http.StatusOK {
+		t.Fatalf("Solved submission returned %v: %v", rr.Code, rr.Body.String())
+	}
+
+	tests := []struct {
+		name   string
+		mutate func(form url.Values)
+	}{
+		{
+			name: "Missing Solution",
+			mutate: func(form url.Values) {
+				form.Del(components.PowChallengeField)
+				form.Del(components.PowNonceField)
+			},
+		},
+		{
+			name: "Wrong Nonce",
+			mutate: func(form url.Values) {
+				challenge := form.Get(components.PowChallengeField)
+				for n := 0; ; n++ {
+					if leadingZeroBits(sha256.Sum256([]byte(challenge+":"+strconv.Itoa(n)))) == 0 {
+						form.Set(components.PowNonceField, strconv.Itoa(n))
+						return
+					}
+				}
+			},
+		},
+		{
+			name: "Reused Solution",
+			mutate: func(form url.Values) {
+				form.Set(components.PowChallengeField, issued.Challenge)
+				form.Set(components.PowNonceField, solvePow(issued.Challenge, issued.Difficulty))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := newContactForm("test@example.com", "Hello", "Valid message")
+			tt.mutate(form)
+			rr := postForm(router, "/api/contact", form, true)
+
+			if rr.Code != http.StatusUnprocessableEntity {
+				t.Errorf("Contact handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+			}
+			if !strings.Contains(rr.Body.String(), `id="form_error"`) {
+				t.Errorf("Contact handler did not render the form error: got body %v", rr.Body.String())
+			}
+		})
+	}
+
+	if n := len(mailer.Sent()); n != 1 {
+		t.Errorf("Mailer delivered %d messages, want 1", n)
+	}
+
+	// 3. A plain POST from a browser without JavaScript needs a form open
+	// well past the time trap, and a client gets only a few of them
+	plainApp := testApp(App{Mailer: mailer})
+	plainApp.Pow = newTestPow()
+	plainRouter := plainApp.Handler()
+	postPlain := func(age time.Duration) *httptest.ResponseRecorder {
+		plain := newContactForm("test@example.com", "Hello", "Valid message")
+		plain.Del(components.PowChallengeField)
+		plain.Del(components.PowNonceField)
+		plain.Set(components.FormTokenField, testGuard.issueAt(time.Now().Add(-age)))
+		return postForm(plainRouter, "/api/contact", plain, false)
+	}
+	if rr := postPlain(5 * time.Second); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Quick plain submission: status %d, want 422", rr.Code)
+	}
+	for i := range powPlainPolicy.Burst {
+		if rr := postPlain(time.Minute); rr.Code != http.StatusOK {
+			t.Fatalf("Plain submission %d: status %d", i+1, rr.Code)
+		}
+	}
+	if rr := postPlain(time.Minute); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Plain submission past the limit: status %d, want 422", rr.Code)
+	}
+	if n := len(mailer.Sent()); n != 1+powPlainPolicy.Burst {
+		t.Errorf("Mailer delivered %d messages, want %d", n, 1+powPlainPolicy.Burst)
+	}
+
+	// 4. Difficulty climbs with one client's challenge rate and is capped
+	ctx := t.Context()
+	pow := NewProofOfWork([]byte("k"))
+	if _, d := pow.Issue(ctx, "192.0.2.1"); d != powBaseBits {
+		t.Errorf("Idle difficulty is %d, want %d", d, powBaseBits)
+	}
+	var d int
+	for range powRateThreshold*4 - 1 {
+		_, d = pow.Issue(ctx, "192.0.2.1")
+	}
+	if d != powBaseBits+2 {
+		t.Errorf("Difficulty at 4x threshold is %d, want %d", d, powBaseBits+2)
+	}
+	for range powRateThreshold * 1000 {
+		_, d = pow.Issue(ctx, "192.0.2.1")
+	}
+	if d != powMaxBits {
+		t.Errorf("Difficulty under flood is %d, want cap %d", d, powMaxBits)
+	}
+
+	// 5. Other clients are not slowed by the flood
+	if _, d := pow.Issue(ctx, "198.51.100.7"); d != powBaseBits {
+		t.Errorf("Another client's difficulty is %d, want %d", d, powBaseBits)
+	}
+
+	// 6. The count is shared, so another instance sees the flood too
+	other := NewProofOfWork([]byte("k"))
+	other.Rates = pow.Rates
+	if _, d := other.Issue(ctx, "192.0.2.1"); d != powMaxBits {
+		t.Errorf("Another instance's difficulty is %d, want %d", d, powMaxBits)
+	}
+}
+
+func TestContactAcknowledgement(t *testing.T) {
+	mailer := &MemoryMailer{}
+	ack := &Acknowledger{
+		Mailer:         mailer,
+		Sender:         testSender,
+		Limiter:        NewMemoryRateBackend(),
+		Policy:         RatePolicy{Name: "ack", Rate: 1.0 / 86400, Burst: 2},
+		ResponseWindow: "24 hours",
+	}
+	router := testApp(App{Mailer: mailer, Ack: ack}).Handler()
+
+	post := func(email string) string {
+		form := newContactForm(email, "Hello", "Line one <b>bold</b>")
+		rr := postForm(router, "/api/contact", form, false)
+		return rr.Body.String()
+	}
+
+	body := post("visitor@example.com")
+
+	// 1. The visitor gets a copy, with the reference shown on screen
+	sent := mailer.Sent()
+	if len(sent) != 2 {
+		t.Fatalf("Mailer delivered %d messages, want notification + acknowledgement", len(sent))
+	}
+	notification, acknowledgement := sent[0], sent[1]
+	if len(acknowledgement.To) != 1 || acknowledgement.To[0] != "visitor@example.com" {
+		t.Errorf("Acknowledgement sent to %v", acknowledgement.To)
+	}
+
+	ref := acknowledgement.Subject[strings.Index(acknowledgement.Subject, "[SF-")+1 : len(acknowledgement.Subject)-1]
+	if !strings.Contains(body, ref) {
+		t.Errorf("Success panel does not show reference %s: got body %v", ref, body)
+	}
+	if !strings.Contains(notification.Text, "Reference: "+ref) {
+		t.Errorf("Notification does not carry reference %s: got %v", ref, notification.Text)
+	}
+	for _, want := range []string{ref, "24 hours", "Line one <b>bold</b>"} {
+		if !strings.Contains(acknowledgement.Text, want) {
+			t.Errorf("Acknowledgement text missing %q: got %v", want, acknowledgement.Text)
+		}
+	}
+	if strings.Contains(acknowledgement.HTML, "<b>bold</b>") {
+		t.Errorf("Acknowledgement HTML contains unescaped visitor markup")
+	}
+
+	// 2. The same recipient is only acknowledged up to the limit, in any letter case
+	post("Visitor@Example.com")
+	post("visitor@example.com")
+	acks := 0
+	for _, msg := range mailer.Sent() {
+		if msg.To[0] != testSender {
+			acks++
+		}
+	}
+	if acks != 2 {
+		t.Errorf("Recipient was acknowledged %d times, want 2", acks)
+	}
+	if n := len(mailer.Sent()) - acks; n != 3 {
+		t.Errorf("Notifications sent = %d, want 3 (the limit only applies to acknowledgements)", n)
+	}
+
+	// 3. The acknowledgement has its own budget, so it still goes out after
+	// the visitor has gone
+	visitorGone := &MemoryMailer{}
+	ack.Mailer = ctxMailer{visitorGone}
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	testApp(App{Mailer: mailer, Ack: ack}).accepted(ctx, Inquiry{ID: newInquiryID(time.Now()), Email: "other@example.com"})
+	if n := len(visitorGone.Sent()); n != 1 {
+		t.Errorf("Acknowledgements sent after the request ended = %d, want 1", n)
+	}
+}
+
+// ctxMailer fails sends whose context is done, as a real transport would
+type ctxMailer struct{ *MemoryMailer }
+
+func (m ctxMailer) Send(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.MemoryMailer.Send(ctx, msg)
+}
+
+func TestContactAttachments(t *testing.T) {
+	pdf := []byte("%PDF-1.7\n1 0 obj\n<<>>\nendobj\n%%EOF\n")
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+	post := func(router http.Handler, files map[string][]byte) *httptest.ResponseRecorder {
+		body, contentType := newMultipartContact(t, newContactForm("test@example.com", "Brief", "Spec attached"), files)
+		req := httptest.NewRequest("POST", "/api/contact", body)
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("HX-Request", "true")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// 1. Accepted files travel with the notification and their metadata is stored
+	mailer := &MemoryMailer{}
+	store := NewMemoryStore()
+	rr := post(testApp(App{Mailer: mailer, Store: store}).Handler(), map[string][]byte{"brief.pdf": pdf, "wireframe.png": png})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Upload rejected: got %v %v", rr.Code, rr.Body.String())
+	}
+	sent := mailer.Sent()
+	if len(sent) != 1 || len(sent[0].Attachments) != 2 {
+		t.Fatalf("Notification did not carry both attachments: got %+v", sent)
+	}
+	if a := sent[0].Attachments[0]; a.Filename != "brief.pdf" || a.ContentType != "application/pdf" || !bytes.Equal(a.Data, pdf) {
+		t.Errorf("First attachment = %s %s (%d bytes)", a.Filename, a.ContentType, len(a.Data))
+	}
+	sentInqs, _ := store.ListByStatus(context.Background(), StatusSent)
+	if len(sentInqs) != 1 || len(sentInqs[0].Attachments) != 2 || sentInqs[0].Attachments[1].SHA256 == "" {
+		t.Errorf("Stored inquiry missing attachment metadata: got %+v", sentInqs)
+	}
+
+	// 2. Rejected uploads come back with the visitor's values and an attachments error
+	tests := []struct {
+		name   string
+		files  map[string][]byte
+		status int
+		want   string
+	}{
+		{"Renamed Executable", map[string][]byte{"brief.pdf": []byte("MZ\x90\x00")}, http.StatusUnprocessableEntity, "brief.pdf is not a PDF, PNG or DOCX file."},
+		{"Extension Mismatch", map[string][]byte{"brief.png": pdf}, http.StatusUnprocessableEntity, "brief.png is not a PDF, PNG or DOCX file."},
+		{"Disallowed Type", map[string][]byte{"notes.txt": []byte("hello")}, http.StatusUnprocessableEntity, "notes.txt is not a PDF, PNG or DOCX file."},
+		{"Too Many Files", map[string][]byte{"a.pdf": pdf, "b.pdf": pdf, "c.pdf": pdf, "d.pdf": pdf}, http.StatusUnprocessableEntity, "Attach at most 3 files."},
+		{"File Too Large", map[string][]byte{"big.pdf": append(append([]byte{}, pdf...), make([]byte, maxAttachmentBytes)...)}, http.StatusUnprocessableEntity, "big.pdf is larger than 3.0 MB."},
+		{"Body Too Large", map[string][]byte{"a.pdf": make([]byte, maxAttachmentBytes), "b.pdf": make([]byte, maxAttachmentBytes)}, http.StatusRequestEntityTooLarge, "Attachments must total 4.0 MB or less."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mailer := &MemoryMailer{}
+			rr := post(testApp(App{Mailer: mailer}).Handler(), tt.files)
+
+			if rr.Code != tt.status {
+				t.Fatalf("Status = %v, want %v: %v", rr.Code, tt.status, rr.Body.String())
+			}
+			body := rr.Body.String()
+			if !strings.Contains(body, `id="attachments_error"`) || !strings.Contains(body, tt.want) {
+				t.Errorf("Panel missing attachments error %q: got %v", tt.want, body)
+			}
+			if tt.status == http.StatusUnprocessableEntity && !strings.Contains(body, `value="test@example.com"`) {
+				t.Errorf("Panel lost the visitor's email")
+			}
+			if n := mailer.Attempts(); n != 0 {
+				t.Errorf("Mailer called %d times for a rejected upload", n)
+			}
+		})
+	}
+
+	// 3. Outbox retries only have the metadata, so the notification says so
+	inq := sentInqs[0]
+	n := inq.Notification()
+	var text bytes.Buffer
+	components.InquiryEmailText(n).Render(context.Background(), &text)
+	if !strings.Contains(text.String(), "brief.pdf") || !strings.Contains(text.String(), "not retained") {
+		t.Errorf("Retried notification does not flag missing attachments: got %v", text.String())
+	}
+
+	// 4. A failed first send with files is not left for a retry without
+	// them; the visitor is asked to send again instead
+	defer func(b time.Duration) { sendBackoff = b }(sendBackoff)
+	sendBackoff = time.Millisecond
+	mailer = &MemoryMailer{Err: errors.New("throttled")}
+	store = NewMemoryStore()
+	rr = post(testApp(App{Mailer: mailer, Store: store}).Handler(), map[string][]byte{"brief.pdf": pdf})
+	if rr.Code != http.StatusBadGateway {
+		t.Errorf("Failed send with attachments: status %v, want 502", rr.Code)
+	}
+	if all, _ := store.List(context.Background()); len(all) != 0 {
+		t.Errorf("Store kept %d inquiries whose files were never sent", len(all))
+	}
+}
+
+func TestContactRouting(t *testing.T) {
+	table, err := parseRoutingTable([]byte(`{"routes": [
+		{"name": "audit", "services": ["audit"], "recipients": ["audits@example.com", "joe@example.com"], "subject_prefix": "[SF/Audit]", "priority": "P2"},
+		{"name": "general", "recipients": ["hello@example.com"]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailer := &MemoryMailer{}
+	store := NewMemoryStore()
+	router := testApp(App{Mailer: mailer, Store: store, Routes: table}).Handler()
+
+	post := func(service, subject string) *httptest.ResponseRecorder {
+		form := newContactForm("test@example.com", subject, "Please review our stack")
+		form.Set("service", service)
+		return postForm(router, "/api/contact", form, false)
+	}
+
+	// 1. The chosen service picks the recipients, prefix and priority tag
+	if rr := post("audit", ""); rr.Code != http.StatusOK {
+		t.Fatalf("Routed submission failed: got %v %v", rr.Code, rr.Body.String())
+	}
+	msg := mailer.Sent()[0]
+	if strings.Join(msg.To, ",") != "audits@example.com,joe@example.com" {
+		t.Errorf("Notification sent to %v", msg.To)
+	}
+	if want := "[SF/Audit] [P2] Architecture Audit"; msg.Subject != want {
+		t.Errorf("Subject = %q, want %q", msg.Subject, want)
+	}
+	if !strings.Contains(msg.Text, "Service: Architecture Audit") || !strings.Contains(msg.Text, "Priority: P2") {
+		t.Errorf("Notification missing service or priority: got %v", msg.Text)
+	}
+
+	// 2. The decision is stored so outbox retries go to the same place
+	sent, _ := store.ListByStatus(context.Background(), StatusSent)
+	if len(sent) != 1 || sent[0].Service != "audit" || sent[0].Routing.Route != "audit" {
+		t.Errorf("Stored inquiry missing routing: got %+v", sent)
+	}
+
+	// 3. No service falls through to the catch-all
+	post("", "Hello")
+	if msg := mailer.Sent()[1]; msg.To[0] != "hello@example.com" || msg.Subject != "[StackFoundry] Hello" {
+		t.Errorf("General inquiry routed to %v with subject %q", msg.To, msg.Subject)
+	}
+
+	// 4. Forged service IDs are rejected, not silently routed to the catch-all
+	rr := post("<script>", "Hello")
+	if rr.Code != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), "Choose a service line from the list.") {
+		t.Errorf("Unknown service accepted: got %v", rr.Code)
+	}
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"stackfoundry.co.uk/components"
+)
+
+// newInquiry collects a validated submission and the request metadata we
+// want alongside it in the inbox. The subject is flattened here because it
+// ends up in a mail header.
+func newInquiry(r *http.Request, form components.ContactFormState, files []Attachment, now time.Time) Inquiry {
+	sessionID, _ := r.Context().Value(SessionKey).(string)
+	inq := Inquiry{
+		ID:        newInquiryID(now),
+		Status:    StatusPending,
+		Email:     form.Email,
+		Service:   form.Service,
+		Subject:   sanitizeHeader(form.Subject),
+		Message:   form.Message,
+		SessionID: sessionID,
+		Referrer:  r.Header.Get("HX-Current-URL"),
+		UserAgent: r.UserAgent(),
+		CreatedAt: now,
+		UpdatedAt: now,
+		files:     files,
+	}
+	for _, f := range files {
+		inq.Attachments = append(inq.Attachments, f.Meta())
+	}
+	return inq
+}
+
+// Notification is the view of the inquiry rendered into the email
+func (inq Inquiry) Notification() components.InquiryNotification {
+	return components.InquiryNotification{
+		Reference:   inq.Reference(),
+		Email:       inq.Email,
+		Service:     components.ServiceLabel(inq.Service),
+		Subject:     inq.Subject,
+		Message:     inq.Message,
+		SessionID:   inq.SessionID,
+		Referrer:    inq.Referrer,
+		UserAgent:   inq.UserAgent,
+		ReceivedAt:  inq.CreatedAt,
+		Attachments: attachmentSummaries(inq.Attachments, len(inq.files) == len(inq.Attachments)),
+		Route:       inq.Routing.Route,
+		Priority:    inq.Routing.Priority,
+		Brief:       inq.briefLines(),
+		EmailFlags:  inq.emailFlags(),
+		SpamScore:   inq.SpamScore,
+	}
+}
+
+func (inq Inquiry) emailFlags() []string {
+	if inq.Screening == nil {
+		return nil
+	}
+	return inq.Screening.Flags()
+}
+
+func (inq Inquiry) briefLines() []components.BriefLine {
+	if inq.Brief == nil {
+		return nil
+	}
+	return inq.Brief.Lines()
+}
+
+func attachmentSummaries(metas []AttachmentMeta, attached bool) []components.AttachmentSummary {
+	var out []components.AttachmentSummary
+	for _, m := range metas {
+		out = append(out, components.AttachmentSummary{Filename: m.Filename, Size: formatBytes(m.Size), Attached: attached})
+	}
+	return out
+}
+
+// sendEmail renders the notification (HTML plus plain text) and hands it to
+// the mailer with any uploaded files, addressed as the inquiry's routing
+// says, retrying within the context deadline.
+func sendEmail(ctx context.Context, mailer Mailer, from string, inq Inquiry) (attempts int, err error) {
+	n := inq.Notification()
+	var html, text bytes.Buffer
+	if err := components.InquiryEmailHTML(n).Render(ctx, &html); err != nil {
+		return 0, err
+	}
+	if err := components.InquiryEmailText(n).Render(ctx, &text); err != nil {
+		return 0, err
+	}
+
+	routing := inq.Routing
+	if len(routing.Recipients) == 0 {
+		routing = defaultRouting
+		routing.Recipients = []string{from}
+	}
+
+	return sendWithRetry(ctx, mailer, Message{
+		From:        from,
+		To:          routing.Recipients,
+		ReplyTo:     []string{sanitizeHeader(n.Email)},
+		Subject:     routing.subject(n),
+		Text:        text.String(),
+		HTML:        html.String(),
+		Attachments: inq.files,
+	})
+}
+
+// sanitizeHeader flattens a visitor-supplied value into a single header-safe
+// line: CR, LF and other control characters become spaces, runs of
+// whitespace collapse, so nothing can smuggle in extra headers.
+func sanitizeHeader(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, s)
+	return strings.Join(strings.Fields(s), " ")
+}
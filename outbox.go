@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// Outbox policy. Records younger than outboxGrace are left alone so the
+// dispatcher never races the request that is delivering them right now.
+// A claim lasts outboxLease, well past one delivery's deadline, so a
+// dispatcher that died mid-send is taken over on a later drain.
+const (
+	outboxGrace         = time.Minute
+	outboxLease         = time.Minute
+	outboxInterval      = time.Minute
+	maxDeliveryAttempts = 10
+)
+
+var (
+	errNoMailer      = errors.New("no mailer configured")
+	errOutboxClaimed = errors.New("inquiry claimed by another dispatcher")
+)
+
+// Dispatcher: Delivers notifications for stored inquiries and records the
+// outcome on each record. The contact handler calls Deliver straight after
+// saving; Drain picks up anything that failed or was never attempted.
+type Dispatcher struct {
+	Store  InquiryStore
+	Mailer Mailer
+	Sender string       // From address, and the inbox for unrouted inquiries
+	Logger *slog.Logger // nil uses slog.Default
+}
+
+// Deliver claims inq, sends its notification and marks it sent or failed.
+// It returns errOutboxClaimed without sending if another dispatcher holds
+// it or it no longer needs sending.
+func (d *Dispatcher) Deliver(ctx context.Context, inq Inquiry) (Inquiry, error) {
+	files := inq.files // the store keeps metadata only
+	inq, err := d.claim(ctx, inq)
+	inq.files = files
+	if err != nil {
+		if !errors.Is(err, errOutboxClaimed) {
+			d.logger().Error("store_failure", slog.String("inquiry", inq.ID), slog.Any("error", err))
+		}
+		return inq, err
+	}
+
+	attempts, err := 0, errNoMailer
+	if d.Mailer != nil {
+		attempts, err = sendEmail(ctx, d.Mailer, d.Sender, inq)
+	}
+
+	inq.Attempts++
+	inq.UpdatedAt = time.Now()
+	inq.LeaseUntil = time.Time{}
+	if err != nil {
+		inq.Status = StatusFailed
+		inq.LastError = err.Error()
+		d.logger().Error("ses_failure", slog.String("inquiry", inq.ID), slog.Any("error", err), slog.Int("attempts", attempts))
+		if inq.Attempts >= maxDeliveryAttempts {
+			// Drain stops here; the inquiry is only in the store and /admin now
+			d.logger().Error("outbox_abandoned", slog.String("inquiry", inq.ID), slog.Int("deliveries", inq.Attempts))
+		}
+	} else {
+		inq.Status = StatusSent
+		inq.LastError = ""
+		d.logger().Info("ses_success", slog.String("inquiry", inq.ID), slog.String("recipient", inq.Email), slog.Int("attempts", attempts))
+	}
+
+	// Recording the outcome must not be cut short by the request deadline
+	uctx := context.WithoutCancel(ctx)
+	updated, uerr := d.Store.Update(uctx, inq)
+	if errors.Is(uerr, ErrInquiryConflict) {
+		// An admin filed or annotated it meanwhile: keep their change and
+		// record the outcome on top of it
+		var cur Inquiry
+		if cur, uerr = d.Store.Get(uctx, inq.ID); uerr == nil {
+			cur.Status, cur.Attempts, cur.LastError, cur.UpdatedAt, cur.LeaseUntil = inq.Status, inq.Attempts, inq.LastError, inq.UpdatedAt, inq.LeaseUntil
+			updated, uerr = d.Store.Update(uctx, cur)
+		}
+	}
+	if uerr != nil {
+		d.logger().Error("store_failure", slog.String("inquiry", inq.ID), slog.Any("error", uerr))
+		return inq, err
+	}
+	return updated, err
+}
+
+// claim marks inq as sending under a lease, conditional on the version read,
+// so of two dispatchers that read the same record only one sends it. A
+// conflict is re-read once, since an admin edit also bumps the version.
+func (d *Dispatcher) claim(ctx context.Context, inq Inquiry) (Inquiry, error) {
+	for range 2 {
+		if !claimable(inq, time.Now()) {
+			return inq, errOutboxClaimed
+		}
+		claimed := inq
+		claimed.Status = StatusSending
+		claimed.LeaseUntil = time.Now().Add(outboxLease)
+		updated, err := d.Store.Update(ctx, claimed)
+		if !errors.Is(err, ErrInquiryConflict) {
+			return updated, err
+		}
+		if inq, err = d.Store.Get(ctx, inq.ID); err != nil {
+			return inq, err
+		}
+	}
+	return inq, errOutboxClaimed
+}
+
+// claimable: Waiting to be sent, or claimed by a dispatcher whose lease lapsed
+func claimable(inq Inquiry, now time.Time) bool {
+	switch inq.Status {
+	case StatusPending, StatusFailed:
+		return true
+	case StatusSending:
+		return now.After(inq.LeaseUntil)
+	}
+	return false
+}
+
+// Drain retries every pending or failed inquiry that is past the grace period
+// and under the attempt cap, and any whose claim has lapsed. It returns how
+// many were delivered. A nil Dispatcher has nothing to drain.
+func (d *Dispatcher) Drain(ctx context.Context) (int, error) {
+	if d == nil {
+		return 0, nil
+	}
+	sent := 0
+	for _, status := range []InquiryStatus{StatusPending, StatusFailed, StatusSending} {
+		inqs, err := d.Store.ListByStatus(ctx, status)
+		if err != nil {
+			return sent, err
+		}
+		for _, inq := range inqs {
+			if inq.Attempts >= maxDeliveryAttempts || time.Since(inq.UpdatedAt) < outboxGrace || !claimable(inq, time.Now()) {
+				continue
+			}
+			if ctx.Err() != nil {
+				return sent, ctx.Err()
+			}
+			dctx, cancel := context.WithTimeout(ctx, deliveryTimeout)
+			if _, err := d.Deliver(dctx, inq); err == nil {
+				sent++
+			}
+			cancel()
+		}
+	}
+	return sent, nil
+}
+
+// Run drains the outbox every interval until ctx is cancelled. It is for
+// local runs only; on Lambda an EventBridge rule drains it on a schedule
+// instead (see lambdaHandler).
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if n, err := d.Drain(ctx); err != nil {
+				d.logger().Error("outbox_drain_failed", slog.Any("error", err))
+			} else if n > 0 {
+				d.logger().Info("outbox_drained", slog.Int("sent", n))
+			}
+		}
+	}
+}
+
+func (d *Dispatcher) logger() *slog.Logger {
+	if d.Logger == nil {
+		return slog.Default()
+	}
+	return d.Logger
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"math/bits"
+	"net/http"
+	"strings"
+	"time"
+
+	"stackfoundry.co.uk/components"
+)
+
+// Proof-of-work defaults. 16 bits is ~65k hashes, well under a second in a
+// browser; each doubling of a client's challenge rate past the threshold adds
+// a bit. A visitor needs one challenge per submission.
+const (
+	powBaseBits      = 16
+	powMaxBits       = 22
+	powRateThreshold = 5 // challenges per minute from one client before difficulty rises
+	powTTL           = 10 * time.Minute
+)
+
+// Plain submissions, from browsers without JavaScript, cannot do the work.
+// Instead the form must have been open far longer than the usual time trap,
+// and each client gets only a few an hour.
+const powPlainMinAge = 20 * time.Second
+
+var powPlainPolicy = RatePolicy{Name: "plain", Rate: 3.0 / 3600, Burst: 3}
+
+// ProofOfWork: Issues HMAC-signed challenges and verifies their solutions.
+// A solution is a nonce such that SHA-256(challenge ":" nonce) starts with
+// at least the challenge's difficulty in zero bits. No third party involved.
+// Spent challenges are claimed in Used, shared like SpamGuard's. Rates counts
+// challenges and limits plain submissions per client; on Lambda it is the
+// shared backend, so neither resets from one instance to the next.
+type ProofOfWork struct {
+	BaseBits      int
+	MaxBits       int
+	RateThreshold int
+	Used          IdempotencyStore
+	Rates         RateLimitBackend
+	Logger        *slog.Logger // nil uses slog.Default
+
+	key []byte
+}
+
+func NewProofOfWork(key []byte) *ProofOfWork {
+	return &ProofOfWork{
+		BaseBits:      powBaseBits,
+		MaxBits:       powMaxBits,
+		RateThreshold: powRateThreshold,
+		Used:          NewMemoryIdempotencyStore(),
+		Rates:         NewMemoryRateBackend(),
+		key:           key,
+	}
+}
+
+// difficultyFor raises the target with a client's recent challenge rate, so
+// one busy client pays without slowing the rest
+func (p *ProofOfWork) difficultyFor(rate int) int {
+	if rate <= p.RateThreshold {
+		return p.BaseBits
+	}
+	extra := int(math.Ceil(math.Log2(float64(rate) / float64(p.RateThreshold))))
+	return min(p.BaseBits+extra, p.MaxBits)
+}
+
+// Issue returns a signed challenge for client and its difficulty. If the
+// count cannot be read the base difficulty is used.
+func (p *ProofOfWork) Issue(ctx context.Context, client string) (string, int) {
+	now := time.Now()
+	difficulty := p.BaseBits
+	if cur, prev, err := p.Rates.Count(ctx, "pow:"+client, time.Minute); err != nil {
+		p.logger().ErrorContext(ctx, "pow_rate_failed", slog.Any("error", err))
+	} else {
+		difficulty = p.difficultyFor(max(cur, prev))
+	}
+
+	payload := make([]byte, 17)
+	binary.BigEndian.PutUint64(payload, uint64(now.Unix()))
+	payload[8] = byte(difficulty)
+	rand.Read(payload[9:])
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(p.sign(payload)), difficulty
+}
+
+func (p *ProofOfWork) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte("pow:"))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// Verify reports whether nonce solves challenge, which must be ours and
+// unexpired. It does not spend the challenge; Spend does.
+func (p *ProofOfWork) Verify(challenge, nonce string) bool {
+	payload, ok := p.verifySignature(challenge)
+	if !ok || nonce == "" || len(nonce) > 20 {
+		return false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(payload)), 0)
+	if time.Since(issued) > powTTL {
+		return false
+	}
+	return leadingZeroBits(sha256.Sum256([]byte(challenge+":"+nonce))) >= int(payload[8])
+}
+
+// Spend atomically marks the challenge as used and reports whether this call
+// was the one that did, so each solution buys exactly one submission.
+func (p *ProofOfWork) Spend(ctx context.Context, challenge string) bool {
+	payload, ok := p.verifySignature(challenge)
+	if !ok {
+		return false
+	}
+	return spend(ctx, p.logger(), p.Used, "pow:"+hex.EncodeToString(payload[9:]), powTTL)
+}
+
+func (p *ProofOfWork) verifySignature(challenge string) ([]byte, bool) {
+	enc, sig, ok := strings.Cut(challenge, ".")
+	if !ok {
+		return nil, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil || len(payload) != 17 {
+		return nil, false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, p.sign(payload)) {
+		return nil, false
+	}
+	return payload, true
+}
+
+func leadingZeroBits(sum [32]byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// handleChallenge issues a fresh challenge for public/js/pow.js to solve
+func handleChallenge(pow *ProofOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		challenge, difficulty := pow.Issue(r.Context(), clientIP(r))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(map[string]any{
+			"challenge":  challenge,
+			"difficulty": difficulty,
+		})
+	}
+}
+
+// powFields reads the solved challenge from the submitted form
+func powFields(r *http.Request) (challenge, nonce string) {
+	return r.FormValue(components.PowChallengeField), r.FormValue(components.PowNonceField)
+}
+
+// powPlain reports whether a submission is a plain form POST, as a browser
+// without JavaScript sends. htmx requests always come from a browser that
+// can solve a challenge, so they never count.
+func powPlain(r *http.Request, challenge, nonce string) bool {
+	return r.Header.Get("HX-Request") == "" && challenge == "" && nonce == ""
+}
+
+// Plain checks a plain submission in place of a solution: its form token
+// (age, from SpamGuard.Age) must be at least powPlainMinAge old, and client
+// must be within powPlainPolicy. A failing store refuses, since nothing else
+// stands in for the work.
+func (p *ProofOfWork) Plain(ctx context.Context, client string, age time.Duration) bool {
+	if age < powPlainMinAge {
+		return false
+	}
+	ok, _, err := p.Rates.Take(ctx, "pow-plain:"+client, powPlainPolicy)
+	if err != nil {
+		p.logger().ErrorContext(ctx, "pow_rate_failed", slog.Any("error", err))
+		return false
+	}
+	return ok
+}
+
+// Passes checks and spends a submission's solution, or applies Plain to a
+// plain submission. tokenAge is the form token's age from SpamGuard.Age.
+func (p *ProofOfWork) Passes(r *http.Request, tokenAge time.Duration) (ok, plain bool) {
+	challenge, nonce := powFields(r)
+	if powPlain(r, challenge, nonce) {
+		return p.Plain(r.Context(), clientIP(r), tokenAge), true
+	}
+	return p.Verify(challenge, nonce) && p.Spend(r.Context(), challenge), false
+}
+
+// powFailure is the form error for a submission that failed proof of work
+func powFailure(plain bool, sender string) string {
+	if plain {
+		return "We could not verify your browser. Wait a minute before sending, or enable JavaScript and retry, or email " + sender + "."
+	}
+	return "Browser verification failed. Enable JavaScript and retry, or email " + sender + "."
+}
+
+func (p *ProofOfWork) logger() *slog.Logger {
+	if p.Logger == nil {
+		return slog.Default()
+	}
+	return p.Logger
+}
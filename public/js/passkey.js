@@ -0,0 +1,79 @@
+// Passkey sign-in and registration for forms marked data-passkey. The form's
+// fields go to data-options, which answers with WebAuthn options (binary
+// fields as base64url); the browser's credential then goes to data-verify
+// along with the same fields, and we follow the redirect it returns.
+(function () {
+  function fromB64(s) {
+    s = s.replace(/-/g, '+').replace(/_/g, '/');
+    return Uint8Array.from(atob(s + '==='.slice((s.length + 3) % 4)), c => c.charCodeAt(0));
+  }
+
+  function toB64(buf) {
+    if (!buf) return '';
+    return btoa(String.fromCharCode(...new Uint8Array(buf)))
+      .replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+  }
+
+  async function post(url, body) {
+    const res = await fetch(url, {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json', 'Accept': 'application/json' },
+      credentials: 'same-origin',
+      body: JSON.stringify(body),
+    });
+    if (!res.ok) throw new Error((await res.text()).trim() || 'Something went wrong.');
+    return res.json();
+  }
+
+  async function register(publicKey) {
+    publicKey.challenge = fromB64(publicKey.challenge);
+    publicKey.user.id = fromB64(publicKey.user.id);
+    publicKey.excludeCredentials.forEach(c => { c.id = fromB64(c.id); });
+    const cred = await navigator.credentials.create({ publicKey });
+    return {
+      id: cred.id,
+      clientDataJSON: toB64(cred.response.clientDataJSON),
+      attestationObject: toB64(cred.response.attestationObject),
+    };
+  }
+
+  async function login(publicKey) {
+    publicKey.challenge = fromB64(publicKey.challenge);
+    publicKey.allowCredentials.forEach(c => { c.id = fromB64(c.id); });
+    const cred = await navigator.credentials.get({ publicKey });
+    return {
+      id: cred.id,
+      clientDataJSON: toB64(cred.response.clientDataJSON),
+      authenticatorData: toB64(cred.response.authenticatorData),
+      signature: toB64(cred.response.signature),
+      userHandle: toB64(cred.response.userHandle),
+    };
+  }
+
+  document.addEventListener('submit', async function (e) {
+    const form = e.target;
+    if (!form.matches('form[data-passkey]')) return;
+    e.preventDefault();
+
+    const status = form.querySelector('[data-passkey-status]');
+    const button = form.querySelector('button');
+    if (!window.PublicKeyCredential) {
+      status.textContent = 'This browser does not support passkeys.';
+      return;
+    }
+
+    const fields = Object.fromEntries(new FormData(form));
+    button.disabled = true;
+    status.textContent = '';
+    try {
+      const { publicKey } = await post(form.dataset.options, fields);
+      const credential = form.dataset.passkey === 'register' ? await register(publicKey) : await login(publicKey);
+      const { redirect } = await post(form.dataset.verify, { ...fields, credential });
+      window.location.assign(redirect);
+    } catch (err) {
+      // NotAllowedError is the user cancelling or the prompt timing out
+      status.textContent = err.name === 'NotAllowedError' ? 'Cancelled.' : err.message;
+      button.disabled = false;
+    }
+  });
+})();
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"stackfoundry.co.uk/components"
+)
+
+// Brief: The answers from the /project wizard, stored with the inquiry they
+// were submitted with. Values are option IDs from components.QualifySteps.
+type Brief struct {
+	Project    string   `json:"project"`
+	Budget     string   `json:"budget"`
+	Timeline   string   `json:"timeline"`
+	Team       string   `json:"team"`
+	Stack      []string `json:"stack,omitempty"`
+	StackOther string   `json:"stack_other,omitempty"`
+}
+
+// answers returns what was chosen for a step, by the step's ID
+func (b Brief) answers(step string) []string {
+	var v string
+	switch step {
+	case "project":
+		v = b.Project
+	case "budget":
+		v = b.Budget
+	case "timeline":
+		v = b.Timeline
+	case "team":
+		v = b.Team
+	case "stack":
+		return b.Stack
+	}
+	if v == "" {
+		return nil
+	}
+	return []string{v}
+}
+
+func (b *Brief) set(step string, values []string, other string) {
+	first := ""
+	if len(values) > 0 {
+		first = values[0]
+	}
+	switch step {
+	case "project":
+		b.Project = first
+	case "budget":
+		b.Budget = first
+	case "timeline":
+		b.Timeline = first
+	case "team":
+		b.Team = first
+	case "stack":
+		b.Stack, b.StackOther = values, other
+	}
+}
+
+// Complete reports whether every step has been answered
+func (b Brief) Complete() bool {
+	for _, s := range components.QualifySteps {
+		if len(b.answers(s.ID)) == 0 && !(s.ID == "stack" && b.StackOther != "") {
+			return false
+		}
+	}
+	return true
+}
+
+// Lines renders the brief for people: one line per step, labels not IDs
+func (b Brief) Lines() []components.BriefLine {
+	var out []components.BriefLine
+	for _, s := range components.QualifySteps {
+		var labels []string
+		for _, id := range b.answers(s.ID) {
+			labels = append(labels, components.QualifyLabel(s.ID, id))
+		}
+		if s.ID == "stack" && b.StackOther != "" {
+			labels = append(labels, b.StackOther)
+		}
+		if len(labels) > 0 {
+			out = append(out, components.BriefLine{Label: s.Title, Value: strings.Join(labels, ", ")})
+		}
+	}
+	return out
+}
+
+// service maps the project type onto a service line where there is one,
+// to preselect it on the contact form
+func (b Brief) service() string {
+	if components.ServiceLabel(b.Project) != "" {
+		return b.Project
+	}
+	return ""
+}
+
+// validateQualifyStep checks one step's answers against its options
+func validateQualifyStep(step components.QualifyStep, values []string, other string) string {
+	for _, v := range values {
+		if components.QualifyLabel(step.ID, v) == "" {
+			return "Choose from the options listed."
+		}
+	}
+	if !step.Multi {
+		if len(values) != 1 {
+			return "Choose one option to continue."
+		}
+		return ""
+	}
+	if utf8.RuneCountInString(other) > components.MaxStackOtherLength || markupPattern.MatchString(other) {
+		return "Keep the extra detail short, without markup."
+	}
+	if len(values) == 0 && other == "" {
+		return "Choose at least one, or tell us what you use."
+	}
+	return ""
+}
+
+// --- SIGNED STATE ---
+
+// briefState is the wizard's progress, carried between steps in a signed
+// hidden field instead of a database. Step == len(QualifySteps) once done.
+type briefState struct {
+	Step   int   `json:"s"`
+	Brief  Brief `json:"b"`
+	Issued int64 `json:"i"`
+}
+
+func (st briefState) done() bool {
+	return st.Step == len(components.QualifySteps) && st.Brief.Complete()
+}
+
+// sealBrief signs the state with the form key, bound to its purpose so a
+// brief can never pass for any other token the key signs
+func (g *SpamGuard) sealBrief(st briefState) string {
+	st.Issued = time.Now().Unix()
+	b, _ := json.Marshal(st)
+	payload := b64url.EncodeToString(b)
+	return payload + "." + b64url.EncodeToString(g.briefMAC(payload))
+}
+
+// openBrief returns the state if the token is genuine, in range and no
+// older than a contact form token may be
+func (g *SpamGuard) openBrief(token string) (briefState, bool) {
+	var st briefState
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return st, false
+	}
+	got, err := b64url.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, g.briefMAC(payload)) {
+		return st, false
+	}
+	b, err := b64url.DecodeString(payload)
+	if err != nil || json.Unmarshal(b, &st) != nil {
+		return st, false
+	}
+	if st.Step < 0 || st.Step > len(components.QualifySteps) || time.Since(time.Unix(st.Issued, 0)) > maxFormAge {
+		return st, false
+	}
+	return st, true
+}
+
+func (g *SpamGuard) briefMAC(payload string) []byte {
+	m := hmac.New(sha256.New, g.key)
+	m.Write([]byte("brief\x00" + payload))
+	return m.Sum(nil)
+}
+
+// --- HANDLERS ---
+
+func registerQualifyRoutes(mux *http.ServeMux, guard *SpamGuard) {
+	mux.HandleFunc("GET /project", func(w http.ResponseWriter, r *http.Request) {
+		renderQualify(w, r, http.StatusOK, guard, briefState{}, components.QualifyView{})
+	})
+	mux.HandleFunc("POST /project", handleQualify(guard))
+}
+
+// handleQualify validates the posted step and moves forward, or back when
+// the Back button was pressed. Without htmx each response is a full page.
+func handleQualify(guard *SpamGuard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, 16<<10)
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Failed to parse form", http.StatusBadRequest)
+			return
+		}
+
+		// 1. Tampered or stale state starts over
+		st, ok := guard.openBrief(r.FormValue(components.BriefField))
+		if !ok || st.Step >= len(components.QualifySteps) {
+			slog.Info("qualify_restart")
+			renderQualify(w, r, http.StatusUnprocessableEntity, guard, briefState{}, components.QualifyView{Error: "Your answers expired. Please start again."})
+			return
+		}
+
+		// 2. Back keeps this step's answers out; they were never validated
+		if r.FormValue("action") == "back" {
+			st.Step = max(st.Step-1, 0)
+			renderQualify(w, r, http.StatusOK, guard, st, components.QualifyView{})
+			return
+		}
+
+		// 3. Validate this step
+		step := components.QualifySteps[st.Step]
+		values := r.Form[step.ID]
+		other := ""
+		if step.ID == "stack" {
+			other = strings.TrimSpace(r.FormValue("stack_other"))
+		}
+		if msg := validateQualifyStep(step, values, other); msg != "" {
+			slog.Info("qualify_invalid", slog.String("step", step.ID))
+			renderQualify(w, r, http.StatusUnprocessableEntity, guard, st, components.QualifyView{Selected: values, Other: other, Error: msg})
+			return
+		}
+		// Keep the options' order and drop repeats, whatever the form sent
+		var chosen []string
+		for _, o := range step.Options {
+			if slices.Contains(values, o.ID) {
+				chosen = append(chosen, o.ID)
+			}
+		}
+		st.Brief.set(step.ID, chosen, other)
+		st.Step++
+
+		if st.Step == len(components.QualifySteps) {
+			slog.Info("qualify_complete", slog.String("project", st.Brief.Project), slog.String("budget", st.Brief.Budget))
+		}
+		renderQualify(w, r, http.StatusOK, guard, st, components.QualifyView{})
+	}
+}
+
+// renderQualify shows the state's current step, or the contact form once
+// every step is answered. v supplies any re-rendered answers and error.
+func renderQualify(w http.ResponseWriter, r *http.Request, status int, guard *SpamGuard, st briefState, v components.QualifyView) {
+	var done components.ContactFormState
+	v.Step = st.Step
+	v.Token = guard.sealBrief(st)
+	if st.done() {
+		done = components.ContactFormState{
+			Service:        st.Brief.service(),
+			Token:          guard.Issue(),
+			IdempotencyKey: newIdempotencyKey(),
+			Brief:          v.Token,
+			BriefLines:     st.Brief.Lines(),
+		}
+	} else if v.Selected == nil && v.Other == "" {
+		v.Selected = st.Brief.answers(components.QualifySteps[st.Step].ID)
+		v.Other = st.Brief.StackOther
+	}
+
+	if r.Header.Get("HX-Request") != "" {
+		if st.done() {
+			RenderHTMLStatus(w, r, status, components.QualifyDone(done))
+		} else {
+			RenderHTMLStatus(w, r, status, components.QualifyPanel(v))
+		}
+		return
+	}
+	sessionID, _ := r.Context().Value(SessionKey).(string)
+	RenderHTMLStatus(w, r, status, components.QualifyPage(sessionID, v, done))
+}
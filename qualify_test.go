@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"stackfoundry.co.uk/components"
+)
+
+var briefPattern = regexp.MustCompile(`name="brief" value="([^"]+)"`)
+
+// postQualify submits one wizard step and returns the response and the brief
+// token it carries
+func postQualify(t *testing.T, router http.Handler, form url.Values, htmx bool) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+	rr := postForm(router, "/project", form, htmx)
+	m := briefPattern.FindStringSubmatch(rr.Body.String())
+	if m == nil {
+		t.Fatalf("No brief token in response (status %d): %s", rr.Code, rr.Body.String())
+	}
+	return rr, m[1]
+}
+
+// completeBrief walks every step with the given answers and returns the final token
+func completeBrief(t *testing.T, router http.Handler, answers map[string][]string) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+	token := testGuard.sealBrief(briefState{})
+	var rr *httptest.ResponseRecorder
+	for _, step := range components.QualifySteps {
+		form := url.Values{components.BriefField: {token}, "action": {"next"}}
+		form[step.ID] = answers[step.ID]
+		rr, token = postQualify(t, router, form, true)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Step %s returned %d: %s", step.ID, rr.Code, rr.Body.String())
+		}
+	}
+	return rr, token
+}
+
+var testAnswers = map[string][]string{
+	"project":  {"audit"},
+	"budget":   {"25-50k"},
+	"timeline": {"1-3m"},
+	"team":     {"6-20"},
+	"stack":    {"python", "go", "go"},
+}
+
+func TestQualifyWizard(t *testing.T) {
+	router := testApp(App{Mailer: &MemoryMailer{}}).Handler()
+
+	// 1. The first step renders as a full page
+	req := httptest.NewRequest("GET", "/project", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "What are we building?") || !strings.Contains(rr.Body.String(), "<html") {
+		t.Fatalf("GET /project: status %d", rr.Code)
+	}
+
+	// 2. Walking every step ends at the contact form with the answers summarised
+	rr, token := completeBrief(t, router, testAnswers)
+	body := rr.Body.String()
+	for _, want := range []string{`id="contact_form"`, "A review of what we have", "£25k to £50k", "Go, Python"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Final step missing %q", want)
+		}
+	}
+	if !strings.Contains(body, `value="audit" selected`) {
+		t.Error("Final step did not preselect the matching service line")
+	}
+
+	st, ok := testGuard.openBrief(token)
+	if !ok || !st.done() {
+		t.Fatalf("Final token not complete: %+v", st)
+	}
+	if got := strings.Join(st.Brief.Stack, ","); got != "go,python" {
+		t.Errorf("Stack stored as %q, want option order without repeats", got)
+	}
+}
+
+func TestQualifyStepValidation(t *testing.T) {
+	router := testApp(App{Mailer: &MemoryMailer{}}).Handler()
+	start := testGuard.sealBrief(briefState{})
+
+	// 1. Invalid answers keep the visitor on the same step
+	for _, tc := range []struct {
+		name string
+		st   briefState
+		form url.Values
+	}{
+		{"missing", briefState{}, url.Values{}},
+		{"unknown option", briefState{}, url.Values{"project": {"moon-base"}}},
+		{"two answers to one question", briefState{}, url.Values{"project": {"mvp", "audit"}}},
+		{"empty stack", briefState{Step: 4}, url.Values{}},
+		{"markup in other", briefState{Step: 4}, url.Values{"stack_other": {"<script>"}}},
+		{"long other", briefState{Step: 4}, url.Values{"stack_other": {strings.Repeat("a", components.MaxStackOtherLength+1)}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.form.Set(components.BriefField, testGuard.sealBrief(tc.st))
+			rr, token := postQualify(t, router, tc.form, true)
+			if rr.Code != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), `id="qualify_error"`) {
+				t.Errorf("Status %d, want 422 with an error", rr.Code)
+			}
+			if st, _ := testGuard.openBrief(token); st.Step != tc.st.Step {
+				t.Errorf("Moved to step %d, want %d", st.Step, tc.st.Step)
+			}
+		})
+	}
+
+	// 2. "Something else" alone satisfies the stack step
+	rr, _ := postQualify(t, router, url.Values{components.BriefField: {testGuard.sealBrief(briefState{Step: 4, Brief: Brief{Project: "mvp", Budget: "unsure", Timeline: "now", Team: "0"}})}, "stack_other": {"Elixir"}}, true)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "Elixir") {
+		t.Errorf("Other-only stack: status %d", rr.Code)
+	}
+
+	// 3. Back returns to the previous step with its answer still chosen
+	_, token := postQualify(t, router, url.Values{components.BriefField: {start}, "project": {"lead"}}, true)
+	rr, token = postQualify(t, router, url.Values{components.BriefField: {token}, "action": {"back"}}, true)
+	if !strings.Contains(rr.Body.String(), `value="lead" checked`) {
+		t.Error("Back did not restore the previous answer")
+	}
+	if st, _ := testGuard.openBrief(token); st.Step != 0 {
+		t.Errorf("Back went to step %d, want 0", st.Step)
+	}
+}
+
+func TestQualifySignedState(t *testing.T) {
+	router := testApp(App{Mailer: &MemoryMailer{}}).Handler()
+
+	valid := testGuard.sealBrief(briefState{Step: 2, Brief: Brief{Project: "mvp", Budget: "lt10k"}})
+	payload, sig, _ := strings.Cut(valid, ".")
+	other := NewSpamGuard([]byte("another-key"))
+
+	// 1. Forged, tampered, foreign and stale tokens all restart at step one
+	for name, token := range map[string]string{
+		"empty":       "",
+		"garbage":     "not-a-token",
+		"tampered":    payload + "x." + sig,
+		"foreign key": other.sealBrief(briefState{Step: 3}),
+		"form token":  testGuard.Issue(),
+		"expired":     staleBrief(briefState{Step: 2}),
+		"finished":    testGuard.sealBrief(briefState{Step: len(components.QualifySteps)}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			rr, token := postQualify(t, router, url.Values{components.BriefField: {token}, "timeline": {"now"}}, true)
+			if rr.Code != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), "What are we building?") {
+				t.Errorf("Status %d, want 422 at the first step", rr.Code)
+			}
+			if st, ok := testGuard.openBrief(token); !ok || st.Step != 0 || st.Brief.Project != "" {
+				t.Errorf("Restart token carries %+v", st)
+			}
+		})
+	}
+
+	// 2. Without htmx every step is a whole page, so plain POSTs work
+	rr, _ := postQualify(t, router, url.Values{components.BriefField: {valid}, "timeline": {"now"}}, false)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "<html") || !strings.Contains(rr.Body.String(), "How many engineers") {
+		t.Errorf("Plain POST: status %d, want the next step as a full page", rr.Code)
+	}
+}
+
+// staleBrief signs a state as if it were issued over a day ago
+func staleBrief(st briefState) string {
+	token := testGuard.sealBrief(st)
+	opened, _ := testGuard.openBrief(token)
+	opened.Issued = time.Now().Add(-maxFormAge - time.Hour).Unix()
+	b, _ := json.Marshal(opened)
+	payload := b64url.EncodeToString(b)
+	return payload + "." + b64url.EncodeToString(testGuard.briefMAC(payload))
+}
+
+func TestContactWithBrief(t *testing.T) {
+	mailer := &MemoryMailer{}
+	store := NewMemoryStore()
+	router := testApp(App{Mailer: mailer, Store: store}).Handler()
+	_, token := completeBrief(t, router, testAnswers)
+
+	send := func(brief string) *httptest.ResponseRecorder {
+		form := newContactForm("cto@example.com", "Audit", "Our monolith is creaking.")
+		form.Set(components.BriefField, brief)
+		return postForm(router, "/api/contact", form, false)
+	}
+
+	// 1. A forged brief is dropped and the visitor told, not silently sent
+	rr := send(testGuard.sealBrief(briefState{Step: len(components.QualifySteps), Brief: Brief{Project: "mvp"}}))
+	if rr.Code != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), "answers expired") {
+		t.Fatalf("Incomplete brief: status %d", rr.Code)
+	}
+	if strings.Contains(rr.Body.String(), `name="brief"`) {
+		t.Error("Rejected brief was put back in the form")
+	}
+
+	// 2. A genuine brief is stored and summarised in the notification
+	rr = send(token)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Contact with brief: status %d: %s", rr.Code, rr.Body.String())
+	}
+	inqs, _ := store.List(t.Context())
+	if len(inqs) != 1 || inqs[0].Brief == nil || inqs[0].Brief.Budget != "25-50k" {
+		t.Fatalf("Brief not stored: %+v", inqs)
+	}
+	sent := mailer.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("Sent %d messages, want 1", len(sent))
+	}
+	for _, want := range []string{"Brief:", "Budget:", "£25k to £50k", "Go, Python"} {
+		if !strings.Contains(sent[0].Text, want) {
+			t.Errorf("Notification text missing %q:\n%s", want, sent[0].Text)
+		}
+	}
+	if !strings.Contains(sent[0].HTML, "Project Brief") {
+		t.Error("Notification HTML missing the brief")
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/awslabs/aws-lambda-go-api-proxy/core"
+
+	"stackfoundry.co.uk/appconfig"
+	"stackfoundry.co.uk/components"
+)
+
+// RatePolicy: A token bucket refilled at Rate tokens per second, holding at most Burst
+type RatePolicy struct {
+	Name  string
+	Rate  float64
+	Burst int
+}
+
+// RateRoute applies a policy to requests whose method matches (empty = any)
+// and whose path starts with Prefix. The first matching route wins.
+type RateRoute struct {
+	Method string
+	Prefix string
+	Policy RatePolicy
+}
+
+// defaultRateRoutes: API Gateway's global throttle (burst 50, rate 10) stays
+// as the outer wall; these stop a single client spending all of it.
+var defaultRateRoutes = []RateRoute{
+	{Method: "POST", Prefix: "/api/contact", Policy: RatePolicy{Name: "contact", Rate: 5.0 / 60, Burst: 3}},
+	{Method: "GET", Prefix: "/api/challenge", Policy: RatePolicy{Name: "challenge", Rate: 30.0 / 60, Burst: 10}},
+	{Method: "POST", Prefix: "/book", Policy: RatePolicy{Name: "booking", Rate: 5.0 / 60, Burst: 3}},
+	{Method: "POST", Prefix: "/project", Policy: RatePolicy{Name: "wizard", Rate: 1, Burst: 20}},
+	{Method: "POST", Prefix: "/privacy/", Policy: RatePolicy{Name: "privacy", Rate: 5.0 / 60, Burst: 3}},
+	{Prefix: "/api/", Policy: RatePolicy{Name: "api", Rate: 1, Burst: 20}},
+	{Prefix: "/admin", Policy: RatePolicy{Name: "admin", Rate: 2, Burst: 30}},
+}
+
+// RateLimitBackend: Where buckets live. The in-memory backend is per
+// instance; a shared implementation (e.g. DynamoDB) makes limits hold across
+// concurrent Lambda instances.
+type RateLimitBackend interface {
+	// Take spends one token from key's bucket. When the bucket is empty it
+	// returns false and how long until a token is available.
+	Take(ctx context.Context, key string, policy RatePolicy) (ok bool, retryAfter time.Duration, err error)
+	// Count records one event for key in fixed windows of the given length
+	// and returns the events in the current window and the one before
+	Count(ctx context.Context, key string, window time.Duration) (cur, prev int, err error)
+}
+
+// RateLimiter: Per-client limiting keyed by source IP and, when the client
+// sends one, X-Session-ID. Both buckets must have a token.
+type RateLimiter struct {
+	Backend RateLimitBackend
+	Routes  []RateRoute
+}
+
+func NewRateLimiter(backend RateLimitBackend, routes []RateRoute) *RateLimiter {
+	return &RateLimiter{Backend: backend, Routes: routes}
+}
+
+// newRateLimiterFromConfig reads per-route overrides from RATE_LIMITS, e.g.
+// "POST /api/contact=5/m:3,GET /api/challenge=30/m:10". Unlisted routes keep
+// their defaults. Buckets are shared across instances like every other limit.
+func newRateLimiterFromConfig(ctx context.Context, cfg appconfig.Config, key []byte) (*RateLimiter, error) {
+	routes := defaultRateRoutes
+	if cfg.RateLimits != "" {
+		overrides, err := parseRateRoutes(cfg.RateLimits)
+		if err != nil {
+			return nil, fmt.Errorf("RATE_LIMITS: %w", err)
+		}
+		routes = append(overrides, routes...)
+	}
+	backend, err := newRateBackendFromConfig(ctx, cfg, key)
+	if err != nil {
+		return nil, err
+	}
+	return NewRateLimiter(backend, routes), nil
+}
+
+// newRateBackendFromConfig keeps buckets in the IDEMPOTENCY_TABLE when there
+// is one, so a limit holds across Lambda instances, or in memory. key HMACs
+// the bucket names.
+func newRateBackendFromConfig(ctx context.Context, cfg appconfig.Config, key []byte) (RateLimitBackend, error) {
+	if cfg.IdempotencyTable == "" {
+		return NewMemoryRateBackend(), nil
+	}
+	aws, err := loadAWSConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &DynamoRateBackend{Client: dynamodb.NewFromConfig(aws), Table: cfg.IdempotencyTable, Key: key}, nil
+}
+
+func parseRateRoutes(spec string) ([]RateRoute, error) {
+	var routes []RateRoute
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		route, limit, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q: want ROUTE=N/UNIT:BURST", entry)
+		}
+
+		var rr RateRoute
+		if method, prefix, ok := strings.Cut(strings.TrimSpace(route), " "); ok {
+			rr.Method, rr.Prefix = method, strings.TrimSpace(prefix)
+		} else {
+			rr.Prefix = method
+		}
+
+		policy, err := parseRatePolicy(strings.TrimSpace(route), limit)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", entry, err)
+		}
+		rr.Policy = policy
+		routes = append(routes, rr)
+	}
+	return routes, nil
+}
+
+// parseRatePolicy reads "N/UNIT[:BURST]", where UNIT is s, m, h or d and
+// BURST defaults to N
+func parseRatePolicy(name, limit string) (RatePolicy, error) {
+	rate, burst, _ := strings.Cut(strings.TrimSpace(limit), ":")
+	count, unit, ok := strings.Cut(rate, "/")
+	n, err := strconv.ParseFloat(count, 64)
+	if !ok || err != nil || n <= 0 {
+		return RatePolicy{}, fmt.Errorf("bad rate %q", rate)
+	}
+	per := map[string]float64{"s": 1, "m": 60, "h": 3600, "d": 86400}[unit]
+	if per == 0 {
+		return RatePolicy{}, fmt.Errorf("unit must be s, m, h or d")
+	}
+	b := int(math.Ceil(n))
+	if burst != "" {
+		if b, err = strconv.Atoi(burst); err != nil || b < 1 {
+			return RatePolicy{}, fmt.Errorf("bad burst %q", burst)
+		}
+	}
+	return RatePolicy{Name: name, Rate: n / per, Burst: b}, nil
+}
+
+func (l *RateLimiter) policyFor(r *http.Request) (RatePolicy, bool) {
+	for _, rr := range l.Routes {
+		if (rr.Method == "" || rr.Method == r.Method) && strings.HasPrefix(r.URL.Path, rr.Prefix) {
+			return rr.Policy, true
+		}
+	}
+	return RatePolicy{}, false
+}
+
+// Middleware: Returns 429 with a cooldown partial and Retry-After once a client's bucket is empty
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy, ok := l.policyFor(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		keys := []string{"ip:" + policy.Name + ":" + clientIP(r)}
+		if sid := r.Header.Get("X-Session-ID"); sid != "" {
+			keys = append(keys, "session:"+policy.Name+":"+sid)
+		}
+
+		var wait time.Duration
+		for _, key := range keys {
+			allowed, retryAfter, err := l.Backend.Take(r.Context(), key, policy)
+			if err != nil {
+				// Fail open: a broken limiter must not take the site down with it
+				slog.Error("rate_limit_backend_failed", slog.Any("error", err))
+				continue
+			}
+			if !allowed {
+				wait = max(wait, retryAfter)
+			}
+		}
+		if wait == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		seconds := int(math.Ceil(wait.Seconds()))
+		slog.Info("rate_limited", slog.String("policy", policy.Name), slog.Int("retry_after", seconds))
+
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		if r.Header.Get("HX-Request") != "" {
+			// Swap inside the target so it is still there for the next attempt
+			w.Header().Set("HX-Reswap", "innerHTML")
+		}
+		RenderHTMLStatus(w, r, http.StatusTooManyRequests, components.Cooldown(seconds))
+	})
+}
+
+// clientIPKey carries the address ClientIPMiddleware resolved
+const clientIPKey ContextKey = "client_ip"
+
+// ClientIPMiddleware: Resolves each request's client address once, believing
+// X-Forwarded-For only when the peer is one of proxies
+func ClientIPMiddleware(proxies []netip.Prefix, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientIPKey, resolveClientIP(r, proxies))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientIP returns the address ClientIPMiddleware resolved. Outside it no
+// proxy is trusted, so X-Forwarded-For is ignored.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey).(string); ok {
+		return ip
+	}
+	return resolveClientIP(r, nil)
+}
+
+// resolveClientIP prefers the source IP API Gateway saw. Otherwise, if the
+// socket peer is a trusted proxy, it walks X-Forwarded-For from the right
+// past our own proxies to the first hop one of them appended. Anything left
+// of that was written by the client and may be forged.
+func resolveClientIP(r *http.Request, proxies []netip.Prefix) string {
+	if gw, ok := core.GetAPIGatewayContextFromContext(r.Context()); ok && gw.Identity.SourceIP != "" {
+		return gw.Identity.SourceIP
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !trustedProxy(ip, proxies) {
+		return ip
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			break
+		}
+		ip = hop
+		if !trustedProxy(hop, proxies) {
+			break
+		}
+	}
+	return ip
+}
+
+func trustedProxy(ip string, proxies []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range proxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies reads TRUSTED_PROXIES, e.g. "127.0.0.1,10.0.0.0/8"
+func parseTrustedProxies(spec string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(entry)
+			if aerr != nil {
+				return nil, fmt.Errorf("%q: want an address or CIDR", entry)
+			}
+			p = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		proxies = append(proxies, p.Masked())
+	}
+	return proxies, nil
+}
+
+// --- MEMORY BACKEND ---
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time // when the bucket will have refilled to its burst
+}
+
+// rateCount: Events for one key in the window starting at start
+type rateCount struct {
+	n       int
+	expires time.Time // once it is no longer the previous window
+}
+
+// MemoryRateBackend: Buckets and counts in maps, swept of refilled buckets
+// and finished counts once a minute
+type MemoryRateBackend struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	counts  map[string]*rateCount // key "@" window start (unix)
+	swept   time.Time
+	now     func() time.Time
+}
+
+func NewMemoryRateBackend() *MemoryRateBackend {
+	return &MemoryRateBackend{buckets: map[string]*tokenBucket{}, counts: map[string]*rateCount{}, now: time.Now}
+}
+
+func (m *MemoryRateBackend) Count(ctx context.Context, key string, window time.Duration) (int, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	m.sweep(now)
+
+	start := now.Truncate(window)
+	c := m.counts[rateCountKey(key, start)]
+	if c == nil {
+		c = &rateCount{expires: start.Add(2 * window)}
+		m.counts[rateCountKey(key, start)] = c
+	}
+	c.n++
+	prev := 0
+	if p := m.counts[rateCountKey(key, start.Add(-window))]; p != nil {
+		prev = p.n
+	}
+	return c.n, prev, nil
+}
+
+func rateCountKey(key string, start time.Time) string {
+	return key + "@" + strconv.FormatInt(start.Unix(), 10)
+}
+
+// sweep drops what can no longer matter; the caller holds mu
+func (m *MemoryRateBackend) sweep(now time.Time) {
+	if now.Sub(m.swept) <= time.Minute {
+		return
+	}
+	for k, b := range m.buckets {
+		if now.After(b.full) {
+			delete(m.buckets, k)
+		}
+	}
+	for k, c := range m.counts {
+		if now.After(c.expires) {
+			delete(m.counts, k)
+		}
+	}
+	m.swept = now
+}
+
+func (m *MemoryRateBackend) Take(ctx context.Context, key string, policy RatePolicy) (bool, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	m.sweep(now)
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(policy.Burst), last: now}
+		m.buckets[key] = b
+	}
+	b.tokens = min(float64(policy.Burst), b.tokens+now.Sub(b.last).Seconds()*policy.Rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		b.full = now.Add(time.Duration((float64(policy.Burst) - b.tokens) / policy.Rate * float64(time.Second)))
+		return true, 0, nil
+	}
+	return false, time.Duration((1 - b.tokens) / policy.Rate * float64(time.Second)), nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const maxRateConflicts = 5 // concurrent takes a bucket retries past before giving up
+
+var errRateContended = errors.New("rate bucket changed concurrently")
+
+// DynamoRateBackend: Buckets as items in the idempotency table, so a limit
+// holds across Lambda instances. Each item keeps its tokens and when it was
+// last taken from, and a write only lands if nobody took in between. Bucket
+// keys are HMAC'd under Key, so no address is stored. The item expires once
+// the bucket would have refilled.
+type DynamoRateBackend struct {
+	Client *dynamodb.Client
+	Table  string
+	Key    []byte
+}
+
+func (s *DynamoRateBackend) Take(ctx context.Context, key string, policy RatePolicy) (bool, time.Duration, error) {
+	id := s.itemKey(key)
+	for range maxRateConflicts {
+		now := time.Now()
+		out, err := s.Client.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName:      aws.String(s.Table),
+			Key:            idempotencyKey(id),
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return false, 0, err
+		}
+
+		tokens, last, found := rateBucket(out.Item, now)
+		if !found {
+			tokens, last = float64(policy.Burst), now
+		}
+		tokens = min(float64(policy.Burst), tokens+now.Sub(last).Seconds()*policy.Rate)
+		if tokens < 1 {
+			return false, time.Duration((1 - tokens) / policy.Rate * float64(time.Second)), nil
+		}
+		tokens--
+		full := now.Add(time.Duration((float64(policy.Burst) - tokens) / policy.Rate * float64(time.Second)))
+
+		item := idempotencyKey(id)
+		item["tokens"] = &types.AttributeValueMemberN{Value: strconv.FormatFloat(tokens, 'g', -1, 64)}
+		item["last"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(now.UnixNano(), 10)}
+		item["expires"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(full.Unix()+1, 10)}
+		put := &dynamodb.PutItemInput{
+			TableName:                aws.String(s.Table),
+			Item:                     item,
+			ConditionExpression:      aws.String("attribute_not_exists(#k)"),
+			ExpressionAttributeNames: map[string]string{"#k": "key"},
+		}
+		if prev, ok := out.Item["last"]; ok {
+			// Also covers an expired bucket the TTL has not deleted yet
+			put.ConditionExpression = aws.String("#last = :last")
+			put.ExpressionAttributeNames = map[string]string{"#last": "last"}
+			put.ExpressionAttributeValues = map[string]types.AttributeValue{":last": prev}
+		}
+		_, err = s.Client.PutItem(ctx, put)
+		var ccf *types.ConditionalCheckFailedException
+		if errors.As(err, &ccf) {
+			continue
+		}
+		if err != nil {
+			return false, 0, err
+		}
+		return true, 0, nil
+	}
+	return false, 0, errRateContended
+}
+
+// Count adds to one item per key and window in a single update, and reads
+// the previous window's item alongside. Both expire once they are too old
+// to be the previous window.
+func (s *DynamoRateBackend) Count(ctx context.Context, key string, window time.Duration) (int, int, error) {
+	start := time.Now().Truncate(window)
+	out, err := s.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(s.Table),
+		Key:              idempotencyKey(s.itemKey(rateCountKey(key, start))),
+		UpdateExpression: aws.String("ADD #n :one SET expires = :exp"),
+		ExpressionAttributeNames: map[string]string{
+			"#n": "count",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+			":exp": &types.AttributeValueMemberN{Value: strconv.FormatInt(start.Add(2*window).Unix(), 10)},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	prev, err := s.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.Table),
+		Key:       idempotencyKey(s.itemKey(rateCountKey(key, start.Add(-window)))),
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return countOf(out.Attributes), countOf(prev.Item), nil
+}
+
+func countOf(item map[string]types.AttributeValue) int {
+	n, _ := item["count"].(*types.AttributeValueMemberN)
+	if n == nil {
+		return 0
+	}
+	v, _ := strconv.Atoi(n.Value)
+	return v
+}
+
+func (s *DynamoRateBackend) itemKey(key string) string {
+	mac := hmac.New(sha256.New, s.Key)
+	mac.Write([]byte(key))
+	return "rate:" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// rateBucket reads an item's tokens and last take, unless it has expired
+func rateBucket(item map[string]types.AttributeValue, now time.Time) (tokens float64, last time.Time, ok bool) {
+	t, _ := item["tokens"].(*types.AttributeValueMemberN)
+	l, _ := item["last"].(*types.AttributeValueMemberN)
+	exp, _ := item["expires"].(*types.AttributeValueMemberN)
+	if t == nil || l == nil || exp == nil {
+		return 0, time.Time{}, false
+	}
+	if n, err := strconv.ParseInt(exp.Value, 10, 64); err != nil || now.Unix() > n {
+		return 0, time.Time{}, false
+	}
+	tokens, err1 := strconv.ParseFloat(t.Value, 64)
+	ns, err2 := strconv.ParseInt(l.Value, 10, 64)
+	if err1 != nil || err2 != nil {
+		return 0, time.Time{}, false
+	}
+	return tokens, time.Unix(0, ns), true
+}
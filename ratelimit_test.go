@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/awslabs/aws-lambda-go-api-proxy/core"
+)
+
+func TestRateLimitMiddleware(t *testing.T) {
+	policy := RatePolicy{Name: "test", Rate: 1.0 / 60, Burst: 2}
+	limiter := NewRateLimiter(NewMemoryRateBackend(), []RateRoute{{Method: "POST", Prefix: "/api/", Policy: policy}})
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	do := func(method, ip, session string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/contact", nil)
+		req.RemoteAddr = ip + ":1234"
+		req.Header.Set("HX-Request", "true")
+		if session != "" {
+			req.Header.Set("X-Session-ID", session)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// 1. The burst is allowed, then the client is cooled down
+	for i := range 2 {
+		if rr := do("POST", "203.0.113.1", ""); rr.Code != http.StatusNoContent {
+			t.Fatalf("Request %d was limited: got %v", i+1, rr.Code)
+		}
+	}
+	rr := do("POST", "203.0.113.1", "")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Request past the burst returned %v, want 429", rr.Code)
+	}
+	if ra := rr.Header().Get("Retry-After"); ra == "" || ra == "0" {
+		t.Errorf("429 is missing Retry-After: got %q", ra)
+	}
+	if rr.Header().Get("HX-Reswap") != "innerHTML" {
+		t.Errorf("429 did not ask HTMX to keep its target")
+	}
+	if !strings.Contains(rr.Body.String(), "Cooling Down") {
+		t.Errorf("429 did not render the cooldown partial: got %v", rr.Body.String())
+	}
+
+	// 2. Other clients and unlimited routes are unaffected
+	if rr := do("POST", "203.0.113.2", ""); rr.Code != http.StatusNoContent {
+		t.Errorf("Second client was limited: got %v", rr.Code)
+	}
+	if rr := do("GET", "203.0.113.1", ""); rr.Code != http.StatusNoContent {
+		t.Errorf("Unmatched route was limited: got %v", rr.Code)
+	}
+
+	// 3. A session is limited even when it rotates IPs
+	do("POST", "198.51.100.1", "sess01")
+	do("POST", "198.51.100.2", "sess01")
+	if rr := do("POST", "198.51.100.3", "sess01"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Session rotating IPs was not limited: got %v", rr.Code)
+	}
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	now := time.Now()
+	backend := NewMemoryRateBackend()
+	backend.now = func() time.Time { return now }
+	policy := RatePolicy{Name: "test", Rate: 1, Burst: 1}
+
+	if ok, _, _ := backend.Take(context.Background(), "k", policy); !ok {
+		t.Fatalf("First take was refused")
+	}
+	ok, wait, _ := backend.Take(context.Background(), "k", policy)
+	if ok || wait != time.Second {
+		t.Errorf("Empty bucket returned ok=%v wait=%v, want refused for 1s", ok, wait)
+	}
+
+	now = now.Add(time.Second)
+	if ok, _, _ := backend.Take(context.Background(), "k", policy); !ok {
+		t.Errorf("Bucket did not refill after a second")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	// 1. API Gateway's view of the source wins over any header
+	req, err := (&core.RequestAccessor{}).EventToRequestWithContext(context.Background(), events.APIGatewayProxyRequest{
+		HTTPMethod:     "POST",
+		Path:           "/api/contact",
+		Headers:        map[string]string{"X-Forwarded-For": "1.1.1.1"},
+		RequestContext: events.APIGatewayProxyRequestContext{Identity: events.APIGatewayRequestIdentity{SourceIP: "203.0.113.9"}},
+	})
+	if err != nil {
+		t.Fatalf("EventToRequestWithContext: %v", err)
+	}
+	if ip := clientIP(req); ip != "203.0.113.9" {
+		t.Errorf("clientIP with API Gateway context = %q, want 203.0.113.9", ip)
+	}
+
+	// 2. Otherwise the socket address; X-Forwarded-For from anyone else is ignored
+	req = httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.4:5555"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	if ip := clientIP(req); ip != "192.0.2.4" {
+		t.Errorf("clientIP from RemoteAddr = %q, want 192.0.2.4", ip)
+	}
+
+	// 3. Behind a trusted proxy, the hop it appended, skipping our own proxies
+	proxies, err := parseTrustedProxies("192.0.2.4, 10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Forwarded-For", "6.6.6.6, 203.0.113.7, 10.1.2.3")
+	var got string
+	ClientIPMiddleware(proxies, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = clientIP(r)
+	})).ServeHTTP(httptest.NewRecorder(), req)
+	if got != "203.0.113.7" {
+		t.Errorf("clientIP behind trusted proxies = %q, want 203.0.113.7", got)
+	}
+
+	// 4. A bad entry is refused
+	if _, err := parseTrustedProxies("10.0.0.0/8, proxy.local"); err == nil {
+		t.Error("parseTrustedProxies accepted a host name")
+	}
+}
+
+func TestParseRateRoutes(t *testing.T) {
+	routes, err := parseRateRoutes("POST /api/contact=5/m:3, /api/=10/s")
+	if err != nil {
+		t.Fatalf("parseRateRoutes: %v", err)
+	}
+	if len(routes) != 2 {
+		t.Fatalf("parseRateRoutes returned %d routes, want 2", len(routes))
+	}
+	if r := routes[0]; r.Method != "POST" || r.Prefix != "/api/contact" || r.Policy.Burst != 3 || r.Policy.Rate != 5.0/60 {
+		t.Errorf("First route parsed as %+v", r)
+	}
+	if r := routes[1]; r.Method != "" || r.Prefix != "/api/" || r.Policy.Burst != 10 || r.Policy.Rate != 10 {
+		t.Errorf("Second route parsed as %+v", r)
+	}
+
+	for _, bad := range []string{"/api/", "/api/=x/m", "/api/=5/w", "/api/=5/m:0"} {
+		if _, err := parseRateRoutes(bad); err == nil {
+			t.Errorf("parseRateRoutes(%q) accepted a bad spec", bad)
+		}
+	}
+}
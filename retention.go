@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/awslabs/aws-lambda-go-api-proxy/httpadapter"
+
+	"stackfoundry.co.uk/appconfig"
+	"stackfoundry.co.uk/components"
+)
+
+// defaultRetentionPolicy is the policy shipped with the binary.
+// RETENTION_POLICY points at a replacement file.
+//
+//go:embed retention.json
+var defaultRetentionPolicy []byte
+
+// Purge triggers, as recorded in the report
+const (
+	purgeTriggerSchedule = "schedule"
+	purgeTriggerCLI      = "cli"
+)
+
+// purgeSubject files purge reports in the audit log alongside data-subject
+// entries; it cannot collide with an address hash
+const (
+	purgeSubject = "retention-purge"
+	auditPurge   = "purge"
+)
+
+// RetentionPolicy: How many days records are kept. Inquiries are keyed by
+// their admin state as it appears in the inbox filter ("new" is unanswered);
+// a state with no rule is kept until someone deletes it. Age counts from the
+// last change, so filing an inquiry restarts its clock. A booking's counts
+// from the end of its call, or its last change if that is later.
+type RetentionPolicy struct {
+	Inquiries map[string]int `json:"inquiries"`
+	Bookings  int            `json:"bookings,omitempty"` // 0 keeps them
+	Audit     int            `json:"audit,omitempty"`    // audit log and purge reports; 0 keeps them
+}
+
+// Notice is the policy as the privacy page states it
+func (p *RetentionPolicy) Notice() components.RetentionNotice {
+	return components.RetentionNotice{
+		Spam:       p.Inquiries["spam"],
+		Quarantine: p.Inquiries["quarantine"],
+		New:        p.Inquiries["new"],
+		Archived:   p.Inquiries["archived"],
+		Replied:    p.Inquiries["replied"],
+		Bookings:   p.Bookings,
+		Audit:      p.Audit,
+	}
+}
+
+// newRetentionPolicyFromConfig loads the file named by RETENTION_POLICY, or
+// the embedded retention.json when it is unset
+func newRetentionPolicyFromConfig(cfg appconfig.Config) (*RetentionPolicy, error) {
+	data := defaultRetentionPolicy
+	if path := cfg.RetentionPolicy; path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("RETENTION_POLICY: %w", err)
+		}
+		data = b
+	}
+	return parseRetentionPolicy(data)
+}
+
+func parseRetentionPolicy(data []byte) (*RetentionPolicy, error) {
+	var p RetentionPolicy
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("retention policy: %w", err)
+	}
+	// A typo here would keep a state forever without anyone noticing
+	known := []string{dispositionNewTag}
+	for _, d := range []Disposition{DispositionReplied, DispositionSpam, DispositionArchived, DispositionQuarantine} {
+		known = append(known, dispositionTag(d))
+	}
+	for state, days := range p.Inquiries {
+		if !slices.Contains(known, state) {
+			return nil, fmt.Errorf("retention policy: unknown state %q", state)
+		}
+		if days < 1 {
+			return nil, fmt.Errorf("retention policy: %q must be kept at least 1 day", state)
+		}
+	}
+	if p.Bookings < 0 || p.Audit < 0 {
+		return nil, errors.New("retention policy: days cannot be negative")
+	}
+	return &p, nil
+}
+
+// PurgeRule: What one rule did in a run. IDs are listed so the report shows
+// which records went without repeating anything they held.
+type PurgeRule struct {
+	Records string    `json:"records"` // "inquiries", "bookings" or "audit"
+	State   string    `json:"state,omitempty"`
+	Days    int       `json:"days"`
+	Cutoff  time.Time `json:"cutoff"`
+	Purged  int       `json:"purged"`
+	IDs     []string  `json:"ids,omitempty"`
+}
+
+// PurgeReport: The evidence a run leaves behind. It is signed as a whole, so
+// an edited count or a dropped ID fails verification.
+type PurgeReport struct {
+	ID         string      `json:"id"`
+	Trigger    string      `json:"trigger"`
+	DryRun     bool        `json:"dry_run,omitempty"`
+	StartedAt  time.Time   `json:"started_at"`
+	FinishedAt time.Time   `json:"finished_at"`
+	Policy     string      `json:"policy"` // SHA-256 of the policy in force
+	Rules      []PurgeRule `json:"rules"`
+	Errors     []string    `json:"errors,omitempty"`
+}
+
+func (r PurgeReport) total() int {
+	n := 0
+	for _, rule := range r.Rules {
+		n += rule.Purged
+	}
+	return n
+}
+
+// signedPurgeReport is the document written out and kept in the audit log.
+// The signature covers the compact JSON of Report.
+type signedPurgeReport struct {
+	Report    json.RawMessage `json:"report"`
+	Signature string          `json:"signature"`
+}
+
+// Purger: Applies a RetentionPolicy to the inquiry store, the bookings and
+// the audit log. A nil Purger is disabled.
+type Purger struct {
+	Policy   *RetentionPolicy
+	Store    InquiryStore
+	Bookings BookingStore // may be nil; then bookings are left alone
+	Audit    AuditLog     // may be nil; then neither purged nor sent reports
+
+	key []byte
+	now func() time.Time
+}
+
+func NewPurger(policy *RetentionPolicy, store InquiryStore, audit AuditLog, key []byte) *Purger {
+	return &Purger{Policy: policy, Store: store, Audit: audit, key: key, now: time.Now}
+}
+
+// newPurgerFromConfig is nil when there is no store to purge. bookings may
+// be nil when booking is off.
+func newPurgerFromConfig(ctx context.Context, cfg appconfig.Config, store InquiryStore, bookings *Bookings, key []byte) (*Purger, error) {
+	if store == nil {
+		return nil, nil
+	}
+	policy, err := newRetentionPolicyFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	audit, err := newAuditLogFromConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	p := NewPurger(policy, store, audit, key)
+	if bookings != nil {
+		p.Bookings = bookings.Store
+	}
+	return p, nil
+}
+
+// Run deletes everything past its retention period, unless dryRun, and
+// returns the report with its signed form. Failures on single records are
+// listed in the report and the run carries on; the error is only for a run
+// that could not start.
+func (p *Purger) Run(ctx context.Context, trigger string, dryRun bool) (PurgeReport, []byte, error) {
+	if p == nil {
+		return PurgeReport{}, nil, errors.New("retention purge is not configured")
+	}
+	now := p.now()
+	policyJSON, _ := json.Marshal(p.Policy)
+	policySum := sha256.Sum256(policyJSON)
+	report := PurgeReport{
+		ID:        newAuditID(now),
+		Trigger:   trigger,
+		DryRun:    dryRun,
+		StartedAt: now.UTC(),
+		Policy:    hex.EncodeToString(policySum[:]),
+	}
+
+	// 1. Inquiries, rule by rule in a stable order
+	inqs, err := p.Store.List(ctx)
+	if err != nil {
+		return PurgeReport{}, nil, fmt.Errorf("list inquiries: %w", err)
+	}
+	states := make([]string, 0, len(p.Policy.Inquiries))
+	for state := range p.Policy.Inquiries {
+		states = append(states, state)
+	}
+	slices.Sort(states)
+	for _, state := range states {
+		days := p.Policy.Inquiries[state]
+		rule := PurgeRule{Records: "inquiries", State: state, Days: days, Cutoff: now.UTC().AddDate(0, 0, -days)}
+		for _, inq := range inqs {
+			last := inq.UpdatedAt
+			if last.IsZero() {
+				last = inq.CreatedAt
+			}
+			if dispositionTag(inq.Disposition) != state || !last.Before(rule.Cutoff) {
+				continue
+			}
+			if !dryRun {
+				// Versioned, so a record filed or annotated since the list
+				// is left for the next run to judge afresh
+				err := p.Store.DeleteVersion(ctx, inq.ID, inq.Version)
+				if errors.Is(err, ErrInquiryConflict) {
+					continue
+				}
+				if err != nil && !errors.Is(err, ErrInquiryNotFound) {
+					report.Errors = append(report.Errors, fmt.Sprintf("inquiry %s: %v", inq.ID, err))
+					continue
+				}
+			}
+			rule.IDs = append(rule.IDs, inq.ID)
+		}
+		rule.Purged = len(rule.IDs)
+		report.Rules = append(report.Rules, rule)
+	}
+
+	// 2. Bookings, once their call is long past
+	if p.Policy.Bookings > 0 && p.Bookings != nil {
+		rule := PurgeRule{Records: "bookings", Days: p.Policy.Bookings, Cutoff: now.UTC().AddDate(0, 0, -p.Policy.Bookings)}
+		bookings, err := p.Bookings.List(ctx)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("bookings: %v", err))
+		}
+		for _, b := range bookings {
+			if !b.End.Before(rule.Cutoff) || !b.UpdatedAt.Before(rule.Cutoff) {
+				continue
+			}
+			if !dryRun {
+				err := p.Bookings.DeleteSequence(ctx, b.ID, b.Sequence)
+				if errors.Is(err, ErrBookingChanged) {
+					continue
+				}
+				if err != nil && !errors.Is(err, ErrBookingNotFound) {
+					report.Errors = append(report.Errors, fmt.Sprintf("booking %s: %v", b.ID, err))
+					continue
+				}
+			}
+			rule.IDs = append(rule.IDs, b.ID)
+		}
+		rule.Purged = len(rule.IDs)
+		report.Rules = append(report.Rules, rule)
+	}
+
+	// 3. The audit log, including earlier purge reports
+	if p.Policy.Audit > 0 && p.Audit != nil {
+		rule := PurgeRule{Records: "audit", Days: p.Policy.Audit, Cutoff: now.UTC().AddDate(0, 0, -p.Policy.Audit)}
+		entries, err := p.Audit.Before(ctx, rule.Cutoff)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("audit log: %v", err))
+		}
+		for _, e := range entries {
+			if !dryRun {
+				if err := p.Audit.Delete(ctx, e); err != nil {
+					report.Errors = append(report.Errors, fmt.Sprintf("audit %s: %v", e.ID, err))
+					continue
+				}
+			}
+			rule.IDs = append(rule.IDs, e.ID)
+		}
+		rule.Purged = len(rule.IDs)
+		report.Rules = append(report.Rules, rule)
+	}
+
+	// 4. Sign, and keep the report with the audit log
+	report.FinishedAt = p.now().UTC()
+	signed := p.sign(report)
+	if !dryRun && p.Audit != nil {
+		outcome := "purged"
+		if len(report.Errors) > 0 {
+			outcome = "partial"
+		}
+		entry := AuditEntry{ID: report.ID, Subject: purgeSubject, Action: auditPurge, Records: report.total(), Outcome: outcome, Detail: string(signed), At: report.FinishedAt}
+		if err := p.Audit.Record(ctx, entry); err != nil {
+			slog.Error("purge_report_record_failed", slog.String("id", report.ID), slog.Any("error", err))
+		}
+	}
+
+	slog.Info("purge_completed",
+		slog.String("id", report.ID),
+		slog.String("trigger", trigger),
+		slog.Bool("dry_run", dryRun),
+		slog.Int("purged", report.total()),
+		slog.Int("errors", len(report.Errors)),
+	)
+	return report, signed, nil
+}
+
+func (p *Purger) sign(report PurgeReport) []byte {
+	b, _ := json.Marshal(report)
+	out, _ := json.MarshalIndent(signedPurgeReport{Report: b, Signature: hex.EncodeToString(purgeReportMAC(p.key, b))}, "", "  ")
+	return append(out, '\n')
+}
+
+func purgeReportMAC(key, report []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("purge-report\x00"))
+	m.Write(report)
+	return m.Sum(nil)
+}
+
+// verifyPurgeReport checks a signed report against key. Whitespace does not
+// matter; any other change does.
+func verifyPurgeReport(key, data []byte) (PurgeReport, error) {
+	var signed signedPurgeReport
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return PurgeReport{}, fmt.Errorf("purge report: %w", err)
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, signed.Report); err != nil {
+		return PurgeReport{}, fmt.Errorf("purge report: %w", err)
+	}
+	sig, err := hex.DecodeString(signed.Signature)
+	if err != nil || !hmac.Equal(sig, purgeReportMAC(key, compact.Bytes())) {
+		return PurgeReport{}, errors.New("purge report: signature does not match")
+	}
+	var report PurgeReport
+	if err := json.Unmarshal(compact.Bytes(), &report); err != nil {
+		return PurgeReport{}, fmt.Errorf("purge report: %w", err)
+	}
+	return report, nil
+}
+
+// taskOutboxDrain is the input of the EventBridge rule that drains the
+// outbox. The purge rule sends the plain scheduled event.
+const taskOutboxDrain = "outbox-drain"
+
+// lambdaHandler serves API Gateway requests and, from the same function,
+// the EventBridge schedules that drain the outbox and run the purge
+func lambdaHandler(adapter *httpadapter.HandlerAdapter, outbox *Dispatcher, purger *Purger) func(context.Context, json.RawMessage) (any, error) {
+	return func(ctx context.Context, event json.RawMessage) (any, error) {
+		var task struct {
+			Task string `json:"task"`
+		}
+		if json.Unmarshal(event, &task) == nil && task.Task == taskOutboxDrain {
+			n, err := outbox.Drain(ctx)
+			if err != nil {
+				slog.Error("outbox_drain_failed", slog.Any("error", err))
+				return nil, err
+			}
+			return map[string]any{"sent": n}, nil
+		}
+		var scheduled events.CloudWatchEvent
+		if json.Unmarshal(event, &scheduled) == nil && scheduled.Source == "aws.events" && scheduled.DetailType == "Scheduled Event" {
+			report, _, err := purger.Run(ctx, purgeTriggerSchedule, false)
+			if err != nil {
+				slog.Error("purge_failed", slog.Any("error", err))
+				return nil, err
+			}
+			return map[string]any{"id": report.ID, "purged": report.total(), "errors": len(report.Errors)}, nil
+		}
+		var req events.APIGatewayProxyRequest
+		if err := json.Unmarshal(event, &req); err != nil {
+			return nil, err
+		}
+		return adapter.ProxyWithContext(ctx, req)
+	}
+}
+
+// runPurge applies the retention policy from the command line, against the
+// stores the environment selects, and writes the signed report. Reports are
+// signed with SPAM_SIGNING_KEY, so it must match the deployment's to verify
+// them later.
+func runPurge(cfg appconfig.Config, args []string) error {
+	if len(args) > 0 && args[0] == "verify" {
+		return runPurgeVerify(cfg, args[1:])
+	}
+	fs := flag.NewFlagSet("purge", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "report what would be purged without deleting it")
+	out := fs.String("out", "", "file to write the signed report to (default stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	key := []byte(cfg.SpamSigningKey.Reveal())
+	if len(key) == 0 {
+		return errors.New("SPAM_SIGNING_KEY is required to sign the report")
+	}
+
+	ctx := context.Background()
+	store, err := newInquiryStoreFromConfig(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	bookings, err := newBookingsFromConfig(ctx, cfg, nil, key)
+	if err != nil {
+		return err
+	}
+	purger, err := newPurgerFromConfig(ctx, cfg, store, bookings, key)
+	if err != nil {
+		return err
+	}
+	report, signed, err := purger.Run(ctx, purgeTriggerCLI, *dryRun)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		os.Stdout.Write(signed)
+	} else if err := os.WriteFile(*out, signed, 0o644); err != nil {
+		return err
+	}
+	if len(report.Errors) > 0 {
+		return fmt.Errorf("%d records could not be purged", len(report.Errors))
+	}
+	return nil
+}
+
+func runPurgeVerify(cfg appconfig.Config, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: purge verify FILE")
+	}
+	key := []byte(cfg.SpamSigningKey.Reveal())
+	if len(key) == 0 {
+		return errors.New("SPAM_SIGNING_KEY is required to verify the report")
+	}
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	report, err := verifyPurgeReport(key, data)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: valid, %s run at %s, %d records purged, %d errors\n",
+		args[0], report.Trigger, report.StartedAt.Format(time.RFC3339), report.total(), len(report.Errors))
+	return nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/awslabs/aws-lambda-go-api-proxy/httpadapter"
+
+	"stackfoundry.co.uk/components"
+)
+
+func TestRetentionPolicy(t *testing.T) {
+	// 1. The shipped policy parses and covers every state
+	p, err := parseRetentionPolicy(defaultRetentionPolicy)
+	if err != nil {
+		t.Fatalf("Embedded policy: %v", err)
+	}
+	if p.Inquiries["spam"] != 7 || p.Inquiries["new"] != 180 || len(p.Inquiries) != 5 || p.Bookings != 365 {
+		t.Errorf("Embedded policy %+v", p)
+	}
+
+	// 2. Typos and zero periods are rejected
+	for name, data := range map[string]string{
+		"Unknown State": `{"inquiries": {"spamm": 7}}`,
+		"Zero Days":     `{"inquiries": {"spam": 0}}`,
+		"Unknown Field": `{"inquiries": {}, "logs": 30}`,
+		"Negative Days": `{"inquiries": {}, "bookings": -1}`,
+	} {
+		if _, err := parseRetentionPolicy([]byte(data)); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	// 3. The privacy page states every period in force
+	var page bytes.Buffer
+	components.Privacy("", p.Notice()).Render(t.Context(), &page)
+	for _, want := range []string{"spam after 7 days", "review after 30 days", "unanswered enquiries after 180 days", "archived enquiries after 365 days", "correspondence after 730 days", "kept for 2190 days"} {
+		if !strings.Contains(page.String(), want) {
+			t.Errorf("Privacy page missing %q", want)
+		}
+	}
+}
+
+// newTestPurger returns a purger over memory stores seeded at now with
+// inquiries, bookings and audit entries either side of their periods
+func newTestPurger(t *testing.T, now time.Time) *Purger {
+	t.Helper()
+	store := NewMemoryStore()
+	for _, inq := range []struct {
+		email string
+		d     Disposition
+		age   int // days since last change
+	}{
+		{"old-spam@example.com", DispositionSpam, 8},
+		{"new-spam@example.com", DispositionSpam, 6},
+		{"old-new@example.com", DispositionNew, 181},
+		{"old-replied@example.com", DispositionReplied, 181},
+	} {
+		at := now.AddDate(0, 0, -inq.age)
+		if err := store.Save(t.Context(), Inquiry{ID: newInquiryID(at), Email: inq.email, Disposition: inq.d, CreatedAt: at, UpdatedAt: at}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	audit := NewMemoryAuditLog()
+	audit.Record(t.Context(), AuditEntry{ID: newAuditID(now.AddDate(-7, 0, 0)), Subject: subjectHash(testAuditKey, "old@example.com"), Action: auditView, At: now.AddDate(-7, 0, 0)})
+	audit.Record(t.Context(), AuditEntry{ID: newAuditID(now.AddDate(0, -1, 0)), Subject: subjectHash(testAuditKey, "recent@example.com"), Action: auditView, At: now.AddDate(0, -1, 0)})
+
+	policy, _ := parseRetentionPolicy(defaultRetentionPolicy)
+	purger := NewPurger(policy, store, audit, []byte("test-signing-key"))
+	purger.Bookings = NewMemoryBookingStore()
+	for _, days := range []int{366, 30} {
+		start := now.AddDate(0, 0, -days)
+		b := Booking{ID: newInquiryID(start), Status: BookingConfirmed, Start: start, End: start.Add(30 * time.Minute), Email: "caller@example.com", CreatedAt: start, UpdatedAt: start}
+		if err := purger.Bookings.Reserve(t.Context(), b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	purger.now = func() time.Time { return now }
+	return purger
+}
+
+func remainingEmails(t *testing.T, store InquiryStore) []string {
+	t.Helper()
+	all, _ := store.List(t.Context())
+	var out []string
+	for _, inq := range all {
+		out = append(out, inq.Email)
+	}
+	slices.Sort(out)
+	return out
+}
+
+func TestPurgerRun(t *testing.T) {
+	now := time.Date(2026, 6, 1, 3, 0, 0, 0, time.UTC)
+	purger := newTestPurger(t, now)
+	store, audit := purger.Store, purger.Audit
+
+	// 1. A dry run reports without deleting or filing a report
+	report, _, err := purger.Run(t.Context(), purgeTriggerCLI, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.total() != 4 || len(remainingEmails(t, store)) != 4 {
+		t.Errorf("Dry run reported %d, left %v", report.total(), remainingEmails(t, store))
+	}
+	if entries, _ := audit.List(t.Context(), purgeSubject); len(entries) != 0 {
+		t.Errorf("Dry run filed %d reports", len(entries))
+	}
+
+	// 2. A real run removes only what is past its period
+	report, signed, err := purger.Run(t.Context(), purgeTriggerSchedule, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"new-spam@example.com", "old-replied@example.com"}
+	if got := remainingEmails(t, store); !slices.Equal(got, want) {
+		t.Errorf("Left %v, want %v", got, want)
+	}
+	if old, _ := audit.List(t.Context(), subjectHash(testAuditKey, "old@example.com")); len(old) != 0 {
+		t.Errorf("Audit entries past retention remain: %+v", old)
+	}
+	if recent, _ := audit.List(t.Context(), subjectHash(testAuditKey, "recent@example.com")); len(recent) != 1 {
+		t.Error("Recent audit entry was purged")
+	}
+	if left, _ := purger.Bookings.List(t.Context()); len(left) != 1 || left[0].End.Before(now.AddDate(0, 0, -31)) {
+		t.Errorf("Bookings left %+v, want only last month's", left)
+	}
+	var rules []string
+	for _, r := range report.Rules {
+		rules = append(rules, fmt.Sprintf("%s:%s=%d", r.Records, r.State, r.Purged))
+	}
+	if got := strings.Join(rules, ","); got != "inquiries:archived=0,inquiries:new=1,inquiries:quarantine=0,inquiries:replied=0,inquiries:spam=1,bookings:=1,audit:=1" {
+		t.Errorf("Rules %s", got)
+	}
+
+	// 3. The signed report is filed in the audit log and holds no addresses
+	entries, _ := audit.List(t.Context(), purgeSubject)
+	if len(entries) != 1 || entries[0].Detail != string(signed) || entries[0].Records != 4 || entries[0].Outcome != "purged" {
+		t.Fatalf("Filed reports %+v", entries)
+	}
+	if strings.Contains(string(signed), "@example.com") {
+		t.Error("Report holds an address")
+	}
+}
+
+// listedThenChanged: Lets an admin change the store just after the purger lists it
+type listedThenChanged struct {
+	InquiryStore
+	change func()
+}
+
+func (s *listedThenChanged) List(ctx context.Context) ([]Inquiry, error) {
+	out, err := s.InquiryStore.List(ctx)
+	if change := s.change; change != nil {
+		s.change = nil
+		change()
+	}
+	return out, err
+}
+
+func TestPurgerSkipsChanged(t *testing.T) {
+	now := time.Date(2026, 6, 1, 3, 0, 0, 0, time.UTC)
+	purger := newTestPurger(t, now)
+	store := purger.Store
+
+	// 1. Old spam is refiled as replied between the list and the delete
+	purger.Store = &listedThenChanged{InquiryStore: store, change: func() {
+		all, _ := store.List(t.Context())
+		for _, inq := range all {
+			if inq.Email == "old-spam@example.com" {
+				inq.Disposition, inq.UpdatedAt = DispositionReplied, now
+				store.Update(t.Context(), inq)
+			}
+		}
+	}}
+	report, _, err := purger.Run(t.Context(), purgeTriggerSchedule, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2. It is kept and not reported as purged
+	if got := remainingEmails(t, store); !slices.Contains(got, "old-spam@example.com") {
+		t.Errorf("Left %v, want the refiled inquiry kept", got)
+	}
+	if len(report.Errors) != 0 || report.total() != 3 {
+		t.Errorf("Report purged %d with errors %v, want 3 and none", report.total(), report.Errors)
+	}
+}
+
+func TestPurgeReportSignature(t *testing.T) {
+	purger := newTestPurger(t, time.Date(2026, 6, 1, 3, 0, 0, 0, time.UTC))
+	_, signed, err := purger.Run(t.Context(), purgeTriggerCLI, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 1. The report verifies as written, and after reformatting
+	if _, err := verifyPurgeReport([]byte("test-signing-key"), signed); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	var compact bytes.Buffer
+	json.Compact(&compact, signed)
+	if _, err := verifyPurgeReport([]byte("test-signing-key"), compact.Bytes()); err != nil {
+		t.Errorf("Verify compacted: %v", err)
+	}
+
+	// 2. Edits and other keys fail
+	edited := bytes.Replace(signed, []byte(`"purged": 1`), []byte(`"purged": 0`), 1)
+	if bytes.Equal(edited, signed) {
+		t.Fatalf("No count to edit in:\n%s", signed)
+	}
+	if _, err := verifyPurgeReport([]byte("test-signing-key"), edited); err == nil {
+		t.Error("Edited report verified")
+	}
+	if _, err := verifyPurgeReport([]byte("other-key"), signed); err == nil {
+		t.Error("Report verified with another key")
+	}
+}
+
+func TestLambdaHandler(t *testing.T) {
+	now := time.Now()
+	purger := newTestPurger(t, now)
+	store := purger.Store
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+	mailer := &MemoryMailer{}
+	outbox := &Dispatcher{Store: store, Mailer: mailer, Sender: testSender}
+	handle := lambdaHandler(httpadapter.New(mux), outbox, purger)
+
+	// 1. The EventBridge schedule runs the purge
+	if _, err := handle(t.Context(), json.RawMessage(`{"source":"aws.events","detail-type":"Scheduled Event","detail":{}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(remainingEmails(t, store)); n != 2 {
+		t.Errorf("%d inquiries left after the scheduled purge, want 2", n)
+	}
+
+	// 2. The outbox rule retries failed notifications
+	failed := Inquiry{ID: newInquiryID(now), Status: StatusFailed, Email: "visitor@example.org", CreatedAt: now, UpdatedAt: now.Add(-2 * outboxGrace)}
+	store.Save(t.Context(), failed)
+	out, err := handle(t.Context(), json.RawMessage(`{"task":"outbox-drain"}`))
+	if err != nil || out.(map[string]any)["sent"] != 1 || len(mailer.Sent()) != 1 {
+		t.Errorf("Drain: %v, %v, %d sent", out, err, len(mailer.Sent()))
+	}
+
+	// 3. Anything else is an API Gateway request
+	out, err = handle(t.Context(), json.RawMessage(`{"httpMethod":"GET","path":"/health","headers":{}}`))
+	res, ok := out.(events.APIGatewayProxyResponse)
+	if err != nil || !ok || res.StatusCode != http.StatusOK || res.Body != "ok" {
+		t.Errorf("Proxy: %+v, %v", out, err)
+	}
+}
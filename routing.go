@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"slices"
+	"strings"
+
+	"stackfoundry.co.uk/appconfig"
+	"stackfoundry.co.uk/components"
+)
+
+// defaultRoutingRules is the table shipped with the binary. ROUTING_RULES
+// points at a replacement file for local runs or a different deployment.
+//
+//go:embed routing.json
+var defaultRoutingRules []byte
+
+// Route: One row of the routing table. Each non-empty criterion must match
+// (any of its values will do); a route with no criteria matches everything.
+type Route struct {
+	Name          string   `json:"name"`
+	Services      []string `json:"services,omitempty"` // components.ServiceLines IDs
+	Keywords      []string `json:"keywords,omitempty"` // case-insensitive, in subject or message
+	Domains       []string `json:"domains,omitempty"`  // sender domain or a subdomain of it
+	Recipients    []string `json:"recipients"`
+	SubjectPrefix string   `json:"subject_prefix,omitempty"`
+	Priority      string   `json:"priority,omitempty"`
+}
+
+// Routing: Where an inquiry's notification goes. Decided once on receipt and
+// stored with the inquiry, so outbox retries go to the same place.
+type Routing struct {
+	Route         string   `json:"route"`
+	Recipients    []string `json:"recipients"`
+	SubjectPrefix string   `json:"subject_prefix,omitempty"`
+	Priority      string   `json:"priority,omitempty"`
+}
+
+// defaultRouting is used when no route matches, and for inquiries stored
+// before routing existed. It has no recipients: notifications then go to
+// the sender's own inbox.
+var defaultRouting = Routing{Route: "default", SubjectPrefix: "[StackFoundry]"}
+
+// RoutingTable: Ordered routes; the first match wins. A nil table routes
+// everything to defaultRouting.
+type RoutingTable struct {
+	Routes []Route `json:"routes"`
+}
+
+// newRoutingTableFromConfig loads the file named by ROUTING_RULES, or the
+// embedded routing.json when it is unset
+func newRoutingTableFromConfig(cfg appconfig.Config) (*RoutingTable, error) {
+	data := defaultRoutingRules
+	if path := cfg.RoutingRules; path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("ROUTING_RULES: %w", err)
+		}
+		data = b
+	}
+	return parseRoutingTable(data)
+}
+
+func parseRoutingTable(data []byte) (*RoutingTable, error) {
+	var t RoutingTable
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&t); err != nil {
+		return nil, fmt.Errorf("routing rules: %w", err)
+	}
+	for i, r := range t.Routes {
+		if r.Name == "" {
+			return nil, fmt.Errorf("route %d: name is required", i)
+		}
+		if len(r.Recipients) == 0 {
+			return nil, fmt.Errorf("route %q: at least one recipient is required", r.Name)
+		}
+		for _, addr := range r.Recipients {
+			if _, err := mail.ParseAddress(addr); err != nil {
+				return nil, fmt.Errorf("route %q: recipient %q: %w", r.Name, addr, err)
+			}
+		}
+		// A typo here would silently send a service line to the catch-all
+		for _, id := range r.Services {
+			if components.ServiceLabel(id) == "" {
+				return nil, fmt.Errorf("route %q: unknown service %q", r.Name, id)
+			}
+		}
+	}
+	if len(t.Routes) == 0 {
+		return nil, errors.New("routing rules: no routes")
+	}
+	return &t, nil
+}
+
+// Match returns the routing for inq: the first route whose criteria all hold
+func (t *RoutingTable) Match(inq Inquiry) Routing {
+	if t == nil {
+		return defaultRouting
+	}
+	text := strings.ToLower(inq.Subject + "\n" + inq.Message)
+	_, domain, _ := splitEmail(strings.ToLower(inq.Email))
+
+	for _, r := range t.Routes {
+		if len(r.Services) > 0 && !slices.Contains(r.Services, inq.Service) {
+			continue
+		}
+		if len(r.Keywords) > 0 && !slices.ContainsFunc(r.Keywords, func(k string) bool {
+			return strings.Contains(text, strings.ToLower(k))
+		}) {
+			continue
+		}
+		if len(r.Domains) > 0 && !slices.ContainsFunc(r.Domains, func(d string) bool {
+			d = strings.ToLower(d)
+			return domain == d || strings.HasSuffix(domain, "."+d)
+		}) {
+			continue
+		}
+		return Routing{Route: r.Name, Recipients: r.Recipients, SubjectPrefix: r.SubjectPrefix, Priority: r.Priority}
+	}
+	return defaultRouting
+}
+
+// subject builds the notification subject: prefix, priority tag, then the
+// visitor's subject, falling back to the service they picked
+func (rt Routing) subject(n components.InquiryNotification) string {
+	parts := []string{cmp.Or(rt.SubjectPrefix, defaultRouting.SubjectPrefix)}
+	if rt.Priority != "" {
+		parts = append(parts, "["+rt.Priority+"]")
+	}
+	switch {
+	case sanitizeHeader(n.Subject) != "":
+		parts = append(parts, sanitizeHeader(n.Subject))
+	case n.Service != "":
+		parts = append(parts, n.Service)
+	default:
+		parts = append(parts, "New Inquiry")
+	}
+	return strings.Join(parts, " ")
+}
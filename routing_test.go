@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRoutingTable(t *testing.T) {
+	// 1. The shipped table must load, or every deploy falls back to the default route
+	if _, err := parseRoutingTable(defaultRoutingRules); err != nil {
+		t.Fatalf("Embedded routing.json is invalid: %v", err)
+	}
+
+	table, err := parseRoutingTable([]byte(`{"routes": [
+		{"name": "audit-enterprise", "services": ["audit"], "domains": ["bigco.com"], "recipients": ["sales@example.com", "cto@example.com"], "priority": "P1"},
+		{"name": "audit", "services": ["audit"], "recipients": ["audits@example.com"], "subject_prefix": "[Audit]"},
+		{"name": "urgent", "keywords": ["Outage"], "recipients": ["oncall@example.com"], "priority": "P1"},
+		{"name": "general", "recipients": ["hello@example.com"]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2. First route whose criteria all hold wins
+	tests := []struct {
+		name    string
+		inq     Inquiry
+		route   string
+		primary string
+	}{
+		{"Service And Domain", Inquiry{Service: "audit", Email: "ceo@eu.BigCo.com"}, "audit-enterprise", "sales@example.com"},
+		{"Service Only", Inquiry{Service: "audit", Email: "me@smallco.io"}, "audit", "audits@example.com"},
+		{"Domain Is Not A Suffix Match", Inquiry{Service: "audit", Email: "me@notbigco.com"}, "audit", "audits@example.com"},
+		{"Keyword In Message", Inquiry{Email: "me@x.io", Message: "We have an OUTAGE in prod"}, "urgent", "oncall@example.com"},
+		{"Catch All", Inquiry{Service: "mvp", Email: "me@x.io", Message: "Hello"}, "general", "hello@example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := table.Match(tt.inq)
+			if got.Route != tt.route || got.Recipients[0] != tt.primary {
+				t.Errorf("Match = %+v, want route %q to %s", got, tt.route, tt.primary)
+			}
+		})
+	}
+
+	// 3. Typos are caught at load time rather than misrouting leads
+	for name, spec := range map[string]string{
+		"Unknown Service":    `{"routes": [{"name": "x", "services": ["mvpp"], "recipients": ["a@example.com"]}]}`,
+		"No Recipients":      `{"routes": [{"name": "x"}]}`,
+		"Bad Recipient":      `{"routes": [{"name": "x", "recipients": ["not an address"]}]}`,
+		"Unknown Field":      `{"routes": [{"name": "x", "recipient": ["a@example.com"]}]}`,
+		"Empty Table":        `{"routes": []}`,
+		"Missing Route Name": `{"routes": [{"recipients": ["a@example.com"]}]}`,
+	} {
+		if _, err := parseRoutingTable([]byte(spec)); err == nil {
+			t.Errorf("%s: parseRoutingTable accepted %s", name, spec)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+
+	"stackfoundry.co.uk/appconfig"
+)
+
+// SecretReader: The one Secrets Manager call startup makes; satisfied by
+// *secretsmanager.Client
+type SecretReader interface {
+	GetSecretValue(ctx context.Context, in *secretsmanager.GetSecretValueInput, opts ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// loadSecrets fills each signing key given only as a Secrets Manager ARN.
+// The stack passes ARNs so the keys never appear in the function's
+// environment, where anyone allowed to read its configuration would see them.
+func loadSecrets(ctx context.Context, cfg *appconfig.Config) error {
+	if cfg.SpamSigningKeyARN == "" && cfg.AdminSessionKeyARN == "" && cfg.AuditKeyARN == "" {
+		return nil
+	}
+	aws, err := loadAWSConfig(ctx, *cfg)
+	if err != nil {
+		return err
+	}
+	return readSecrets(ctx, secretsmanager.NewFromConfig(aws), cfg)
+}
+
+// readSecrets reads every key that has an ARN and no value. A key set
+// directly wins, so a local override needs no AWS access.
+func readSecrets(ctx context.Context, client SecretReader, cfg *appconfig.Config) error {
+	for _, ref := range []struct {
+		env string
+		arn string
+		key *appconfig.Secret
+	}{
+		{"SPAM_SIGNING_KEY", cfg.SpamSigningKeyARN, &cfg.SpamSigningKey},
+		{"ADMIN_SESSION_KEY", cfg.AdminSessionKeyARN, &cfg.AdminSessionKey},
+		{"AUDIT_KEY", cfg.AuditKeyARN, &cfg.AuditKey},
+	} {
+		if ref.arn == "" || *ref.key != "" {
+			continue
+		}
+		out, err := client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(ref.arn)})
+		if err != nil {
+			return fmt.Errorf("%s: %w", ref.env, err)
+		}
+		if aws.ToString(out.SecretString) == "" {
+			return fmt.Errorf("%s: secret %s is empty", ref.env, ref.arn)
+		}
+		*ref.key = appconfig.Secret(aws.ToString(out.SecretString))
+	}
+	return nil
+}
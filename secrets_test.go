@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+
+	"stackfoundry.co.uk/appconfig"
+)
+
+// fakeSecrets: Secret values by ARN, and which ARNs were asked for
+type fakeSecrets struct {
+	values map[string]string
+	read   []string
+}
+
+func (f *fakeSecrets) GetSecretValue(ctx context.Context, in *secretsmanager.GetSecretValueInput, opts ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	arn := aws.ToString(in.SecretId)
+	f.read = append(f.read, arn)
+	v, ok := f.values[arn]
+	if !ok {
+		return nil, errors.New("ResourceNotFoundException")
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(v)}, nil
+}
+
+func TestReadSecrets(t *testing.T) {
+	client := &fakeSecrets{values: map[string]string{"arn:form": "form-key", "arn:audit": "audit-key"}}
+	cfg := appconfig.Defaults()
+	cfg.SpamSigningKeyARN, cfg.AuditKeyARN = "arn:form", "arn:audit"
+	cfg.AdminSessionKeyARN, cfg.AdminSessionKey = "arn:session", "set-directly"
+
+	// 1. Keys given by ARN are read; one set directly is left alone
+	if err := readSecrets(context.Background(), client, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SpamSigningKey.Reveal() != "form-key" || cfg.AuditKey.Reveal() != "audit-key" || cfg.AdminSessionKey.Reveal() != "set-directly" {
+		t.Errorf("Keys after reading: %q %q %q", cfg.SpamSigningKey.Reveal(), cfg.AuditKey.Reveal(), cfg.AdminSessionKey.Reveal())
+	}
+	if len(client.read) != 2 {
+		t.Errorf("Read %v, want only the two unset keys", client.read)
+	}
+
+	// 2. A secret that cannot be read stops startup, naming the setting
+	cfg = appconfig.Defaults()
+	cfg.AuditKeyARN = "arn:missing"
+	if err := readSecrets(context.Background(), client, &cfg); err == nil || !strings.HasPrefix(err.Error(), "AUDIT_KEY:") {
+		t.Errorf("Missing secret returned %v", err)
+	}
+}
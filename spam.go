@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"stackfoundry.co.uk/appconfig"
+	"stackfoundry.co.uk/components"
+)
+
+// Time-trap policy. Nobody reads the form and types a message in under
+// three seconds; a token older than a day is someone replaying a scrape.
+const (
+	minFillTime = 3 * time.Second
+	maxFormAge  = 24 * time.Hour
+)
+
+// Reasons logged with spam_blocked
+const (
+	spamHoneypot = "honeypot"
+	spamBadToken = "bad_token"
+	spamTooFast  = "too_fast"
+	spamExpired  = "expired"
+	spamReplayed = "replayed"
+)
+
+// SpamGuard: Issues and checks the signed render timestamp embedded in the
+// contact form. A token is base64url(issued-at || nonce) "." base64url(HMAC).
+// Spent nonces are claimed in Used, which must be shared by every instance
+// for a token to be single-use across them.
+type SpamGuard struct {
+	Used   IdempotencyStore
+	Logger *slog.Logger // nil uses slog.Default
+
+	key []byte
+}
+
+func NewSpamGuard(key []byte) *SpamGuard {
+	return &SpamGuard{Used: NewMemoryIdempotencyStore(), key: key}
+}
+
+// spamKeyFromConfig is SPAM_SIGNING_KEY, which signs form tokens,
+// proof-of-work challenges and booking manage links. Without it a random key
+// is used, which only works while a single process serves both render and
+// submit.
+func spamKeyFromConfig(cfg appconfig.Config, log *slog.Logger) []byte {
+	key := []byte(cfg.SpamSigningKey.Reveal())
+	if len(key) == 0 {
+		log.Warn("spam_key_ephemeral")
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return key
+}
+
+// Issue returns a token stamped with the current time
+func (g *SpamGuard) Issue() string {
+	return g.issueAt(time.Now())
+}
+
+// IssueForRetry returns a token pre-aged past the time trap, for forms that
+// put the visitor's already-typed values straight back in front of them.
+func (g *SpamGuard) IssueForRetry() string {
+	return g.issueAt(time.Now().Add(-minFillTime))
+}
+
+func (g *SpamGuard) issueAt(t time.Time) string {
+	payload := make([]byte, 16)
+	binary.BigEndian.PutUint64(payload, uint64(t.Unix()))
+	rand.Read(payload[8:])
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(g.sign(payload))
+}
+
+// sign returns the form-token signature. The purpose prefix keeps it distinct
+// from anything else signed with the same key.
+func (g *SpamGuard) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, g.key)
+	mac.Write([]byte("form-token\x00"))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// Check returns why the submission looks automated, or "" if it passes.
+// It does not spend the token; call Spend once the submission is otherwise
+// acceptable, so a visitor sent back to fix a field can submit again.
+func (g *SpamGuard) Check(r *http.Request) string {
+	if r.FormValue(components.HoneypotField) != "" {
+		return spamHoneypot
+	}
+
+	age, ok := g.Age(r.FormValue(components.FormTokenField))
+	if !ok {
+		return spamBadToken
+	}
+	switch {
+	case age < minFillTime:
+		return spamTooFast
+	case age > maxFormAge:
+		return spamExpired
+	}
+	return ""
+}
+
+// Age returns how long ago token was issued, or false if it is not ours
+func (g *SpamGuard) Age(token string) (time.Duration, bool) {
+	payload, ok := g.verify(token)
+	if !ok {
+		return 0, false
+	}
+	return time.Since(time.Unix(int64(binary.BigEndian.Uint64(payload)), 0)), true
+}
+
+// Spend atomically marks the token as used and reports whether this call
+// was the one that did. A second submission of the same token, concurrent or
+// on another instance, gets false. If the store is unreachable the token is
+// let through: the time trap and proof of work still apply.
+func (g *SpamGuard) Spend(ctx context.Context, token string) bool {
+	payload, ok := g.verify(token)
+	if !ok {
+		return false
+	}
+	return spend(ctx, g.logger(), g.Used, "form-token:"+hex.EncodeToString(payload[8:]), maxFormAge)
+}
+
+// spend claims key in the shared used-set. The ":" keeps these keys apart
+// from form idempotency keys, which are base64url.
+func spend(ctx context.Context, log *slog.Logger, used IdempotencyStore, key string, ttl time.Duration) bool {
+	held, _, err := used.Claim(ctx, key, "spent", ttl)
+	if err != nil {
+		log.ErrorContext(ctx, "spend_failed", slog.Any("error", err))
+		return true
+	}
+	return held == ""
+}
+
+func (g *SpamGuard) logger() *slog.Logger {
+	if g.Logger == nil {
+		return slog.Default()
+	}
+	return g.Logger
+}
+
+func (g *SpamGuard) verify(token string) ([]byte, bool) {
+	p, s, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(p)
+	if err != nil || len(payload) != 16 {
+		return nil, false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || !hmac.Equal(sig, g.sign(payload)) {
+		return nil, false
+	}
+	return payload, true
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"stackfoundry.co.uk/appconfig"
+)
+
+// defaultSpamModel is trained by `train` from spam_corpus.jsonl alone, since
+// it is committed and embedded. SPAM_MODEL points at a replacement file.
+//
+//go:embed spam_model.json
+var defaultSpamModel []byte
+
+const (
+	labelSpam = "spam"
+	labelHam  = "ham"
+)
+
+// spamPhrases are pitches that turn up in SEO and outsourcing spam and
+// almost never in a real brief. Each one present is a feature of its own.
+var spamPhrases = []string{
+	"backlink", "guest post", "do-follow", "dofollow", "first page of google",
+	"rank you", "ranking", "seo", "link building", "lead generation",
+	"hire dedicated", "dedicated developers", "dedicated resources", "offshore",
+	"outsourc", "white label", "staff augmentation", "kindly revert", "kindly let me know",
+	"dear sir", "dear webmaster", "dear ceo", "price list", "affordable price",
+	"cheap price", "limited time", "free audit", "free trial", "guaranteed",
+	"whatsapp", "telegram", "bitcoin", "crypto", "followers", "per hour",
+}
+
+var (
+	linkPattern  = regexp.MustCompile(`(?i)https?://|www\.`)
+	moneyPattern = regexp.MustCompile(`[$£€]\s?\d`)
+)
+
+// spamFeatures turns an inquiry into the counts the model is trained on:
+// its words, plus "#" features for links, stock phrases, prices, shouting
+// and which writing systems it mixes
+func spamFeatures(subject, message string) map[string]int {
+	text := subject + "\n" + message
+	lower := strings.ToLower(text)
+	f := map[string]int{}
+
+	// 1. Words
+	for w := range strings.FieldsFuncSeq(lower, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		if n := utf8.RuneCountInString(w); n >= 2 && n <= 24 {
+			f[w]++
+		}
+	}
+
+	// 2. Links, bucketed: one link is normal, several is a pitch
+	switch n := len(linkPattern.FindAllStringIndex(text, -1)); {
+	case n == 0:
+		f["#links:0"]++
+	case n == 1:
+		f["#links:1"]++
+	default:
+		f["#links:many"]++
+	}
+
+	// 3. Stock phrases and prices
+	for _, p := range spamPhrases {
+		if strings.Contains(lower, p) {
+			f["#phrase:"+p]++
+		}
+	}
+	if moneyPattern.MatchString(text) {
+		f["#money"]++
+	}
+
+	// 4. Character-set mix and shouting
+	scripts := map[string]bool{}
+	letters, upper := 0, 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		if unicode.IsUpper(r) {
+			upper++
+		}
+		switch {
+		case unicode.In(r, unicode.Latin):
+			scripts["latin"] = true
+		case unicode.In(r, unicode.Cyrillic):
+			scripts["cyrillic"] = true
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			scripts["cjk"] = true
+		case unicode.In(r, unicode.Arabic):
+			scripts["arabic"] = true
+		default:
+			scripts["other"] = true
+		}
+	}
+	for s := range scripts {
+		if s != "latin" {
+			f["#script:"+s]++
+		}
+	}
+	if len(scripts) > 1 {
+		f["#scripts:mixed"]++
+	}
+	if letters >= 20 && upper*2 > letters {
+		f["#shouting"]++
+	}
+	return f
+}
+
+// --- MODEL ---
+
+// spamModel: A multinomial naive Bayes model, stored as raw counts so it can
+// be retrained by adding examples and inspected by eye
+type spamModel struct {
+	Docs   map[string]int            `json:"docs"`   // label -> examples
+	Counts map[string]map[string]int `json:"counts"` // label -> feature -> occurrences
+
+	totals map[string]int
+	vocab  int
+}
+
+func newSpamModel() *spamModel {
+	return &spamModel{
+		Docs:   map[string]int{labelSpam: 0, labelHam: 0},
+		Counts: map[string]map[string]int{labelSpam: {}, labelHam: {}},
+	}
+}
+
+func parseSpamModel(data []byte) (*spamModel, error) {
+	m := newSpamModel()
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	if m.Docs[labelSpam] == 0 || m.Docs[labelHam] == 0 {
+		return nil, errors.New("spam model needs examples of both spam and ham")
+	}
+	m.prepare()
+	return m, nil
+}
+
+// add counts one labelled example
+func (m *spamModel) add(label string, features map[string]int) {
+	m.Docs[label]++
+	for f, n := range features {
+		m.Counts[label][f] += n
+	}
+}
+
+// prepare caches the per-label totals and vocabulary size Score needs
+func (m *spamModel) prepare() {
+	m.totals = map[string]int{}
+	vocab := map[string]bool{}
+	for label, counts := range m.Counts {
+		for f, n := range counts {
+			m.totals[label] += n
+			vocab[f] = true
+		}
+	}
+	m.vocab = len(vocab)
+}
+
+// Score returns the probability that the features are spam, with Laplace
+// smoothing. Features neither label has seen carry no evidence and are skipped.
+func (m *spamModel) Score(features map[string]int) float64 {
+	docs := float64(m.Docs[labelSpam] + m.Docs[labelHam])
+	logp := func(label string) float64 {
+		p := math.Log((float64(m.Docs[label]) + 1) / (docs + 2))
+		denom := float64(m.totals[label] + m.vocab)
+		for f, n := range features {
+			if m.Counts[labelSpam][f] == 0 && m.Counts[labelHam][f] == 0 {
+				continue
+			}
+			p += float64(n) * math.Log((float64(m.Counts[label][f])+1)/denom)
+		}
+		return p
+	}
+	return 1 / (1 + math.Exp(logp(labelHam)-logp(labelSpam)))
+}
+
+// --- FILTER ---
+
+// SpamFilter: Scores each inquiry's text and says whether to quarantine it.
+// A nil *SpamFilter is valid, scores everything 0 and quarantines nothing.
+type SpamFilter struct {
+	Model     *spamModel
+	Threshold float64
+}
+
+// newSpamFilterFromConfig loads the embedded model, or SPAM_MODEL, and the
+// SPAM_THRESHOLD score (0 to 1) at which inquiries are quarantined. The
+// default of 0.9 quarantines only what the model is very sure of; a missed
+// spam costs a click, a quarantined client costs a reply. SPAM_FILTER=off
+// turns it off.
+func newSpamFilterFromConfig(cfg appconfig.Config) (*SpamFilter, error) {
+	if !cfg.SpamFilter {
+		return nil, nil
+	}
+	data := defaultSpamModel
+	if path := cfg.SpamModel; path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("SPAM_MODEL: %w", err)
+		}
+		data = b
+	}
+	model, err := parseSpamModel(data)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.SpamThreshold <= 0 || cfg.SpamThreshold > 1 {
+		return nil, fmt.Errorf("SPAM_THRESHOLD must be above 0 and at most 1, got %g", cfg.SpamThreshold)
+	}
+	return &SpamFilter{Model: model, Threshold: cfg.SpamThreshold}, nil
+}
+
+// Score is the model's spam probability for an inquiry's subject and message
+func (f *SpamFilter) Score(subject, message string) float64 {
+	if f == nil {
+		return 0
+	}
+	return f.Model.Score(spamFeatures(subject, message))
+}
+
+// Quarantine reports whether a score is over the threshold
+func (f *SpamFilter) Quarantine(score float64) bool {
+	return f != nil && score >= f.Threshold
+}
+
+// --- TRAINING ---
+
+// spamExample is one line of spam_corpus.jsonl
+type spamExample struct {
+	Label   string `json:"label"`
+	Subject string `json:"subject"`
+	Message string `json:"message"`
+}
+
+func parseSpamCorpus(data []byte) ([]spamExample, error) {
+	var out []spamExample
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, 1<<20)
+	for n := 1; sc.Scan(); n++ {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		var ex spamExample
+		if err := json.Unmarshal(sc.Bytes(), &ex); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if ex.Label != labelSpam && ex.Label != labelHam {
+			return nil, fmt.Errorf("line %d: label must be %q or %q", n, labelSpam, labelHam)
+		}
+		out = append(out, ex)
+	}
+	return out, sc.Err()
+}
+
+// decisionExamples turns admin filing into training data: spam is spam, and
+// anything that was replied to is ham. Unfiled, archived and quarantined
+// inquiries say nothing either way.
+func decisionExamples(inqs []Inquiry) []spamExample {
+	var out []spamExample
+	for _, inq := range inqs {
+		switch inq.Disposition {
+		case DispositionSpam:
+			out = append(out, spamExample{Label: labelSpam, Subject: inq.Subject, Message: inq.Message})
+		case DispositionReplied:
+			out = append(out, spamExample{Label: labelHam, Subject: inq.Subject, Message: inq.Message})
+		}
+	}
+	return out
+}
+
+// trainSpamModel learns from the corpus and from admin decisions. Decisions
+// are real inquiries, so only their "#" features and words the corpus already
+// has are counted: names, companies and addresses never reach the model, and
+// what is left stays the same whether or not their inquiry is later erased.
+func trainSpamModel(corpus, decisions []spamExample) *spamModel {
+	m := newSpamModel()
+	vocab := map[string]bool{}
+	for _, ex := range corpus {
+		features := spamFeatures(ex.Subject, ex.Message)
+		for f := range features {
+			vocab[f] = true
+		}
+		m.add(ex.Label, features)
+	}
+	for _, ex := range decisions {
+		features := spamFeatures(ex.Subject, ex.Message)
+		for f := range features {
+			if !strings.HasPrefix(f, "#") && !vocab[f] {
+				delete(features, f)
+			}
+		}
+		m.add(ex.Label, features)
+	}
+	m.prepare()
+	return m
+}
+
+// runTrain rebuilds the model from the checked-in corpus. With -decisions it
+// also learns from the admin decisions in the store INQUIRY_STORE selects,
+// limited to the corpus vocabulary, and writes to data/ (not committed)
+// unless -out says otherwise; SPAM_MODEL then picks it up. Rebuild to ship
+// a model written to spam_model.json.
+func runTrain(cfg appconfig.Config, args []string) error {
+	fs := flag.NewFlagSet("train", flag.ContinueOnError)
+	corpus := fs.String("corpus", "spam_corpus.jsonl", "labelled examples, one JSON object per line")
+	out := fs.String("out", "", "model file to write (default spam_model.json, or data/spam_model.json with -decisions)")
+	decisions := fs.Bool("decisions", false, "also learn from inquiries admins filed as spam or replied to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" {
+		*out = "spam_model.json"
+		if *decisions {
+			*out = filepath.Join("data", "spam_model.json")
+		}
+	}
+
+	data, err := os.ReadFile(*corpus)
+	if err != nil {
+		return err
+	}
+	examples, err := parseSpamCorpus(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", *corpus, err)
+	}
+	var extra []spamExample
+	if *decisions {
+		ctx := context.Background()
+		store, err := newInquiryStoreFromConfig(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		if store != nil {
+			inqs, err := store.List(ctx)
+			if err != nil {
+				return err
+			}
+			extra = decisionExamples(inqs)
+		}
+	}
+
+	m := trainSpamModel(examples, extra)
+	if m.Docs[labelSpam] == 0 || m.Docs[labelHam] == 0 {
+		return errors.New("need at least one spam and one ham example")
+	}
+	b, err := json.MarshalIndent(m, "", " ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(*out), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(*out, append(b, '\n'), 0o644); err != nil {
+		return err
+	}
+
+	examples = append(examples, extra...)
+	correct := 0
+	for _, ex := range examples {
+		if (m.Score(spamFeatures(ex.Subject, ex.Message)) >= 0.5) == (ex.Label == labelSpam) {
+			correct++
+		}
+	}
+	use := "rebuild to embed it"
+	if filepath.Clean(*out) != "spam_model.json" {
+		use = "set SPAM_MODEL=" + *out + " to use it"
+	}
+	fmt.Printf("wrote %s: %d spam, %d ham (%d from admin decisions), %d/%d training examples classified correctly; %s\n",
+		*out, m.Docs[labelSpam], m.Docs[labelHam], len(extra), correct, len(examples), use)
+	return nil
+}
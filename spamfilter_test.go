@@ -0,0 +1,199 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"stackfoundry.co.uk/appconfig"
+)
+
+func testSpamFilter(t *testing.T) *SpamFilter {
+	t.Helper()
+	filter, err := newSpamFilterFromConfig(appconfig.Defaults())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filter
+}
+
+func TestSpamFeatures(t *testing.T) {
+	f := spamFeatures("GET MORE TRAFFIC NOW", "Visit https://a.example and www.b.example for backlinks from $99. Пишите нам")
+	for _, want := range []string{"traffic", "#links:many", "#phrase:backlink", "#money", "#script:cyrillic", "#scripts:mixed"} {
+		if f[want] == 0 {
+			t.Errorf("Missing feature %q in %v", want, f)
+		}
+	}
+	if f["#shouting"] != 0 {
+		t.Error("Mixed-case message counted as shouting")
+	}
+
+	f = spamFeatures("URGENT BUSINESS PROPOSAL", "PLEASE REPLY TODAY WITH YOUR DETAILS")
+	if f["#shouting"] == 0 || f["#links:0"] == 0 {
+		t.Errorf("Shouting message features: %v", f)
+	}
+}
+
+func TestSpamFilterScore(t *testing.T) {
+	filter := testSpamFilter(t)
+
+	// 1. Pitches the corpus has never seen verbatim still score as spam
+	for _, tt := range []struct{ subject, message string }{
+		{"Boost your Google ranking", "Dear sir, we offer guaranteed first page of google results and high quality do-follow backlinks at an affordable price. Kindly revert."},
+		{"Dedicated developers from $12 per hour", "Hire dedicated developers from our offshore team. White label and staff augmentation available. Contact us on whatsapp."},
+	} {
+		if s := filter.Score(tt.subject, tt.message); !filter.Quarantine(s) {
+			t.Errorf("Spam %q scored %.2f, below the threshold", tt.subject, s)
+		}
+	}
+
+	// 2. Real briefs, including one with a link, stay in the inbox
+	for _, tt := range []struct{ subject, message string }{
+		{"Go backend for our booking app", "We are a small team building a booking platform and need help designing the API and the Postgres schema. Could we talk next week?"},
+		{"AWS costs", "Our Lambda bill doubled after launch. The repo is at https://github.com/example/app if you want a look before a call."},
+	} {
+		if s := filter.Score(tt.subject, tt.message); filter.Quarantine(s) {
+			t.Errorf("Ham %q scored %.2f, quarantined", tt.subject, s)
+		}
+	}
+
+	// 3. A nil filter scores nothing and quarantines nothing
+	var off *SpamFilter
+	if s := off.Score("SEO", "backlinks"); s != 0 || off.Quarantine(1) {
+		t.Error("Nil filter scored or quarantined")
+	}
+}
+
+func TestSpamQuarantine(t *testing.T) {
+	mailer := &MemoryMailer{}
+	store := NewMemoryStore()
+	auth := newTestAdminAuth(t, AdminUser{Name: "joe", Role: RoleOwner})
+	var hooked atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hooked.Add(1) }))
+	defer srv.Close()
+	ack := &Acknowledger{Mailer: mailer, Sender: testSender, Limiter: NewMemoryRateBackend(), Policy: RatePolicy{Name: "ack", Rate: 1, Burst: 5}}
+	hooks := NewWebhooks([]WebhookEndpoint{{Name: "crm", URL: srv.URL, Format: WebhookJSON, Secret: []byte("whsec-test")}})
+	router := testApp(App{Mailer: mailer, Store: store, Admin: auth, Filter: testSpamFilter(t), Ack: ack, Hooks: hooks}).Handler()
+
+	// 1. Spam looks accepted, but is held without an email
+	rr := postForm(router, "/api/contact", newContactForm("seo@agency.example", "Guaranteed first page of Google", "Dear sir, we build high quality backlinks and guest posts at cheap price. Free audit, kindly revert on whatsapp."), true)
+	if rr.Code != http.StatusOK || referencePattern.FindString(rr.Body.String()) == "" {
+		t.Fatalf("Quarantined submission: status %d", rr.Code)
+	}
+	if n := len(mailer.Sent()); n != 0 || hooked.Load() != 0 {
+		t.Errorf("Sent %d emails and %d webhooks for spam", n, hooked.Load())
+	}
+	inqs, _ := store.List(t.Context())
+	if len(inqs) != 1 || inqs[0].Status != StatusHeld || inqs[0].Disposition != DispositionQuarantine || inqs[0].SpamScore < appconfig.Defaults().SpamThreshold {
+		t.Fatalf("Stored %+v, want one held quarantined inquiry", inqs)
+	}
+	held := inqs[0]
+
+	// 2. The inbox hides it; the Quarantine filter shows it
+	for query, want := range map[string]bool{"": false, "?disposition=quarantine": true} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, adminRequest(auth, "GET", "/admin"+query, nil))
+		if got := strings.Contains(rr.Body.String(), held.Reference()); got != want {
+			t.Errorf("Inbox %q lists the quarantined inquiry: %v, want %v", query, got, want)
+		}
+	}
+
+	// 3. Filing it as spam keeps it held
+	post := func(disposition string) {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, adminRequest(auth, "POST", "/admin/inquiries/"+held.ID+"/disposition", url.Values{"disposition": {disposition}}))
+		if rr.Code != http.StatusSeeOther {
+			t.Fatalf("Mark %s: status %d", disposition, rr.Code)
+		}
+	}
+	post("spam")
+	if inq, _ := store.Get(t.Context(), held.ID); inq.Status != StatusHeld {
+		t.Errorf("Filed as spam, status %q", inq.Status)
+	}
+
+	// 4. Filing it anywhere else releases it to the outbox, and sends the
+	// acknowledgement and webhooks it was held back from
+	post("new")
+	if inq, _ := store.Get(t.Context(), held.ID); inq.Status != StatusPending {
+		t.Errorf("Released, status %q", inq.Status)
+	}
+	if sent := mailer.Sent(); len(sent) != 1 || sent[0].To[0] != "seo@agency.example" || hooked.Load() != 1 {
+		t.Errorf("Release sent %+v and %d webhooks, want the ack and one", sent, hooked.Load())
+	}
+
+	// 5. A real inquiry is delivered as usual, with its score in the notification
+	postForm(router, "/api/contact", newContactForm("cto@startup.example", "Go API review", "Could you review our Go API before launch? We expect a lot of traffic next month."), true)
+	if sent := mailer.Sent(); len(sent) != 3 || !strings.Contains(sent[1].Text, "Spam Score") {
+		t.Errorf("Ham notification: %+v", sent)
+	}
+}
+
+func TestDecisionExamples(t *testing.T) {
+	got := decisionExamples([]Inquiry{
+		{Subject: "a", Disposition: DispositionSpam},
+		{Subject: "b", Disposition: DispositionReplied},
+		{Subject: "c", Disposition: DispositionArchived},
+		{Subject: "d", Disposition: DispositionQuarantine},
+		{Subject: "e"},
+	})
+	if len(got) != 2 || got[0].Label != labelSpam || got[1].Label != labelHam {
+		t.Errorf("decisionExamples = %+v", got)
+	}
+}
+
+func TestTrain(t *testing.T) {
+	dir := t.TempDir()
+	corpus := filepath.Join(dir, "corpus.jsonl")
+	out := filepath.Join(dir, "model.json")
+	os.WriteFile(corpus, []byte(`{"label":"spam","subject":"Backlinks","message":"Cheap backlinks for your site"}
+{"label":"ham","subject":"API","message":"We need help with our Go API"}
+`), 0o644)
+
+	// 1. The written model loads and separates its own examples
+	if err := runTrain(appconfig.Defaults(), []string{"-corpus", corpus, "-out", out, "-decisions=false"}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(out)
+	m, err := parseSpamModel(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Score(spamFeatures("Backlinks", "Cheap backlinks")) <= 0.5 || m.Score(spamFeatures("API", "Go API help")) >= 0.5 {
+		t.Error("Trained model does not separate its examples")
+	}
+
+	// 2. A one-sided corpus is refused, and bad labels name their line
+	os.WriteFile(corpus, []byte(`{"label":"spam","subject":"x","message":"y"}`+"\n"), 0o644)
+	if err := runTrain(appconfig.Defaults(), []string{"-corpus", corpus, "-out", out, "-decisions=false"}); err == nil {
+		t.Error("Trained on spam alone")
+	}
+	os.WriteFile(corpus, []byte(`{"label":"spam","subject":"x","message":"y"}`+"\n"+`{"label":"maybe"}`+"\n"), 0o644)
+	if err := runTrain(appconfig.Defaults(), []string{"-corpus", corpus, "-out", out, "-decisions=false"}); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Bad label: err = %v", err)
+	}
+
+	// 3. Decisions only count words the corpus already has
+	m = trainSpamModel(
+		[]spamExample{{Label: labelSpam, Subject: "Backlinks", Message: "Cheap backlinks"}, {Label: labelHam, Subject: "API", Message: "Go API help"}},
+		[]spamExample{{Label: labelHam, Subject: "API for Lovelace Ltd", Message: "Ada from Lovelace needs Go API help, call 07700900123"}},
+	)
+	if m.Docs[labelHam] != 2 || m.Counts[labelHam]["api"] != 4 {
+		t.Errorf("Decision not counted: %+v", m)
+	}
+	for _, word := range []string{"lovelace", "ada", "ltd", "07700900123"} {
+		if m.Counts[labelHam][word] != 0 {
+			t.Errorf("Model learned %q from a decision", word)
+		}
+	}
+
+	// 4. The checked-in corpus parses
+	data, _ = os.ReadFile("spam_corpus.jsonl")
+	if ex, err := parseSpamCorpus(data); err != nil || len(ex) == 0 {
+		t.Errorf("spam_corpus.jsonl: %d examples, err %v", len(ex), err)
+	}
+}
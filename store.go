@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	"stackfoundry.co.uk/appconfig"
+)
+
+// InquiryStatus tracks a stored inquiry through the outbox
+type InquiryStatus string
+
+const (
+	StatusPending InquiryStatus = "pending" // saved, notification not yet delivered
+	StatusSent    InquiryStatus = "sent"    // notification delivered
+	StatusFailed  InquiryStatus = "failed"  // last delivery attempt failed; retried by the dispatcher
+	StatusSending InquiryStatus = "sending" // claimed by a dispatcher until LeaseUntil
+	StatusHeld    InquiryStatus = "held"    // quarantined; not delivered unless an admin releases it
+)
+
+// Disposition is where an admin has filed the inquiry. It is separate from
+// InquiryStatus, which only tracks whether the notification went out.
+type Disposition string
+
+const (
+	DispositionNew        Disposition = "" // not yet handled
+	DispositionReplied    Disposition = "replied"
+	DispositionSpam       Disposition = "spam"
+	DispositionArchived   Disposition = "archived"
+	DispositionQuarantine Disposition = "quarantine" // held by the spam filter until released
+)
+
+// Note: A timestamped admin comment on an inquiry
+type Note struct {
+	At     time.Time `json:"at"`
+	Author string    `json:"author"`
+	Text   string    `json:"text"`
+}
+
+var (
+	ErrInquiryNotFound = errors.New("inquiry not found")
+	ErrInquiryConflict = errors.New("inquiry changed concurrently")
+)
+
+// Inquiry: One contact form submission, saved before any email is attempted
+type Inquiry struct {
+	ID        string        `json:"id"`
+	Status    InquiryStatus `json:"status"`
+	Email     string        `json:"email"`
+	Service   string        `json:"service,omitempty"`
+	Subject   string        `json:"subject"`
+	Message   string        `json:"message"`
+	SessionID string        `json:"session_id,omitempty"`
+	Referrer  string        `json:"referrer,omitempty"`
+	UserAgent string        `json:"user_agent,omitempty"`
+	CreatedAt time.Time     `json:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+	Attempts  int           `json:"attempts"`
+	LastError string        `json:"last_error,omitempty"`
+	// LeaseUntil is when a sending claim lapses and another dispatcher may take over
+	LeaseUntil time.Time `json:"lease_until,omitzero"`
+
+	Attachments []AttachmentMeta `json:"attachments,omitempty"`
+	Brief       *Brief           `json:"brief,omitempty"`
+	Screening   *EmailScreening  `json:"screening,omitempty"`
+	SpamScore   float64          `json:"spam_score,omitempty"`
+	Routing     Routing          `json:"routing"`
+	Disposition Disposition      `json:"disposition,omitempty"`
+	Notes       []Note           `json:"notes,omitempty"`
+	// WebhookFailures lists the receivers that never got this inquiry
+	WebhookFailures []WebhookFailure `json:"webhook_failures,omitempty"`
+	Version         int              `json:"version"`
+
+	// files holds the uploaded bytes for the request that received them.
+	// Only the metadata is stored, so the contact handler withdraws an
+	// inquiry with files whose first send failed.
+	files []Attachment
+}
+
+// InquiryStore: Durable home for inquiries. Save creates. Update overwrites
+// only if the stored Version still matches inq's, then increments it; a
+// record changed since it was read gives ErrInquiryConflict.
+type InquiryStore interface {
+	Save(ctx context.Context, inq Inquiry) error
+	Update(ctx context.Context, inq Inquiry) (Inquiry, error)
+	Get(ctx context.Context, id string) (Inquiry, error)
+	ListByStatus(ctx context.Context, status InquiryStatus) ([]Inquiry, error)
+	// List returns every inquiry, newest first
+	List(ctx context.Context) ([]Inquiry, error)
+	// Delete removes an inquiry for good, or returns ErrInquiryNotFound
+	Delete(ctx context.Context, id string) error
+	// DeleteVersion deletes only while the stored Version is still version,
+	// and returns ErrInquiryConflict if it has changed since it was read
+	DeleteVersion(ctx context.Context, id string, version int) error
+}
+
+// newInquiryID returns a sortable, unguessable ID: UTC timestamp plus random suffix
+func newInquiryID(now time.Time) string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return now.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b)
+}
+
+// inquiryReference is the short form shown to the visitor, e.g. "SF-1A2B3C4D".
+// It is the random half of the ID, so it cannot be guessed from the time.
+func inquiryReference(id string) string {
+	_, suffix, _ := strings.Cut(id, "-")
+	return "SF-" + strings.ToUpper(suffix)
+}
+
+// Reference returns the visitor-facing reference for the inquiry
+func (inq Inquiry) Reference() string {
+	return inquiryReference(inq.ID)
+}
+
+// newInquiryStoreFromConfig picks a store from INQUIRY_STORE (jsonl, dynamodb, memory, none).
+// Lambda defaults to DynamoDB; local runs default to a JSONL file.
+func newInquiryStoreFromConfig(ctx context.Context, cfg appconfig.Config) (InquiryStore, error) {
+	switch cfg.InquiryStore {
+	case "jsonl":
+		store, err := OpenJSONLStore(cfg.InquiryStorePath)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case "dynamodb":
+		if cfg.InquiryTable == "" {
+			return nil, errors.New("INQUIRY_TABLE is required for the dynamodb store")
+		}
+		aws, err := loadAWSConfig(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &DynamoStore{Client: dynamodb.NewFromConfig(aws), Table: cfg.InquiryTable}, nil
+	case "memory":
+		return NewMemoryStore(), nil
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown inquiry store %q", cfg.InquiryStore)
+	}
+}
+
+// loadAWSConfig is the SDK configuration every AWS client shares, in REGION
+func loadAWSConfig(ctx context.Context, cfg appconfig.Config) (aws.Config, error) {
+	c, err := config.LoadDefaultConfig(ctx, config.WithRegion(cfg.Region))
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("aws config: %w", err)
+	}
+	return c, nil
+}
+
+// --- MEMORY ---
+
+// MemoryStore: Map-backed store. Used by tests and as the base of JSONLStore.
+type MemoryStore struct {
+	mu   sync.Mutex
+	byID map[string]Inquiry
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{byID: map[string]Inquiry{}}
+}
+
+func (s *MemoryStore) Save(ctx context.Context, inq Inquiry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.byID[inq.ID]; ok {
+		return fmt.Errorf("inquiry %s already exists", inq.ID)
+	}
+	inq.files = nil // like the durable stores, keep metadata only
+	s.byID[inq.ID] = inq
+	return nil
+}
+
+func (s *MemoryStore) Update(ctx context.Context, inq Inquiry) (Inquiry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, ok := s.byID[inq.ID]
+	if !ok {
+		return Inquiry{}, ErrInquiryNotFound
+	}
+	if cur.Version != inq.Version {
+		return Inquiry{}, ErrInquiryConflict
+	}
+	inq.files = nil
+	inq.Version++
+	s.byID[inq.ID] = inq
+	return inq, nil
+}
+
+func (s *MemoryStore) Get(ctx context.Context, id string) (Inquiry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inq, ok := s.byID[id]
+	if !ok {
+		return Inquiry{}, ErrInquiryNotFound
+	}
+	return inq, nil
+}
+
+func (s *MemoryStore) ListByStatus(ctx context.Context, status InquiryStatus) ([]Inquiry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Inquiry
+	for _, inq := range s.byID {
+		if inq.Status == status {
+			out = append(out, inq)
+		}
+	}
+	slices.SortFunc(out, func(a, b Inquiry) int { return cmp.Compare(a.ID, b.ID) })
+	return out, nil
+}
+
+func (s *MemoryStore) List(ctx context.Context) ([]Inquiry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := slices.Collect(maps.Values(s.byID))
+	slices.SortFunc(out, func(a, b Inquiry) int { return cmp.Compare(b.ID, a.ID) })
+	return out, nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.byID[id]; !ok {
+		return ErrInquiryNotFound
+	}
+	delete(s.byID, id)
+	return nil
+}
+
+func (s *MemoryStore) DeleteVersion(ctx context.Context, id string, version int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, ok := s.byID[id]
+	if !ok {
+		return ErrInquiryNotFound
+	}
+	if cur.Version != version {
+		return ErrInquiryConflict
+	}
+	delete(s.byID, id)
+	return nil
+}
+
+// --- JSONL ---
+
+// JSONLStore: Append-only JSON Lines file for local runs. Every Save and
+// Update appends the full record; on open the last line per ID wins. Chosen
+// over SQLite to keep the binary static and free of cgo.
+type JSONLStore struct {
+	*MemoryStore
+	path string
+	mu   sync.Mutex
+}
+
+func OpenJSONLStore(path string) (*JSONLStore, error) {
+	s := &JSONLStore{MemoryStore: NewMemoryStore(), path: path}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		var inq Inquiry
+		if err := json.Unmarshal(sc.Bytes(), &inq); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		s.byID[inq.ID] = inq
+	}
+	return s, sc.Err()
+}
+
+// Save and Update hit the file before the in-memory index, so a failed write
+// never leaves a record that would vanish on restart.
+func (s *JSONLStore) Save(ctx context.Context, inq Inquiry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.MemoryStore.Get(ctx, inq.ID); err == nil {
+		return fmt.Errorf("inquiry %s already exists", inq.ID)
+	}
+	if err := s.append(inq); err != nil {
+		return err
+	}
+	return s.MemoryStore.Save(ctx, inq)
+}
+
+func (s *JSONLStore) Update(ctx context.Context, inq Inquiry) (Inquiry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, err := s.MemoryStore.Get(ctx, inq.ID)
+	if err != nil {
+		return Inquiry{}, err
+	}
+	if cur.Version != inq.Version {
+		return Inquiry{}, ErrInquiryConflict
+	}
+	next := inq
+	next.Version++
+	if err := s.append(next); err != nil {
+		return Inquiry{}, err
+	}
+	return s.MemoryStore.Update(ctx, inq)
+}
+
+// Delete rewrites the file without the inquiry. Appending a tombstone would
+// leave the erased record on disk, which defeats the point of deleting it.
+func (s *JSONLStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.MemoryStore.Get(ctx, id); err != nil {
+		return err
+	}
+	return s.remove(ctx, id)
+}
+
+func (s *JSONLStore) DeleteVersion(ctx context.Context, id string, version int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, err := s.MemoryStore.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if cur.Version != version {
+		return ErrInquiryConflict
+	}
+	return s.remove(ctx, id)
+}
+
+// remove rewrites the file without id; the caller holds s.mu
+func (s *JSONLStore) remove(ctx context.Context, id string) error {
+	all, err := s.MemoryStore.List(ctx)
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	for _, inq := range slices.Backward(all) {
+		if inq.ID == id {
+			continue
+		}
+		line, err := json.Marshal(inq)
+		if err != nil {
+			return err
+		}
+		b.Write(append(line, '\n'))
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b.Bytes(), 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	return s.MemoryStore.Delete(ctx, id)
+}
+
+func (s *JSONLStore) append(inq Inquiry) error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(inq)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
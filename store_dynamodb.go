@@ -0,0 +1,280 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// statusIndex is the GSI (partition "status", sort "updated_at") the dispatcher
+// queries for undelivered inquiries. Defined alongside the table in infra.go.
+const statusIndex = "status-index"
+
+// DynamoStore: One item per inquiry, keyed by "id"
+type DynamoStore struct {
+	Client *dynamodb.Client
+	Table  string
+}
+
+func (s *DynamoStore) Save(ctx context.Context, inq Inquiry) error {
+	_, err := s.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(s.Table),
+		Item:                inquiryToItem(inq),
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	return err
+}
+
+// Update is a put conditional on the version read. Items written before
+// versions existed have none and count as version 0.
+func (s *DynamoStore) Update(ctx context.Context, inq Inquiry) (Inquiry, error) {
+	expected := inq.Version
+	inq.Version++
+	cond := "attribute_exists(id) AND version = :v"
+	if expected == 0 {
+		cond = "attribute_exists(id) AND (attribute_not_exists(version) OR version = :v)"
+	}
+	_, err := s.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(s.Table),
+		Item:                inquiryToItem(inq),
+		ConditionExpression: aws.String(cond),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":v": &types.AttributeValueMemberN{Value: strconv.Itoa(expected)},
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var cfe *types.ConditionalCheckFailedException
+	if errors.As(err, &cfe) {
+		if cfe.Item == nil {
+			return Inquiry{}, ErrInquiryNotFound
+		}
+		return Inquiry{}, ErrInquiryConflict
+	}
+	if err != nil {
+		return Inquiry{}, err
+	}
+	return inq, nil
+}
+
+func (s *DynamoStore) Get(ctx context.Context, id string) (Inquiry, error) {
+	out, err := s.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.Table),
+		Key:            map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: id}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return Inquiry{}, err
+	}
+	if out.Item == nil {
+		return Inquiry{}, ErrInquiryNotFound
+	}
+	return itemToInquiry(out.Item), nil
+}
+
+func (s *DynamoStore) ListByStatus(ctx context.Context, status InquiryStatus) ([]Inquiry, error) {
+	var out []Inquiry
+	p := dynamodb.NewQueryPaginator(s.Client, &dynamodb.QueryInput{
+		TableName:              aws.String(s.Table),
+		IndexName:              aws.String(statusIndex),
+		KeyConditionExpression: aws.String("#s = :s"),
+		ExpressionAttributeNames: map[string]string{
+			"#s": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":s": &types.AttributeValueMemberS{Value: string(status)},
+		},
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			out = append(out, itemToInquiry(item))
+		}
+	}
+	return out, nil
+}
+
+// List scans the whole table. Fine at inbox volumes; a date-keyed index would
+// be the next step if it ever is not.
+func (s *DynamoStore) Delete(ctx context.Context, id string) error {
+	_, err := s.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(s.Table),
+		Key:                 map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: id}},
+		ConditionExpression: aws.String("attribute_exists(id)"),
+	})
+	var cfe *types.ConditionalCheckFailedException
+	if errors.As(err, &cfe) {
+		return ErrInquiryNotFound
+	}
+	return err
+}
+
+// DeleteVersion is a delete conditional on the version read, like Update
+func (s *DynamoStore) DeleteVersion(ctx context.Context, id string, version int) error {
+	cond := "attribute_exists(id) AND version = :v"
+	if version == 0 {
+		cond = "attribute_exists(id) AND (attribute_not_exists(version) OR version = :v)"
+	}
+	_, err := s.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(s.Table),
+		Key:                 map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: id}},
+		ConditionExpression: aws.String(cond),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":v": &types.AttributeValueMemberN{Value: strconv.Itoa(version)},
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var cfe *types.ConditionalCheckFailedException
+	if errors.As(err, &cfe) {
+		if cfe.Item == nil {
+			return ErrInquiryNotFound
+		}
+		return ErrInquiryConflict
+	}
+	return err
+}
+
+func (s *DynamoStore) List(ctx context.Context) ([]Inquiry, error) {
+	var out []Inquiry
+	p := dynamodb.NewScanPaginator(s.Client, &dynamodb.ScanInput{TableName: aws.String(s.Table)})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			out = append(out, itemToInquiry(item))
+		}
+	}
+	slices.SortFunc(out, func(a, b Inquiry) int { return cmp.Compare(b.ID, a.ID) })
+	return out, nil
+}
+
+// --- ITEM MAPPING ---
+
+func inquiryToItem(inq Inquiry) map[string]types.AttributeValue {
+	item := map[string]types.AttributeValue{
+		"id":         &types.AttributeValueMemberS{Value: inq.ID},
+		"status":     &types.AttributeValueMemberS{Value: string(inq.Status)},
+		"email":      &types.AttributeValueMemberS{Value: inq.Email},
+		"message":    &types.AttributeValueMemberS{Value: inq.Message},
+		"created_at": &types.AttributeValueMemberS{Value: inq.CreatedAt.UTC().Format(time.RFC3339Nano)},
+		"updated_at": &types.AttributeValueMemberS{Value: inq.UpdatedAt.UTC().Format(time.RFC3339Nano)},
+		"attempts":   &types.AttributeValueMemberN{Value: strconv.Itoa(inq.Attempts)},
+		"version":    &types.AttributeValueMemberN{Value: strconv.Itoa(inq.Version)},
+	}
+	// Optional fields are left off the item when empty
+	for k, v := range map[string]string{
+		"service":     inq.Service,
+		"subject":     inq.Subject,
+		"session_id":  inq.SessionID,
+		"referrer":    inq.Referrer,
+		"user_agent":  inq.UserAgent,
+		"last_error":  inq.LastError,
+		"disposition": string(inq.Disposition),
+	} {
+		if v != "" {
+			item[k] = &types.AttributeValueMemberS{Value: v}
+		}
+	}
+	if !inq.LeaseUntil.IsZero() {
+		item["lease_until"] = &types.AttributeValueMemberS{Value: inq.LeaseUntil.UTC().Format(time.RFC3339Nano)}
+	}
+	if len(inq.Attachments) > 0 {
+		b, _ := json.Marshal(inq.Attachments)
+		item["attachments"] = &types.AttributeValueMemberS{Value: string(b)}
+	}
+	if inq.Brief != nil {
+		b, _ := json.Marshal(inq.Brief)
+		item["brief"] = &types.AttributeValueMemberS{Value: string(b)}
+	}
+	if inq.SpamScore > 0 {
+		item["spam_score"] = &types.AttributeValueMemberN{Value: strconv.FormatFloat(inq.SpamScore, 'f', -1, 64)}
+	}
+	if inq.Screening != nil {
+		b, _ := json.Marshal(inq.Screening)
+		item["screening"] = &types.AttributeValueMemberS{Value: string(b)}
+	}
+	if len(inq.Notes) > 0 {
+		b, _ := json.Marshal(inq.Notes)
+		item["notes"] = &types.AttributeValueMemberS{Value: string(b)}
+	}
+	if len(inq.WebhookFailures) > 0 {
+		b, _ := json.Marshal(inq.WebhookFailures)
+		item["webhook_failures"] = &types.AttributeValueMemberS{Value: string(b)}
+	}
+	if len(inq.Routing.Recipients) > 0 {
+		b, _ := json.Marshal(inq.Routing)
+		item["routing"] = &types.AttributeValueMemberS{Value: string(b)}
+	}
+	return item
+}
+
+func itemToInquiry(item map[string]types.AttributeValue) Inquiry {
+	str := func(k string) string {
+		if v, ok := item[k].(*types.AttributeValueMemberS); ok {
+			return v.Value
+		}
+		return ""
+	}
+	ts := func(k string) time.Time {
+		t, _ := time.Parse(time.RFC3339Nano, str(k))
+		return t
+	}
+	inq := Inquiry{
+		ID:          str("id"),
+		Status:      InquiryStatus(str("status")),
+		Email:       str("email"),
+		Service:     str("service"),
+		Subject:     str("subject"),
+		Message:     str("message"),
+		SessionID:   str("session_id"),
+		Referrer:    str("referrer"),
+		UserAgent:   str("user_agent"),
+		CreatedAt:   ts("created_at"),
+		UpdatedAt:   ts("updated_at"),
+		LastError:   str("last_error"),
+		LeaseUntil:  ts("lease_until"),
+		Disposition: Disposition(str("disposition")),
+	}
+	if v, ok := item["attempts"].(*types.AttributeValueMemberN); ok {
+		inq.Attempts, _ = strconv.Atoi(v.Value)
+	}
+	if v, ok := item["version"].(*types.AttributeValueMemberN); ok {
+		inq.Version, _ = strconv.Atoi(v.Value)
+	}
+	if v, ok := item["spam_score"].(*types.AttributeValueMemberN); ok {
+		inq.SpamScore, _ = strconv.ParseFloat(v.Value, 64)
+	}
+	if v := str("attachments"); v != "" {
+		json.Unmarshal([]byte(v), &inq.Attachments)
+	}
+	if v := str("brief"); v != "" {
+		inq.Brief = &Brief{}
+		json.Unmarshal([]byte(v), inq.Brief)
+	}
+	if v := str("screening"); v != "" {
+		inq.Screening = &EmailScreening{}
+		json.Unmarshal([]byte(v), inq.Screening)
+	}
+	if v := str("notes"); v != "" {
+		json.Unmarshal([]byte(v), &inq.Notes)
+	}
+	if v := str("webhook_failures"); v != "" {
+		json.Unmarshal([]byte(v), &inq.WebhookFailures)
+	}
+	if v := str("routing"); v != "" {
+		json.Unmarshal([]byte(v), &inq.Routing)
+	}
+	return inq
+}
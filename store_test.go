@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONLStoreReload(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "inquiries.jsonl")
+
+	store, err := OpenJSONLStore(path)
+	if err != nil {
+		t.Fatalf("OpenJSONLStore: %v", err)
+	}
+
+	now := time.Now()
+	inq := Inquiry{ID: newInquiryID(now), Status: StatusPending, Email: "test@example.com", Message: "Hello", CreatedAt: now, UpdatedAt: now}
+	if err := store.Save(ctx, inq); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if err := store.Save(ctx, inq); err == nil {
+		t.Errorf("Save accepted a duplicate ID")
+	}
+
+	stale := inq
+	inq.Status = StatusSent
+	inq.Attempts = 1
+	if inq, err = store.Update(ctx, inq); err != nil || inq.Version != 1 {
+		t.Fatalf("Update: version %d, %v", inq.Version, err)
+	}
+	if _, err := store.Update(ctx, Inquiry{ID: "missing"}); err != ErrInquiryNotFound {
+		t.Errorf("Update of unknown ID returned %v, want ErrInquiryNotFound", err)
+	}
+
+	// A write based on an older read is refused, not silently applied
+	stale.Notes = []Note{{Text: "Written from a stale copy"}}
+	if _, err := store.Update(ctx, stale); err != ErrInquiryConflict {
+		t.Errorf("Stale update returned %v, want ErrInquiryConflict", err)
+	}
+
+	// The last line per ID wins when the file is reopened
+	reopened, err := OpenJSONLStore(path)
+	if err != nil {
+		t.Fatalf("OpenJSONLStore (reopen): %v", err)
+	}
+	got, err := reopened.Get(ctx, inq.ID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.Status != StatusSent || got.Attempts != 1 || got.Email != "test@example.com" || got.Version != 1 || len(got.Notes) != 0 {
+		t.Errorf("Reloaded inquiry is %+v", got)
+	}
+	if pending, _ := reopened.ListByStatus(ctx, StatusPending); len(pending) != 0 {
+		t.Errorf("Reloaded store still lists %d pending inquiries", len(pending))
+	}
+}
+
+func TestJSONLStoreDelete(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "inquiries.jsonl")
+	store, err := OpenJSONLStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	keep := Inquiry{ID: newInquiryID(now), Email: "keep@example.com", Message: "Stays"}
+	gone := Inquiry{ID: newInquiryID(now), Email: "gone@example.com", Message: "Erase me"}
+	store.Save(ctx, keep)
+	store.Save(ctx, gone)
+	gone.Status = StatusSent
+	gone, _ = store.Update(ctx, gone)
+
+	// 1. Every line for the inquiry leaves the file, not just the index
+	if err := store.Delete(ctx, gone.ID); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := store.Delete(ctx, gone.ID); err != ErrInquiryNotFound {
+		t.Errorf("Second delete returned %v, want ErrInquiryNotFound", err)
+	}
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "gone@example.com") || !strings.Contains(string(data), "keep@example.com") {
+		t.Errorf("File after delete:\n%s", data)
+	}
+
+	// 2. The rewritten file reloads, and appends still work after it
+	store.Update(ctx, keep)
+	reopened, err := OpenJSONLStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all, _ := reopened.List(ctx); len(all) != 1 || all[0].ID != keep.ID {
+		t.Errorf("Reloaded %+v", all)
+	}
+}
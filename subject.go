@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"stackfoundry.co.uk/appconfig"
+	"stackfoundry.co.uk/components"
+)
+
+// subjectLinkTTL is how long an emailed access link works. Short, because
+// anyone holding the link can read and erase everything we have.
+const subjectLinkTTL = time.Hour
+
+// defaultSubjectLinkLimit caps links per address, so the form cannot be used
+// to fill someone's inbox
+const defaultSubjectLinkLimit = "3/d:3"
+
+// SubjectDataProvider: One place we keep personal data, able to find and
+// erase everything about an email address. Matching is case-insensitive.
+type SubjectDataProvider interface {
+	// Name labels the provider's records in exports and on the page
+	Name() string
+	// Export returns every record held about email, each marshalled as JSON
+	Export(ctx context.Context, email string) ([]any, error)
+	// Erase deletes every record held about email and returns how many went
+	Erase(ctx context.Context, email string) (int, error)
+}
+
+// InquirySubjectData exposes stored inquiries, notes included, to
+// data-subject requests
+type InquirySubjectData struct {
+	Store InquiryStore
+}
+
+func (p InquirySubjectData) Name() string { return "inquiries" }
+
+func (p InquirySubjectData) find(ctx context.Context, email string) ([]Inquiry, error) {
+	all, err := p.Store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []Inquiry
+	for _, inq := range all {
+		if strings.EqualFold(strings.TrimSpace(inq.Email), email) {
+			out = append(out, inq)
+		}
+	}
+	return out, nil
+}
+
+func (p InquirySubjectData) Export(ctx context.Context, email string) ([]any, error) {
+	inqs, err := p.find(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]any, len(inqs))
+	for i, inq := range inqs {
+		out[i] = inq
+	}
+	return out, nil
+}
+
+func (p InquirySubjectData) Erase(ctx context.Context, email string) (int, error) {
+	inqs, err := p.find(ctx, email)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, inq := range inqs {
+		if err := p.Store.Delete(ctx, inq.ID); err != nil && !errors.Is(err, ErrInquiryNotFound) {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// BookingSubjectData exposes discovery-call bookings, which hold the
+// visitor's name and address, to data-subject requests
+type BookingSubjectData struct {
+	Store BookingStore
+}
+
+func (p BookingSubjectData) Name() string { return "bookings" }
+
+func (p BookingSubjectData) Export(ctx context.Context, email string) ([]any, error) {
+	bks, err := p.Store.ByEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]any, len(bks))
+	for i, b := range bks {
+		out[i] = b
+	}
+	return out, nil
+}
+
+// Erase deletes the bookings outright. A call still to come loses its slot
+// without a cancellation email, since there is no longer anyone to send it to.
+func (p BookingSubjectData) Erase(ctx context.Context, email string) (int, error) {
+	bks, err := p.Store.ByEmail(ctx, email)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, b := range bks {
+		if err := p.Store.Delete(ctx, b.ID); err != nil && !errors.Is(err, ErrBookingNotFound) {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// --- SERVICE ---
+
+// SubjectRequests: Self-service access and erasure. A visitor asks for a
+// link, we email it to the address, and the link lets them download or
+// erase what the providers hold. Every step is written to Audit.
+type SubjectRequests struct {
+	Providers []SubjectDataProvider
+	Audit     AuditLog
+	Mailer    Mailer // nil means links cannot be sent, so requests are refused
+	Sender    string // From address on the links
+	Limiter   RateLimitBackend
+	Policy    RatePolicy
+	BaseURL   string // absolute site URL for links in emails
+
+	key      []byte
+	auditKey []byte
+	now      func() time.Time
+}
+
+// NewSubjectRequests signs access links with key and hashes addresses in the
+// audit log with auditKey
+func NewSubjectRequests(providers []SubjectDataProvider, audit AuditLog, mailer Mailer, sender, baseURL string, key, auditKey []byte) *SubjectRequests {
+	policy, _ := parseRatePolicy("subject", defaultSubjectLinkLimit)
+	return &SubjectRequests{
+		Providers: providers,
+		Audit:     audit,
+		Mailer:    mailer,
+		Sender:    sender,
+		Limiter:   NewMemoryRateBackend(),
+		Policy:    policy,
+		BaseURL:   strings.TrimSuffix(baseURL, "/"),
+		key:       key,
+		auditKey:  auditKey,
+		now:       time.Now,
+	}
+}
+
+// newSubjectRequestsFromConfig covers the inquiry store and bookings, records
+// to SUBJECT_AUDIT_TABLE and builds links on PRIVACY_BASE_URL. With neither
+// there is nothing to request, and it returns nil.
+func newSubjectRequestsFromConfig(ctx context.Context, cfg appconfig.Config, mailer Mailer, store InquiryStore, bookings *Bookings, key []byte) (*SubjectRequests, error) {
+	var providers []SubjectDataProvider
+	if store != nil {
+		providers = append(providers, InquirySubjectData{Store: store})
+	}
+	if bookings != nil {
+		providers = append(providers, BookingSubjectData{Store: bookings.Store})
+	}
+	if len(providers) == 0 {
+		return nil, nil
+	}
+	audit, err := newAuditLogFromConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewSubjectRequests(providers, audit, mailer, cfg.SenderEmail, cfg.PrivacyBaseURL, key, auditKeyFromConfig(cfg)), nil
+}
+
+// subjectClaim is the signed body of an access link
+type subjectClaim struct {
+	Email   string `json:"e"`
+	Expires int64  `json:"x"`
+}
+
+// seal signs an access link token for email. The purpose prefix keeps it
+// distinct from anything else signed with the same key.
+func (s *SubjectRequests) seal(email string) string {
+	b, _ := json.Marshal(subjectClaim{Email: email, Expires: s.now().Add(subjectLinkTTL).Unix()})
+	payload := b64url.EncodeToString(b)
+	return payload + "." + b64url.EncodeToString(s.mac(payload))
+}
+
+// open returns the address a genuine, unexpired token was issued for
+func (s *SubjectRequests) open(token string) (string, bool) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", false
+	}
+	got, err := b64url.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, s.mac(payload)) {
+		return "", false
+	}
+	b, err := b64url.DecodeString(payload)
+	var c subjectClaim
+	if err != nil || json.Unmarshal(b, &c) != nil || c.Email == "" {
+		return "", false
+	}
+	if s.now().Unix() > c.Expires {
+		return "", false
+	}
+	return c.Email, true
+}
+
+func (s *SubjectRequests) mac(payload string) []byte {
+	m := hmac.New(sha256.New, s.key)
+	m.Write([]byte("subject-access\x00" + payload))
+	return m.Sum(nil)
+}
+
+// audit records an action. A failed write is logged but does not undo the
+// action; the slog line is the fallback record.
+func (s *SubjectRequests) audit(ctx context.Context, email, action string, records int, outcome string) {
+	e := AuditEntry{
+		ID:      newAuditID(s.now()),
+		Subject: subjectHash(s.auditKey, email),
+		Action:  action,
+		Records: records,
+		Outcome: outcome,
+		At:      s.now(),
+	}
+	// The hash stays out of the logs, which are readable far more widely
+	slog.Info("subject_"+action, slog.Int("records", records), slog.String("outcome", outcome))
+	if err := s.Audit.Record(context.WithoutCancel(ctx), e); err != nil {
+		slog.Error("audit_failure", slog.String("action", action), slog.Any("error", err))
+	}
+}
+
+// export collects every provider's records for email
+func (s *SubjectRequests) export(ctx context.Context, email string) (map[string][]any, int, error) {
+	out := map[string][]any{}
+	total := 0
+	for _, p := range s.Providers {
+		records, err := p.Export(ctx, email)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: %w", p.Name(), err)
+		}
+		out[p.Name()] = records
+		total += len(records)
+	}
+	return out, total, nil
+}
+
+// sections summarises an export for the page
+func (s *SubjectRequests) sections(data map[string][]any) []components.SubjectSection {
+	var out []components.SubjectSection
+	for _, p := range s.Providers {
+		out = append(out, components.SubjectSection{Label: p.Name(), Records: len(data[p.Name()])})
+	}
+	return out
+}
+
+// sendLink emails an access link. Failures are logged and audited, never
+// shown: the page says the same thing whether or not we hold anything.
+func (s *SubjectRequests) sendLink(ctx context.Context, email string) string {
+	ok, _, err := s.Limiter.Take(ctx, "subject:"+strings.ToLower(email), s.Policy)
+	if err != nil {
+		slog.Error("subject_limit_failed", slog.Any("error", err))
+		return "failed"
+	}
+	if !ok {
+		return "rate_limited"
+	}
+
+	view := components.SubjectLinkEmail{
+		URL:     s.BaseURL + "/privacy/data?" + url.Values{"t": {s.seal(email)}}.Encode(),
+		Expires: s.now().Add(subjectLinkTTL).UTC().Format("15:04 MST"),
+	}
+	var html, text bytes.Buffer
+	if err := components.SubjectLinkEmailHTML(view).Render(ctx, &html); err != nil {
+		slog.Error("subject_render_failed", slog.Any("error", err))
+		return "failed"
+	}
+	if err := components.SubjectLinkEmailText(view).Render(ctx, &text); err != nil {
+		slog.Error("subject_render_failed", slog.Any("error", err))
+		return "failed"
+	}
+	attempts, err := sendWithRetry(ctx, s.Mailer, Message{
+		From:    s.Sender,
+		To:      []string{sanitizeHeader(email)},
+		ReplyTo: []string{s.Sender},
+		Subject: "Your data held by StackFoundry",
+		Text:    text.String(),
+		HTML:    html.String(),
+	})
+	if err != nil {
+		slog.Error("subject_mail_failure", slog.Any("error", err), slog.Int("attempts", attempts))
+		return "failed"
+	}
+	return "sent"
+}
+
+// --- HANDLERS ---
+
+// registerSubjectRoutes mounts the self-service pages under /privacy.
+// Without the service, the request page sends visitors to the policy, which
+// gives an address to write to instead.
+func registerSubjectRoutes(mux *http.ServeMux, s *SubjectRequests, guard *SpamGuard, pow *ProofOfWork) {
+	if s == nil || s.Mailer == nil {
+		mux.HandleFunc("GET /privacy/request", func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "/privacy#rights", http.StatusSeeOther)
+		})
+		return
+	}
+	mux.HandleFunc("GET /privacy/request", func(w http.ResponseWriter, r *http.Request) {
+		sessionID, _ := r.Context().Value(SessionKey).(string)
+		RenderHTML(w, r, components.SubjectRequestPage(sessionID, components.SubjectRequestState{Token: guard.Issue()}))
+	})
+	mux.HandleFunc("POST /privacy/request", s.handleRequest(guard, pow))
+	mux.HandleFunc("GET /privacy/data", s.handleView)
+	mux.HandleFunc("GET /privacy/data/export", s.handleExport)
+	mux.HandleFunc("POST /privacy/data/erase", s.handleErase)
+}
+
+func (s *SubjectRequests) handleRequest(guard *SpamGuard, pow *ProofOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, 16<<10)
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Failed to parse form", http.StatusBadRequest)
+			return
+		}
+		form := parseSubjectRequestForm(r)
+
+		// SPAM: Bots get the same answer as people, so they learn nothing
+		if reason := guard.Check(r); reason != "" {
+			slog.Info("spam_blocked", slog.String("reason", reason))
+			RenderHTML(w, r, components.SubjectRequestSent(form.Email))
+			return
+		}
+
+		// VALIDATION
+		if errs := validateSubjectRequest(form); len(errs) > 0 {
+			form.Errors = errs
+			form.Token = guard.IssueForRetry()
+			RenderHTMLStatus(w, r, http.StatusUnprocessableEntity, components.SubjectRequestPanel(form))
+			return
+		}
+
+		// PROOF OF WORK: Solved in the browser by public/js/pow.js. Browsers
+		// without JavaScript face a long time trap and a tight limit instead.
+		tokenAge, _ := guard.Age(form.Token)
+		if ok, plain := pow.Passes(r, tokenAge); !ok {
+			slog.Info("pow_failed", slog.Bool("plain", plain))
+			form.Errors = map[string]string{"form": powFailure(plain, s.Sender)}
+			form.Token = guard.IssueForRetry()
+			RenderHTMLStatus(w, r, http.StatusUnprocessableEntity, components.SubjectRequestPanel(form))
+			return
+		}
+
+		// REPLAY: Spent atomically, so racing copies send one link
+		if !guard.Spend(r.Context(), form.Token) {
+			slog.Info("spam_blocked", slog.String("reason", spamReplayed))
+			RenderHTML(w, r, components.SubjectRequestSent(form.Email))
+			return
+		}
+
+		// Only addresses we hold data for get mail; the page cannot tell them apart
+		ctx, cancel := context.WithTimeout(r.Context(), deliveryTimeout)
+		defer cancel()
+		_, total, err := s.export(ctx, form.Email)
+		outcome := "nothing_held"
+		switch {
+		case err != nil:
+			slog.Error("subject_store_failure", slog.Any("error", err))
+			outcome = "failed"
+		case total > 0:
+			outcome = s.sendLink(ctx, form.Email)
+		}
+		s.audit(ctx, form.Email, auditLinkRequested, total, outcome)
+
+		RenderHTML(w, r, components.SubjectRequestSent(form.Email))
+	}
+}
+
+// load returns the address a link names, or renders the expired page
+func (s *SubjectRequests) load(w http.ResponseWriter, r *http.Request) (string, bool) {
+	email, ok := s.open(r.FormValue("t"))
+	if !ok {
+		sessionID, _ := r.Context().Value(SessionKey).(string)
+		RenderHTMLStatus(w, r, http.StatusGone, components.SubjectData(sessionID, components.SubjectDataView{Expired: true}))
+		return "", false
+	}
+	return email, true
+}
+
+// render shows what is held, with export and erase actions
+func (s *SubjectRequests) render(w http.ResponseWriter, r *http.Request, status int, email string, v components.SubjectDataView) {
+	data, _, err := s.export(r.Context(), email)
+	if err != nil {
+		slog.Error("subject_store_failure", slog.Any("error", err))
+		http.Error(w, "Your data is unavailable right now. Please email "+s.Sender+".", http.StatusServiceUnavailable)
+		return
+	}
+	v.Email = email
+	v.Token = r.FormValue("t")
+	v.Sections = s.sections(data)
+	sessionID, _ := r.Context().Value(SessionKey).(string)
+	RenderHTMLStatus(w, r, status, components.SubjectData(sessionID, v))
+}
+
+func (s *SubjectRequests) handleView(w http.ResponseWriter, r *http.Request) {
+	email, ok := s.load(w, r)
+	if !ok {
+		return
+	}
+	s.audit(r.Context(), email, auditView, 0, "")
+	s.render(w, r, http.StatusOK, email, components.SubjectDataView{})
+}
+
+// subjectExport is the downloaded file
+type subjectExport struct {
+	Email       string           `json:"email"`
+	GeneratedAt time.Time        `json:"generated_at"`
+	Controller  string           `json:"controller"`
+	Data        map[string][]any `json:"data"`
+}
+
+func (s *SubjectRequests) handleExport(w http.ResponseWriter, r *http.Request) {
+	email, ok := s.load(w, r)
+	if !ok {
+		return
+	}
+	data, total, err := s.export(r.Context(), email)
+	if err != nil {
+		slog.Error("subject_store_failure", slog.Any("error", err))
+		s.audit(r.Context(), email, auditExport, 0, "failed")
+		http.Error(w, "Your data is unavailable right now. Please email "+s.Sender+".", http.StatusServiceUnavailable)
+		return
+	}
+	s.audit(r.Context(), email, auditExport, total, "sent")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="stackfoundry-data.json"`)
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(subjectExport{Email: email, GeneratedAt: s.now().UTC(), Controller: "StackFoundry Ltd <" + s.Sender + ">", Data: data})
+}
+
+func (s *SubjectRequests) handleErase(w http.ResponseWriter, r *http.Request) {
+	email, ok := s.load(w, r)
+	if !ok {
+		return
+	}
+	if r.FormValue("confirm") != "yes" {
+		s.render(w, r, http.StatusUnprocessableEntity, email, components.SubjectDataView{Error: "Tick the box to confirm you want everything erased."})
+		return
+	}
+
+	// Each provider is tried even if one fails, so as much as possible goes
+	erased := 0
+	var failed []string
+	for _, p := range s.Providers {
+		n, err := p.Erase(r.Context(), email)
+		erased += n
+		if err != nil {
+			slog.Error("subject_erase_failure", slog.String("provider", p.Name()), slog.Any("error", err))
+			failed = append(failed, p.Name())
+		}
+	}
+	if len(failed) > 0 {
+		s.audit(r.Context(), email, auditErase, erased, "partial")
+		s.render(w, r, http.StatusServiceUnavailable, email, components.SubjectDataView{Error: "Some of your data could not be erased. Please try again, or email " + s.Sender + "."})
+		return
+	}
+	s.audit(r.Context(), email, auditErase, erased, "erased")
+	s.render(w, r, http.StatusOK, email, components.SubjectDataView{Notice: fmt.Sprintf("Done. Records erased: %d. Backups that still hold them expire within 35 days.", erased)})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testAuditKey = []byte("test-audit-key")
+
+var subjectLinkPattern = regexp.MustCompile(`/privacy/data\?t=[A-Za-z0-9_.%-]+`)
+
+// newTestSubjects holds inquiries and a booking for jo@example.com, under
+// several spellings, and one of each for someone else
+func newTestSubjects(t *testing.T, mailer Mailer) *SubjectRequests {
+	t.Helper()
+	store := NewMemoryStore()
+	base := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	for i, email := range []string{"jo@example.com", "Jo@Example.com", "someone@else.example"} {
+		inq := Inquiry{ID: newInquiryID(base.Add(time.Duration(i) * time.Hour)), Email: email, Subject: "Hello", Message: "Message " + email, Status: StatusSent}
+		if err := store.Save(t.Context(), inq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bookings := NewMemoryBookingStore()
+	for i, email := range []string{"JO@example.com", "someone@else.example"} {
+		start := base.AddDate(0, 0, 7+i)
+		bookings.Reserve(t.Context(), Booking{ID: newInquiryID(start), Status: BookingConfirmed, Start: start, End: start.Add(30 * time.Minute), Name: "Jo", Email: email})
+	}
+	return NewSubjectRequests([]SubjectDataProvider{InquirySubjectData{Store: store}, BookingSubjectData{Store: bookings}}, NewMemoryAuditLog(), mailer, testSender, "https://www.example.com", []byte("test-signing-key"), testAuditKey)
+}
+
+func TestSubjectRequestFlow(t *testing.T) {
+	mailer := &MemoryMailer{}
+	subjects := newTestSubjects(t, mailer)
+	router := testApp(App{Mailer: mailer, Subjects: subjects}).Handler()
+	store, bookings, audit := subjects.Providers[0].(InquirySubjectData).Store, subjects.Providers[1].(BookingSubjectData).Store, subjects.Audit
+
+	// 1. Held and unknown addresses get the same page; only the held one gets mail
+	held := postForm(router, "/privacy/request", newContactForm("JO@example.com", "", ""), false)
+	unknown := postForm(router, "/privacy/request", newContactForm("nobody@example.com", "", ""), false)
+	if held.Code != http.StatusOK || unknown.Code != http.StatusOK || !strings.Contains(unknown.Body.String(), "Check Your Inbox") {
+		t.Fatalf("Request pages: %d, %d", held.Code, unknown.Code)
+	}
+	sent := mailer.Sent()
+	if len(sent) != 1 || sent[0].To[0] != "JO@example.com" {
+		t.Fatalf("Sent %+v, want one link to the held address", sent)
+	}
+	link := subjectLinkPattern.FindString(sent[0].Text)
+	if link == "" || !strings.Contains(sent[0].Text, "https://www.example.com"+link) {
+		t.Fatalf("No access link in:\n%s", sent[0].Text)
+	}
+	token, _ := url.ParseQuery(strings.TrimPrefix(link, "/privacy/data?"))
+
+	// 2. The link shows both inquiries and the booking, whatever the case of the address
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", link, nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "<dd>2</dd>") || !strings.Contains(rr.Body.String(), "<dd>1</dd>") {
+		t.Errorf("Data page: status %d", rr.Code)
+	}
+
+	// 3. The export has them in full
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/privacy/data/export?t="+url.QueryEscape(token.Get("t")), nil))
+	var export subjectExport
+	if err := json.Unmarshal(rr.Body.Bytes(), &export); err != nil || len(export.Data["inquiries"]) != 2 || len(export.Data["bookings"]) != 1 {
+		t.Fatalf("Export: %v, %s", err, rr.Body.String())
+	}
+	if !strings.HasPrefix(rr.Header().Get("Content-Disposition"), "attachment") || strings.Contains(rr.Body.String(), "someone@else.example") {
+		t.Errorf("Export headers %v or contents wrong", rr.Header())
+	}
+
+	// 4. Erasure needs the box ticked, then removes only their records
+	if rr := postForm(router, "/privacy/data/erase", url.Values{"t": {token.Get("t")}}, false); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Unconfirmed erase: status %d", rr.Code)
+	}
+	rr = postForm(router, "/privacy/data/erase", url.Values{"t": {token.Get("t")}, "confirm": {"yes"}}, false)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "Records erased: 3") {
+		t.Errorf("Erase: status %d", rr.Code)
+	}
+	if all, _ := store.List(t.Context()); len(all) != 1 || all[0].Email != "someone@else.example" {
+		t.Errorf("Left in the store: %+v", all)
+	}
+	if bks, _ := bookings.ByEmail(t.Context(), "jo@example.com"); len(bks) != 0 {
+		t.Errorf("Bookings left: %+v", bks)
+	}
+	if held, _ := bookings.Held(t.Context(), time.Time{}, time.Now().AddDate(1, 0, 0)); len(held) != 1 {
+		t.Errorf("%d slots held after erasure, want the other booking's only", len(held))
+	}
+
+	// 5. Every step is audited under the hash, never the address
+	entries, _ := audit.List(t.Context(), subjectHash(testAuditKey, "jo@example.com"))
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, e.Action+":"+e.Outcome)
+	}
+	if got := strings.Join(actions, ","); got != "link_requested:sent,view:,export:sent,erase:erased" {
+		t.Errorf("Audit trail %s", got)
+	}
+	if entries[len(entries)-1].Records != 3 {
+		t.Errorf("Erase audited %d records, want 3", entries[len(entries)-1].Records)
+	}
+	b, _ := json.Marshal(entries)
+	if strings.Contains(strings.ToLower(string(b)), "jo@example.com") {
+		t.Error("Audit log holds the address")
+	}
+	unkeyed := sha256.Sum256([]byte("jo@example.com"))
+	if entries[0].Subject == hex.EncodeToString(unkeyed[:]) || entries[0].Subject == subjectHash([]byte("other-key"), "jo@example.com") {
+		t.Error("Audit subject is not keyed by the audit key")
+	}
+	if nobody, _ := audit.List(t.Context(), subjectHash(testAuditKey, "nobody@example.com")); len(nobody) != 1 || nobody[0].Outcome != "nothing_held" {
+		t.Errorf("Unknown address audit: %+v", nobody)
+	}
+}
+
+func TestSubjectLinks(t *testing.T) {
+	subjects := newTestSubjects(t, &MemoryMailer{})
+	router := testApp(App{Subjects: subjects}).Handler()
+	token := subjects.seal("jo@example.com")
+
+	// 1. Tampered and expired links open nothing
+	payload, sig, _ := strings.Cut(token, ".")
+	forged := subjects.seal("someone@else.example")
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+	for name, tok := range map[string]string{
+		"Swapped Payload": forgedPayload + "." + sig,
+		"No Signature":    payload,
+		"Garbage":         "x.y",
+	} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/privacy/data/export?t="+url.QueryEscape(tok), nil))
+		if rr.Code != http.StatusGone {
+			t.Errorf("%s: status %d", name, rr.Code)
+		}
+	}
+	subjects.now = func() time.Time { return time.Now().Add(subjectLinkTTL + time.Minute) }
+	if _, ok := subjects.open(token); ok {
+		t.Error("Expired link opened")
+	}
+
+	// 2. Links are signed for this purpose only
+	if _, ok := testGuard.openBrief(token); ok {
+		t.Error("Access link accepted as a brief")
+	}
+}
+
+func TestSubjectRequestValidation(t *testing.T) {
+	mailer := &MemoryMailer{}
+	router := testApp(App{Mailer: mailer, Subjects: newTestSubjects(t, mailer)}).Handler()
+
+	// 1. A bad address comes back with the field error
+	if rr := postForm(router, "/privacy/request", newContactForm("not-an-address", "", ""), false); rr.Code != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), "email_error") {
+		t.Errorf("Invalid address: status %d", rr.Code)
+	}
+
+	// 2. Repeat requests stop sending once the address's limit is spent
+	for range 5 {
+		postForm(router, "/privacy/request", newContactForm("jo@example.com", "", ""), false)
+	}
+	if n := len(mailer.Sent()); n != 3 {
+		t.Errorf("Sent %d links, want 3", n)
+	}
+
+	// 3. Without the service the request page points at the policy
+	off := testApp(App{}).Handler()
+	rr := httptest.NewRecorder()
+	off.ServeHTTP(rr, httptest.NewRequest("GET", "/privacy/request", nil))
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/privacy#rights" {
+		t.Errorf("Disabled: status %d, location %q", rr.Code, rr.Header().Get("Location"))
+	}
+}
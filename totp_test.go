@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/base32"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 appendix B (SHA-1), truncated to six digits
+	key := []byte("12345678901234567890")
+	for unix, want := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		if got := totpCode(key, unix/totpPeriod); got != want {
+			t.Errorf("At %d got %s, want %s", unix, got, want)
+		}
+	}
+
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key)
+	now := time.Unix(1234567890, 0)
+	step, ok := verifyTOTP(secret, "005924", now, 0)
+	if !ok {
+		t.Fatal("Current code rejected")
+	}
+	if _, ok := verifyTOTP(secret, "005924", now, step); ok {
+		t.Error("Replayed code accepted")
+	}
+	if _, ok := verifyTOTP(secret, "005924", now.Add(totpPeriod*time.Second), 0); !ok {
+		t.Error("Code from one step ago rejected")
+	}
+	if _, ok := verifyTOTP(secret, "005924", now.Add(3*totpPeriod*time.Second), 0); ok {
+		t.Error("Stale code accepted")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes := newRecoveryCodes()
+	if len(codes) != recoveryCodeCount || len(slices.Compact(slices.Sorted(slices.Values(codes)))) != recoveryCodeCount {
+		t.Fatalf("Want %d distinct codes, got %v", recoveryCodeCount, codes)
+	}
+	// Typed loosely, a code still matches its hash
+	loose := " " + codes[0][:5] + " " + codes[0][6:] + " "
+	if !slices.Contains(hashes, hashRecoveryCode(loose)) {
+		t.Errorf("%q did not match", loose)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"stackfoundry.co.uk/components"
+)
+
+// Same rules as the LIMITS / regex checks in components.ContactForm, so bots
+// and no-JS clients get no more leeway than a browser does. Addresses get the
+// stricter, deliverable-only check in validEmail, which the browser's loose regex defers to.
+var (
+	markupPattern = regexp.MustCompile(`<[^>]+>`)
+)
+
+// parseContactForm reads the submitted fields, trimmed as the browser trims them.
+func parseContactForm(r *http.Request) components.ContactFormState {
+	return components.ContactFormState{
+		Email:   strings.TrimSpace(r.FormValue("email")),
+		Service: strings.TrimSpace(r.FormValue("service")),
+		Subject: strings.TrimSpace(r.FormValue("subject")),
+		Message: strings.TrimSpace(r.FormValue("message")),
+		Token:   r.FormValue(components.FormTokenField),
+		Brief:   r.FormValue(components.BriefField),
+
+		IdempotencyKey: r.FormValue(components.IdempotencyField),
+	}
+}
+
+// validateContact returns per-field errors, keyed like the *_error slots in
+// the form. An empty map means the submission is acceptable.
+func validateContact(form components.ContactFormState) map[string]string {
+	errs := map[string]string{}
+
+	if form.Email == "" || utf8.RuneCountInString(form.Email) > components.MaxEmailLength || !validEmail(form.Email) {
+		errs["email"] = "Please enter a valid email address."
+	}
+
+	if form.Service != "" && components.ServiceLabel(form.Service) == "" {
+		errs["service"] = "Choose a service line from the list."
+	}
+
+	if utf8.RuneCountInString(form.Subject) > components.MaxSubjectLength || markupPattern.MatchString(form.Subject) {
+		errs["subject"] = "Subject too long or contains invalid characters."
+	}
+
+	switch n := utf8.RuneCountInString(form.Message); {
+	case n == 0:
+		errs["message"] = "Mission parameters required."
+	case n > components.MaxMessageLength:
+		errs["message"] = "Message exceeds limit."
+	}
+
+	return errs
+}
+
+// parseBookingForm reads the booking fields, trimmed as the browser trims them
+func parseBookingForm(r *http.Request) components.BookingFormState {
+	return components.BookingFormState{
+		Name:  strings.TrimSpace(r.FormValue("name")),
+		Email: strings.TrimSpace(r.FormValue("email")),
+		Topic: strings.TrimSpace(r.FormValue("topic")),
+		Start: r.FormValue("start"),
+		Token: r.FormValue(components.FormTokenField),
+	}
+}
+
+// validateBooking checks the visitor's details; the slot is checked
+// against the schedule by the handler
+func validateBooking(form components.BookingFormState) map[string]string {
+	errs := map[string]string{}
+
+	if n := utf8.RuneCountInString(form.Name); n == 0 || n > components.MaxNameLength || markupPattern.MatchString(form.Name) {
+		errs["name"] = "Please tell us your name."
+	}
+
+	if form.Email == "" || utf8.RuneCountInString(form.Email) > components.MaxEmailLength || !validEmail(form.Email) {
+		errs["email"] = "Please enter a valid email address."
+	}
+
+	if utf8.RuneCountInString(form.Topic) > components.MaxTopicLength {
+		errs["topic"] = "Please keep this short; there is time to talk on the call."
+	}
+
+	return errs
+}
+
+// parseSubjectRequestForm reads the data request form
+func parseSubjectRequestForm(r *http.Request) components.SubjectRequestState {
+	return components.SubjectRequestState{
+		Email: strings.TrimSpace(r.FormValue("email")),
+		Token: r.FormValue(components.FormTokenField),
+	}
+}
+
+func validateSubjectRequest(form components.SubjectRequestState) map[string]string {
+	errs := map[string]string{}
+	if form.Email == "" || utf8.RuneCountInString(form.Email) > components.MaxEmailLength || !validEmail(form.Email) {
+		errs["email"] = "Please enter a valid email address."
+	}
+	return errs
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"time"
+)
+
+// Just enough of WebAuthn Level 2 for passkey sign-in to one site: attestation
+// is requested as "none" and not verified, so any authenticator the browser
+// offers is accepted, and user verification (PIN or biometric) is required
+// because a passkey is the only factor.
+
+// COSE algorithm identifiers we accept, in order of preference
+const (
+	coseES256 = -7
+	coseEdDSA = -8
+	coseRS256 = -257
+)
+
+var coseAlgorithms = []int64{coseES256, coseEdDSA, coseRS256}
+
+// Authenticator data flags
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+)
+
+var b64url = base64.RawURLEncoding
+
+// RelyingParty: The site passkeys are bound to. ID is the registrable domain,
+// so one passkey works on every origin listed.
+type RelyingParty struct {
+	ID      string
+	Name    string
+	Origins []string
+}
+
+// Passkey: A registered WebAuthn credential. PublicKey is the COSE_Key as the
+// authenticator sent it.
+type Passkey struct {
+	ID         []byte    `json:"id"`
+	PublicKey  []byte    `json:"public_key"`
+	SignCount  uint32    `json:"sign_count"`
+	Name       string    `json:"name"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at,omitzero"`
+}
+
+// --- BROWSER OPTIONS ---
+
+// Byte fields are base64url strings; passkey.js decodes them for the browser API
+type credentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type creationOptions struct {
+	Challenge string `json:"challenge"`
+	RP        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams []struct {
+		Type string `json:"type"`
+		Alg  int64  `json:"alg"`
+	} `json:"pubKeyCredParams"`
+	ExcludeCredentials     []credentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+	Attestation string `json:"attestation"`
+	Timeout     int    `json:"timeout"`
+}
+
+type requestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []credentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+	Timeout          int                    `json:"timeout"`
+}
+
+// creationOptions asks for a discoverable credential, so the account can sign
+// in without typing a name. The user handle is the account name.
+func (rp *RelyingParty) creationOptions(user AdminUser, challenge []byte) creationOptions {
+	var o creationOptions
+	o.Challenge = b64url.EncodeToString(challenge)
+	o.RP.ID, o.RP.Name = rp.ID, rp.Name
+	o.User.ID = b64url.EncodeToString([]byte(user.Name))
+	o.User.Name, o.User.DisplayName = user.Name, user.Name
+	for _, alg := range coseAlgorithms {
+		o.PubKeyCredParams = append(o.PubKeyCredParams, struct {
+			Type string `json:"type"`
+			Alg  int64  `json:"alg"`
+		}{"public-key", alg})
+	}
+	o.ExcludeCredentials = descriptors(user.Passkeys)
+	o.AuthenticatorSelection.ResidentKey = "preferred"
+	o.AuthenticatorSelection.UserVerification = "required"
+	o.Attestation = "none"
+	o.Timeout = int(challengeTTL.Milliseconds())
+	return o
+}
+
+// requestOptions leaves allowCredentials empty when the account is not known
+// yet, letting the browser offer any passkey it holds for this site
+func (rp *RelyingParty) requestOptions(passkeys []Passkey, challenge []byte) requestOptions {
+	return requestOptions{
+		Challenge:        b64url.EncodeToString(challenge),
+		RPID:             rp.ID,
+		AllowCredentials: descriptors(passkeys),
+		UserVerification: "required",
+		Timeout:          int(challengeTTL.Milliseconds()),
+	}
+}
+
+func descriptors(passkeys []Passkey) []credentialDescriptor {
+	out := []credentialDescriptor{}
+	for _, pk := range passkeys {
+		out = append(out, credentialDescriptor{Type: "public-key", ID: b64url.EncodeToString(pk.ID)})
+	}
+	return out
+}
+
+// --- VERIFICATION ---
+
+// RegistrationResponse: navigator.credentials.create() output, base64url fields
+type RegistrationResponse struct {
+	ID                string `json:"id"`
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject"`
+}
+
+// AssertionResponse: navigator.credentials.get() output, base64url fields
+type AssertionResponse struct {
+	ID                string `json:"id"`
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+	UserHandle        string `json:"userHandle"`
+}
+
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// verifyClientData checks the ceremony type, that the browser signed our
+// challenge, and that it did so on one of our origins
+func (rp *RelyingParty) verifyClientData(raw []byte, ceremony string, challenge []byte) error {
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return fmt.Errorf("client data: %w", err)
+	}
+	if cd.Type != ceremony {
+		return fmt.Errorf("client data type %q, want %q", cd.Type, ceremony)
+	}
+	got, err := b64url.DecodeString(cd.Challenge)
+	if err != nil || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return errors.New("challenge mismatch")
+	}
+	if cd.CrossOrigin || !slices.Contains(rp.Origins, cd.Origin) {
+		return fmt.Errorf("unexpected origin %q", cd.Origin)
+	}
+	return nil
+}
+
+func (rp *RelyingParty) verifyAuthData(ad authenticatorData) error {
+	want := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(ad.RPIDHash, want[:]) {
+		return errors.New("credential is for another site")
+	}
+	if ad.Flags&flagUserPresent == 0 || ad.Flags&flagUserVerified == 0 {
+		return errors.New("user was not verified")
+	}
+	return nil
+}
+
+// verifyRegistration returns the new credential; the caller names and stores it
+func (rp *RelyingParty) verifyRegistration(res RegistrationResponse, challenge []byte) (Passkey, error) {
+	rawClient, err1 := b64url.DecodeString(res.ClientDataJSON)
+	rawAtt, err2 := b64url.DecodeString(res.AttestationObject)
+	if err := errors.Join(err1, err2); err != nil {
+		return Passkey{}, fmt.Errorf("decoding response: %w", err)
+	}
+	if err := rp.verifyClientData(rawClient, "webauthn.create", challenge); err != nil {
+		return Passkey{}, err
+	}
+
+	v, _, err := cborDecode(rawAtt, 0)
+	if err != nil {
+		return Passkey{}, fmt.Errorf("attestation object: %w", err)
+	}
+	att, _ := v.(map[any]any)
+	rawAuth, _ := att["authData"].([]byte)
+	ad, err := parseAuthData(rawAuth)
+	if err != nil {
+		return Passkey{}, err
+	}
+	if err := rp.verifyAuthData(ad); err != nil {
+		return Passkey{}, err
+	}
+	if ad.Flags&flagAttested == 0 || len(ad.CredentialID) == 0 {
+		return Passkey{}, errors.New("no credential in attestation")
+	}
+	if _, err := parseCOSEKey(ad.PublicKey); err != nil {
+		return Passkey{}, err
+	}
+	return Passkey{ID: ad.CredentialID, PublicKey: ad.PublicKey, SignCount: ad.SignCount}, nil
+}
+
+// verifyAssertion checks a sign-in against a stored passkey and returns the
+// authenticator's new signature counter
+func (rp *RelyingParty) verifyAssertion(res AssertionResponse, pk Passkey, challenge []byte) (uint32, error) {
+	rawClient, err1 := b64url.DecodeString(res.ClientDataJSON)
+	rawAuth, err2 := b64url.DecodeString(res.AuthenticatorData)
+	sig, err3 := b64url.DecodeString(res.Signature)
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return 0, fmt.Errorf("decoding response: %w", err)
+	}
+	if err := rp.verifyClientData(rawClient, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+	ad, err := parseAuthData(rawAuth)
+	if err != nil {
+		return 0, err
+	}
+	if err := rp.verifyAuthData(ad); err != nil {
+		return 0, err
+	}
+
+	verify, err := parseCOSEKey(pk.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+	clientHash := sha256.Sum256(rawClient)
+	if !verify(append(rawAuth, clientHash[:]...), sig) {
+		return 0, errors.New("bad signature")
+	}
+
+	// A counter that fails to advance means the key has been cloned. Synced
+	// passkeys always report zero, which is allowed.
+	if ad.SignCount != 0 || pk.SignCount != 0 {
+		if ad.SignCount <= pk.SignCount {
+			return 0, errors.New("signature counter went backwards")
+		}
+	}
+	return ad.SignCount, nil
+}
+
+// parseAuthData: rpIdHash(32) flags(1) signCount(4) [aaguid(16) idLen(2) id key]
+func parseAuthData(b []byte) (authenticatorData, error) {
+	if len(b) < 37 {
+		return authenticatorData{}, errors.New("authenticator data too short")
+	}
+	ad := authenticatorData{RPIDHash: b[:32], Flags: b[32], SignCount: binary.BigEndian.Uint32(b[33:37])}
+	if ad.Flags&flagAttested == 0 {
+		return ad, nil
+	}
+	rest := b[37:]
+	if len(rest) < 18 {
+		return ad, errors.New("attested credential data too short")
+	}
+	n := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < n {
+		return ad, errors.New("credential ID truncated")
+	}
+	ad.CredentialID = rest[:n]
+	// The key is one CBOR item; extensions may follow it
+	_, after, err := cborDecode(rest[n:], 0)
+	if err != nil {
+		return ad, fmt.Errorf("credential public key: %w", err)
+	}
+	ad.PublicKey = rest[n : len(rest)-len(after)]
+	return ad, nil
+}
+
+// parseCOSEKey returns a verifier for the key's algorithm
+func parseCOSEKey(b []byte) (func(data, sig []byte) bool, error) {
+	v, _, err := cborDecode(b, 0)
+	if err != nil {
+		return nil, fmt.Errorf("COSE key: %w", err)
+	}
+	key, _ := v.(map[any]any)
+	param := func(label int64) []byte { p, _ := key[label].([]byte); return p }
+	alg, _ := key[int64(3)].(int64)
+
+	switch alg {
+	case coseES256:
+		x, y := param(-2), param(-3)
+		if crv, _ := key[int64(-1)].(int64); crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("unsupported EC2 key")
+		}
+		pub, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), slices.Concat([]byte{4}, x, y))
+		if err != nil {
+			return nil, err
+		}
+		return func(data, sig []byte) bool {
+			h := sha256.Sum256(data)
+			return ecdsa.VerifyASN1(pub, h[:], sig)
+		}, nil
+	case coseEdDSA:
+		x := param(-2)
+		if crv, _ := key[int64(-1)].(int64); crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("unsupported OKP key")
+		}
+		return func(data, sig []byte) bool { return ed25519.Verify(x, data, sig) }, nil
+	case coseRS256:
+		n, e := param(-1), param(-2)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("unsupported RSA key")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		return func(data, sig []byte) bool {
+			h := sha256.Sum256(data)
+			return rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig) == nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported COSE algorithm %d", alg)
+	}
+}
+
+// --- CBOR ---
+
+const cborMaxDepth = 8
+
+// cborDecode reads one data item: integers, byte and text strings, arrays,
+// maps, tags and simple values. Indefinite lengths are refused; authenticators
+// send canonical CBOR. Map keys come back as int64 or string.
+func cborDecode(b []byte, depth int) (any, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, errors.New("cbor: nested too deeply")
+	}
+	if len(b) == 0 {
+		return nil, nil, errors.New("cbor: unexpected end")
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	b = b[1:]
+
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(b) < size {
+			return nil, nil, errors.New("cbor: unexpected end")
+		}
+		for _, c := range b[:size] {
+			arg = arg<<8 | uint64(c)
+		}
+		b = b[size:]
+	default:
+		return nil, nil, fmt.Errorf("cbor: unsupported additional info %d", info)
+	}
+
+	switch major {
+	case 0:
+		if arg > 1<<63-1 {
+			return nil, nil, errors.New("cbor: integer overflow")
+		}
+		return int64(arg), b, nil
+	case 1:
+		if arg > 1<<63-1 {
+			return nil, nil, errors.New("cbor: integer overflow")
+		}
+		return -1 - int64(arg), b, nil
+	case 2, 3:
+		if uint64(len(b)) < arg {
+			return nil, nil, errors.New("cbor: string truncated")
+		}
+		s := b[:arg]
+		if major == 3 {
+			return string(s), b[arg:], nil
+		}
+		return bytes.Clone(s), b[arg:], nil
+	case 4:
+		if arg > uint64(len(b)) {
+			return nil, nil, errors.New("cbor: array truncated")
+		}
+		out := make([]any, 0, arg)
+		for range arg {
+			var v any
+			var err error
+			if v, b, err = cborDecode(b, depth+1); err != nil {
+				return nil, nil, err
+			}
+			out = append(out, v)
+		}
+		return out, b, nil
+	case 5:
+		if arg > uint64(len(b)) {
+			return nil, nil, errors.New("cbor: map truncated")
+		}
+		out := make(map[any]any, arg)
+		for range arg {
+			var k, v any
+			var err error
+			if k, b, err = cborDecode(b, depth+1); err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errors.New("cbor: unsupported map key")
+			}
+			if v, b, err = cborDecode(b, depth+1); err != nil {
+				return nil, nil, err
+			}
+			out[k] = v
+		}
+		return out, b, nil
+	case 6:
+		return cborDecode(b, depth+1)
+	default:
+		switch {
+		case info == 20:
+			return false, b, nil
+		case info == 21:
+			return true, b, nil
+		case info == 22 || info == 23:
+			return nil, b, nil
+		case info >= 25 && info <= 27:
+			return nil, b, nil // floats: not used by WebAuthn, skipped
+		}
+		return nil, nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+var testRP = RelyingParty{ID: "localhost", Name: "StackFoundry", Origins: []string{"http://localhost:8080"}}
+
+// testAuthenticator is a software passkey: an ES256 key and a counter
+type testAuthenticator struct {
+	key   *ecdsa.PrivateKey
+	id    []byte
+	rpID  string
+	count uint32
+	flags byte
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &testAuthenticator{key: key, id: id, rpID: "localhost", flags: flagUserPresent | flagUserVerified}
+}
+
+func (ta *testAuthenticator) coseKey() []byte {
+	pub, _ := ta.key.PublicKey.Bytes()
+	return cborEncode(map[any]any{int64(1): int64(2), int64(3): int64(coseES256), int64(-1): int64(1), int64(-2): pub[1:33], int64(-3): pub[33:]})
+}
+
+func (ta *testAuthenticator) authData(attested bool) []byte {
+	h := sha256.Sum256([]byte(ta.rpID))
+	b := append(h[:], ta.flags)
+	b = binary.BigEndian.AppendUint32(b, ta.count)
+	if attested {
+		b[32] |= flagAttested
+		b = append(b, make([]byte, 16)...) // AAGUID
+		b = binary.BigEndian.AppendUint16(b, uint16(len(ta.id)))
+		b = append(b, ta.id...)
+		b = append(b, ta.coseKey()...)
+	}
+	return b
+}
+
+func testClientData(ceremony, origin string, challenge []byte) []byte {
+	b, _ := json.Marshal(clientData{Type: ceremony, Challenge: b64url.EncodeToString(challenge), Origin: origin})
+	return b
+}
+
+func (ta *testAuthenticator) register(origin string, challenge []byte) RegistrationResponse {
+	att := cborEncode(map[any]any{"fmt": "none", "attStmt": map[any]any{}, "authData": ta.authData(true)})
+	return RegistrationResponse{
+		ID:                b64url.EncodeToString(ta.id),
+		ClientDataJSON:    b64url.EncodeToString(testClientData("webauthn.create", origin, challenge)),
+		AttestationObject: b64url.EncodeToString(att),
+	}
+}
+
+func (ta *testAuthenticator) assert(origin string, challenge []byte, user string) AssertionResponse {
+	ta.count++
+	ad := ta.authData(false)
+	cd := testClientData("webauthn.get", origin, challenge)
+	h := sha256.Sum256(cd)
+	digest := sha256.Sum256(append(ad, h[:]...))
+	sig, _ := ecdsa.SignASN1(rand.Reader, ta.key, digest[:])
+	return AssertionResponse{
+		ID:                b64url.EncodeToString(ta.id),
+		ClientDataJSON:    b64url.EncodeToString(cd),
+		AuthenticatorData: b64url.EncodeToString(ad),
+		Signature:         b64url.EncodeToString(sig),
+		UserHandle:        b64url.EncodeToString([]byte(user)),
+	}
+}
+
+// cborEncode covers what the tests send: ints, strings, bytes and maps
+func cborEncode(v any) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 1<<8:
+			return []byte{major<<5 | 24, byte(n)}
+		case n < 1<<16:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+		default:
+			return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+		}
+	}
+	switch v := v.(type) {
+	case int64:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case map[any]any:
+		b := head(5, uint64(len(v)))
+		for k, val := range v {
+			b = append(b, cborEncode(k)...)
+			b = append(b, cborEncode(val)...)
+		}
+		return b
+	}
+	panic("cborEncode: unsupported type")
+}
+
+func TestWebAuthnRegistration(t *testing.T) {
+	challenge := []byte("0123456789abcdef0123456789abcdef")
+
+	ta := newTestAuthenticator(t)
+	pk, err := testRP.verifyRegistration(ta.register("http://localhost:8080", challenge), challenge)
+	if err != nil {
+		t.Fatalf("Valid registration rejected: %v", err)
+	}
+	if string(pk.ID) != string(ta.id) {
+		t.Errorf("Credential ID = %x, want %x", pk.ID, ta.id)
+	}
+
+	tests := []struct {
+		name  string
+		setup func(*testAuthenticator) RegistrationResponse
+		want  string
+	}{
+		{"Wrong Origin", func(ta *testAuthenticator) RegistrationResponse {
+			return ta.register("https://evil.example", challenge)
+		}, "origin"},
+		{"Wrong Challenge", func(ta *testAuthenticator) RegistrationResponse {
+			return ta.register("http://localhost:8080", []byte("stale"))
+		}, "challenge"},
+		{"Other Site", func(ta *testAuthenticator) RegistrationResponse {
+			ta.rpID = "evil.example"
+			return ta.register("http://localhost:8080", challenge)
+		}, "another site"},
+		{"No User Verification", func(ta *testAuthenticator) RegistrationResponse {
+			ta.flags = flagUserPresent
+			return ta.register("http://localhost:8080", challenge)
+		}, "not verified"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := testRP.verifyRegistration(tt.setup(newTestAuthenticator(t)), challenge)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Got %v, want an error mentioning %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebAuthnAssertion(t *testing.T) {
+	challenge := []byte("0123456789abcdef0123456789abcdef")
+	ta := newTestAuthenticator(t)
+	pk, err := testRP.verifyRegistration(ta.register("http://localhost:8080", challenge), challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 1. A good signature returns the new counter
+	count, err := testRP.verifyAssertion(ta.assert("http://localhost:8080", challenge, "joe"), pk, challenge)
+	if err != nil || count != 1 {
+		t.Fatalf("Got %d, %v; want counter 1", count, err)
+	}
+	pk.SignCount = count
+
+	// 2. Tampered data fails the signature check
+	res := ta.assert("http://localhost:8080", challenge, "joe")
+	ad, _ := b64url.DecodeString(res.AuthenticatorData)
+	ad[36]++ // bump the counter without re-signing
+	res.AuthenticatorData = b64url.EncodeToString(ad)
+	if _, err := testRP.verifyAssertion(res, pk, challenge); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Errorf("Tampered assertion: got %v", err)
+	}
+
+	// 3. A counter that does not advance means a cloned key
+	ta.count = 0
+	if _, err := testRP.verifyAssertion(ta.assert("http://localhost:8080", challenge, "joe"), pk, challenge); err == nil {
+		t.Error("Counter regression accepted")
+	}
+
+	// 4. Registration responses are not sign-ins
+	reg := ta.register("http://localhost:8080", challenge)
+	res = ta.assert("http://localhost:8080", challenge, "joe")
+	res.ClientDataJSON = reg.ClientDataJSON
+	if _, err := testRP.verifyAssertion(res, pk, challenge); err == nil || !strings.Contains(err.Error(), "type") {
+		t.Errorf("Create ceremony accepted as get: %v", err)
+	}
+}
+
+func TestCBORDecodeLimits(t *testing.T) {
+	for name, in := range map[string][]byte{
+		"Empty":              {},
+		"Truncated String":   {0x45, 'a'},
+		"Indefinite Length":  {0x5f},
+		"Huge Array":         {0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"Byte String Key":    {0xa1, 0x41, 'k', 0x01},
+		"Too Deeply Nested":  []byte(strings.Repeat("\x81", 20) + "\x01"),
+		"Overflowing Length": {0x5b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	} {
+		if _, _, err := cborDecode(in, 0); err == nil {
+			t.Errorf("%s: decoded without error", name)
+		}
+	}
+}
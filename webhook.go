@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"stackfoundry.co.uk/appconfig"
+)
+
+// Signature headers. The signature is hex(HMAC-SHA256(secret, timestamp + "." + body)),
+// so a receiver can reject both tampered bodies and replays of old ones.
+const (
+	webhookTimestampHeader = "X-StackFoundry-Timestamp"
+	webhookSignatureHeader = "X-StackFoundry-Signature"
+	webhookSignaturePrefix = "v1="
+	webhookTolerance       = 5 * time.Minute
+)
+
+// Webhook retry policy. Hooks run on their own budget, webhookTimeout,
+// so a slow endpoint cannot hold the visitor's response past the Lambda timeout.
+const maxWebhookAttempts = 4
+
+var webhookBackoff = 250 * time.Millisecond
+
+// Payload formats
+const (
+	WebhookJSON    = "json"
+	WebhookSlack   = "slack"
+	WebhookDiscord = "discord"
+)
+
+// WebhookEndpoint: One configured receiver. Secret may be empty for Slack and
+// Discord, which authenticate by the URL itself.
+type WebhookEndpoint struct {
+	Name   string
+	URL    string
+	Format string
+	Secret []byte
+}
+
+// WebhookFailure: One delivery that gave up, recorded on the inquiry so
+// /admin shows which receivers never got it
+type WebhookFailure struct {
+	Endpoint string    `json:"endpoint"`
+	At       time.Time `json:"at"`
+	Attempts int       `json:"attempts"`
+	Status   int       `json:"status,omitempty"`
+	// Error is a class from webhookErrorClass, never the error text, which
+	// can quote the endpoint URL
+	Error string `json:"error"`
+}
+
+// WebhookPayload is the body sent to "json" endpoints
+type WebhookPayload struct {
+	Event       string           `json:"event"`
+	ID          string           `json:"id"`
+	Reference   string           `json:"reference"`
+	Email       string           `json:"email"`
+	Service     string           `json:"service,omitempty"`
+	Subject     string           `json:"subject"`
+	Message     string           `json:"message"`
+	SessionID   string           `json:"session_id,omitempty"`
+	Referrer    string           `json:"referrer,omitempty"`
+	Route       string           `json:"route,omitempty"`
+	Priority    string           `json:"priority,omitempty"`
+	Attachments []AttachmentMeta `json:"attachments,omitempty"`
+	Brief       *Brief           `json:"brief,omitempty"`
+	Screening   *EmailScreening  `json:"screening,omitempty"`
+	SpamScore   float64          `json:"spam_score,omitempty"`
+	CreatedAt   time.Time        `json:"created_at"`
+}
+
+// Webhooks: Posts each accepted inquiry to every endpoint. A nil *Webhooks is
+// valid and sends nothing.
+type Webhooks struct {
+	Endpoints []WebhookEndpoint
+	Client    *http.Client
+	Logger    *slog.Logger // nil uses slog.Default
+}
+
+func NewWebhooks(endpoints []WebhookEndpoint) *Webhooks {
+	return &Webhooks{Endpoints: endpoints, Client: &http.Client{}}
+}
+
+func (h *Webhooks) logger() *slog.Logger {
+	if h.Logger == nil {
+		return slog.Default()
+	}
+	return h.Logger
+}
+
+// newWebhooksFromConfig reads WEBHOOKS, e.g. "crm=json:https://crm.example/hook,
+// leads=slack:https://hooks.slack.com/...". The signing secret for an
+// endpoint is WEBHOOK_SECRET_<NAME>, falling back to WEBHOOK_SECRET.
+func newWebhooksFromConfig(cfg appconfig.Config) (*Webhooks, error) {
+	if cfg.Webhooks == "" {
+		return nil, nil
+	}
+	endpoints, err := parseWebhookEndpoints(cfg.Webhooks)
+	if err != nil {
+		return nil, fmt.Errorf("WEBHOOKS: %w", err)
+	}
+	for i, ep := range endpoints {
+		secret := cfg.WebhookSecretFor(ep.Name).Reveal()
+		if secret == "" && ep.Format == WebhookJSON {
+			return nil, fmt.Errorf("webhook %q: json endpoints need a signing secret", ep.Name)
+		}
+		endpoints[i].Secret = []byte(secret)
+	}
+	return NewWebhooks(endpoints), nil
+}
+
+func parseWebhookEndpoints(spec string) ([]WebhookEndpoint, error) {
+	var out []WebhookEndpoint
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		name, rest, ok := strings.Cut(entry, "=")
+		format, rawURL, ok2 := strings.Cut(rest, ":")
+		if !ok || !ok2 || name == "" {
+			return nil, fmt.Errorf("%q: want NAME=FORMAT:URL", entry)
+		}
+		switch format {
+		case WebhookJSON, WebhookSlack, WebhookDiscord:
+		default:
+			return nil, fmt.Errorf("%q: format must be json, slack or discord", entry)
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("%q: bad URL", entry)
+		}
+		out = append(out, WebhookEndpoint{Name: name, URL: rawURL, Format: format})
+	}
+	return out, nil
+}
+
+// Send posts inq to every endpoint in parallel and waits for them all, since
+// Lambda freezes anything still running once the response is written.
+// Failures are logged and returned in endpoint order, never shown to the
+// visitor.
+func (h *Webhooks) Send(ctx context.Context, inq Inquiry) []WebhookFailure {
+	if h == nil {
+		return nil
+	}
+	results := make([]*WebhookFailure, len(h.Endpoints))
+	var wg sync.WaitGroup
+	for i, ep := range h.Endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			attempts, status, err := h.deliver(ctx, ep, inq)
+			if err != nil {
+				class := webhookErrorClass(err, status)
+				h.logger().Error("webhook_failure", slog.String("endpoint", ep.Name), slog.String("inquiry", inq.ID), slog.String("error", class), slog.Int("status", status), slog.Int("attempts", attempts))
+				results[i] = &WebhookFailure{Endpoint: ep.Name, At: time.Now(), Attempts: attempts, Status: status, Error: class}
+				return
+			}
+			h.logger().Info("webhook_sent", slog.String("endpoint", ep.Name), slog.String("inquiry", inq.ID), slog.Int("attempts", attempts))
+		}()
+	}
+	wg.Wait()
+
+	var failures []WebhookFailure
+	for _, f := range results {
+		if f != nil {
+			failures = append(failures, *f)
+		}
+	}
+	return failures
+}
+
+// deliver retries network errors, 429 and 5xx with exponential backoff. Any
+// other non-2xx means the receiver rejected the payload, so it is not retried.
+func (h *Webhooks) deliver(ctx context.Context, ep WebhookEndpoint, inq Inquiry) (attempts, status int, err error) {
+	body, err := webhookBody(ep.Format, inq)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: %v", errWebhookPayload, err)
+	}
+
+	backoff := webhookBackoff
+	for attempts = 1; ; attempts++ {
+		var retry bool
+		status, retry, err = h.post(ctx, ep, body)
+		if err == nil {
+			return attempts, status, nil
+		}
+		if !retry || attempts == maxWebhookAttempts {
+			return attempts, status, err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+			return attempts, status, err
+		}
+		select {
+		case <-ctx.Done():
+			return attempts, status, errors.Join(err, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (h *Webhooks) post(ctx context.Context, ep WebhookEndpoint, body []byte) (status int, retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ep.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "StackFoundry-Webhooks/1")
+	if len(ep.Secret) > 0 {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, ts)
+		req.Header.Set(webhookSignatureHeader, webhookSignaturePrefix+signWebhook(ep.Secret, ts, body))
+	}
+
+	res, err := h.Client.Do(req)
+	if err != nil {
+		// A *url.Error quotes the URL, which is the secret for Slack and Discord
+		if ue, ok := err.(*url.Error); ok {
+			err = ue.Err
+		}
+		return 0, true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(res.Body, 4<<10))
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return res.StatusCode, false, nil
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+		return res.StatusCode, true, fmt.Errorf("endpoint returned %s", res.Status)
+	default:
+		return res.StatusCode, false, fmt.Errorf("endpoint returned %s", res.Status)
+	}
+}
+
+var errWebhookPayload = errors.New("payload could not be encoded")
+
+// webhookErrorClass names what went wrong in a few fixed words, so failures
+// can be logged and shown in /admin without leaking anything about the endpoint
+func webhookErrorClass(err error, status int) string {
+	var ne net.Error
+	switch {
+	case status != 0:
+		return "http_status"
+	case errors.Is(err, errWebhookPayload):
+		return "payload"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	default:
+		return "network"
+	}
+}
+
+// --- SIGNING ---
+
+func signWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook checks a received payload's signature and that its timestamp
+// is within tolerance of now. Receivers should call it before parsing the body.
+func VerifyWebhook(secret []byte, header http.Header, body []byte, now time.Time) error {
+	ts := header.Get(webhookTimestampHeader)
+	sig, ok := strings.CutPrefix(header.Get(webhookSignatureHeader), webhookSignaturePrefix)
+	if ts == "" || !ok {
+		return errors.New("missing signature headers")
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.New("bad timestamp")
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > webhookTolerance || age < -webhookTolerance {
+		return errors.New("timestamp outside tolerance")
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return errors.New("bad signature encoding")
+	}
+	want, _ := hex.DecodeString(signWebhook(secret, ts, body))
+	if !hmac.Equal(got, want) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// --- FORMATTERS ---
+
+func webhookBody(format string, inq Inquiry) ([]byte, error) {
+	switch format {
+	case WebhookSlack:
+		return json.Marshal(slackPayload(inq))
+	case WebhookDiscord:
+		return json.Marshal(discordPayload(inq))
+	default:
+		return json.Marshal(WebhookPayload{
+			Event:       "inquiry.received",
+			ID:          inq.ID,
+			Reference:   inq.Reference(),
+			Email:       inq.Email,
+			Service:     inq.Service,
+			Subject:     inq.Subject,
+			Message:     inq.Message,
+			SessionID:   inq.SessionID,
+			Referrer:    inq.Referrer,
+			Route:       inq.Routing.Route,
+			Priority:    inq.Routing.Priority,
+			Attachments: inq.Attachments,
+			Brief:       inq.Brief,
+			Screening:   inq.Screening,
+			SpamScore:   inq.SpamScore,
+			CreatedAt:   inq.CreatedAt,
+		})
+	}
+}
+
+// slackEscape neutralises mrkdwn control characters, which also stops
+// visitors injecting <!channel> pings or disguised links
+var slackEscape = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func slackPayload(inq Inquiry) map[string]any {
+	n := inq.Notification()
+	title := "New inquiry " + inq.Reference()
+	if inq.Routing.Priority != "" {
+		title += " [" + inq.Routing.Priority + "]"
+	}
+	fields := fmt.Sprintf("*From:* %s\n*Service:* %s\n*Subject:* %s",
+		slackEscape.Replace(inq.Email),
+		slackEscape.Replace(cmp.Or(n.Service, "General Inquiry")),
+		slackEscape.Replace(cmp.Or(inq.Subject, "(no subject)")))
+	return map[string]any{
+		"text": title,
+		"blocks": []map[string]any{
+			{"type": "header", "text": map[string]any{"type": "plain_text", "text": title}},
+			{"type": "section", "text": map[string]any{"type": "mrkdwn", "text": fields}},
+			{"type": "section", "text": map[string]any{"type": "mrkdwn", "text": truncate(slackEscape.Replace(inq.Message), 2900)}},
+			{"type": "context", "elements": []map[string]any{
+				{"type": "mrkdwn", "text": slackEscape.Replace("Session " + inq.SessionID + " · " + inq.CreatedAt.UTC().Format(time.RFC3339))},
+			}},
+		},
+	}
+}
+
+func discordPayload(inq Inquiry) map[string]any {
+	n := inq.Notification()
+	title := "New inquiry " + inq.Reference()
+	if inq.Routing.Priority != "" {
+		title += " [" + inq.Routing.Priority + "]"
+	}
+	return map[string]any{
+		// Never let visitor text trigger @everyone or role pings
+		"allowed_mentions": map[string]any{"parse": []string{}},
+		"embeds": []map[string]any{{
+			"title":       title,
+			"description": truncate(inq.Message, 4000),
+			"color":       0xff4d00,
+			"timestamp":   inq.CreatedAt.UTC().Format(time.RFC3339),
+			"fields": []map[string]any{
+				{"name": "From", "value": truncate(inq.Email, 1000), "inline": true},
+				{"name": "Service", "value": cmp.Or(n.Service, "General Inquiry"), "inline": true},
+				{"name": "Subject", "value": truncate(cmp.Or(inq.Subject, "(no subject)"), 1000)},
+				{"name": "Session", "value": cmp.Or(inq.SessionID, "-"), "inline": true},
+			},
+		}},
+	}
+}
+
+// truncate cuts s to at most n runes, marking the cut
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
+
+// --- TEST RECEIVER ---
+
+// runWebhookReceiver is the "webhook-receiver" subcommand: a local endpoint
+// that verifies signatures and prints each payload, for testing WEBHOOKS.
+func runWebhookReceiver(cfg appconfig.Config, args []string) error {
+	fs := flag.NewFlagSet("webhook-receiver", flag.ContinueOnError)
+	addr := fs.String("addr", ":8090", "listen address")
+	secret := fs.String("secret", cfg.WebhookSecret.Reveal(), "signing secret (default $WEBHOOK_SECRET)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *secret == "" {
+		return errors.New("a signing secret is required (-secret or WEBHOOK_SECRET)")
+	}
+	slog.Info("webhook_receiver_listening", slog.String("addr", *addr))
+	return http.ListenAndServe(*addr, webhookReceiver([]byte(*secret), os.Stdout))
+}
+
+// webhookReceiver returns 401 for anything unsigned or mis-signed and echoes
+// verified payloads to out
+func webhookReceiver(secret []byte, out io.Writer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "bad body", http.StatusBadRequest)
+			return
+		}
+		if err := VerifyWebhook(secret, r.Header, body, time.Now()); err != nil {
+			slog.Warn("webhook_rejected", slog.Any("error", err))
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		var pretty bytes.Buffer
+		if json.Indent(&pretty, body, "", "  ") == nil {
+			body = pretty.Bytes()
+		}
+		fmt.Fprintf(out, "%s\n", body)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testInquiry() Inquiry {
+	now := time.Now()
+	return Inquiry{
+		ID:        newInquiryID(now),
+		Email:     "visitor@example.com",
+		Service:   "audit",
+		Subject:   "Audit <!channel>",
+		Message:   "@everyone please look at <https://evil.example|this>",
+		SessionID: "abc123",
+		Routing:   Routing{Route: "audit", Priority: "P2"},
+		CreatedAt: now,
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	defer func(b time.Duration) { webhookBackoff = b }(webhookBackoff)
+	webhookBackoff = time.Millisecond
+	secret := []byte("whsec-test")
+
+	// 1. Signed JSON arrives and verifies after transient failures are retried
+	var calls atomic.Int32
+	var received bytes.Buffer
+	receiver := webhookReceiver(secret, &received)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= 2 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		receiver.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	hooks := NewWebhooks([]WebhookEndpoint{{Name: "crm", URL: srv.URL, Format: WebhookJSON, Secret: secret}})
+	inq := testInquiry()
+	failures := hooks.Send(context.Background(), inq)
+
+	if calls.Load() != 3 {
+		t.Errorf("Endpoint called %d times, want 3", calls.Load())
+	}
+	var payload WebhookPayload
+	if err := json.Unmarshal(received.Bytes(), &payload); err != nil {
+		t.Fatalf("Receiver did not accept the payload: %v (%q)", err, received.String())
+	}
+	if payload.ID != inq.ID || payload.Reference != inq.Reference() || payload.SessionID != "abc123" || payload.Priority != "P2" {
+		t.Errorf("Payload = %+v", payload)
+	}
+	if len(failures) != 0 {
+		t.Errorf("Successful delivery returned failures: %+v", failures)
+	}
+
+	// 2. A rejection is not retried, and is returned naming the endpoint
+	calls.Store(0)
+	bad := NewWebhooks([]WebhookEndpoint{{Name: "crm", URL: srv.URL, Format: WebhookJSON, Secret: []byte("wrong")}})
+	failures = bad.Send(context.Background(), inq)
+	if calls.Load() != 3 {
+		t.Errorf("Endpoint called %d times, want 3 (2 busy + 1 rejected)", calls.Load())
+	}
+	if len(failures) != 1 || failures[0].Status != http.StatusUnauthorized || failures[0].Endpoint != "crm" {
+		t.Errorf("Failure log = %+v", failures)
+	}
+
+	// 3. A transport error is recorded by class, without the URL, which is
+	// the secret for Slack and Discord
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	slack := NewWebhooks([]WebhookEndpoint{{Name: "leads", URL: closed.URL + "/services/T0/B0/secret-token", Format: WebhookSlack}})
+	failures = slack.Send(context.Background(), inq)
+	if len(failures) != 1 || failures[0].Error != "network" || strings.Contains(fmt.Sprint(failures), "secret-token") {
+		t.Errorf("Failure log = %+v, want a network class without the URL", failures)
+	}
+}
+
+func TestWebhookFailureRecorded(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusGone)
+	}))
+	defer srv.Close()
+	store := NewMemoryStore()
+	auth := newTestAdminAuth(t, AdminUser{Name: "joe", Role: RoleOwner})
+	hooks := NewWebhooks([]WebhookEndpoint{{Name: "crm", URL: srv.URL, Format: WebhookJSON, Secret: []byte("whsec-test")}})
+	router := testApp(App{Mailer: &MemoryMailer{}, Store: store, Admin: auth, Hooks: hooks}).Handler()
+
+	// 1. The failure is saved on the inquiry alongside the delivery outcome
+	postForm(router, "/api/contact", newContactForm("dev@example.com", "Hello", "A message long enough to pass validation."), true)
+	inqs, _ := store.List(t.Context())
+	if len(inqs) != 1 || len(inqs[0].WebhookFailures) != 1 || inqs[0].WebhookFailures[0].Endpoint != "crm" || inqs[0].Status != StatusSent {
+		t.Fatalf("Stored %+v, want one sent inquiry with the crm failure", inqs)
+	}
+
+	// 2. The detail view shows it
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, adminRequest(auth, "GET", "/admin/inquiries/"+inqs[0].ID, nil))
+	if body := rr.Body.String(); !strings.Contains(body, `id="webhook_failures"`) || !strings.Contains(body, "crm: HTTP 410") {
+		t.Errorf("Detail view does not show the webhook failure")
+	}
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	secret := []byte("whsec-test")
+	body := []byte(`{"id":"1"}`)
+	now := time.Now()
+	ts := strconv.FormatInt(now.Unix(), 10)
+	stale := strconv.FormatInt(now.Add(-time.Hour).Unix(), 10)
+
+	header := func(ts, sig string) http.Header {
+		h := http.Header{}
+		h.Set(webhookTimestampHeader, ts)
+		h.Set(webhookSignatureHeader, sig)
+		return h
+	}
+	good := webhookSignaturePrefix + signWebhook(secret, ts, body)
+
+	if err := VerifyWebhook(secret, header(ts, good), body, now); err != nil {
+		t.Errorf("Valid signature rejected: %v", err)
+	}
+	tests := map[string]struct {
+		h    http.Header
+		body []byte
+	}{
+		"Tampered Body":     {header(ts, good), []byte(`{"id":"2"}`)},
+		"Wrong Secret":      {header(ts, webhookSignaturePrefix+signWebhook([]byte("other"), ts, body)), body},
+		"Replayed":          {header(stale, webhookSignaturePrefix+signWebhook(secret, stale, body)), body},
+		"Missing Headers":   {http.Header{}, body},
+		"Timestamp Swapped": {header(strconv.FormatInt(now.Add(time.Second).Unix(), 10), good), body},
+	}
+	for name, tt := range tests {
+		if err := VerifyWebhook(secret, tt.h, tt.body, now); err == nil {
+			t.Errorf("%s: VerifyWebhook accepted it", name)
+		}
+	}
+}
+
+func TestWebhookFormatters(t *testing.T) {
+	inq := testInquiry()
+
+	// 1. Slack: visitor text cannot ping the channel or disguise a link
+	slack, _ := webhookBody(WebhookSlack, inq)
+	if strings.Contains(string(slack), "<!channel>") || strings.Contains(string(slack), "<https://evil") {
+		t.Errorf("Slack payload carries live mrkdwn: %s", slack)
+	}
+	if !strings.Contains(string(slack), inq.Reference()) || !strings.Contains(string(slack), "Architecture Audit") {
+		t.Errorf("Slack payload missing reference or service: %s", slack)
+	}
+
+	// 2. Discord: mentions are disabled outright
+	discord, _ := webhookBody(WebhookDiscord, inq)
+	var d struct {
+		AllowedMentions struct {
+			Parse []string `json:"parse"`
+		} `json:"allowed_mentions"`
+		Embeds []struct {
+			Title string `json:"title"`
+		} `json:"embeds"`
+	}
+	if err := json.Unmarshal(discord, &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.AllowedMentions.Parse == nil || len(d.AllowedMentions.Parse) != 0 {
+		t.Errorf("Discord payload allows mentions: %s", discord)
+	}
+	if len(d.Embeds) != 1 || !strings.Contains(d.Embeds[0].Title, "[P2]") {
+		t.Errorf("Discord embed = %+v", d.Embeds)
+	}
+
+	// 3. Endpoint specs
+	eps, err := parseWebhookEndpoints("crm=json:https://crm.example/hook?x=1, leads=slack:https://hooks.slack.com/services/T/B/X")
+	if err != nil || len(eps) != 2 || eps[0].URL != "https://crm.example/hook?x=1" || eps[1].Format != WebhookSlack {
+		t.Errorf("parseWebhookEndpoints = %+v, %v", eps, err)
+	}
+	for _, spec := range []string{"crm=xml:https://x.example", "crm=json:ftp://x.example", "crm", "=json:https://x.example"} {
+		if _, err := parseWebhookEndpoints(spec); err == nil {
+			t.Errorf("parseWebhookEndpoints(%q) accepted", spec)
+		}
+	}
+}